@@ -0,0 +1,150 @@
+//go:build go1.21
+
+package nds
+
+import (
+	"context"
+	"errors"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// mutateLimit is the Google Cloud Datastore limit for the maximum number of
+// mutations in a single commit.
+const mutateLimit = 500
+
+// ErrBatchChunkNotCommitted is returned by Batch.Commit for the valid entries
+// of a chunk that wasn't committed because another entry in it was invalid.
+var ErrBatchChunkNotCommitted = errors.New("nds: batch chunk not committed")
+
+// Batch accumulates puts and deletes of entities of type T to be applied by
+// Commit. It is a type-safe alternative to building parallel key and value
+// slices for Mutate. A Batch is not safe for concurrent use.
+//
+// Batch needs Go 1.21 or later.
+type Batch[T any] struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	key *datastore.Key
+	// val is nil for deletes.
+	val interface{}
+	err error
+}
+
+// NewBatch returns an empty Batch.
+func NewBatch[T any]() *Batch[T] {
+	return &Batch[T]{}
+}
+
+// Put adds a put of val under key. Incomplete keys are allocated by Commit.
+func (b *Batch[T]) Put(key *datastore.Key, val *T) *Batch[T] {
+	e := batchEntry{key: key, val: val}
+	switch {
+	case key == nil:
+		e.err = datastore.ErrInvalidKey
+	case val == nil:
+		e.err = datastore.ErrInvalidEntityType
+	}
+	b.entries = append(b.entries, e)
+	return b
+}
+
+// Delete adds a delete of the entity for key.
+func (b *Batch[T]) Delete(key *datastore.Key) *Batch[T] {
+	e := batchEntry{key: key}
+	if key == nil || key.Incomplete() {
+		e.err = datastore.ErrInvalidKey
+	}
+	b.entries = append(b.entries, e)
+	return b
+}
+
+// Len returns the number of puts and deletes in the batch.
+func (b *Batch[T]) Len() int {
+	return len(b.entries)
+}
+
+// Commit applies the batch through c.Mutate, so the cache is kept consistent
+// exactly like it is for Mutate. Entries are applied in the order they were
+// added, in chunks of up to 500 that are each committed atomically. An entry
+// for a key already written earlier in the chunk starts a new chunk, so later
+// entries win.
+//
+// Commit returns the keys in one-to-one correspondence with the entries,
+// including the keys allocated for incomplete keys. If any entry failed the
+// error is a datastore.MultiError holding each entry's error, and the keys of
+// failed entries are nil. Invalid entries are never sent; a chunk the
+// datastore rejected reports its own error for each of its entries, or
+// ErrBatchChunkNotCommitted for the entries that were fine. Chunks after a
+// failed one are still committed.
+func (b *Batch[T]) Commit(ctx context.Context, c *Client) ([]*datastore.Key, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Batch.Commit")
+	defer span.End()
+
+	keys := make([]*datastore.Key, len(b.entries))
+	errs := make(datastore.MultiError, len(b.entries))
+	failed := false
+
+	var chunk []int
+	seen := make(map[string]bool)
+	commit := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		muts := make([]*Mutation, len(chunk))
+		for j, i := range chunk {
+			if e := b.entries[i]; e.val != nil {
+				muts[j] = NewUpsert(e.key, e.val)
+			} else {
+				muts[j] = NewDelete(e.key)
+			}
+		}
+
+		chunkKeys, err := c.Mutate(ctx, muts...)
+		me, isMultiErr := err.(datastore.MultiError)
+		for j, i := range chunk {
+			switch {
+			case err == nil:
+				keys[i] = chunkKeys[j]
+				continue
+			case !isMultiErr:
+				errs[i] = err
+			case me[j] != nil:
+				errs[i] = me[j]
+			default:
+				errs[i] = ErrBatchChunkNotCommitted
+			}
+			failed = true
+		}
+		chunk = chunk[:0]
+		seen = make(map[string]bool)
+	}
+
+	for i, e := range b.entries {
+		if e.err != nil {
+			errs[i], failed = e.err, true
+			continue
+		}
+		if !e.key.Incomplete() {
+			k := e.key.Encode()
+			if seen[k] {
+				commit()
+			}
+			seen[k] = true
+		}
+		chunk = append(chunk, i)
+		if len(chunk) == mutateLimit {
+			commit()
+		}
+	}
+	commit()
+
+	if failed {
+		return keys, errs
+	}
+	return keys, nil
+}
@@ -0,0 +1,130 @@
+//go:build go1.21
+
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestBatchSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestBatchCommit", BatchCommitTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func BatchCommitTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("BatchCommitTest%d", time.Now().UnixNano())
+
+		// Seed entities to delete and cache them so the batch must evict them.
+		deleteKeys := make([]*datastore.Key, 300)
+		seed := make([]testEntity, len(deleteKeys))
+		for i := range deleteKeys {
+			deleteKeys[i] = datastore.IDKey(kind, int64(10000+i), nil)
+		}
+		if _, err := ndsClient.PutMulti(ctx, deleteKeys, seed); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.GetMulti(ctx, deleteKeys, seed); err != nil {
+			t.Fatal(err)
+		}
+
+		b := nds.NewBatch[testEntity]()
+		for i := 0; i < 1200; i++ {
+			b.Put(datastore.NameKey(kind, fmt.Sprint(i), nil), &testEntity{i})
+		}
+		for _, key := range deleteKeys {
+			b.Delete(key)
+		}
+		// Invalid entries must fail on their own without the rest.
+		b.Put(nil, &testEntity{})
+		b.Delete(datastore.IncompleteKey(kind, nil))
+		b.Put(datastore.NameKey(kind, "0", nil), nil)
+		// A second put of the same key wins over the first one.
+		b.Put(datastore.NameKey(kind, "0", nil), &testEntity{-1})
+		b.Put(datastore.IncompleteKey(kind, nil), &testEntity{-2})
+
+		if b.Len() != 1505 {
+			t.Fatalf("expected 1505 entries, got %d", b.Len())
+		}
+
+		keys, err := b.Commit(ctx, ndsClient)
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		}
+		if len(keys) != b.Len() || len(me) != b.Len() {
+			t.Fatalf("expected %d keys and errors, got %d and %d",
+				b.Len(), len(keys), len(me))
+		}
+		for i := range me {
+			switch i {
+			case 1500, 1501:
+				if me[i] != datastore.ErrInvalidKey {
+					t.Fatalf("expected ErrInvalidKey for entry %d, got %v", i, me[i])
+				}
+			case 1502:
+				if me[i] != datastore.ErrInvalidEntityType {
+					t.Fatalf("expected ErrInvalidEntityType for entry %d, got %v", i, me[i])
+				}
+			default:
+				if me[i] != nil {
+					t.Fatalf("expected no error for entry %d, got %v", i, me[i])
+				}
+				if keys[i] == nil || keys[i].Incomplete() {
+					t.Fatalf("expected complete key for entry %d, got %v", i, keys[i])
+				}
+			}
+		}
+
+		got := make([]testEntity, 1200)
+		if err := ndsClient.GetMulti(ctx, keys[:1200], got); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].IntVal != i {
+				t.Fatalf("expected %d for entry %d, got %d", i, i, got[i].IntVal)
+			}
+		}
+		if got[0].IntVal != -1 {
+			t.Fatalf("expected the later put to win, got %d", got[0].IntVal)
+		}
+
+		var allocated testEntity
+		if err := ndsClient.Get(ctx, keys[1504], &allocated); err != nil {
+			t.Fatal(err)
+		}
+		if allocated.IntVal != -2 {
+			t.Fatalf("expected -2, got %d", allocated.IntVal)
+		}
+
+		err = ndsClient.GetMulti(ctx, deleteKeys, make([]testEntity, len(deleteKeys)))
+		me, ok = err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		}
+		for i, err := range me {
+			if err != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected ErrNoSuchEntity for deleted entry %d, got %v", i, err)
+			}
+		}
+	}
+}
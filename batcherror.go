@@ -0,0 +1,133 @@
+package nds
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WithBatchErrors makes the batch calls, such as GetMulti, PutMulti,
+// DeleteMulti and ExistsMulti, return a *BatchError instead of a
+// datastore.MultiError when only some keys failed, so callers don't have to
+// line the errors up with the keys themselves. It is disabled by default as
+// code type-asserting datastore.MultiError doesn't see a *BatchError as one;
+// such code should use errors.As, which finds the datastore.MultiError a
+// *BatchError wraps.
+func WithBatchErrors(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.batchErrors = enabled
+	}
+}
+
+// BatchError is the error of a batch call in which only some keys failed. It
+// pairs each key passed to the call with its error and wraps the
+// datastore.MultiError the call would otherwise return.
+type BatchError struct {
+	keys []*datastore.Key
+	errs datastore.MultiError
+	// index holds the index of the first occurrence of each complete key.
+	index map[string]int
+}
+
+// newBatchError returns a *BatchError pairing keys with the errors of me,
+// which must be as long as keys.
+func newBatchError(keys []*datastore.Key, me datastore.MultiError) *BatchError {
+	index := make(map[string]int, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		if _, ok := index[key.Encode()]; !ok {
+			index[key.Encode()] = i
+		}
+	}
+	return &BatchError{keys: keys, errs: me, index: index}
+}
+
+// batchError returns err as a *BatchError for keys if WithBatchErrors is
+// enabled and err is a datastore.MultiError, and err itself otherwise.
+func (c *Client) batchError(keys []*datastore.Key, err error) error {
+	me, ok := err.(datastore.MultiError)
+	if !c.batchErrors || !ok || len(me) != len(keys) {
+		return err
+	}
+	return newBatchError(keys, me)
+}
+
+// unwrapBatchError returns the datastore.MultiError wrapped by err if it is
+// a *BatchError, and err itself otherwise, for the Client's own calls to its
+// batch methods.
+func unwrapBatchError(err error) error {
+	if be, ok := err.(*BatchError); ok {
+		return be.errs
+	}
+	return err
+}
+
+func (e *BatchError) Error() string {
+	first, n := -1, 0
+	for i, err := range e.errs {
+		if err != nil {
+			if first < 0 {
+				first = i
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "nds: (0 errors)"
+	case 1:
+		return fmt.Sprintf("nds: key %v: %v", e.keys[first], e.errs[first])
+	}
+	return fmt.Sprintf("nds: key %v: %v (and %d other errors)",
+		e.keys[first], e.errs[first], n-1)
+}
+
+// Unwrap returns the datastore.MultiError with the errors in the order of the
+// keys.
+func (e *BatchError) Unwrap() error {
+	return e.errs
+}
+
+// Err returns the error of key, or nil if it succeeded or wasn't part of the
+// call. A key passed several times gets the error of its first occurrence.
+// Nil and incomplete keys have no stable identity, so their errors are only
+// available from Errors.
+func (e *BatchError) Err(key *datastore.Key) error {
+	if key == nil || key.Incomplete() {
+		return nil
+	}
+	if i, ok := e.index[key.Encode()]; ok {
+		return e.errs[i]
+	}
+	return nil
+}
+
+// Errors returns the datastore.MultiError with the errors in the order of the
+// keys, like Unwrap.
+func (e *BatchError) Errors() datastore.MultiError {
+	return e.errs
+}
+
+// Failed returns the keys that failed, in the order they were passed.
+func (e *BatchError) Failed() []*datastore.Key {
+	failed := make([]*datastore.Key, 0, len(e.keys))
+	for i, key := range e.keys {
+		if e.errs[i] != nil {
+			failed = append(failed, key)
+		}
+	}
+	return failed
+}
+
+// Succeeded returns the keys that succeeded, in the order they were passed.
+func (e *BatchError) Succeeded() []*datastore.Key {
+	succeeded := make([]*datastore.Key, 0, len(e.keys))
+	for i, key := range e.keys {
+		if e.errs[i] == nil {
+			succeeded = append(succeeded, key)
+		}
+	}
+	return succeeded
+}
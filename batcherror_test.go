@@ -0,0 +1,123 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestBatchErrorSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestBatchErrors", BatchErrorsTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func BatchErrorsTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("BatchErrorsTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "written1", nil),
+			datastore.NameKey(kind, "failed", nil),
+			datastore.NameKey(kind, "written2", nil),
+		}
+		expectedErr := errors.New("expected error")
+		ds := &partialDatastore{
+			Client: dsClient,
+			fail:   map[string]error{keys[1].String(): expectedErr},
+		}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient), nds.WithDatastore(ds),
+			nds.WithBatchErrors(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectBatchError := func(err error, failed *datastore.Key, failedErr error) {
+			t.Helper()
+			be, ok := err.(*nds.BatchError)
+			if !ok {
+				t.Fatalf("expected a *nds.BatchError, got %T: %v", err, err)
+			}
+			for _, key := range keys {
+				want := error(nil)
+				if key.Equal(failed) {
+					want = failedErr
+				}
+				if got := be.Err(key); got != want {
+					t.Fatalf("expected %v for %s, got %v", want, key.Name, got)
+				}
+			}
+			if f := be.Failed(); len(f) != 1 || !f[0].Equal(failed) {
+				t.Fatalf("expected only %s to fail, got %v", failed.Name, f)
+			}
+			if s := be.Succeeded(); len(s) != 2 || s[0].Equal(failed) || s[1].Equal(failed) {
+				t.Fatalf("expected the other keys to succeed, got %v", s)
+			}
+			var me datastore.MultiError
+			if !errors.As(err, &me) || len(me) != len(keys) {
+				t.Fatalf("expected a wrapped datastore.MultiError, got %v", me)
+			}
+		}
+
+		_, err = ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}, {3}})
+		expectBatchError(err, keys[1], expectedErr)
+
+		entities := make([]testEntity, len(keys))
+		err = ndsClient.GetMulti(ctx, keys, entities)
+		expectBatchError(err, keys[1], datastore.ErrNoSuchEntity)
+		if entities[0].IntVal != 1 || entities[2].IntVal != 3 {
+			t.Fatalf("expected the written entities, got %+v", entities)
+		}
+
+		// A nil key only gets an error at its own index.
+		err = ndsClient.DeleteMulti(ctx, []*datastore.Key{keys[0], nil, keys[2]})
+		be, ok := err.(*nds.BatchError)
+		if !ok {
+			t.Fatalf("expected a *nds.BatchError, got %T: %v", err, err)
+		}
+		if be.Err(keys[0]) != nil || be.Err(keys[2]) != nil {
+			t.Fatalf("expected no errors for the complete keys, got %v", be)
+		}
+		if f := be.Failed(); len(f) != 1 || f[0] != nil {
+			t.Fatalf("expected only the nil key to fail, got %v", f)
+		}
+		if be.Errors()[1] == nil {
+			t.Fatal("expected an error for the nil key")
+		}
+
+		// ExistsMulti and Exists report a nil key the same way.
+		_, err = ndsClient.ExistsMulti(ctx, []*datastore.Key{keys[0], nil, keys[2]})
+		if be, ok := err.(*nds.BatchError); !ok {
+			t.Fatalf("expected a *nds.BatchError, got %T: %v", err, err)
+		} else if f := be.Failed(); len(f) != 1 || f[0] != nil {
+			t.Fatalf("expected only the nil key to fail, got %v", f)
+		}
+		if _, err := ndsClient.Exists(ctx, nil); err != datastore.ErrInvalidKey {
+			t.Fatalf("expected %v, got %v", datastore.ErrInvalidKey, err)
+		}
+
+		// Calls that fail as a whole keep their error.
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, 1)); err == nil {
+			t.Fatal("expected an error")
+		} else if _, ok := err.(*nds.BatchError); ok {
+			t.Fatalf("expected a plain error, got %v", err)
+		}
+	}
+}
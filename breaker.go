@@ -0,0 +1,332 @@
+package nds
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCircuitOpen is returned in place of a datastore call while the circuit
+// breaker configured with WithCircuitBreaker is open.
+var ErrCircuitOpen = errors.New("nds: circuit breaker is open")
+
+// BreakerState is the state of the datastore circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every datastore call through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails datastore calls with ErrCircuitOpen until the
+	// cooldown has elapsed.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe calls through to decide
+	// whether the breaker should close again or re-open.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerStateChange is emitted to the ObserverFunc every time the circuit
+// breaker changes state.
+type BreakerStateChange struct {
+	From, To BreakerState
+}
+
+func (BreakerStateChange) isEvent() {}
+
+// CircuitBreakerSettings configures the circuit breaker set up by
+// WithCircuitBreaker. Zero values are replaced by their defaults.
+type CircuitBreakerSettings struct {
+	// Window is the period over which datastore call outcomes are counted
+	// before the counts are reset. Defaults to 10 seconds.
+	Window time.Duration
+	// MinRequests is the number of calls that must be made within Window
+	// before the breaker considers tripping. Defaults to 20.
+	MinRequests int
+	// FailureRatio is the ratio of failed to total calls within Window that
+	// trips the breaker. Defaults to 0.5.
+	FailureRatio float64
+	// Cooldown is how long the breaker stays open before half-opening.
+	// Defaults to 30 seconds.
+	Cooldown time.Duration
+	// HalfOpenProbes is the number of successful probe calls needed to close
+	// a half-open breaker. Only this many calls are let through concurrently
+	// while half-open. Defaults to 1.
+	HalfOpenProbes int
+	// ServeCacheWhenOpen makes GetMulti and Get return the entities found in
+	// the cache while the breaker is open. Keys that missed the cache get
+	// ErrCircuitOpen in the returned datastore.MultiError.
+	ServeCacheWhenOpen bool
+}
+
+// WithCircuitBreaker wraps every datastore call made by the Client in a
+// circuit breaker. Once the failure ratio within a window is exceeded the
+// breaker opens and datastore calls fail fast with ErrCircuitOpen for the
+// cooldown period, after which a few probe calls are let through to decide
+// whether the datastore has recovered.
+func WithCircuitBreaker(settings CircuitBreakerSettings) ClientOption {
+	return func(c *Client) {
+		c.breaker = newCircuitBreaker(settings)
+		c.breaker.onChange = func(ctx context.Context, from, to BreakerState) {
+			c.observe(ctx, BreakerStateChange{From: from, To: to})
+		}
+	}
+}
+
+// BreakerState returns the current state of the circuit breaker. It always
+// returns BreakerClosed if no circuit breaker is configured.
+func (c *Client) BreakerState() BreakerState {
+	if c.breaker == nil {
+		return BreakerClosed
+	}
+	c.breaker.Lock()
+	defer c.breaker.Unlock()
+	return c.breaker.state
+}
+
+type circuitBreaker struct {
+	settings CircuitBreakerSettings
+	onChange func(ctx context.Context, from, to BreakerState)
+
+	// now exists so tests can control the passing of time.
+	now func() time.Time
+
+	sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+func newCircuitBreaker(settings CircuitBreakerSettings) *circuitBreaker {
+	if settings.Window <= 0 {
+		settings.Window = 10 * time.Second
+	}
+	if settings.MinRequests <= 0 {
+		settings.MinRequests = 20
+	}
+	if settings.FailureRatio <= 0 {
+		settings.FailureRatio = 0.5
+	}
+	if settings.Cooldown <= 0 {
+		settings.Cooldown = 30 * time.Second
+	}
+	if settings.HalfOpenProbes <= 0 {
+		settings.HalfOpenProbes = 1
+	}
+	return &circuitBreaker{
+		settings: settings,
+		now:      time.Now,
+	}
+}
+
+// allow reports whether a datastore call may be made. If it may, the returned
+// function must be called with the outcome of the call.
+func (b *circuitBreaker) allow(ctx context.Context) (func(error), error) {
+	b.Lock()
+	from := b.state
+	now := b.now()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.settings.Cooldown {
+			b.Unlock()
+			return nil, ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen, now)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= b.settings.HalfOpenProbes {
+			b.Unlock()
+			b.notify(ctx, from, BreakerHalfOpen)
+			return nil, ErrCircuitOpen
+		}
+		b.probes++
+		b.Unlock()
+		b.notify(ctx, from, BreakerHalfOpen)
+		return func(err error) { b.recordProbe(ctx, err) }, nil
+	}
+
+	if now.Sub(b.windowStart) >= b.settings.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.Unlock()
+	return func(err error) { b.record(ctx, err) }, nil
+}
+
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	if _, ok := err.(breakerIgnoredError); ok {
+		return
+	}
+	b.Lock()
+	if b.state != BreakerClosed {
+		// Another call tripped the breaker while this one was in flight.
+		b.Unlock()
+		return
+	}
+	b.requests++
+	if isBreakerFailure(err) {
+		b.failures++
+	}
+	tripped := b.requests >= b.settings.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= b.settings.FailureRatio
+	if tripped {
+		b.setState(BreakerOpen, b.now())
+	}
+	b.Unlock()
+	if tripped {
+		b.notify(ctx, BreakerClosed, BreakerOpen)
+	}
+}
+
+func (b *circuitBreaker) recordProbe(ctx context.Context, err error) {
+	b.Lock()
+	if b.state != BreakerHalfOpen {
+		b.Unlock()
+		return
+	}
+	b.probes--
+	if _, ok := err.(breakerIgnoredError); ok {
+		// Free the probe for another call to decide the breaker's state.
+		b.Unlock()
+		return
+	}
+	to := BreakerHalfOpen
+	if isBreakerFailure(err) {
+		to = BreakerOpen
+	} else if b.successes++; b.successes >= b.settings.HalfOpenProbes {
+		to = BreakerClosed
+	}
+	if to != BreakerHalfOpen {
+		b.setState(to, b.now())
+	}
+	b.Unlock()
+	b.notify(ctx, BreakerHalfOpen, to)
+}
+
+// rejecting reports whether a call made now would fail with ErrCircuitOpen.
+func (b *circuitBreaker) rejecting() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return b.now().Sub(b.openedAt) < b.settings.Cooldown
+	case BreakerHalfOpen:
+		return b.probes >= b.settings.HalfOpenProbes
+	}
+	return false
+}
+
+// setState must be called with the breaker locked.
+func (b *circuitBreaker) setState(state BreakerState, now time.Time) {
+	b.state = state
+	b.probes, b.successes = 0, 0
+	switch state {
+	case BreakerOpen:
+		b.openedAt = now
+	case BreakerClosed:
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+}
+
+func (b *circuitBreaker) notify(ctx context.Context, from, to BreakerState) {
+	if from != to && b.onChange != nil {
+		b.onChange(ctx, from, to)
+	}
+}
+
+// isBreakerFailure reports whether err indicates the datastore is unhealthy
+// as opposed to the call being invalid or an entity level error.
+func isBreakerFailure(err error) bool {
+	switch err {
+	case nil, datastore.ErrNoSuchEntity, datastore.ErrConcurrentTransaction,
+		datastore.ErrInvalidKey, datastore.ErrInvalidEntityType,
+		context.Canceled, ErrCircuitOpen:
+		return false
+	}
+	if _, ok := err.(datastore.MultiError); ok {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound,
+		codes.AlreadyExists, codes.FailedPrecondition, codes.PermissionDenied:
+		return false
+	}
+	return true
+}
+
+// breakerIgnoredError wraps an error returned by a guarded call that says
+// nothing about the datastore's health, such as an error from the cache or the
+// caller's own code. guardDatastore unwraps it without recording an outcome.
+type breakerIgnoredError struct {
+	err error
+}
+
+func (e breakerIgnoredError) Error() string {
+	return e.err.Error()
+}
+
+// ignoreBreaker keeps err from being recorded by the circuit breaker.
+func ignoreBreaker(err error) error {
+	if err == nil {
+		return nil
+	}
+	return breakerIgnoredError{err}
+}
+
+// isDatastoreError reports whether err came from a datastore RPC rather than
+// from, for example, the caller's code inside a transaction.
+func isDatastoreError(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	s, ok := status.FromError(err)
+	return ok && s.Code() != codes.Unknown
+}
+
+// guardDatastore runs the datastore call f through the circuit breaker if one
+// is configured and records its stats.
+func (c *Client) guardDatastore(ctx context.Context, f func() error) error {
+	timed := func() error {
+		countOp(ctx, datastoreCall)
+		start := time.Now()
+		err := f()
+		timeDatastoreCall(ctx, start)
+		c.datastoreStats(ctx, start, unwrapBreakerIgnored(err))
+		return err
+	}
+	if c.breaker == nil {
+		return unwrapBreakerIgnored(timed())
+	}
+	done, err := c.breaker.allow(ctx)
+	if err != nil {
+		return err
+	}
+	err = timed()
+	done(err)
+	return unwrapBreakerIgnored(err)
+}
+
+func unwrapBreakerIgnored(err error) error {
+	if ie, ok := err.(breakerIgnoredError); ok {
+		return ie.err
+	}
+	return err
+}
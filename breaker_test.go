@@ -0,0 +1,294 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+
+	var changes []nds.BreakerState
+	call, state := nds.NewTestBreaker(nds.CircuitBreakerSettings{
+		Window:         time.Minute,
+		MinRequests:    4,
+		FailureRatio:   0.5,
+		Cooldown:       time.Second,
+		HalfOpenProbes: 2,
+	}, clock, func(from, to nds.BreakerState) {
+		changes = append(changes, to)
+	})
+
+	// Fault injecting datastore stub.
+	dsErr := errors.New("datastore unavailable")
+	var dsCalls int
+	failing := func() error {
+		dsCalls++
+		return dsErr
+	}
+	healthy := func() error {
+		dsCalls++
+		return nil
+	}
+
+	// Entity level errors must not trip the breaker.
+	for i := 0; i < 10; i++ {
+		if err := call(func() error { return datastore.ErrNoSuchEntity }); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", err)
+		}
+	}
+	if s := state(); s != nds.BreakerClosed {
+		t.Fatalf("expected closed breaker, got %s", s)
+	}
+
+	// Let the window roll over so the successes above are forgotten.
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := call(failing); err != dsErr {
+			t.Fatalf("expected %v, got %v", dsErr, err)
+		}
+		if s := state(); s != nds.BreakerClosed {
+			t.Fatalf("breaker tripped before MinRequests, got %s", s)
+		}
+	}
+	if err := call(failing); err != dsErr {
+		t.Fatalf("expected %v, got %v", dsErr, err)
+	}
+	if s := state(); s != nds.BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", s)
+	}
+
+	// Open breakers fail fast without calling the datastore.
+	dsCalls = 0
+	if err := call(healthy); err != nds.ErrCircuitOpen {
+		t.Fatalf("expected nds.ErrCircuitOpen, got %v", err)
+	}
+	if dsCalls != 0 {
+		t.Fatalf("expected no datastore calls, got %d", dsCalls)
+	}
+
+	// After the cooldown a failed probe re-opens the breaker.
+	now = now.Add(time.Second)
+	if err := call(failing); err != dsErr {
+		t.Fatalf("expected %v, got %v", dsErr, err)
+	}
+	if s := state(); s != nds.BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", s)
+	}
+
+	// Successful probes close it again.
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if err := call(healthy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := state(); s != nds.BreakerClosed {
+		t.Fatalf("expected closed breaker, got %s", s)
+	}
+
+	want := []nds.BreakerState{
+		nds.BreakerOpen,
+		nds.BreakerHalfOpen,
+		nds.BreakerOpen,
+		nds.BreakerHalfOpen,
+		nds.BreakerClosed,
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("expected state changes %v, got %v", want, changes)
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbeLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+	call, state := nds.NewTestBreaker(nds.CircuitBreakerSettings{
+		MinRequests: 1,
+		Cooldown:    time.Second,
+	}, func() time.Time { return now }, func(from, to nds.BreakerState) {})
+
+	if err := call(func() error { return context.DeadlineExceeded }); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if s := state(); s != nds.BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", s)
+	}
+
+	now = now.Add(time.Second)
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- call(func() error {
+			close(probing)
+			<-release
+			return nil
+		})
+	}()
+	<-probing
+
+	// Only one probe is allowed while half-open.
+	if err := call(func() error { return nil }); err != nds.ErrCircuitOpen {
+		t.Fatalf("expected nds.ErrCircuitOpen, got %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s := state(); s != nds.BreakerClosed {
+		t.Fatalf("expected closed breaker, got %s", s)
+	}
+}
+
+func TestCircuitBreakerSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestCircuitBreakerServeCacheWhenOpen", CircuitBreakerServeCacheWhenOpenTest(item.ctx, item.cacher))
+			t.Run("TestCircuitBreakerRunInTransaction", CircuitBreakerRunInTransactionTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func CircuitBreakerServeCacheWhenOpenTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		errUnavailable := status.Error(codes.Unavailable, "datastore down")
+		logOKTest := func(err error) bool {
+			return err == errUnavailable
+		}
+		ndsClient, err := NewClient(ctx, cacher, t, logOKTest,
+			nds.WithCircuitBreaker(nds.CircuitBreakerSettings{
+				MinRequests:        2,
+				FailureRatio:       0.5,
+				Cooldown:           time.Hour,
+				ServeCacheWhenOpen: true,
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		cachedKey := datastore.IDKey("CircuitBreakerServeCacheWhenOpenTest", 1, nil)
+		missedKey := datastore.IDKey("CircuitBreakerServeCacheWhenOpenTest", 2, nil)
+		keys := []*datastore.Key{cachedKey, missedKey}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Client.DeleteMulti(ctx, keys)
+
+		// Cache only the first entity.
+		if err := ndsClient.Get(ctx, cachedKey, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Fault injecting datastore stub.
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) > 0 {
+				return errUnavailable
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		for i := 0; i < 2; i++ {
+			if err := ndsClient.Get(ctx, missedKey, &testEntity{}); err != errUnavailable {
+				t.Fatalf("expected unavailable error, got %v", err)
+			}
+		}
+		if state := ndsClient.BreakerState(); state != nds.BreakerOpen {
+			t.Fatalf("expected breaker open, got %s", state)
+		}
+
+		// Remove the locks the failed reads left behind.
+		if err := cacher.DeleteMulti(ctx, []string{ndsClient.CacheKey(missedKey)}); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]testEntity, len(keys))
+		err = ndsClient.GetMulti(ctx, keys, got)
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		}
+		if me[0] != nil || got[0].Value != 1 {
+			t.Fatalf("expected cached entity to be served, got %v %+v", me[0], got[0])
+		}
+		if me[1] != nds.ErrCircuitOpen {
+			t.Fatalf("expected nds.ErrCircuitOpen for the miss, got %v", me[1])
+		}
+
+		items, err := cacher.GetMulti(ctx, []string{ndsClient.CacheKey(missedKey)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 0 {
+			t.Fatal("expected no cache lock for a key the datastore wasn't asked for")
+		}
+
+		// Writes fail fast without evicting the cached entity.
+		if _, err := ndsClient.Put(ctx, cachedKey, &testEntity{3}); err != nds.ErrCircuitOpen {
+			t.Fatalf("expected nds.ErrCircuitOpen, got %v", err)
+		}
+		items, err = cacher.GetMulti(ctx, []string{ndsClient.CacheKey(cachedKey)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item, ok := items[ndsClient.CacheKey(cachedKey)]; !ok || item.Flags != nds.EntityItem {
+			t.Fatal("expected the cached entity to stay in the cache")
+		}
+	}
+}
+
+func CircuitBreakerRunInTransactionTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithCircuitBreaker(nds.CircuitBreakerSettings{
+				MinRequests:  2,
+				FailureRatio: 0.5,
+				Cooldown:     time.Hour,
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The caller's own errors don't count towards the breaker.
+		errValidation := errors.New("validation failed")
+		for i := 0; i < 3; i++ {
+			if _, err := ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+				return errValidation
+			}); err != errValidation {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+		}
+		if state := ndsClient.BreakerState(); state != nds.BreakerClosed {
+			t.Fatalf("expected breaker closed, got %s", state)
+		}
+
+		// Datastore errors from reads inside the transaction do.
+		errUnavailable := status.Error(codes.Unavailable, "datastore down")
+		for i := 0; i < 2; i++ {
+			if _, err := ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+				return errUnavailable
+			}); err != errUnavailable {
+				t.Fatalf("expected unavailable error, got %v", err)
+			}
+		}
+		if state := ndsClient.BreakerState(); state != nds.BreakerOpen {
+			t.Fatalf("expected breaker open, got %s", state)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package nds
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// ExportEncoder encodes the entity for key as one record of an Export.
+type ExportEncoder func(key *datastore.Key, entity datastore.PropertyList) ([]byte, error)
+
+// Export writes every entity matched by q to w, each as the record returned by
+// encode, and returns how many were written. It is meant for backups, for
+// example with encode returning a line of JSON per entity. The query is run
+// keys-only, a page at a time like Reindex, and each page of entities is
+// loaded with GetMulti, so entities warm in the cache are read from it, and
+// written out before the next page is read. Only one page is held in memory
+// whatever the size of the result set. Any limit or cursor set on q is
+// overridden.
+//
+// Records are written in query order, one Write call each. Entities deleted
+// after the query has returned their keys are skipped and not counted. Export
+// stops at the first error, from the query, a read, encode or w, and returns
+// it along with the number of records written so far. Pass WithConcurrency to
+// override the Client's read concurrency for the page reads.
+func (c *Client) Export(ctx context.Context, q *datastore.Query, w io.Writer,
+	encode ExportEncoder, opts ...CallOption) (int, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Export")
+	defer span.End()
+
+	exported := 0
+	var cursor datastore.Cursor
+	for {
+		keys, next, err := c.reindexPage(ctx, q, cursor)
+		if err != nil {
+			return exported, err
+		}
+		n, err := c.exportKeys(ctx, keys, w, encode, opts)
+		exported += n
+		if err != nil {
+			return exported, err
+		}
+		if len(keys) < reindexPageSize {
+			return exported, nil
+		}
+		cursor = next
+	}
+}
+
+// exportKeys writes the entities for keys to w and returns how many were
+// written along with the first error.
+func (c *Client) exportKeys(ctx context.Context, keys []*datastore.Key,
+	w io.Writer, encode ExportEncoder, opts []CallOption) (int, error) {
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	entities := make([]datastore.PropertyList, len(keys))
+	err := unwrapBatchError(c.GetMulti(ctx, keys, entities, opts...))
+	me, _ := err.(datastore.MultiError)
+	if err != nil && me == nil {
+		return 0, err
+	}
+
+	exported := 0
+	for i, key := range keys {
+		if me != nil {
+			switch me[i] {
+			case nil:
+			case datastore.ErrNoSuchEntity:
+				continue
+			default:
+				return exported, me[i]
+			}
+		}
+		record, err := encode(key, entities[i])
+		if err != nil {
+			return exported, err
+		}
+		if _, err := w.Write(record); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	return exported, nil
+}
@@ -0,0 +1,121 @@
+package nds_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestExportSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestExport", ExportTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+type exportRecord struct {
+	Key   string
+	Value int64
+}
+
+func exportJSON(key *datastore.Key, entity datastore.PropertyList) ([]byte, error) {
+	record := exportRecord{Key: key.Name}
+	for _, p := range entity {
+		if p.Name == "Value" {
+			record.Value = p.Value.(int64)
+		}
+	}
+	data, err := json.Marshal(record)
+	return append(data, '\n'), err
+}
+
+func ExportTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Page through the entities a few at a time.
+		nds.SetReindexPageSize(7)
+		defer nds.SetReindexPageSize(500)
+
+		type testEntity struct {
+			Value int
+		}
+
+		kind := fmt.Sprintf("ExportTest%d", time.Now().UnixNano())
+		const count = 30
+		keys := make([]*datastore.Key, count)
+		entities := make([]testEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey(kind, strconv.Itoa(i), nil)
+			entities[i] = testEntity{i}
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Prime the cache for the first entity, then change it behind the
+		// cache's back to tell the cached entity apart.
+		if err := ndsClient.Get(ctx, keys[0], &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ndsClient.Client.Put(ctx, keys[0], &testEntity{100}); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		exported, err := ndsClient.Export(ctx, datastore.NewQuery(kind), &buf, exportJSON,
+			nds.WithConcurrency(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exported != count {
+			t.Fatalf("expected %d exported, got %d", count, exported)
+		}
+
+		seen := make(map[string]int64, count)
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			var record exportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := seen[record.Key]; ok {
+				t.Fatalf("expected %s exported once", record.Key)
+			}
+			seen[record.Key] = record.Value
+		}
+		if len(seen) != count {
+			t.Fatalf("expected %d records, got %d", count, len(seen))
+		}
+		// The first entity is exported as cached.
+		for i, key := range keys {
+			if value := seen[key.Name]; value != int64(entities[i].Value) {
+				t.Fatalf("expected %d for %s, got %d", entities[i].Value, key.Name, value)
+			}
+		}
+
+		// An encoding error stops the export.
+		errEncode := errors.New("encode failed")
+		exported, err = ndsClient.Export(ctx, datastore.NewQuery(kind), &buf,
+			func(key *datastore.Key, entity datastore.PropertyList) ([]byte, error) {
+				return nil, errEncode
+			})
+		if err != errEncode || exported != 0 {
+			t.Fatalf("expected %v after 0 records, got %v after %d", errEncode, err, exported)
+		}
+	}
+}
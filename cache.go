@@ -41,9 +41,33 @@ var (
 	ErrCASConflict = errors.New("nds: cas conflict")
 	// ErrNotStored means that an item was not stored due to a condition check failure (e.g. during an Add or CompareAndSwap call)
 	ErrNotStored = errors.New("nds: not stored")
+	// ErrIncrementUnsupported means the Cacher doesn't implement Incrementer.
+	// Cacher wrappers return it from IncrementMulti to say so.
+	ErrIncrementUnsupported = errors.New("nds: cacher does not support increments")
+	// ErrCompareAndDeleteUnsupported means the Cacher doesn't implement
+	// CompareAndDeleter. Cacher wrappers return it from CompareAndDeleteMulti
+	// to say so.
+	ErrCompareAndDeleteUnsupported = errors.New("nds: cacher does not support compare-and-delete")
+	// ErrFlushUnsupported means the Cacher doesn't implement Flusher.
+	ErrFlushUnsupported = errors.New("nds: cacher does not support flushing")
+	// ErrTTLReadUnsupported means the Cacher doesn't implement TTLReader.
+	ErrTTLReadUnsupported = errors.New("nds: cacher does not support reading TTLs")
+	// ErrCompareAndSwapUnsupported means CompareAndSwap was called on a
+	// Client without a Cacher
+	ErrCompareAndSwapUnsupported = errors.New("nds: CompareAndSwap needs a cacher")
+	// ErrCacheChecksum is reported to the OnErrorFunc for every cached entity
+	// that fails the checksum added by WithCacheChecksums.
+	ErrCacheChecksum = errors.New("nds: cached entity failed its checksum")
 )
 
 // Cacher represents a cache backend that can be used by nds.
+//
+// nds doesn't create a cache context per call. Large GetMulti, PutMulti and
+// DeleteMulti calls are split into chunks that call the Cacher concurrently
+// from several goroutines with the same context, so a Cacher must be safe for
+// concurrent use and must not keep per-call state in the context. Cachers that
+// need connections should pool them, such as the redis Cacher taking one
+// connection from its pool per method call.
 type Cacher interface {
 	// AddMulti adds each provided Item into the cache if and only if the key for the item is not
 	// currently in use. For any item that was not stored due to a key conflict, a MultiError is returned
@@ -69,6 +93,50 @@ type Cacher interface {
 	SetMulti(ctx context.Context, items []*Item) error
 }
 
+// Incrementer is implemented by Cachers that support atomic counters, which
+// Client.Increment counts in. With Cachers that don't implement it Increment
+// counts in the datastore instead.
+type Incrementer interface {
+	// IncrementMulti atomically adds each delta to the int64 counter stored under the key with the same index,
+	// starting counters that aren't in the cache at zero, and returns the new values. Counters never expire.
+	// Counter keys are only ever used with IncrementMulti and DeleteMulti, never with the other Cacher methods.
+	// If any counter could not be incremented a MultiError should be returned with an error in the
+	// corresponding index for that key.
+	IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error)
+}
+
+// CompareAndDeleter is implemented by Cachers that can delete an item only if
+// it is unchanged, which nds uses to remove the locks it set once a write is
+// done without removing a lock a later writer has set on the same key since.
+// Anything else found in place of a lock, such as the lock of a read, is
+// still deleted.
+// With Cachers that don't implement it the locks are removed with DeleteMulti,
+// so a slow writer can remove a newer writer's lock and let a concurrent read
+// cache an entity the newer write is about to replace until it expires.
+type CompareAndDeleter interface {
+	// CompareAndDeleteMulti atomically deletes each item's key if the item stored under it still has the same Flags
+	// and Value, ignoring Expiration and the CAS info. If any item was not deleted a MultiError should be returned
+	// with ErrCASConflict in the corresponding index for an item that has changed and ErrCacheMiss for one that is
+	// not in the cache.
+	CompareAndDeleteMulti(ctx context.Context, items []*Item) error
+}
+
+// Flusher is implemented by Cachers that can remove every item they hold,
+// which Client.FlushCache does. It must only be implemented by Cachers that
+// own their backend, as it removes what other users of it stored too.
+type Flusher interface {
+	// Flush removes every item from the cache.
+	Flush(ctx context.Context) error
+}
+
+// TTLReader is implemented by Cachers that can tell how long items have left
+// before they expire, which Client.CacheTTL reports.
+type TTLReader interface {
+	// TTLMulti returns the time each key that is in the cache has left before it expires, or 0 for one that never
+	// expires. Keys that aren't in the cache are left out of the map, like with GetMulti.
+	TTLMulti(ctx context.Context, keys []string) (map[string]time.Duration, error)
+}
+
 // Item is the unit of Cacher gets and sets.
 // Taken from google.golang.org/appengine/memcache
 type Item struct {
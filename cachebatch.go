@@ -0,0 +1,132 @@
+package nds
+
+import "context"
+
+// WithCacheBatchSize limits every Cacher call the client makes to n keys,
+// independently of how the datastore calls are chunked. Larger batches, such
+// as the 1000 keys of a GetMulti chunk or the 500 of a PutMulti chunk, are
+// split into calls of at most n keys made one after the other, which suits
+// cache backends that are faster or only reliable with smaller batches. An n
+// of 0 or less doesn't split cache calls, which is the default.
+func WithCacheBatchSize(n int) ClientOption {
+	return func(c *Client) {
+		c.cacheBatchSize = n
+	}
+}
+
+// batchingCacher splits the calls to the wrapped Cacher into batches of at
+// most size keys.
+type batchingCacher struct {
+	Cacher
+	size int
+}
+
+// split calls f with the bounds of consecutive batches of at most b.size of
+// the n keys or items. If any batch fails it returns a MultiError over all n,
+// spreading the error of a batch that didn't return a MultiError over each of
+// its indexes. A method the wrapped Cacher doesn't support fails as a whole.
+func (b *batchingCacher) split(n int, f func(lo, hi int) error) error {
+	if n <= b.size {
+		return f(0, n)
+	}
+	var me MultiError
+	for lo := 0; lo < n; lo += b.size {
+		hi := lo + b.size
+		if hi > n {
+			hi = n
+		}
+		err := f(lo, hi)
+		switch err {
+		case nil:
+			continue
+		case ErrIncrementUnsupported, ErrCompareAndDeleteUnsupported:
+			return err
+		}
+		if me == nil {
+			me = make(MultiError, n)
+		}
+		if bme, ok := err.(MultiError); ok {
+			copy(me[lo:hi], bme)
+			continue
+		}
+		for i := lo; i < hi; i++ {
+			me[i] = err
+		}
+	}
+	if me == nil {
+		return nil
+	}
+	return me
+}
+
+func (b *batchingCacher) AddMulti(ctx context.Context, items []*Item) error {
+	return b.split(len(items), func(lo, hi int) error {
+		return b.Cacher.AddMulti(ctx, items[lo:hi])
+	})
+}
+
+func (b *batchingCacher) CompareAndSwapMulti(ctx context.Context, items []*Item) error {
+	return b.split(len(items), func(lo, hi int) error {
+		return b.Cacher.CompareAndSwapMulti(ctx, items[lo:hi])
+	})
+}
+
+func (b *batchingCacher) DeleteMulti(ctx context.Context, keys []string) error {
+	return b.split(len(keys), func(lo, hi int) error {
+		return b.Cacher.DeleteMulti(ctx, keys[lo:hi])
+	})
+}
+
+// GetMulti returns the items of every batch that succeeded along with the
+// first error, as GetMulti errors aren't per key.
+func (b *batchingCacher) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	if len(keys) <= b.size {
+		return b.Cacher.GetMulti(ctx, keys)
+	}
+	items := make(map[string]*Item, len(keys))
+	var firstErr error
+	for lo := 0; lo < len(keys); lo += b.size {
+		hi := lo + b.size
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		batch, err := b.Cacher.GetMulti(ctx, keys[lo:hi])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for key, item := range batch {
+			items[key] = item
+		}
+	}
+	return items, firstErr
+}
+
+func (b *batchingCacher) SetMulti(ctx context.Context, items []*Item) error {
+	return b.split(len(items), func(lo, hi int) error {
+		return b.Cacher.SetMulti(ctx, items[lo:hi])
+	})
+}
+
+func (b *batchingCacher) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	inc, ok := b.Cacher.(Incrementer)
+	if !ok {
+		return nil, ErrIncrementUnsupported
+	}
+	vals := make([]int64, len(keys))
+	err := b.split(len(keys), func(lo, hi int) error {
+		batch, err := inc.IncrementMulti(ctx, keys[lo:hi], deltas[lo:hi])
+		copy(vals[lo:hi], batch)
+		return err
+	})
+	return vals, err
+}
+
+func (b *batchingCacher) CompareAndDeleteMulti(ctx context.Context, items []*Item) error {
+	cad, ok := b.Cacher.(CompareAndDeleter)
+	if !ok {
+		return ErrCompareAndDeleteUnsupported
+	}
+	return b.split(len(items), func(lo, hi int) error {
+		return cad.CompareAndDeleteMulti(ctx, items[lo:hi])
+	})
+}
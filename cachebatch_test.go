@@ -0,0 +1,106 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestCacheBatchSizeSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestCacheBatchSize", CacheBatchSizeTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func CacheBatchSizeTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var (
+			mu    sync.Mutex
+			sizes = map[string][]int{}
+		)
+		record := func(method string, n int) {
+			mu.Lock()
+			sizes[method] = append(sizes[method], n)
+			mu.Unlock()
+		}
+		mc := &mockCacher{
+			cacher: cacher,
+			addMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				record("AddMulti", len(items))
+				return cacher.AddMulti(ctx, items)
+			},
+			compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+				record("CompareAndSwapMulti", len(items))
+				return cacher.CompareAndSwapMulti(ctx, items)
+			},
+			deleteMultiHook: func(ctx context.Context, keys []string) error {
+				record("DeleteMulti", len(keys))
+				return cacher.DeleteMulti(ctx, keys)
+			},
+			getMultiHook: func(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
+				record("GetMulti", len(keys))
+				return cacher.GetMulti(ctx, keys)
+			},
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				record("SetMulti", len(items))
+				return cacher.SetMulti(ctx, items)
+			},
+		}
+
+		const batchSize = 100
+		ndsClient, err := NewClient(ctx, mc, t, nil, nds.WithCacheBatchSize(batchSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		// 1001 keys make datastore chunks of 500 and 1 for puts and of 1000
+		// and 1 for gets.
+		const count = 1001
+		kind := fmt.Sprintf("CacheBatchSizeTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, count)
+		entities := make([]testEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey(kind, strconv.Itoa(i), nil)
+			entities[i] = testEntity{i}
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		// The first read fills the cache, the second is served from it.
+		for i := 0; i < 2; i++ {
+			if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, count)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, method := range []string{"AddMulti", "CompareAndSwapMulti",
+			"DeleteMulti", "GetMulti", "SetMulti"} {
+			total, full := 0, false
+			for _, n := range sizes[method] {
+				if n > batchSize {
+					t.Fatalf("expected %s calls of at most %d keys, got %d",
+						method, batchSize, n)
+				}
+				total += n
+				full = full || n == batchSize
+			}
+			if total < count || !full {
+				t.Fatalf("expected %s calls of %d keys covering all %d, got %v",
+					method, batchSize, count, sizes[method])
+			}
+		}
+	}
+}
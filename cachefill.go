@@ -0,0 +1,103 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// WithAsyncCacheFill makes Get and GetMulti return entities loaded from the
+// datastore straight away and write them to the cache in the background,
+// taking the cache write off the read's latency. At most maxPending
+// background writes run at once; once that many are pending, reads write to
+// the cache themselves as they do by default. The background writes still
+// compare-and-swap the cache locks taken by the read, so a Put or Delete that
+// happened in the meantime always wins. A value of 0 or less disables it,
+// which is the default.
+func WithAsyncCacheFill(maxPending int) ClientOption {
+	return func(c *Client) {
+		if maxPending <= 0 {
+			c.cacheFill = nil
+			return
+		}
+		c.cacheFill = make(chan struct{}, maxPending)
+	}
+}
+
+// fillCache writes the cache items read from the datastore to the cache,
+// in the background if WithAsyncCacheFill is enabled and there is room.
+func (c *Client) fillCache(ctx context.Context, cacheItems []cacheItem) {
+	if c.populateLimit != nil {
+		c.populateCache(ctx, lockedCacheItems(cacheItems))
+		return
+	}
+	if c.cacheFill == nil {
+		c.saveCache(ctx, cacheItems)
+		return
+	}
+
+	saveItems := lockedCacheItems(cacheItems)
+	if len(saveItems) == 0 {
+		return
+	}
+
+	select {
+	case c.cacheFill <- struct{}{}:
+	default:
+		c.saveCache(ctx, saveItems)
+		return
+	}
+
+	// The locks expire after cacheLockTime so there is no point in trying
+	// any longer, whatever the caller's deadline was.
+	fillCtx, cancel := context.WithTimeout(detachedContext{ctx}, cacheLockTime)
+	go func() {
+		defer func() {
+			cancel()
+			<-c.cacheFill
+		}()
+		var span *trace.Span
+		fillCtx, span = trace.StartSpan(fillCtx, "github.com/qedus/nds.fillCache")
+		defer span.End()
+		c.saveCache(fillCtx, saveItems)
+	}()
+}
+
+// lockedCacheItems returns the cache items locked by the read, to be written
+// to the cache once it has returned.
+func lockedCacheItems(cacheItems []cacheItem) []cacheItem {
+	saveItems := make([]cacheItem, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == internalLock {
+			// Only the cache item is needed, not the caller's value.
+			saveItems = append(saveItems, cacheItem)
+			saveItems[len(saveItems)-1].val = reflect.Value{}
+		}
+	}
+	return saveItems
+}
+
+// cleanupContext returns a context for removing the cache locks and entities
+// of a write once it has been sent to the datastore. Canceling ctx doesn't
+// cancel it, as the write may have been applied anyway and a lock or entity
+// left behind keeps the entity from being cached or serves it stale, but it
+// doesn't outlive the locks.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, cacheLockTime)
+}
+
+// detachedContext keeps the values of a context but not its deadline or
+// cancelation, so background work can outlive the call that started it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
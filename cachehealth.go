@@ -0,0 +1,112 @@
+package nds
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LastCacheError returns the most recent error the cache backend returned and
+// when it happened. Misses, CAS conflicts and items not stored because their
+// key was in use are part of normal operation and not recorded. It returns a
+// nil error and the zero time if the cache has never failed.
+func (c *Client) LastCacheError() (error, time.Time) {
+	c.cacheHealth.Lock()
+	defer c.cacheHealth.Unlock()
+	return c.cacheHealth.err, c.cacheHealth.at
+}
+
+// CacheHealthy reports whether the cache backend has not failed within the
+// last window.
+func (c *Client) CacheHealthy(window time.Duration) bool {
+	err, at := c.LastCacheError()
+	return err == nil || time.Since(at) > window
+}
+
+type cacheHealth struct {
+	sync.Mutex
+	err error
+	at  time.Time
+}
+
+func (h *cacheHealth) record(err error) {
+	if err = cacheFailure(err); err == nil {
+		return
+	}
+	h.Lock()
+	h.err, h.at = err, time.Now()
+	h.Unlock()
+}
+
+// cacheFailure returns the error in err, if any, that means the cache backend
+// failed rather than a condition check failing.
+func cacheFailure(err error) error {
+	me, ok := err.(MultiError)
+	if !ok {
+		return err
+	}
+	for _, e := range me {
+		switch e {
+		case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored:
+		default:
+			return e
+		}
+	}
+	return nil
+}
+
+// healthCacher records the errors returned by the wrapped Cacher.
+type healthCacher struct {
+	Cacher
+	health *cacheHealth
+}
+
+func (h *healthCacher) AddMulti(ctx context.Context, items []*Item) error {
+	err := h.Cacher.AddMulti(ctx, items)
+	h.health.record(err)
+	return err
+}
+
+func (h *healthCacher) CompareAndSwapMulti(ctx context.Context, items []*Item) error {
+	err := h.Cacher.CompareAndSwapMulti(ctx, items)
+	h.health.record(err)
+	return err
+}
+
+func (h *healthCacher) DeleteMulti(ctx context.Context, keys []string) error {
+	err := h.Cacher.DeleteMulti(ctx, keys)
+	h.health.record(err)
+	return err
+}
+
+func (h *healthCacher) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	items, err := h.Cacher.GetMulti(ctx, keys)
+	h.health.record(err)
+	return items, err
+}
+
+func (h *healthCacher) SetMulti(ctx context.Context, items []*Item) error {
+	err := h.Cacher.SetMulti(ctx, items)
+	h.health.record(err)
+	return err
+}
+
+func (h *healthCacher) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	inc, ok := h.Cacher.(Incrementer)
+	if !ok {
+		return nil, ErrIncrementUnsupported
+	}
+	vals, err := inc.IncrementMulti(ctx, keys, deltas)
+	h.health.record(err)
+	return vals, err
+}
+
+func (h *healthCacher) CompareAndDeleteMulti(ctx context.Context, items []*Item) error {
+	cad, ok := h.Cacher.(CompareAndDeleter)
+	if !ok {
+		return ErrCompareAndDeleteUnsupported
+	}
+	err := cad.CompareAndDeleteMulti(ctx, items)
+	h.health.record(err)
+	return err
+}
@@ -0,0 +1,96 @@
+//go:build aememcache
+// +build aememcache
+
+// Package aememcache provides an nds.Cacher backed by the App Engine standard
+// environment's built-in memcache service, for legacy projects still running
+// there. It is only built with the aememcache build tag, so that other builds
+// don't depend on google.golang.org/appengine:
+//
+//	go build -tags aememcache
+package aememcache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bashtian/nds"
+	"github.com/bashtian/nds/cachers/memcache"
+)
+
+// maxItemSize is the largest key plus value AppEngine's memcache will store.
+// Memcache's 1MB limit includes around 73 bytes of per item overhead so some
+// margin is left for it. Larger items fail the whole batch they are part of so
+// they are filtered out before calling memcache.
+const maxItemSize = 1<<20 - 128
+
+// ErrItemTooLarge is returned in the nds.MultiError index of every item that
+// is too large to be stored in memcache.
+var ErrItemTooLarge = errors.New("aememcache: item too large")
+
+// backend is the cachers/memcache Cacher with the items too large for
+// memcache filtered out of its writes.
+type backend struct {
+	nds.Cacher
+}
+
+// NewCacher will return a nds.Cacher backed by AppEngine's memcache.
+func NewCacher() nds.Cacher {
+	return &backend{Cacher: memcache.NewCacher()}
+}
+
+func (m *backend) AddMulti(ctx context.Context, items []*nds.Item) error {
+	return storeMulti(items, func(items []*nds.Item) error {
+		return m.Cacher.AddMulti(ctx, items)
+	})
+}
+
+func (m *backend) CompareAndSwapMulti(ctx context.Context, items []*nds.Item) error {
+	return storeMulti(items, func(items []*nds.Item) error {
+		return m.Cacher.CompareAndSwapMulti(ctx, items)
+	})
+}
+
+func (m *backend) SetMulti(ctx context.Context, items []*nds.Item) error {
+	return storeMulti(items, func(items []*nds.Item) error {
+		return m.Cacher.SetMulti(ctx, items)
+	})
+}
+
+func (m *backend) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	return m.Cacher.(nds.Incrementer).IncrementMulti(ctx, keys, deltas)
+}
+
+// storeMulti calls store with the items that fit in memcache and returns an
+// nds.MultiError with ErrItemTooLarge for those that don't.
+func storeMulti(items []*nds.Item, store func([]*nds.Item) error) error {
+	fit := make([]*nds.Item, 0, len(items))
+	fitIndex := make([]int, 0, len(items))
+	me, hasErr := make(nds.MultiError, len(items)), false
+	for i, item := range items {
+		if len(item.Key)+len(item.Value) > maxItemSize {
+			me[i] = ErrItemTooLarge
+			hasErr = true
+			continue
+		}
+		fit = append(fit, item)
+		fitIndex = append(fitIndex, i)
+	}
+
+	if !hasErr {
+		return store(items)
+	}
+
+	if len(fit) > 0 {
+		err := store(fit)
+		if fitMe, ok := err.(nds.MultiError); ok {
+			for i, index := range fitIndex {
+				me[index] = fitMe[i]
+			}
+		} else if err != nil {
+			for _, index := range fitIndex {
+				me[index] = err
+			}
+		}
+	}
+	return me
+}
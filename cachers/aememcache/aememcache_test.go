@@ -0,0 +1,106 @@
+//go:build aememcache
+// +build aememcache
+
+package aememcache_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+
+	"github.com/bashtian/nds"
+	"github.com/bashtian/nds/cachers/aememcache"
+)
+
+func TestCacher(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping memcache tests...")
+		return
+	}
+
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("cannot test memcache, error starting aetest: %v", err)
+	}
+	defer done()
+
+	cacher := aememcache.NewCacher()
+
+	t.Run("lock round trip", func(t *testing.T) {
+		lock := &nds.Item{Key: "lock-round-trip", Flags: 2, Value: []byte{1, 2, 3, 4}}
+		if err := cacher.AddMulti(ctx, []*nds.Item{lock}); err != nil {
+			t.Fatalf("expected lock to be added, got %v", err)
+		}
+
+		// A second lock can't be added while the first is held.
+		other := &nds.Item{Key: "lock-round-trip", Flags: 2, Value: []byte{5, 6, 7, 8}}
+		if me, ok := cacher.AddMulti(ctx, []*nds.Item{other}).(nds.MultiError); !ok || me[0] != nds.ErrNotStored {
+			t.Fatalf("expected nds.ErrNotStored, got %v", me)
+		}
+
+		items, err := cacher.GetMulti(ctx, []string{lock.Key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, ok := items[lock.Key]
+		if !ok || !bytes.Equal(item.Value, lock.Value) {
+			t.Fatalf("expected our lock, got %v", item)
+		}
+
+		// Swap the lock for a value.
+		item.Flags = 1
+		item.Value = []byte("entity")
+		if err := cacher.CompareAndSwapMulti(ctx, []*nds.Item{item}); err != nil {
+			t.Fatalf("expected lock to be swapped, got %v", err)
+		}
+
+		// A stale CAS must fail.
+		item.Value = []byte("stale")
+		if me, ok := cacher.CompareAndSwapMulti(ctx, []*nds.Item{item}).(nds.MultiError); !ok || me[0] != nds.ErrCASConflict {
+			t.Fatalf("expected nds.ErrCASConflict, got %v", me)
+		}
+
+		if err := cacher.DeleteMulti(ctx, []string{lock.Key}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("item too large", func(t *testing.T) {
+		items := []*nds.Item{
+			{Key: "small", Value: []byte("small")},
+			{Key: "large", Value: []byte(strings.Repeat("a", 1<<20))},
+			// Memcache's per item overhead makes this too large as well.
+			{Key: "almost", Value: []byte(strings.Repeat("a", 1<<20-len("almost")-16))},
+		}
+		me, ok := cacher.SetMulti(ctx, items).(nds.MultiError)
+		if !ok {
+			t.Fatalf("expected nds.MultiError, got %v", me)
+		}
+		if me[0] != nil || me[1] != aememcache.ErrItemTooLarge || me[2] != aememcache.ErrItemTooLarge {
+			t.Fatalf("expected [nil, ErrItemTooLarge, ErrItemTooLarge], got %v", me)
+		}
+
+		got, err := cacher.GetMulti(ctx, []string{"small", "large"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got["small"]; !ok {
+			t.Fatal("expected small item to be stored")
+		}
+		if _, ok := got["large"]; ok {
+			t.Fatal("expected large item not to be stored")
+		}
+
+		// Locks and CAS must not mistake a too large item for a held lock.
+		if me, ok := cacher.AddMulti(ctx, items[1:2]).(nds.MultiError); !ok || me[0] != aememcache.ErrItemTooLarge {
+			t.Fatalf("expected aememcache.ErrItemTooLarge, got %v", me)
+		}
+		small := got["small"]
+		small.Value = items[1].Value
+		if me, ok := cacher.CompareAndSwapMulti(ctx, []*nds.Item{small}).(nds.MultiError); !ok || me[0] != aememcache.ErrItemTooLarge {
+			t.Fatalf("expected aememcache.ErrItemTooLarge, got %v", me)
+		}
+	})
+}
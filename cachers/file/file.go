@@ -0,0 +1,312 @@
+// Package file IS NOT MEANT TO BE USED IN PRODUCTION - IT IS FOR CLI TOOLS AND OFFLINE TESTING
+// ONLY. IT STORES ITEMS IN A LOCAL DIRECTORY SO THEY SURVIVE PROCESS RESTARTS, BUT ONLY ADD IS
+// SAFE TO USE FROM SEVERAL PROCESSES SHARING THE SAME DIRECTORY, AND ONLY AS LONG AS NO MORE
+// THAN TWO OF THEM ADD THE SAME EXPIRED ITEM AT ONCE!
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bashtian/nds"
+)
+
+// headerSize is the size of the expiration and flags stored before the value.
+const headerSize = 8 + 4
+
+// NewCacher will create dir if it doesn't exist and return a nds.Cacher
+// storing one file per item in it.
+func NewCacher(dir string) (nds.Cacher, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &file{dir: dir}, nil
+}
+
+type object struct {
+	expires time.Time
+	flags   uint32
+	value   []byte
+}
+
+func (o *object) casInfo() []byte {
+	hasher := sha1.New()
+	_ = binary.Write(hasher, binary.LittleEndian, o.flags)
+	_, _ = hasher.Write(o.value) // err is always nil
+	return hasher.Sum(nil)
+}
+
+type file struct {
+	dir string
+	sync.RWMutex
+}
+
+func (f *file) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:]))
+}
+
+func (f *file) encode(item *nds.Item) []byte {
+	var expires int64
+	if item.Expiration > 0 {
+		expires = time.Now().Add(item.Expiration).UnixNano()
+	}
+	b := make([]byte, headerSize, headerSize+len(item.Value))
+	binary.LittleEndian.PutUint64(b, uint64(expires))
+	binary.LittleEndian.PutUint32(b[8:], item.Flags)
+	return append(b, item.Value...)
+}
+
+// load returns the unexpired object stored at path or nil if there is none.
+// Expired objects are removed.
+func (f *file) load(path string) (*object, error) {
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(fd)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < headerSize {
+		// Partially written by an Add in another process.
+		return nil, nil
+	}
+	obj := &object{
+		flags: binary.LittleEndian.Uint32(b[8:]),
+		value: b[headerSize:],
+	}
+	if expires := int64(binary.LittleEndian.Uint64(b)); expires != 0 {
+		obj.expires = time.Unix(0, expires)
+		if !time.Now().Before(obj.expires) {
+			return nil, f.removeExpired(path, info)
+		}
+	}
+	return obj, nil
+}
+
+// removeExpired removes the expired file at path described by expired. Another
+// process may have removed it already and added a new file in its place, so
+// whatever is at path is first moved aside, and put back without replacing
+// anything if it turns out not to be the expired file. A file added at path
+// while another one is moved aside makes the one moved aside get dropped.
+func (f *file) removeExpired(path string, expired os.FileInfo) error {
+	tmp, err := ioutil.TempFile(f.dir, ".expired")
+	if err != nil {
+		return err
+	}
+	aside := tmp.Name()
+	tmp.Close()
+	defer os.Remove(aside)
+
+	if err := os.Rename(path, aside); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info, err := os.Stat(aside)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(info, expired) {
+		return nil
+	}
+	if err := os.Link(aside, path); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// store atomically replaces the file at path with data.
+func (f *file) store(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(f.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// add creates the file at path with data unless it already holds an
+// unexpired object. O_EXCL makes this safe across processes.
+func (f *file) add(path string, data []byte) error {
+	for retried := false; ; retried = true {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) && !retried {
+			// Remove the file if it has expired and try once more.
+			if obj, err := f.load(path); err != nil {
+				return err
+			} else if obj == nil {
+				continue
+			}
+			return nds.ErrNotStored
+		} else if os.IsExist(err) {
+			return nds.ErrNotStored
+		} else if err != nil {
+			return err
+		}
+		// A single write keeps other processes from reading a partial header.
+		_, err = fd.Write(data)
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+		return err
+	}
+}
+
+func (f *file) AddMulti(ctx context.Context, items []*nds.Item) error {
+	f.RLock()
+	defer f.RUnlock()
+	me := make(nds.MultiError, len(items))
+	hasErr := false
+	for i, item := range items {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := f.add(f.path(item.Key), f.encode(item)); err != nil {
+			me[i] = err
+			hasErr = true
+		}
+	}
+	if hasErr {
+		return me
+	}
+	return nil
+}
+
+func (f *file) CompareAndSwapMulti(ctx context.Context, items []*nds.Item) error {
+	f.Lock() // No other cache operations should happen while we do our CAS operations, here to make the ops "atomic"
+	defer f.Unlock()
+	me := make(nds.MultiError, len(items))
+	hasErr := false
+	for i, item := range items {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		path := f.path(item.Key)
+		obj, err := f.load(path)
+		switch {
+		case err != nil:
+			me[i] = err
+		case obj == nil:
+			me[i] = nds.ErrNotStored
+		case !bytes.Equal(item.GetCASInfo().([]byte), obj.casInfo()):
+			me[i] = nds.ErrCASConflict
+		default:
+			me[i] = f.store(path, f.encode(item))
+		}
+		if me[i] != nil {
+			hasErr = true
+		}
+	}
+	if hasErr {
+		return me
+	}
+	return nil
+}
+
+func (f *file) DeleteMulti(ctx context.Context, keys []string) error {
+	f.RLock()
+	defer f.RUnlock()
+	me := make(nds.MultiError, len(keys))
+	hasErr := false
+	for i, key := range keys {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := os.Remove(f.path(key)); os.IsNotExist(err) {
+			me[i] = nds.ErrCacheMiss
+			hasErr = true
+		} else if err != nil {
+			me[i] = err
+			hasErr = true
+		}
+	}
+	if hasErr {
+		return me
+	}
+	return nil
+}
+
+func (f *file) GetMulti(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	f.RLock()
+	defer f.RUnlock()
+	result := make(map[string]*nds.Item)
+
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		obj, err := f.load(f.path(key))
+		if err != nil {
+			return nil, err
+		} else if obj == nil {
+			continue
+		}
+		ndsItem := &nds.Item{
+			Key:   key,
+			Flags: obj.flags,
+			Value: obj.value,
+		}
+		ndsItem.SetCASInfo(obj.casInfo())
+		result[key] = ndsItem
+	}
+
+	return result, nil
+}
+
+func (f *file) SetMulti(ctx context.Context, items []*nds.Item) error {
+	f.RLock()
+	defer f.RUnlock()
+	for _, item := range items {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := f.store(f.path(item.Key), f.encode(item)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
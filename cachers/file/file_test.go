@@ -0,0 +1,137 @@
+package file_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bashtian/nds"
+	"github.com/bashtian/nds/cachers/file"
+)
+
+func newCacher(t *testing.T) (nds.Cacher, string) {
+	dir, err := ioutil.TempDir("", "nds-file-cacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacher, err := file.NewCacher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cacher, dir
+}
+
+func countFiles(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestFileCacherAddLock(t *testing.T) {
+	ctx := context.Background()
+	cacher, dir := newCacher(t)
+	defer os.RemoveAll(dir)
+
+	// A second cacher on the same directory stands in for another process.
+	other, err := file.NewCacher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := &nds.Item{Key: "lock", Flags: 2, Value: []byte{1, 2, 3, 4}, Expiration: time.Minute}
+	if err := cacher.AddMulti(ctx, []*nds.Item{lock}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.AddMulti(ctx, []*nds.Item{
+		{Key: "lock", Flags: 2, Value: []byte{5, 6, 7, 8}},
+		{Key: "free", Flags: 2, Value: []byte{5, 6, 7, 8}},
+	})
+	me, ok := err.(nds.MultiError)
+	if !ok {
+		t.Fatalf("expected a nds.MultiError, got %v", err)
+	}
+	if me[0] != nds.ErrNotStored || me[1] != nil {
+		t.Fatalf("expected [%v <nil>], got %v", nds.ErrNotStored, me)
+	}
+
+	items, err := other.GetMulti(ctx, []string{"lock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := items["lock"]; item == nil || string(item.Value) != string(lock.Value) ||
+		item.Flags != lock.Flags {
+		t.Fatalf("expected the first lock, got %+v", item)
+	}
+
+	// The lock can be swapped by whoever read it and deleted afterwards.
+	items["lock"].Value = []byte("value")
+	if err := cacher.CompareAndSwapMulti(ctx, []*nds.Item{items["lock"]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacher.CompareAndSwapMulti(ctx, []*nds.Item{items["lock"]}); err == nil {
+		t.Fatal("expected a stale compare and swap to fail")
+	}
+	if err := cacher.DeleteMulti(ctx, []string{"lock", "free"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Fatalf("expected no files, got %d", n)
+	}
+}
+
+func TestFileCacherExpiration(t *testing.T) {
+	ctx := context.Background()
+	cacher, dir := newCacher(t)
+	defer os.RemoveAll(dir)
+
+	if err := cacher.SetMulti(ctx, []*nds.Item{
+		{Key: "short", Value: []byte("short"), Expiration: 10 * time.Millisecond},
+		{Key: "forever", Value: []byte("forever")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacher.AddMulti(ctx, []*nds.Item{
+		{Key: "lock", Flags: 2, Value: []byte{1}, Expiration: 10 * time.Millisecond},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, dir); n != 3 {
+		t.Fatalf("expected 3 files, got %d", n)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	items, err := cacher.GetMulti(ctx, []string{"short", "forever"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := items["short"]; ok {
+		t.Fatal("expected short to have expired")
+	}
+	if item := items["forever"]; item == nil || string(item.Value) != "forever" {
+		t.Fatalf("expected forever to be cached, got %+v", item)
+	}
+	if n := countFiles(t, dir); n != 2 {
+		t.Fatalf("expected the expired file to be removed, got %d files", n)
+	}
+
+	// An expired lock doesn't block a new one.
+	if err := cacher.AddMulti(ctx, []*nds.Item{
+		{Key: "lock", Flags: 2, Value: []byte{2}},
+	}); err != nil {
+		t.Fatalf("expected the expired lock to be replaced, got %v", err)
+	}
+	items, err = cacher.GetMulti(ctx, []string{"lock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := items["lock"]; item == nil || item.Value[0] != 2 {
+		t.Fatalf("expected the new lock, got %+v", item)
+	}
+}
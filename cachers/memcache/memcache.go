@@ -37,7 +37,31 @@ func (m *backend) GetMulti(ctx context.Context, keys []string) (map[string]*nds.
 }
 
 func (m *backend) SetMulti(ctx context.Context, items []*nds.Item) error {
-	return memcache.SetMulti(ctx, convertToMemcacheItems(items))
+	return convertToNDSMultiError(memcache.SetMulti(ctx, convertToMemcacheItems(items)))
+}
+
+// counterOffset is the initial value of memcache counters. Memcache counters
+// are unsigned and can't go below zero, so nds counters are offset to start
+// in the middle of the range.
+const counterOffset = 1 << 63
+
+func (m *backend) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	vals := make([]int64, len(keys))
+	me := make(nds.MultiError, len(keys))
+	hasErr := false
+	for i, key := range keys {
+		val, err := memcache.Increment(ctx, key, deltas[i], counterOffset)
+		if err != nil {
+			me[i] = err
+			hasErr = true
+			continue
+		}
+		vals[i] = int64(val - counterOffset)
+	}
+	if hasErr {
+		return vals, me
+	}
+	return vals, nil
 }
 
 func convertToMemcacheItems(items []*nds.Item) []*memcache.Item {
@@ -7,6 +7,7 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"strconv"
 	"sync"
 	"time"
 
@@ -114,6 +115,36 @@ func (m *memory) DeleteMulti(ctx context.Context, keys []string) error {
 	return nil
 }
 
+func (m *memory) CompareAndDeleteMulti(ctx context.Context, items []*nds.Item) error {
+	m.Lock() // Like CompareAndSwapMulti, to make the compare and delete "atomic"
+	defer m.Unlock()
+	me := make(nds.MultiError, len(items))
+	hasErr := false
+	for i, item := range items {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if cacheItem, found := m.store.Get(item.Key); found {
+			obj := cacheItem.(*object)
+			if obj.flags == item.Flags && bytes.Equal(obj.value, item.Value) {
+				m.store.Delete(item.Key)
+			} else {
+				hasErr = true
+				me[i] = nds.ErrCASConflict
+			}
+		} else {
+			hasErr = true
+			me[i] = nds.ErrCacheMiss
+		}
+	}
+	if hasErr {
+		return me
+	}
+	return nil
+}
+
 func (m *memory) GetMulti(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
 	if len(keys) == 0 {
 		return nil, nil
@@ -157,3 +188,59 @@ func (m *memory) SetMulti(ctx context.Context, items []*nds.Item) error {
 	}
 	return nil
 }
+
+func (m *memory) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	m.Lock() // Like CompareAndSwapMulti, to make the read and write "atomic"
+	defer m.Unlock()
+	vals := make([]int64, len(keys))
+	me := make(nds.MultiError, len(keys))
+	hasErr := false
+	for i, key := range keys {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		var val int64
+		if cacheItem, found := m.store.Get(key); found {
+			var err error
+			if val, err = strconv.ParseInt(string(cacheItem.(*object).value), 10, 64); err != nil {
+				me[i] = err
+				hasErr = true
+				continue
+			}
+		}
+		vals[i] = val + deltas[i]
+		m.store.Set(key, &object{value: []byte(strconv.FormatInt(vals[i], 10))}, cache.NoExpiration)
+	}
+	if hasErr {
+		return vals, me
+	}
+	return vals, nil
+}
+
+func (m *memory) Flush(ctx context.Context) error {
+	m.Lock()
+	defer m.Unlock()
+	m.store.Flush()
+	return nil
+}
+
+func (m *memory) TTLMulti(ctx context.Context, keys []string) (map[string]time.Duration, error) {
+	result := make(map[string]time.Duration)
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		if _, expiration, found := m.store.GetWithExpiration(key); found {
+			var ttl time.Duration
+			if !expiration.IsZero() {
+				ttl = time.Until(expiration)
+			}
+			result[key] = ttl
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,234 @@
+// Package recording provides a Cacher that records every call nds makes to
+// the Cacher it wraps, so tests can assert on the exact sequence of cache
+// operations behind Client calls.
+package recording
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bashtian/nds"
+)
+
+// Op is one recorded Cacher call.
+type Op struct {
+	// Method is the name of the Cacher method called, such as "GetMulti".
+	Method string
+	// Keys are the keys passed in, or the keys of the items passed in.
+	Keys []string
+	// Flags and Sizes are the flags and value lengths of the items passed in.
+	// For GetMulti they are those of the items returned for each of the Keys,
+	// with a Size of -1 for the keys that missed.
+	Flags []uint32
+	Sizes []int
+	// Err is the error the call returned.
+	Err error
+}
+
+func (op Op) String() string {
+	var b strings.Builder
+	b.WriteString(op.Method)
+	fmt.Fprintf(&b, " keys=%q", op.Keys)
+	if op.Flags != nil {
+		fmt.Fprintf(&b, " flags=%v sizes=%v", op.Flags, op.Sizes)
+	}
+	if op.Err != nil {
+		fmt.Fprintf(&b, " err=%v", op.Err)
+	}
+	return b.String()
+}
+
+// Cacher wraps a Cacher and records the calls made to it. It implements
+// nds.Incrementer and nds.CompareAndDeleter, returning the errors saying they
+// are unsupported if the wrapped Cacher doesn't, so wrapping a Cacher doesn't
+// change what nds does.
+type Cacher struct {
+	cacher nds.Cacher
+
+	mu  sync.Mutex
+	ops []Op
+}
+
+// NewCacher returns a Cacher recording the calls made to cacher.
+func NewCacher(cacher nds.Cacher) *Cacher {
+	return &Cacher{cacher: cacher}
+}
+
+// Ops returns the calls recorded so far, in the order they returned.
+func (c *Cacher) Ops() []Op {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Op(nil), c.ops...)
+}
+
+// Methods returns the methods of the calls recorded so far, in order.
+func (c *Cacher) Methods() []string {
+	ops := c.Ops()
+	methods := make([]string, len(ops))
+	for i, op := range ops {
+		methods[i] = op.Method
+	}
+	return methods
+}
+
+// Reset forgets the calls recorded so far.
+func (c *Cacher) Reset() {
+	c.mu.Lock()
+	c.ops = nil
+	c.mu.Unlock()
+}
+
+// ExpectMethods returns an error describing the recorded calls unless their
+// methods are exactly methods, in order.
+func (c *Cacher) ExpectMethods(methods ...string) error {
+	want := make([]Op, len(methods))
+	for i, method := range methods {
+		want[i].Method = method
+	}
+	return c.Expect(want...)
+}
+
+// Expect returns an error describing the recorded calls unless they match
+// want one for one, in order. Only the Method and the fields set in want are
+// compared: Keys, Flags and Sizes are compared if they aren't nil and Err if
+// it isn't nil, by its message.
+func (c *Cacher) Expect(want ...Op) error {
+	ops := c.Ops()
+	mismatch := len(ops) != len(want)
+	for i := 0; !mismatch && i < len(ops); i++ {
+		mismatch = !matches(ops[i], want[i])
+	}
+	if !mismatch {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "recording: expected %d cache calls:", len(want))
+	for _, op := range want {
+		fmt.Fprintf(&b, "\n\t%v", op)
+	}
+	fmt.Fprintf(&b, "\ngot %d:", len(ops))
+	for _, op := range ops {
+		fmt.Fprintf(&b, "\n\t%v", op)
+	}
+	return errors.New(b.String())
+}
+
+func matches(got, want Op) bool {
+	if got.Method != want.Method {
+		return false
+	}
+	if want.Keys != nil && !equalStrings(got.Keys, want.Keys) {
+		return false
+	}
+	if want.Flags != nil && fmt.Sprint(got.Flags) != fmt.Sprint(want.Flags) {
+		return false
+	}
+	if want.Sizes != nil && fmt.Sprint(got.Sizes) != fmt.Sprint(want.Sizes) {
+		return false
+	}
+	if want.Err != nil && (got.Err == nil || got.Err.Error() != want.Err.Error()) {
+		return false
+	}
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cacher) record(op Op) {
+	c.mu.Lock()
+	c.ops = append(c.ops, op)
+	c.mu.Unlock()
+}
+
+// itemsOp returns the Op for a call passing items.
+func itemsOp(method string, items []*nds.Item, err error) Op {
+	op := Op{
+		Method: method,
+		Keys:   make([]string, len(items)),
+		Flags:  make([]uint32, len(items)),
+		Sizes:  make([]int, len(items)),
+		Err:    err,
+	}
+	for i, item := range items {
+		op.Keys[i], op.Flags[i], op.Sizes[i] = item.Key, item.Flags, len(item.Value)
+	}
+	return op
+}
+
+func (c *Cacher) AddMulti(ctx context.Context, items []*nds.Item) error {
+	err := c.cacher.AddMulti(ctx, items)
+	c.record(itemsOp("AddMulti", items, err))
+	return err
+}
+
+func (c *Cacher) CompareAndSwapMulti(ctx context.Context, items []*nds.Item) error {
+	err := c.cacher.CompareAndSwapMulti(ctx, items)
+	c.record(itemsOp("CompareAndSwapMulti", items, err))
+	return err
+}
+
+func (c *Cacher) DeleteMulti(ctx context.Context, keys []string) error {
+	err := c.cacher.DeleteMulti(ctx, keys)
+	c.record(Op{Method: "DeleteMulti", Keys: append([]string(nil), keys...), Err: err})
+	return err
+}
+
+func (c *Cacher) GetMulti(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
+	items, err := c.cacher.GetMulti(ctx, keys)
+	op := Op{
+		Method: "GetMulti",
+		Keys:   append([]string(nil), keys...),
+		Flags:  make([]uint32, len(keys)),
+		Sizes:  make([]int, len(keys)),
+		Err:    err,
+	}
+	for i, key := range keys {
+		if item, ok := items[key]; ok {
+			op.Flags[i], op.Sizes[i] = item.Flags, len(item.Value)
+		} else {
+			op.Sizes[i] = -1
+		}
+	}
+	c.record(op)
+	return items, err
+}
+
+func (c *Cacher) SetMulti(ctx context.Context, items []*nds.Item) error {
+	err := c.cacher.SetMulti(ctx, items)
+	c.record(itemsOp("SetMulti", items, err))
+	return err
+}
+
+func (c *Cacher) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	inc, ok := c.cacher.(nds.Incrementer)
+	if !ok {
+		return nil, nds.ErrIncrementUnsupported
+	}
+	vals, err := inc.IncrementMulti(ctx, keys, deltas)
+	c.record(Op{Method: "IncrementMulti", Keys: append([]string(nil), keys...), Err: err})
+	return vals, err
+}
+
+func (c *Cacher) CompareAndDeleteMulti(ctx context.Context, items []*nds.Item) error {
+	cad, ok := c.cacher.(nds.CompareAndDeleter)
+	if !ok {
+		return nds.ErrCompareAndDeleteUnsupported
+	}
+	err := cad.CompareAndDeleteMulti(ctx, items)
+	c.record(itemsOp("CompareAndDeleteMulti", items, err))
+	return err
+}
@@ -0,0 +1,94 @@
+package recording_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/bashtian/nds"
+	"github.com/bashtian/nds/cachers/memory"
+	"github.com/bashtian/nds/cachers/recording"
+)
+
+func TestRecordingCacherPutGet(t *testing.T) {
+	ctx := context.Background()
+	cacher := recording.NewCacher(memory.NewCacher())
+	client, err := nds.NewClient(ctx, cacher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testEntity struct {
+		IntVal int
+	}
+	key := datastore.NameKey("TestRecordingCacherPutGet", "one", nil)
+	if _, err := client.Put(ctx, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	// The first read misses and fills the cache, the second hits.
+	for i := 0; i < 2; i++ {
+		if err := client.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cacheKey := []string{client.CacheKey(key)}
+	if err := cacher.Expect(
+		// Put locks the key and unlocks it once written.
+		recording.Op{Method: "SetMulti", Keys: cacheKey},
+		recording.Op{Method: "CompareAndDeleteMulti", Keys: cacheKey},
+		// The miss locks the key to fill it.
+		recording.Op{Method: "GetMulti", Keys: cacheKey, Sizes: []int{-1}},
+		recording.Op{Method: "AddMulti", Keys: cacheKey},
+		recording.Op{Method: "GetMulti", Keys: cacheKey},
+		recording.Op{Method: "CompareAndSwapMulti", Keys: cacheKey},
+		// The hit.
+		recording.Op{Method: "GetMulti", Keys: cacheKey},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := cacher.Ops()
+	lockFlags, entityFlags := ops[0].Flags[0], ops[5].Flags[0]
+	if lockFlags == entityFlags {
+		t.Fatalf("expected the lock and entity flags to differ, got %d", lockFlags)
+	}
+	if ops[3].Flags[0] != lockFlags || ops[4].Flags[0] != lockFlags {
+		t.Fatalf("expected the miss to be locked with flags %d, got %v", lockFlags, ops)
+	}
+	if hit := ops[6]; hit.Flags[0] != entityFlags || hit.Sizes[0] != ops[5].Sizes[0] {
+		t.Fatalf("expected the hit to read the cached entity %v, got %v", ops[5], hit)
+	}
+
+	cacher.Reset()
+	if err := client.Get(ctx, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacher.ExpectMethods("GetMulti"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordingCacherMismatch(t *testing.T) {
+	ctx := context.Background()
+	cacher := recording.NewCacher(memory.NewCacher())
+	if err := cacher.SetMulti(ctx, []*nds.Item{{Key: "one", Value: []byte{1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := cacher.ExpectMethods("GetMulti")
+	if err == nil {
+		t.Fatal("expected a mismatch")
+	}
+	if !strings.Contains(err.Error(), `SetMulti keys=["one"] flags=[0] sizes=[1]`) {
+		t.Fatalf("expected the recorded call in the error, got %v", err)
+	}
+	if err := cacher.Expect(recording.Op{Method: "SetMulti", Keys: []string{"two"}}); err == nil {
+		t.Fatal("expected a key mismatch")
+	}
+	if err := cacher.Expect(recording.Op{Method: "SetMulti", Keys: []string{"one"}, Sizes: []int{1}}); err != nil {
+		t.Fatal(err)
+	}
+}
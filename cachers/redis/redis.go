@@ -392,3 +392,37 @@ func (b *backend) SetMulti(ctx context.Context, items []*nds.Item) (err error) {
 
 	return
 }
+
+func (b *backend) IncrementMulti(ctx context.Context, keys []string, deltas []int64) (vals []int64, err error) {
+	if len(keys) == 0 {
+		return
+	}
+	redisConn := b.store.GetWithContext(ctx).(redis.ConnWithContext)
+	defer func() {
+		if cerr := redisConn.CloseContext(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	for i, key := range keys {
+		if err = redisConn.SendContext(ctx, "INCRBY", key, deltas[i]); err != nil {
+			return
+		}
+	}
+	if err = redisConn.FlushContext(ctx); err != nil {
+		return
+	}
+
+	vals = make([]int64, len(keys))
+	me := make(nds.MultiError, len(keys))
+	hasErr := false
+	for i := range keys {
+		if vals[i], me[i] = redis.Int64(redisConn.ReceiveContext(ctx)); me[i] != nil {
+			hasErr = true
+		}
+	}
+	if hasErr {
+		err = me
+	}
+	return
+}
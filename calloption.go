@@ -0,0 +1,103 @@
+package nds
+
+import "errors"
+
+// CallOption configures a single call to a Client method, overriding the
+// Client's configuration for that call only.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	withoutCacheLocks   bool
+	withoutColdKeyLocks bool
+	// concurrency is 0 unless set by WithConcurrency.
+	concurrency    int
+	concurrencySet bool
+	// equal is set by WithEqual.
+	equal func(current, val interface{}) bool
+}
+
+func newCallOptions(opts []CallOption) callOptions {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithoutCacheLocks makes DeleteMulti, Delete and DeleteAll skip locking the
+// cache and instead remove the cached entities once the datastore delete
+// succeeds. This halves the cache traffic of bulk cleanup jobs, at the cost of
+// a small window in which a concurrent Get can cache an entity that is being
+// deleted. Only use it when no reader cares about that, for example when
+// deleting expired data nobody reads anymore.
+func WithoutCacheLocks() CallOption {
+	return func(o *callOptions) {
+		o.withoutCacheLocks = true
+	}
+}
+
+// WithoutColdKeyLocks makes DeleteMulti, Delete and DeleteAll first check
+// which keys have anything in the cache, whether an entity, a tombstone or a
+// lock, and only lock those, deleting the others straight from the datastore.
+// A batch of cold keys then costs a cache read instead of a cache write and
+// leaves no locks behind to use up cache memory or count against
+// WithCacheRateLimit. Batches of mostly cached keys cost the extra read.
+//
+// It is not as safe as locking every key. A Get that starts caching a key
+// after the check and reads the datastore before the delete caches the
+// deleted entity, which then stays cached until the cacher evicts it, as
+// entities don't expire unless WithCacheTTL is set, or until the key is
+// written again. Only use it for cold data that is unlikely to be read while
+// it is deleted. Cold keys also don't get tombstones with
+// WithDeleteTombstones. If the check fails every key is locked.
+func WithoutColdKeyLocks() CallOption {
+	return func(o *callOptions) {
+		o.withoutColdKeyLocks = true
+	}
+}
+
+// WithConcurrency makes GetMulti, PutMulti or DeleteMulti run at most n of
+// its shards at once for this call, instead of sharing the limit set with
+// WithReadConcurrency, WithWriteConcurrency or WithDeleteConcurrency with
+// every other call. n must be positive.
+func WithConcurrency(n int) CallOption {
+	return func(o *callOptions) {
+		o.concurrency, o.concurrencySet = n, true
+	}
+}
+
+// WithEqual makes PutIfChanged compare the stored entity with the new one
+// using equal instead of comparing their encoded properties. current is a
+// pointer to the stored entity, loaded into a new value of the type val
+// points to, and val is the value passed to PutIfChanged. Returning true
+// skips the write.
+func WithEqual(equal func(current, val interface{}) bool) CallOption {
+	return func(o *callOptions) {
+		o.equal = equal
+	}
+}
+
+// concurrencyOr returns the concurrency set with WithConcurrency, or def if
+// it wasn't passed.
+func (o callOptions) concurrencyOr(def int) (int, error) {
+	if !o.concurrencySet {
+		return def, nil
+	}
+	if o.concurrency <= 0 {
+		return 0, errors.New("nds: WithConcurrency needs a positive limit")
+	}
+	return o.concurrency, nil
+}
+
+// shardLimit returns the shard limit of the call, which is def, the Client's
+// limit, unless WithConcurrency was passed.
+func (o callOptions) shardLimit(def shardLimit) (shardLimit, error) {
+	if !o.concurrencySet {
+		return def, nil
+	}
+	n, err := o.concurrencyOr(0)
+	if err != nil {
+		return nil, err
+	}
+	return newShardLimit(n), nil
+}
@@ -0,0 +1,74 @@
+package nds
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+// WithConsistencyCanary makes a probability fraction of Get and GetMulti calls
+// check, once they have been served as usual, that what the cache holds for
+// their keys matches the datastore, calling onMismatch for every key where
+// the two differ. Unlike WithShadowReads, sampled calls return what they would
+// have returned anyway, so it can be left running to keep validating the
+// cache in production, at the cost of a datastore and a cache read per
+// sampled call. The datastore is read before the cache so that an nds write
+// racing the check isn't mistaken for a mismatch, but a write that bypasses
+// nds can be. Locks and keys missing from the cache never mismatch, and
+// failed checks are passed to the OnErrorFunc. Calls are sampled using the
+// source set with WithRand.
+func WithConsistencyCanary(probability float64,
+	onMismatch func(ctx context.Context, m CacheMismatch)) ClientOption {
+	return func(c *Client) {
+		c.canaryRate, c.onCanaryMismatch = probability, onMismatch
+	}
+}
+
+func (c *Client) sampleCanary() bool {
+	return c.canaryRate > 0 && c.onCanaryMismatch != nil && c.randFloat64() < c.canaryRate
+}
+
+// checkCanary compares the cache against the datastore for keys, calling the
+// WithConsistencyCanary callback for every key where they differ.
+func (c *Client) checkCanary(ctx context.Context, keys []*datastore.Key) {
+	checkKeys := make([]*datastore.Key, 0, len(keys))
+	cacheKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		checkKeys = append(checkKeys, key)
+		cacheKeys = append(cacheKeys, createCacheKey(c.keys, key))
+	}
+	if len(checkKeys) == 0 {
+		return
+	}
+
+	pls := make([]datastore.PropertyList, len(checkKeys))
+	me := make(datastore.MultiError, len(checkKeys))
+	if err := c.guardDatastore(ctx, func() error {
+		return c.ds.GetMulti(ctx, checkKeys, pls)
+	}); err != nil {
+		e, ok := err.(datastore.MultiError)
+		if !ok {
+			c.onError(ctx, errors.Wrap(err, "nds:checkCanary GetMulti"))
+			return
+		}
+		me = e
+	}
+
+	items, err := c.cacher.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:checkCanary cache.GetMulti"))
+		return
+	}
+	for i, key := range checkKeys {
+		if me[i] != nil && me[i] != datastore.ErrNoSuchEntity {
+			continue
+		}
+		if item, ok := items[cacheKeys[i]]; ok && c.cacheMismatch(ctx, item, pls[i], me[i]) {
+			c.onCanaryMismatch(ctx, CacheMismatch{Key: key})
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestConsistencyCanarySuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestConsistencyCanary", ConsistencyCanaryTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func ConsistencyCanaryTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var mismatches []*datastore.Key
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithConsistencyCanary(1, func(_ context.Context, m nds.CacheMismatch) {
+				mismatches = append(mismatches, m.Key)
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Val int
+		}
+
+		kind := fmt.Sprintf("ConsistencyCanaryTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "consistent", nil),
+			datastore.NameKey(kind, "stale", nil),
+			datastore.NameKey(kind, "missing", nil),
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys[:2], []testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Filling the cache finds nothing to disagree with.
+		err = ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys)))
+		if me, ok := err.(datastore.MultiError); !ok || me[2] != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected only the missing key to fail, got %v", err)
+		}
+		if len(mismatches) != 0 {
+			t.Fatalf("expected no mismatches, got %v", mismatches)
+		}
+
+		// Corrupt the cached value of the second key.
+		data, err := nds.MarshalPropertyList(datastore.PropertyList{
+			{Name: "Val", Value: int64(3)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cacher.SetMulti(ctx, []*nds.Item{{
+			Key:   ndsClient.CacheKey(keys[1]),
+			Flags: nds.EntityItem,
+			Value: data,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]testEntity, len(keys))
+		err = ndsClient.GetMulti(ctx, keys, got)
+		if me, ok := err.(datastore.MultiError); !ok || me[2] != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected only the missing key to fail, got %v", err)
+		}
+
+		// The caller is still served from the cache.
+		if got[0].Val != 1 || got[1].Val != 3 {
+			t.Fatalf("expected the cached values, got %v", got)
+		}
+		if len(mismatches) != 1 || !mismatches[0].Equal(keys[1]) {
+			t.Fatalf("expected a single mismatch for %s, got %v", keys[1], mismatches)
+		}
+	}
+}
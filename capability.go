@@ -0,0 +1,77 @@
+package nds
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+// Capabilities lists the optional interfaces a Cacher implements. The
+// features that rely on them either fall back to something else or fail with
+// the matching Err...Unsupported error. CompareAndSwapMulti is part of Cacher
+// itself, so every Cacher supports compare-and-swap.
+type Capabilities struct {
+	// Increment is set for an Incrementer, otherwise Client.Increment counts
+	// in the datastore.
+	Increment bool
+	// CompareAndDelete is set for a CompareAndDeleter, otherwise locks are
+	// removed with DeleteMulti.
+	CompareAndDelete bool
+	// Flush is set for a Flusher, otherwise Client.FlushCache fails with
+	// ErrFlushUnsupported.
+	Flush bool
+	// TTLRead is set for a TTLReader, otherwise Client.CacheTTL fails with
+	// ErrTTLReadUnsupported.
+	TTLRead bool
+}
+
+// CacherCapabilities returns the optional interfaces cacher implements.
+// Cachers that wrap another one, and so implement an interface whether or not
+// the wrapped one does, should return the Err...Unsupported error of the
+// interface when the wrapped one doesn't, as the wrappers of nds do.
+func CacherCapabilities(cacher Cacher) Capabilities {
+	var caps Capabilities
+	_, caps.Increment = cacher.(Incrementer)
+	_, caps.CompareAndDelete = cacher.(CompareAndDeleter)
+	_, caps.Flush = cacher.(Flusher)
+	_, caps.TTLRead = cacher.(TTLReader)
+	return caps
+}
+
+// Capabilities returns the capabilities of the Cacher the client was created
+// with, as found by CacherCapabilities when it was created. A Client without
+// a Cacher has none.
+func (c *Client) Capabilities() Capabilities {
+	return c.capabilities
+}
+
+// FlushCache removes every item from the cache, including those stored by
+// other clients sharing it. It fails with ErrFlushUnsupported if the Cacher
+// isn't a Flusher.
+func (c *Client) FlushCache(ctx context.Context) error {
+	if !c.capabilities.Flush {
+		return ErrFlushUnsupported
+	}
+	return errors.Wrap(c.baseCacher.(Flusher).Flush(ctx), "nds:FlushCache")
+}
+
+// CacheTTL returns the time the entity cached for key has left before it
+// expires, or 0 if it never does, and ErrCacheMiss if it isn't cached. It
+// fails with ErrTTLReadUnsupported if the Cacher isn't a TTLReader.
+func (c *Client) CacheTTL(ctx context.Context, key *datastore.Key) (time.Duration, error) {
+	if !c.capabilities.TTLRead {
+		return 0, ErrTTLReadUnsupported
+	}
+	cacheKey := c.CacheKey(key)
+	ttls, err := c.baseCacher.(TTLReader).TTLMulti(ctx, []string{cacheKey})
+	if err != nil {
+		return 0, errors.Wrap(err, "nds:CacheTTL")
+	}
+	ttl, ok := ttls[cacheKey]
+	if !ok {
+		return 0, ErrCacheMiss
+	}
+	return ttl, nil
+}
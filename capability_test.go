@@ -0,0 +1,110 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestCapabilitySuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestCapabilities", CapabilitiesTest(item.ctx, item.cacher))
+			t.Run("TestMinimalCacherCapabilities", MinimalCacherCapabilitiesTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+// minimalCacher hides every optional interface of the Cacher it embeds.
+type minimalCacher struct {
+	nds.Cacher
+}
+
+func CapabilitiesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caps := ndsClient.Capabilities()
+		if want := nds.CacherCapabilities(cacher); caps != want {
+			t.Fatalf("expected %+v, got %+v", want, caps)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("CapabilitiesTest%d", time.Now().UnixNano()), "one", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		ttl, err := ndsClient.CacheTTL(ctx, key)
+		switch {
+		case !caps.TTLRead && err != nds.ErrTTLReadUnsupported:
+			t.Fatalf("expected %v, got %v", nds.ErrTTLReadUnsupported, err)
+		case caps.TTLRead && (err != nil || ttl < 0):
+			t.Fatalf("expected the TTL of the cached entity, got %s, %v", ttl, err)
+		}
+
+		err = ndsClient.FlushCache(ctx)
+		switch {
+		case !caps.Flush && err != nds.ErrFlushUnsupported:
+			t.Fatalf("expected %v, got %v", nds.ErrFlushUnsupported, err)
+		case caps.Flush && err != nil:
+			t.Fatal(err)
+		case caps.Flush:
+			report, err := ndsClient.Inspect(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.CacheState != nds.CacheAbsent {
+				t.Fatalf("expected the cache flushed, got %s", report.CacheState)
+			}
+		}
+	}
+}
+
+func MinimalCacherCapabilitiesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, minimalCacher{cacher}, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caps := ndsClient.Capabilities(); caps != (nds.Capabilities{}) {
+			t.Fatalf("expected no capabilities, got %+v", caps)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("MinimalCacherCapabilitiesTest%d", time.Now().UnixNano()), "one", nil)
+		if err := ndsClient.FlushCache(ctx); err != nds.ErrFlushUnsupported {
+			t.Fatalf("expected %v, got %v", nds.ErrFlushUnsupported, err)
+		}
+		if _, err := ndsClient.CacheTTL(ctx, key); err != nds.ErrTTLReadUnsupported {
+			t.Fatalf("expected %v, got %v", nds.ErrTTLReadUnsupported, err)
+		}
+
+		// The features with a fallback still work.
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
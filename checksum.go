@@ -0,0 +1,107 @@
+package nds
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+// checksumSize is the size of the CRC-32 prepended to cached entities.
+const checksumSize = 4
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WithCacheChecksums prepends a CRC-32 checksum to every entity written to
+// the cache and verifies it whenever one is read back. An entity that fails
+// its checksum, because the cache backend corrupted or truncated it, is
+// reported to the OnErrorFunc and treated as a cache miss instead of being
+// decoded, so the entity is read from the datastore. The corrupted entity is
+// not cached over until it is written again or expires.
+//
+// Clients sharing a cache must all use checksums or none do, as entities
+// cached by a client without them fail the check and entities cached with
+// them don't decode without it.
+func WithCacheChecksums(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.cacheChecksums = enabled
+	}
+}
+
+// checksumCacher adds checksums to the entities written to the wrapped Cacher
+// and verifies the ones read from it. Locks, tombstones and counters are
+// never decoded into entities and are left as they are.
+type checksumCacher struct {
+	Cacher
+	onError func(ctx context.Context, err error)
+}
+
+// checksummed returns copies of items with a checksum prepended to the values
+// of entities.
+func checksummed(items []*Item) []*Item {
+	sums := make([]*Item, len(items))
+	for i, item := range items {
+		if item.Flags != entityItem {
+			sums[i] = item
+			continue
+		}
+		value := make([]byte, checksumSize+len(item.Value))
+		binary.BigEndian.PutUint32(value, crc32.Checksum(item.Value, checksumTable))
+		copy(value[checksumSize:], item.Value)
+		sums[i] = &Item{
+			Key:        item.Key,
+			Value:      value,
+			Flags:      item.Flags,
+			Expiration: item.Expiration,
+			casInfo:    item.casInfo,
+		}
+	}
+	return sums
+}
+
+func (cc *checksumCacher) AddMulti(ctx context.Context, items []*Item) error {
+	return cc.Cacher.AddMulti(ctx, checksummed(items))
+}
+
+func (cc *checksumCacher) CompareAndSwapMulti(ctx context.Context, items []*Item) error {
+	return cc.Cacher.CompareAndSwapMulti(ctx, checksummed(items))
+}
+
+func (cc *checksumCacher) SetMulti(ctx context.Context, items []*Item) error {
+	return cc.Cacher.SetMulti(ctx, checksummed(items))
+}
+
+func (cc *checksumCacher) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	items, err := cc.Cacher.GetMulti(ctx, keys)
+	for key, item := range items {
+		if item.Flags != entityItem {
+			continue
+		}
+		if len(item.Value) < checksumSize ||
+			binary.BigEndian.Uint32(item.Value) !=
+				crc32.Checksum(item.Value[checksumSize:], checksumTable) {
+			delete(items, key)
+			cc.onError(ctx, errors.Wrapf(ErrCacheChecksum, "nds:checksumCacher GetMulti %s", key))
+			continue
+		}
+		item.Value = item.Value[checksumSize:]
+	}
+	return items, err
+}
+
+func (cc *checksumCacher) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	inc, ok := cc.Cacher.(Incrementer)
+	if !ok {
+		return nil, ErrIncrementUnsupported
+	}
+	return inc.IncrementMulti(ctx, keys, deltas)
+}
+
+func (cc *checksumCacher) CompareAndDeleteMulti(ctx context.Context, items []*Item) error {
+	cad, ok := cc.Cacher.(CompareAndDeleter)
+	if !ok {
+		return ErrCompareAndDeleteUnsupported
+	}
+	return cad.CompareAndDeleteMulti(ctx, checksummed(items))
+}
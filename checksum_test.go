@@ -0,0 +1,109 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestCacheChecksumsSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestCacheChecksums", CacheChecksumsTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func CacheChecksumsTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		corrupted := 0
+		logOKTest := func(err error) bool {
+			if strings.Contains(err.Error(), nds.ErrCacheChecksum.Error()) {
+				corrupted++
+				return true
+			}
+			// The corrupted entity keeps the read from locking its slot.
+			return strings.Contains(err.Error(), nds.ErrNotStored.Error())
+		}
+		ndsClient, err := NewClient(ctx, cacher, t, logOKTest, nds.WithCacheChecksums(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("CacheChecksumsTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "key", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, key)
+
+		var loaded []*datastore.Key
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			loaded = append(loaded, keys...)
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		// Cache the entity and check it is served from the cache.
+		for i := 0; i < 2; i++ {
+			loaded = nil
+			val := &testEntity{}
+			if err := ndsClient.Get(ctx, key, val); err != nil {
+				t.Fatal(err)
+			}
+			if val.IntVal != 1 {
+				t.Fatalf("expected 1, got %d", val.IntVal)
+			}
+		}
+		if len(loaded) != 0 {
+			t.Fatalf("expected a cache hit, loaded %v", loaded)
+		}
+
+		// Flip a bit of the cached entity behind the client's back.
+		cacheKey := ndsClient.CacheKey(key)
+		items, err := cacher.GetMulti(ctx, []string{cacheKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, ok := items[cacheKey]
+		if !ok || item.Flags != nds.EntityItem {
+			t.Fatalf("expected %v cached", key)
+		}
+		value := append([]byte(nil), item.Value...)
+		value[len(value)-1] ^= 1
+		if err := cacher.SetMulti(ctx, []*nds.Item{{
+			Key:        cacheKey,
+			Flags:      nds.EntityItem,
+			Value:      value,
+			Expiration: time.Minute,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded = nil
+		val := &testEntity{}
+		if err := ndsClient.Get(ctx, key, val); err != nil {
+			t.Fatal(err)
+		}
+		if val.IntVal != 1 {
+			t.Fatalf("expected 1, got %d", val.IntVal)
+		}
+		if len(loaded) != 1 || !loaded[0].Equal(key) {
+			t.Fatalf("expected %v loaded from the datastore, got %v", key, loaded)
+		}
+		if corrupted == 0 {
+			t.Fatal("expected the checksum error reported")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// GetChildren loads the entities of kind that have parent as an ancestor,
+// appends them to dst and returns their keys in the same order. dst must be a
+// pointer to a []S, []*S or []P, as for datastore.Client.GetAll. An empty kind
+// loads descendants of every kind. Like any ancestor query it includes
+// grandchildren and further descendants, but never parent itself.
+//
+// The query is keys-only and the entities are then loaded with GetMulti, so
+// the ones that are cached come from the cache, the rest are fetched from the
+// datastore in batches, and all of them are cached afterwards. Entities
+// deleted between the query and the load are left out.
+func (c *Client) GetChildren(ctx context.Context, parent *datastore.Key,
+	kind string, dst interface{}) ([]*datastore.Key, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetChildren")
+	defer span.End()
+	parent = c.inNamespace(parent)
+
+	if parent == nil || parent.Incomplete() {
+		return nil, datastore.ErrInvalidKey
+	}
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() || dv.Elem().Kind() != reflect.Slice {
+		return nil, datastore.ErrInvalidEntityType
+	}
+
+	q := datastore.NewQuery(kind).Namespace(parent.Namespace).
+		Ancestor(parent).KeysOnly()
+	var found []*datastore.Key
+	if err := c.guardDatastore(ctx, func() error {
+		var err error
+		found, err = c.ds.GetAll(ctx, q, nil)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	keys := found[:0]
+	for _, key := range found {
+		if !key.Equal(parent) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	vals := reflect.MakeSlice(dv.Elem().Type(), len(keys), len(keys))
+	if err := c.GetMulti(ctx, keys, vals.Interface()); err != nil {
+		me, ok := unwrapBatchError(err).(datastore.MultiError)
+		if !ok {
+			return nil, err
+		}
+		n := 0
+		for i, err := range me {
+			switch err {
+			case nil:
+			case datastore.ErrNoSuchEntity:
+				continue
+			default:
+				return nil, me
+			}
+			keys[n] = keys[i]
+			vals.Index(n).Set(vals.Index(i))
+			n++
+		}
+		keys, vals = keys[:n], vals.Slice(0, n)
+	}
+
+	dv.Elem().Set(reflect.AppendSlice(dv.Elem(), vals))
+	return keys, nil
+}
@@ -0,0 +1,109 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestGetChildrenSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetChildren", GetChildrenTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func GetChildrenTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("GetChildrenTest%d", time.Now().UnixNano())
+		parent := datastore.NameKey(kind, "parent", nil)
+		keys := []*datastore.Key{parent}
+		for i := 1; i <= 5; i++ {
+			keys = append(keys, datastore.IDKey(kind, int64(i), parent))
+		}
+		// Children of another kind and of another parent are not loaded.
+		other := []*datastore.Key{
+			datastore.IDKey(kind+"Other", 1, parent),
+			datastore.IDKey(kind, 1, datastore.NameKey(kind, "other", nil)),
+		}
+		entities := make([]testEntity, len(keys)+len(other))
+		for i := range entities {
+			entities[i].IntVal = i
+		}
+		if _, err := ndsClient.PutMulti(ctx, append(keys, other...), entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cache two of the children.
+		if err := ndsClient.GetMulti(ctx, keys[1:3], make([]testEntity, 2)); err != nil {
+			t.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		var fetched []*datastore.Key
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			mu.Lock()
+			fetched = append(fetched, keys...)
+			mu.Unlock()
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		got := []*testEntity{{IntVal: -1}}
+		childKeys, err := ndsClient.GetChildren(ctx, parent, kind, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(childKeys) != 5 || len(got) != 6 {
+			t.Fatalf("expected 5 children appended, got %d keys and %d entities",
+				len(childKeys), len(got))
+		}
+		for i, key := range childKeys {
+			if got[i+1].IntVal != int(key.ID) {
+				t.Fatalf("expected entity %d for %v, got %d", key.ID, key, got[i+1].IntVal)
+			}
+		}
+
+		// Only the uncached children come from the datastore.
+		if len(fetched) != 3 {
+			t.Fatalf("expected 3 children fetched from the datastore, got %v", fetched)
+		}
+		for _, key := range fetched {
+			if key.Equal(keys[1]) || key.Equal(keys[2]) {
+				t.Fatalf("expected cached child %v not to be fetched", key)
+			}
+		}
+
+		// Now the cache is warm for all of them.
+		fetched = nil
+		var again []testEntity
+		if _, err := ndsClient.GetChildren(ctx, parent, kind, &again); err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != 5 || len(fetched) != 0 {
+			t.Fatalf("expected 5 children from the cache, got %d with %d fetched",
+				len(again), len(fetched))
+		}
+
+		if _, err := ndsClient.GetChildren(ctx, parent, kind, again); err != datastore.ErrInvalidEntityType {
+			t.Fatalf("expected ErrInvalidEntityType for a non-pointer dst, got %v", err)
+		}
+	}
+}
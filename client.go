@@ -2,7 +2,10 @@ package nds
 
 import (
 	"context"
+	"hash"
 	"log"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/datastore"
 )
@@ -10,8 +13,85 @@ import (
 type OnErrorFunc func(ctx context.Context, err error)
 
 type Client struct {
-	cacher    Cacher
-	onErrorFn OnErrorFunc
+	cacher     Cacher
+	onErrorFn  OnErrorFunc
+	observerFn ObserverFunc
+	breaker    *circuitBreaker
+	inFlight   *byteBudget
+	cacheLimit *tokenBucket
+	cacheFill  chan struct{}
+
+	populateLimit *tokenBucket
+	populateTail  PopulateTailPolicy
+
+	maxBufferedChunks int
+	cacheBatchSize    int
+	coalescer         *readCoalescer
+	readHedgeDelay    time.Duration
+
+	readLimit, writeLimit, deleteLimit shardLimit
+
+	cacheHealth cacheHealth
+	counters    pendingCounters
+
+	txsMu sync.Mutex
+	txs   map[*datastore.Transaction]*Transaction
+
+	keys            keyScheme
+	writeThrough    bool
+	shadowRate      float64
+	cacheTTL        time.Duration
+	ttlJitter       float64
+	lockWait        time.Duration
+	lockPoll        time.Duration
+	logLockedReads  bool
+	tombstoneTTL    time.Duration
+	negativeKinds   map[string]time.Duration
+	immutableKinds  map[string]bool
+	counterFlush    time.Duration
+	serveStale      bool
+	expiresProperty string
+	cacheChecksums  bool
+	namespace       string
+	rand            *lockedRand
+
+	versionProperty string
+
+	// kindCodecs holds the codecs set up with WithKindCodec by kind, codecs
+	// holds them by name.
+	kindCodecs map[string]Codec
+	codecs     map[string]Codec
+	valueCodec Codec
+
+	canaryRate       float64
+	onCanaryMismatch func(ctx context.Context, m CacheMismatch)
+
+	lockRetryAttempts int
+	lockRetryBackoff  time.Duration
+	lockCleanup       chan struct{}
+	keepFailedLocks   bool
+
+	// baseCacher is the Cacher the client was created with, before it was
+	// wrapped, for the calls of the optional interfaces it implements.
+	baseCacher   Cacher
+	capabilities Capabilities
+
+	kindStats *kindStats
+
+	warmupKeys []*datastore.Key
+	warmupDone chan struct{}
+
+	queryCacheTTL time.Duration
+	stuckLockAge  time.Duration
+	batchErrors   bool
+
+	readCachePolicy  ReadCacheErrorPolicy
+	writeCachePolicy WriteCacheErrorPolicy
+	encodePolicy     EncodeErrorPolicy
+
+	// ds makes the datastore calls nds wraps, it is the embedded
+	// datastore.Client unless WithDatastore was used.
+	ds Datastore
 
 	// TODO: Client is exported since we embedded datastore.Client - fix this
 	*datastore.Client
@@ -21,12 +101,57 @@ type Client struct {
 // Inspired by Google's api/option package.
 type ClientOption func(*Client)
 
+// Datastore is the part of datastore.Client the Client calls through. The
+// *datastore.Client is the real one; a fake passed to WithDatastore can make
+// these calls fail or behave differently for fault-injection tests.
+type Datastore interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error)
+	Run(ctx context.Context, q *datastore.Query) *datastore.Iterator
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	Mutate(ctx context.Context, muts ...*datastore.Mutation) ([]*datastore.Key, error)
+	NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (*datastore.Transaction, error)
+	RunInTransaction(ctx context.Context, f func(tx *datastore.Transaction) error,
+		opts ...datastore.TransactionOption) (*datastore.Commit, error)
+}
+
 func WithDatastoreClient(ds *datastore.Client) ClientOption {
 	return func(c *Client) {
 		c.Client = ds
 	}
 }
 
+// WithDatastore makes the Client call ds instead of the datastore.Client for
+// every datastore call it wraps. Wrapping a real datastore.Client, for example
+// by embedding it and overriding PutMulti, fakes just the calls that matter to
+// a test:
+//
+//	type failingPuts struct{ *datastore.Client }
+//
+//	func (failingPuts) PutMulti(context.Context, []*datastore.Key, interface{}) ([]*datastore.Key, error) {
+//		return nil, errors.New("injected")
+//	}
+//
+//	client, err := nds.NewClient(ctx, cacher, nds.WithDatastoreClient(ds),
+//		nds.WithDatastore(failingPuts{ds}))
+//
+// The methods of datastore.Client that nds doesn't wrap, such as AllocateIDs,
+// are still called on the datastore.Client set with WithDatastoreClient. No
+// default datastore.Client is created when WithDatastore is used, so without
+// WithDatastoreClient those methods can only be used if ds is a
+// *datastore.Client itself.
+func WithDatastore(ds Datastore) ClientOption {
+	return func(c *Client) {
+		c.ds = ds
+		if dsClient, ok := ds.(*datastore.Client); ok {
+			c.Client = dsClient
+		}
+	}
+}
+
 // WithOnErrorFunc sets up an OnErrorFunc to be called for every internal
 // error that doesn't return to the caller but maybe useful to capture for
 // logging/debugging/reporting purposes. For example, to keep the original
@@ -39,6 +164,81 @@ func WithOnErrorFunc(f OnErrorFunc) ClientOption {
 	}
 }
 
+// WithObserver sets up an ObserverFunc to be called for every Event emitted by
+// the client, such as circuit breaker state changes. By default events are
+// discarded.
+func WithObserver(f ObserverFunc) ClientOption {
+	return func(c *Client) {
+		c.observerFn = f
+	}
+}
+
+// WithDatabaseID tells the client which named datastore database the wrapped
+// datastore.Client reads and writes, so it can be included in every cache key.
+// nds can't discover this from the datastore.Client itself, so this must match
+// the database the client was created for. The default database needs no
+// option and keeps the cache keys nds has always used.
+//
+// To use several databases, create one datastore.Client per database and wrap
+// each in its own nds Client sharing a single Cacher:
+//
+//	orders, err := nds.NewClient(ctx, cacher,
+//		nds.WithDatastoreClient(ordersDS), nds.WithDatabaseID("orders"))
+//	users, err := nds.NewClient(ctx, cacher,
+//		nds.WithDatastoreClient(usersDS), nds.WithDatabaseID("users"))
+//
+// The same key read through orders and users is then cached separately.
+func WithDatabaseID(databaseID string) ClientOption {
+	return func(c *Client) {
+		c.keys.databaseID = databaseID
+	}
+}
+
+// WithKeyHasher sets how the client shortens cache keys that would be too
+// long for the cache backend. Keys longer than maxKeySize bytes are replaced
+// by the hex encoded hash of the whole key computed with newHash, for example
+// sha256.New, while shorter keys are left readable. A nil newHash keeps the
+// default of SHA-1 and a maxKeySize of 0 or less keeps the default of 250
+// bytes, which is memcache's limit. The hashed key of newHash must itself fit
+// the backend's limit.
+//
+// Lock keys always equal cache keys, and counter keys are hashed the same way
+// with their own prefix, so they keep corresponding. Changing the hasher or
+// the size changes the cache keys of long keys, so every Client sharing a
+// cache must be configured the same way, or writes through one won't
+// invalidate what another cached. Switch them all at once and flush the
+// entities with long keys from the cache when doing so.
+func WithKeyHasher(newHash func() hash.Hash, maxKeySize int) ClientOption {
+	return func(c *Client) {
+		c.keys.newHash = newHash
+		c.keys.maxKeySize = maxKeySize
+	}
+}
+
+// CacheKey returns the cache key the client uses to store the entity for key.
+// It equals the package level CacheKey unless WithDatabaseID, WithKeyHasher
+// or WithCacheKeyFunc was used.
+func (c *Client) CacheKey(key *datastore.Key) string {
+	return createCacheKey(c.keys, c.inNamespace(key))
+}
+
+// LockKey returns the cache key the client uses to lock the entity for key
+// while it is being written. It always equals c.CacheKey(key).
+func (c *Client) LockKey(key *datastore.Key) string {
+	return createCacheKey(c.keys, c.inNamespace(key))
+}
+
+// WithWriteThrough makes Put and PutMulti populate the cache with the written
+// entities once the datastore write succeeds, so a read straight after a write
+// is a cache hit. The cache lock set before the write is replaced using
+// compare-and-swap so no stale value can be cached in between. It costs an
+// extra cache read and write per put and is disabled by default.
+func WithWriteThrough(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.writeThrough = enabled
+	}
+}
+
 // NewClient will return an nds.Client that can be used exactly like a datastore.Client but will
 // transparently use the cache configuration provided to cache requests when it can.
 func NewClient(ctx context.Context, cacher Cacher, opts ...ClientOption) (*Client, error) {
@@ -50,7 +250,34 @@ func NewClient(ctx context.Context, cacher Cacher, opts ...ClientOption) (*Clien
 		opt(client)
 	}
 
-	if client.Client == nil {
+	if client.rand == nil {
+		client.rand = newDefaultRand()
+	}
+
+	if client.cacher != nil {
+		// The optional interfaces are looked for before the cacher is
+		// wrapped, as the wrappers implement them all.
+		client.baseCacher = client.cacher
+		client.capabilities = CacherCapabilities(client.cacher)
+		if client.cacheChecksums {
+			client.cacher = &checksumCacher{Cacher: client.cacher, onError: client.onError}
+		}
+		client.cacher = &healthCacher{
+			Cacher: &countingCacher{Cacher: client.cacher},
+			health: &client.cacheHealth,
+		}
+		// The limit wraps the health check so waiting out the limit is
+		// never recorded as a cache failure.
+		if client.cacheLimit != nil {
+			client.cacher = &rateLimitedCacher{Cacher: client.cacher, limit: client.cacheLimit}
+		}
+		// Batches are split last so each call is limited and counted.
+		if client.cacheBatchSize > 0 {
+			client.cacher = &batchingCacher{Cacher: client.cacher, size: client.cacheBatchSize}
+		}
+	}
+
+	if client.Client == nil && client.ds == nil {
 		// Default datastore.Client
 		if ds, err := datastore.NewClient(ctx, ""); err != nil {
 			return nil, err
@@ -58,6 +285,10 @@ func NewClient(ctx context.Context, cacher Cacher, opts ...ClientOption) (*Clien
 			client.Client = ds
 		}
 	}
+	if client.ds == nil {
+		client.ds = client.Client
+	}
+	client.startWarmup(ctx)
 
 	return client, nil
 }
@@ -69,3 +300,9 @@ func (c *Client) onError(ctx context.Context, err error) {
 	}
 	log.Println(err)
 }
+
+func (c *Client) observe(ctx context.Context, e Event) {
+	if c.observerFn != nil {
+		c.observerFn(ctx, e)
+	}
+}
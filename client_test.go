@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/qedus/nds/v2"
@@ -67,6 +70,67 @@ func TestClient_onError(t *testing.T) {
 
 }
 
+func TestClient_LastCacheError(t *testing.T) {
+	ctx := context.Background()
+	testErr := errors.New("cache down")
+
+	fail := true
+	testCacher := &mockCacher{
+		cacher: memory.NewCacher(),
+		getMultiHook: func(_ context.Context, _ []string) (map[string]*nds.Item, error) {
+			if fail {
+				return nil, testErr
+			}
+			return nil, nds.MultiError{nds.ErrCacheMiss}
+		},
+	}
+
+	dsClient, err := datastore.NewClient(ctx, "")
+	if err != nil {
+		t.Fatalf("could not get datastore client: %v", err)
+	}
+	c, err := nds.NewClient(ctx, testCacher, nds.WithDatastoreClient(dsClient),
+		nds.WithOnErrorFunc(func(context.Context, error) {}))
+	if err != nil {
+		t.Fatalf("could not make nds client due to error: %v", err)
+	}
+
+	if err, at := c.LastCacheError(); err != nil || !at.IsZero() {
+		t.Fatalf("expected no cache error, got %v at %v", err, at)
+	}
+	if !c.CacheHealthy(time.Minute) {
+		t.Fatal("expected a new client to be healthy")
+	}
+
+	type testObject struct{}
+	keys := []*datastore.Key{datastore.NameKey("LastCacheErrorTest", "name", nil)}
+	before := time.Now()
+	c.GetMulti(ctx, keys, make([]testObject, 1))
+
+	gotErr, at := c.LastCacheError()
+	if gotErr != testErr {
+		t.Fatalf("expected %v, got %v", testErr, gotErr)
+	}
+	if at.Before(before) || at.After(time.Now()) {
+		t.Fatalf("unexpected error time %v", at)
+	}
+	if c.CacheHealthy(time.Minute) {
+		t.Fatal("expected cache to be unhealthy")
+	}
+
+	// Cache misses are not failures.
+	fail = false
+	c.GetMulti(ctx, keys, make([]testObject, 1))
+	if gotErr, _ := c.LastCacheError(); gotErr != testErr {
+		t.Fatalf("expected %v to be kept, got %v", testErr, gotErr)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if !c.CacheHealthy(time.Millisecond) {
+		t.Fatal("expected cache to be healthy after the window")
+	}
+}
+
 func TestNewClient(t *testing.T) {
 	cctx, cancel := context.WithCancel(context.Background())
 	cancel()
@@ -107,3 +171,100 @@ func TestNewClient(t *testing.T) {
 		})
 	}
 }
+
+// partialDatastore fails the puts of the keys in fail and makes the others
+// with the datastore.Client it embeds.
+type partialDatastore struct {
+	*datastore.Client
+	fail map[string]error
+}
+
+func (p *partialDatastore) PutMulti(ctx context.Context,
+	keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	vals := reflect.ValueOf(src)
+	me := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if err := p.fail[key.String()]; err != nil {
+			me[i], failed = err, true
+			continue
+		}
+		if _, err := p.Client.Put(ctx, key, vals.Index(i).Addr().Interface()); err != nil {
+			return nil, err
+		}
+	}
+	if failed {
+		return keys, me
+	}
+	return keys, nil
+}
+
+func TestClient_WithDatastore(t *testing.T) {
+	ctx := context.Background()
+	cacher := memory.NewCacher()
+
+	dsClient, err := datastore.NewClient(ctx, "")
+	if err != nil {
+		t.Fatalf("could not get datastore client: %v", err)
+	}
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	kind := fmt.Sprintf("WithDatastoreTest%d", time.Now().UnixNano())
+	keys := []*datastore.Key{
+		datastore.NameKey(kind, "written", nil),
+		datastore.NameKey(kind, "failed", nil),
+	}
+	expectedErr := errors.New("expected error")
+	ds := &partialDatastore{
+		Client: dsClient,
+		fail:   map[string]error{keys[1].String(): expectedErr},
+	}
+
+	// Only the fake is given, so nds must make every call through it.
+	c, err := nds.NewClient(ctx, cacher, nds.WithDatastore(ds))
+	if err != nil {
+		t.Fatalf("could not make nds client due to error: %v", err)
+	}
+	if c.Client != nil {
+		t.Fatalf("expected no default datastore.Client, got %v", c.Client)
+	}
+
+	// Cache both keys so the failed write must still remove its lock.
+	if err := c.GetMulti(ctx, keys, make([]testEntity, len(keys))); err == nil {
+		t.Fatal("expected both keys missing")
+	}
+
+	_, err = c.PutMulti(ctx, keys, []testEntity{{1}, {2}})
+	me, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("expected a datastore.MultiError, got %v", err)
+	}
+	if me[0] != nil || me[1] != expectedErr {
+		t.Fatalf("expected [nil %v], got %v", expectedErr, me)
+	}
+
+	cacheKeys := []string{c.CacheKey(keys[0]), c.CacheKey(keys[1])}
+	items, err := cacher.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("expected the locks and stale misses removed, got %v", items)
+	}
+
+	entities := make([]testEntity, len(keys))
+	err = c.GetMulti(ctx, keys, entities)
+	me, ok = err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("expected a datastore.MultiError, got %v", err)
+	}
+	if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected [nil %v], got %v", datastore.ErrNoSuchEntity, me)
+	}
+	if entities[0].IntVal != 1 {
+		t.Fatalf("expected the written entity, got %+v", entities[0])
+	}
+}
@@ -0,0 +1,249 @@
+package nds
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WithReadCoalesceWindow makes the entities that Get and GetMulti calls miss
+// in the cache within window of each other load from the datastore with a
+// single GetMulti call, so spiky load on hot keys costs fewer round trips.
+// The first miss opens the window and its load waits for the window to close,
+// so every read can take up to window longer. Keys missed by several calls are
+// looked up once and each call gets its own copy of the entity. As the lookup
+// is made once the window closes, after every call sharing it has started, no
+// call is served an older entity than it would have loaded itself.
+//
+// A window closes early once its lookup reaches the datastore's limit of 1000
+// keys. A call whose context is done stops waiting and fails with the
+// context's error; the shared lookup is only canceled once no call is left
+// waiting for it, and is attributed to the call that opened the window by its
+// context, for example by WithOpStats. Only reads through a Cacher are
+// coalesced. A window of 0 or less disables coalescing, which is the default.
+func WithReadCoalesceWindow(window time.Duration) ClientOption {
+	return func(c *Client) {
+		if window <= 0 {
+			c.coalescer = nil
+			return
+		}
+		c.coalescer = &readCoalescer{
+			window: window,
+			fetch: func(ctx context.Context, keys []*datastore.Key,
+				vals []datastore.PropertyList) error {
+				return c.guardDatastore(ctx, func() error {
+					return c.hedgedGetMulti(ctx, keys, vals)
+				})
+			},
+		}
+	}
+}
+
+// readCoalescer gathers the datastore lookups made within a window into
+// batches of at most getMultiLimit keys.
+type readCoalescer struct {
+	window time.Duration
+	fetch  func(ctx context.Context, keys []*datastore.Key, vals []datastore.PropertyList) error
+
+	sync.Mutex
+	pending *coalescedRead
+}
+
+// coalescedRead is one lookup shared by the calls that joined it.
+type coalescedRead struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// keys, index, waiters and started are guarded by the readCoalescer.
+	keys    []*datastore.Key
+	index   map[string]int
+	waiters int
+	started bool
+
+	// vals and err are set once done is closed.
+	vals []datastore.PropertyList
+	err  error
+	done chan struct{}
+}
+
+// get loads keys into vals like the datastore's GetMulti, as part of the
+// pending batch.
+func (r *readCoalescer) get(ctx context.Context, keys []*datastore.Key,
+	vals []datastore.PropertyList) error {
+
+	r.Lock()
+	batch := r.pending
+	if batch != nil && len(batch.keys)+batch.newKeys(keys) > getMultiLimit {
+		r.startLocked(batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &coalescedRead{
+			index: make(map[string]int, len(keys)),
+			done:  make(chan struct{}),
+		}
+		batch.ctx, batch.cancel = context.WithCancel(detachedContext{ctx})
+		r.pending = batch
+		time.AfterFunc(r.window, func() {
+			r.Lock()
+			r.startLocked(batch)
+			r.Unlock()
+		})
+	}
+	positions := batch.add(keys)
+	batch.waiters++
+	r.Unlock()
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		r.Lock()
+		if batch.waiters--; batch.waiters == 0 {
+			// Nobody is left to look the batch up for.
+			batch.started = true
+			if r.pending == batch {
+				r.pending = nil
+			}
+			batch.cancel()
+		}
+		r.Unlock()
+		return ctx.Err()
+	}
+
+	var me datastore.MultiError
+	if err, ok := batch.err.(datastore.MultiError); ok {
+		me = err
+	} else if batch.err != nil {
+		return batch.err
+	}
+	var errs datastore.MultiError
+	for i, p := range positions {
+		if me != nil && me[p] != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[i] = me[p]
+			continue
+		}
+		vals[i] = copyPropertyList(batch.vals[p])
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// startLocked takes batch off the pending slot and looks it up, unless that
+// has happened already. It must be called with r locked.
+func (r *readCoalescer) startLocked(batch *coalescedRead) {
+	if batch.started {
+		return
+	}
+	batch.started = true
+	if r.pending == batch {
+		r.pending = nil
+	}
+	go func() {
+		defer batch.cancel()
+		batch.vals = make([]datastore.PropertyList, len(batch.keys))
+		batch.err = r.fetch(batch.ctx, batch.keys, batch.vals)
+		close(batch.done)
+	}()
+}
+
+// newKeys returns how many of keys aren't in the batch yet.
+func (b *coalescedRead) newKeys(keys []*datastore.Key) int {
+	n := 0
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		encoded := key.Encode()
+		if _, ok := b.index[encoded]; !ok && !seen[encoded] {
+			seen[encoded] = true
+			n++
+		}
+	}
+	return n
+}
+
+// add adds keys to the batch and returns their positions in it.
+func (b *coalescedRead) add(keys []*datastore.Key) []int {
+	positions := make([]int, len(keys))
+	for i, key := range keys {
+		encoded := key.Encode()
+		p, ok := b.index[encoded]
+		if !ok {
+			p = len(b.keys)
+			b.index[encoded] = p
+			b.keys = append(b.keys, key)
+		}
+		positions[i] = p
+	}
+	return positions
+}
+
+// coalescable reports whether keys can share a lookup. The datastore fails a
+// whole GetMulti without looking up any key if one of them is invalid, so
+// those calls must be made on their own.
+func coalescable(keys []*datastore.Key) bool {
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			return false
+		}
+		for k := key; k != nil; k = k.Parent {
+			if k.Kind == "" || (k.Name != "" && k.ID != 0) {
+				return false
+			}
+			if k.Parent != nil &&
+				(k.Parent.Incomplete() || k.Parent.Namespace != k.Namespace) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// copyPropertyList copies pl deeply enough that changing the entity loaded
+// from it can't change another copy.
+func copyPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	cp := make(datastore.PropertyList, len(pl))
+	for i, p := range pl {
+		p.Value = copyPropertyValue(p.Value)
+		cp[i] = p
+	}
+	return cp
+}
+
+func copyPropertyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return append([]byte(nil), v...)
+	case []interface{}:
+		cp := make([]interface{}, len(v))
+		for i, e := range v {
+			cp[i] = copyPropertyValue(e)
+		}
+		return cp
+	case *datastore.Key:
+		return copyKey(v)
+	case *datastore.Entity:
+		if v == nil {
+			return v
+		}
+		return &datastore.Entity{
+			Key:        copyKey(v.Key),
+			Properties: copyPropertyList(v.Properties),
+		}
+	}
+	return v
+}
+
+func copyKey(key *datastore.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	cp := *key
+	cp.Parent = copyKey(key.Parent)
+	return &cp
+}
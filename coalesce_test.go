@@ -0,0 +1,170 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestReadCoalesceWindowSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestReadCoalesceWindow", ReadCoalesceWindowTest(item.ctx, item.cacher))
+			t.Run("TestReadCoalesceWindowDeadline", ReadCoalesceWindowDeadlineTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+// countingDatastore counts the GetMulti calls made through it.
+type countingDatastore struct {
+	*datastore.Client
+	gets int32
+}
+
+func (c *countingDatastore) GetMulti(ctx context.Context,
+	keys []*datastore.Key, dst interface{}) error {
+	atomic.AddInt32(&c.gets, 1)
+	return c.Client.GetMulti(ctx, keys, dst)
+}
+
+func newCoalescingClient(ctx context.Context, cacher nds.Cacher, t *testing.T,
+	window time.Duration) (*nds.Client, *countingDatastore) {
+	dsClient, err := datastore.NewClient(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &countingDatastore{Client: dsClient}
+	ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithDatastoreClient(dsClient),
+		nds.WithDatastore(ds), nds.WithReadCoalesceWindow(window))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ndsClient, ds
+}
+
+func ReadCoalesceWindowTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, ds := newCoalescingClient(ctx, cacher, t, 100*time.Millisecond)
+
+		type testEntity struct {
+			IntVal int
+			Bytes  []byte
+		}
+
+		kind := fmt.Sprintf("ReadCoalesceWindowTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, 10)
+		entities := make([]testEntity, len(keys))
+		for i := range keys {
+			keys[i] = datastore.NameKey(kind, strconv.Itoa(i), nil)
+			entities[i] = testEntity{i, []byte{byte(i)}}
+		}
+		if _, err := ndsClient.Client.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Overlapping reads that miss the cache arrive a little apart, one
+		// of them for a key that doesn't exist.
+		missing := datastore.NameKey(kind, "missing", nil)
+		const readers = 5
+		var wg sync.WaitGroup
+		results := make([][]testEntity, readers)
+		errs := make([]error, readers)
+		for r := 0; r < readers; r++ {
+			readKeys := append([]*datastore.Key(nil), keys[r:r+5]...)
+			if r == readers-1 {
+				readKeys = append(readKeys, missing)
+			}
+			results[r] = make([]testEntity, len(readKeys))
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				errs[r] = ndsClient.GetMulti(ctx, readKeys, results[r])
+			}(r)
+			time.Sleep(5 * time.Millisecond)
+		}
+		wg.Wait()
+
+		if gets := atomic.LoadInt32(&ds.gets); gets != 1 {
+			t.Fatalf("expected 1 datastore GetMulti, got %d", gets)
+		}
+		for r := 0; r < readers; r++ {
+			if r == readers-1 {
+				me, ok := errs[r].(datastore.MultiError)
+				if !ok || me[len(me)-1] != datastore.ErrNoSuchEntity {
+					t.Fatalf("expected the missing key to fail with %v, got %v",
+						datastore.ErrNoSuchEntity, errs[r])
+				}
+				for _, err := range me[:len(me)-1] {
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			} else if errs[r] != nil {
+				t.Fatal(errs[r])
+			}
+			for i := 0; i < 5; i++ {
+				if got := results[r][i]; got.IntVal != r+i || got.Bytes[0] != byte(r+i) {
+					t.Fatalf("reader %d: expected entity %d, got %+v", r, r+i, got)
+				}
+			}
+		}
+
+		// Each reader got its own copy of the entities they share.
+		results[0][1].Bytes[0] = 99
+		if results[1][0].Bytes[0] != 1 {
+			t.Fatal("expected readers not to share entity values")
+		}
+	}
+}
+
+func ReadCoalesceWindowDeadlineTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, ds := newCoalescingClient(ctx, cacher, t, 100*time.Millisecond)
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		key := datastore.NameKey(
+			fmt.Sprintf("ReadCoalesceWindowDeadlineTest%d", time.Now().UnixNano()), "key", nil)
+		if _, err := ndsClient.Client.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The read opening the window gives up before it closes, which
+		// mustn't fail the read that joined it.
+		shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		var wg sync.WaitGroup
+		var shortErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shortErr = ndsClient.Get(shortCtx, key, &testEntity{})
+		}()
+		time.Sleep(time.Millisecond)
+
+		entity := &testEntity{}
+		if err := ndsClient.Get(ctx, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		if shortErr != context.DeadlineExceeded {
+			t.Fatalf("expected %v, got %v", context.DeadlineExceeded, shortErr)
+		}
+		if entity.IntVal != 1 {
+			t.Fatalf("expected the entity, got %+v", entity)
+		}
+		if gets := atomic.LoadInt32(&ds.gets); gets != 1 {
+			t.Fatalf("expected 1 datastore GetMulti, got %d", gets)
+		}
+	}
+}
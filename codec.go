@@ -0,0 +1,84 @@
+package nds
+
+import (
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+// codecMarker starts the cached entities encoded by a Codec, ahead of the
+// length and name of the codec. It never starts a gob stream, as those start
+// with the non-zero length of their first message, so entities cached with
+// the default encoding still decode.
+const codecMarker = 0
+
+// Codec encodes the entities of the kinds it is set up for with WithKindCodec
+// for the cache, in place of the default gob encoding, for example so that a
+// service in another language can read them.
+type Codec interface {
+	// Name identifies the codec in the entities it encodes, so they are
+	// decoded with it whatever kind they are read as. It must be unique among
+	// the codecs of a Client and at most 255 bytes long.
+	Name() string
+	Marshal(pl datastore.PropertyList) ([]byte, error)
+	Unmarshal(data []byte, pl *datastore.PropertyList) error
+}
+
+// WithKindCodec makes entities of kind be cached encoded by codec; the other
+// kinds keep the default gob encoding. The name of the codec is cached along
+// with every entity it encodes and picks the codec that decodes it, so
+// changing the codec of a kind doesn't break the entities already cached.
+// Clients sharing a cache must all be set up with the codecs found in it,
+// otherwise entities encoded by an unknown codec can't be decoded and are
+// read from the datastore instead.
+func WithKindCodec(kind string, codec Codec) ClientOption {
+	return func(c *Client) {
+		if c.kindCodecs == nil {
+			c.kindCodecs = make(map[string]Codec)
+			c.codecs = make(map[string]Codec)
+		}
+		c.kindCodecs[kind] = codec
+		c.codecs[codec.Name()] = codec
+	}
+}
+
+// marshalEntity encodes pl, the entity for key, for the cache.
+func (c *Client) marshalEntity(key *datastore.Key, pl datastore.PropertyList) ([]byte, error) {
+	codec, ok := c.kindCodecs[key.Kind]
+	if !ok {
+		if c.valueCodec != nil {
+			return c.valueCodec.Marshal(pl)
+		}
+		return marshal(pl)
+	}
+	name := codec.Name()
+	if len(name) > 255 {
+		return nil, errors.Errorf("nds: codec name %q is longer than 255 bytes", name)
+	}
+	data, err := codec.Marshal(pl)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, 0, 2+len(name)+len(data))
+	encoded = append(encoded, codecMarker, byte(len(name)))
+	encoded = append(encoded, name...)
+	return append(encoded, data...), nil
+}
+
+// unmarshalEntity decodes an entity encoded by marshalEntity.
+func (c *Client) unmarshalEntity(data []byte, pl *datastore.PropertyList) error {
+	if len(data) == 0 || data[0] != codecMarker {
+		if c.valueCodec != nil {
+			return c.valueCodec.Unmarshal(data, pl)
+		}
+		return unmarshal(data, pl)
+	}
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return errors.New("nds: truncated codec name")
+	}
+	name := string(data[2 : 2+data[1]])
+	codec, ok := c.codecs[name]
+	if !ok {
+		return errors.Errorf("nds: unknown codec %q", name)
+	}
+	return codec.Unmarshal(data[2+len(name):], pl)
+}
@@ -0,0 +1,127 @@
+package nds_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestKindCodecSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestKindCodec", KindCodecTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+// prefixCodec is the default encoding behind a prefix of its name, so the
+// cached entities it encoded can be told apart.
+type prefixCodec struct {
+	name            string
+	marshals, loads int32
+}
+
+func (p *prefixCodec) Name() string { return p.name }
+
+func (p *prefixCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	atomic.AddInt32(&p.marshals, 1)
+	data, err := nds.MarshalPropertyList(pl)
+	return append([]byte(p.name), data...), err
+}
+
+func (p *prefixCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	atomic.AddInt32(&p.loads, 1)
+	if !bytes.HasPrefix(data, []byte(p.name)) {
+		return errors.New("missing prefix " + p.name)
+	}
+	return nds.UnmarshalPropertyList(data[len(p.name):], pl)
+}
+
+func KindCodecTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		suffix := time.Now().UnixNano()
+		kinds := []string{
+			fmt.Sprintf("KindCodecTestA%d", suffix),
+			fmt.Sprintf("KindCodecTestB%d", suffix),
+			fmt.Sprintf("KindCodecTestDefault%d", suffix),
+		}
+		codecs := []*prefixCodec{{name: "codec-a"}, {name: "codec-b"}}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithKindCodec(kinds[0], codecs[0]),
+			nds.WithKindCodec(kinds[1], codecs[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		keys := make([]*datastore.Key, len(kinds))
+		for i, kind := range kinds {
+			keys[i] = datastore.NameKey(kind, "one", nil)
+			if _, err := ndsClient.Put(ctx, keys[i], &testEntity{i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Fill the cache, then change the datastore behind its back so
+		// reading the cache can be told apart.
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+		for i, key := range keys {
+			if _, err := ndsClient.Client.Put(ctx, key, &testEntity{i + 10}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := make([]testEntity, len(keys))
+		if err := ndsClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		for i := range keys {
+			if got[i].IntVal != i {
+				t.Fatalf("expected the cached entity %d, got %+v", i, got[i])
+			}
+		}
+
+		for i, codec := range codecs {
+			if codec.marshals != 1 || codec.loads != 1 {
+				t.Fatalf("expected %s to encode and decode one entity, got %d and %d",
+					codec.name, codec.marshals, codec.loads)
+			}
+			cacheKey := ndsClient.CacheKey(keys[i])
+			items, err := cacher.GetMulti(ctx, []string{cacheKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item := items[cacheKey]; item == nil || !bytes.Contains(item.Value, []byte(codec.name)) {
+				t.Fatalf("expected the entity of %s cached by %s", kinds[i], codec.name)
+			}
+		}
+
+		// A client without the codecs can't decode those entities and reads
+		// them from the datastore, but still decodes the default ones.
+		plainClient, err := NewClient(ctx, cacher, t, func(err error) bool {
+			return strings.Contains(err.Error(), "unknown codec")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = make([]testEntity, len(keys))
+		if err := plainClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		if got[0].IntVal != 10 || got[1].IntVal != 11 || got[2].IntVal != 2 {
+			t.Fatalf("expected codec entities from the datastore only, got %+v", got)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// CompareAndSwap saves new for key only if the entity currently stored for it
+// equals old, and reports whether it did. A nil old means the entity must not
+// exist. Entities are compared by the properties they are saved with.
+//
+// The swap is made without a datastore transaction by claiming the key's
+// cache slot with the cacher's compare-and-swap: the cached entity is checked
+// against old and replaced by a lock in one step, or, if nothing is cached,
+// a lock is added and the datastore is read instead. Of any number of
+// concurrent CompareAndSwap calls for a key, from any number of Clients
+// sharing a cache, at most one succeeds. A key locked by another write is
+// reported as not swapped so the caller can retry. Writes made through Put,
+// Delete or transactions don't claim the slot that way, so CompareAndSwap
+// offers no protection against them; use PutIfVersion or a transaction if
+// they may race. Without a Cacher it returns ErrCompareAndSwapUnsupported.
+//
+// Once new is written the lock is replaced by it, the same way as with
+// WithWriteThrough, or evicted if that fails.
+func (c *Client) CompareAndSwap(ctx context.Context, key *datastore.Key,
+	old, new interface{}) (bool, error) {
+
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.CompareAndSwap")
+	defer span.End()
+	key = c.inNamespace(key)
+
+	if c.cacher == nil {
+		return false, ErrCompareAndSwapUnsupported
+	}
+	if key == nil || key.Incomplete() {
+		return false, datastore.ErrInvalidKey
+	}
+	if new == nil {
+		return false, datastore.ErrInvalidEntityType
+	}
+	keys := []*datastore.Key{key}
+	c.forgetRequestCache(ctx, keys)
+	defer c.forgetRequestCache(ctx, keys)
+
+	// old is compared the way it would be when read back from the datastore.
+	oldErr := datastore.ErrNoSuchEntity
+	var oldPL datastore.PropertyList
+	if old != nil {
+		pl, err := saveValue(reflect.ValueOf(old))
+		if err != nil {
+			return false, err
+		}
+		oldErr, oldPL = nil, roundTripPropertyList(pl)
+	}
+	newPL, err := saveValue(reflect.ValueOf(new))
+	if err != nil {
+		return false, err
+	}
+
+	cacheKey := createCacheKey(c.keys, key)
+	items, err := c.cacher.GetMulti(ctx, []string{cacheKey})
+	if err != nil {
+		return false, errors.Wrap(err, "nds:CompareAndSwap GetMulti")
+	}
+
+	lock := &Item{
+		Key:        cacheKey,
+		Flags:      lockItem,
+		Value:      writerLock(),
+		Expiration: cacheLockTime,
+	}
+	item, ok := items[cacheKey]
+	switch {
+	case !ok:
+		// Nothing is cached, so claim the slot and check the datastore.
+		if err := c.cacher.AddMulti(ctx, []*Item{lock}); err != nil {
+			if lostCacheSlot(err) {
+				return false, nil
+			}
+			return false, errors.Wrap(err, "nds:CompareAndSwap AddMulti")
+		}
+		stored, err := c.storedItem(ctx, key)
+		if err != nil {
+			c.unlockCache(ctx, []*Item{lock}, "nds:CompareAndSwap DeleteMulti")
+			return false, err
+		}
+		if c.cacheMismatch(ctx, stored, oldPL, oldErr) {
+			c.unlockCache(ctx, []*Item{lock}, "nds:CompareAndSwap DeleteMulti")
+			return false, nil
+		}
+	case item.Flags == lockItem:
+		return false, nil
+	default:
+		if c.cacheMismatch(ctx, item, oldPL, oldErr) {
+			return false, nil
+		}
+		item.Flags, item.Value, item.Expiration = lock.Flags, lock.Value, lock.Expiration
+		if err := c.cacher.CompareAndSwapMulti(ctx, []*Item{item}); err != nil {
+			if lostCacheSlot(err) {
+				return false, nil
+			}
+			return false, errors.Wrap(err, "nds:CompareAndSwap CompareAndSwapMulti")
+		}
+	}
+
+	c.rememberWrites(ctx, keys)
+	if err := c.guardDatastore(ctx, func() error {
+		_, err := c.ds.Put(ctx, key, &newPL)
+		return err
+	}); err != nil {
+		c.unlockCache(ctx, []*Item{lock}, "nds:CompareAndSwap DeleteMulti")
+		return false, err
+	}
+	c.invalidateQueries(ctx, keys)
+
+	if remaining := c.replaceLocks(ctx, keys,
+		reflect.ValueOf([]interface{}{new}), []*Item{lock}); len(remaining) > 0 {
+		c.unlockCache(ctx, remaining, "nds:CompareAndSwap DeleteMulti")
+	}
+	return true, nil
+}
+
+// storedItem returns the entity stored for key as the cache item it would be
+// cached as.
+func (c *Client) storedItem(ctx context.Context, key *datastore.Key) (*Item, error) {
+	var pl datastore.PropertyList
+	err := c.guardDatastore(ctx, func() error {
+		return c.ds.Get(ctx, key, &pl)
+	})
+	switch err {
+	case nil:
+		data, err := c.marshalEntity(key, pl)
+		if err != nil {
+			return nil, err
+		}
+		return &Item{Flags: entityItem, Value: data}, nil
+	case datastore.ErrNoSuchEntity:
+		return &Item{Flags: noneItem, Value: []byte{}}, nil
+	}
+	return nil, err
+}
+
+// lostCacheSlot reports whether err means another caller changed a cache slot
+// first.
+func lostCacheSlot(err error) bool {
+	me, ok := err.(MultiError)
+	if !ok || len(me) != 1 {
+		return false
+	}
+	switch me[0] {
+	case ErrNotStored, ErrCASConflict, ErrCacheMiss:
+		return true
+	}
+	return false
+}
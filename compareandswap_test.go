@@ -0,0 +1,238 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestCompareAndSwapSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestCompareAndSwap", CompareAndSwapTest(item.ctx, item.cacher))
+			t.Run("TestCompareAndSwapConcurrent", CompareAndSwapConcurrentTest(item.ctx, item.cacher))
+			t.Run("TestCompareAndSwapWriteHooks", CompareAndSwapWriteHooksTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+type casEntity struct {
+	IntVal int
+}
+
+func CompareAndSwapTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := fmt.Sprintf("CompareAndSwapTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "key", nil)
+		swap := func(old, new interface{}, want bool) {
+			t.Helper()
+			swapped, err := ndsClient.CompareAndSwap(ctx, key, old, new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if swapped != want {
+				t.Fatalf("expected swapped %t, got %t", want, swapped)
+			}
+		}
+		get := func(want casEntity) {
+			t.Helper()
+			got := casEntity{}
+			if err := ndsClient.Get(ctx, key, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		}
+
+		// A nil old only matches a missing entity, cached or not.
+		swap(&casEntity{1}, &casEntity{2}, false)
+		if err := ndsClient.Get(ctx, key, &casEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", err)
+		}
+		swap(nil, &casEntity{1}, true)
+		get(casEntity{1})
+
+		// The swap replaced the cached entity.
+		swap(casEntity{1}, &casEntity{2}, true)
+		get(casEntity{2})
+		swap(&casEntity{1}, &casEntity{3}, false)
+		swap(nil, &casEntity{3}, false)
+		get(casEntity{2})
+
+		// Nothing cached, so the datastore is checked.
+		if _, err := ndsClient.Put(ctx, key, &casEntity{4}); err != nil {
+			t.Fatal(err)
+		}
+		swap(&casEntity{2}, &casEntity{5}, false)
+		swap(&casEntity{4}, &casEntity{5}, true)
+		get(casEntity{5})
+
+		noCacheClient, err := NewClient(ctx, nil, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := noCacheClient.CompareAndSwap(ctx, key,
+			&casEntity{5}, &casEntity{6}); err != nds.ErrCompareAndSwapUnsupported {
+			t.Fatalf("expected nds.ErrCompareAndSwapUnsupported, got %v", err)
+		}
+	}
+}
+
+func CompareAndSwapConcurrentTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := fmt.Sprintf("CompareAndSwapConcurrentTest%d", time.Now().UnixNano())
+		for i := 0; i < 20; i++ {
+			key := datastore.NameKey(kind, fmt.Sprint(i), nil)
+			if _, err := ndsClient.Put(ctx, key, &casEntity{0}); err != nil {
+				t.Fatal(err)
+			}
+			// Half the races start with the entity cached.
+			if i%2 == 0 {
+				if err := ndsClient.Get(ctx, key, &casEntity{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			swapped := make([]bool, 2)
+			errs := make([]error, 2)
+			for j := range swapped {
+				wg.Add(1)
+				go func(j int) {
+					defer wg.Done()
+					<-start
+					swapped[j], errs[j] = ndsClient.CompareAndSwap(ctx, key,
+						&casEntity{0}, &casEntity{j + 1})
+				}(j)
+			}
+			close(start)
+			wg.Wait()
+
+			winner := -1
+			for j := range swapped {
+				if errs[j] != nil {
+					t.Fatal(errs[j])
+				}
+				if swapped[j] {
+					if winner >= 0 {
+						t.Fatalf("expected one swap to succeed for %v, both did", key)
+					}
+					winner = j
+				}
+			}
+			if winner < 0 {
+				t.Fatalf("expected one swap to succeed for %v, none did", key)
+			}
+
+			got := casEntity{}
+			if err := ndsClient.Get(ctx, key, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.IntVal != winner+1 {
+				t.Fatalf("expected %d for %v, got %v", winner+1, key, got)
+			}
+		}
+	}
+}
+
+func CompareAndSwapWriteHooksTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithQueryCacheTTL(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := fmt.Sprintf("CompareAndSwapWriteHooksTest%d", time.Now().UnixNano())
+		parent := datastore.NameKey(kind, "parent", nil)
+		key := datastore.NameKey(kind, "key", parent)
+		if _, err := ndsClient.Put(ctx, key, &casEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The request cache forgets the swapped entity.
+		requestCtx := nds.WithRequestCache(ctx)
+		got := casEntity{}
+		if err := ndsClient.Get(requestCtx, key, &got); err != nil {
+			t.Fatal(err)
+		}
+		swapped, err := ndsClient.CompareAndSwap(requestCtx, key, &casEntity{1}, &casEntity{2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !swapped {
+			t.Fatal("expected the swap to succeed")
+		}
+		if err := ndsClient.Get(requestCtx, key, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.IntVal != 2 {
+			t.Fatalf("expected 2, got %v", got)
+		}
+
+		// The swapped key is read back with a lookup, even with eventual
+		// consistency.
+		rywCtx := nds.WithEventualConsistency(nds.WithReadYourWrites(ctx))
+		if _, err := ndsClient.CompareAndSwap(rywCtx, key, &casEntity{2}, &casEntity{3}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cacher.DeleteMulti(ctx, []string{nds.CreateCacheKey(key)}); err != nil {
+			t.Fatal(err)
+		}
+		var lookedUp []*datastore.Key
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			lookedUp = append(lookedUp, keys...)
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+		if err := ndsClient.Get(rywCtx, key, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.IntVal != 3 {
+			t.Fatalf("expected 3, got %v", got)
+		}
+		if len(lookedUp) != 1 || !lookedUp[0].Equal(key) {
+			t.Fatalf("expected %v looked up, got %v", key, lookedUp)
+		}
+
+		// Creating an entity invalidates the cached queries of its kind.
+		q := datastore.NewQuery(kind).Ancestor(parent)
+		keys, err := ndsClient.GetAllKeys(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 {
+			t.Fatalf("expected 1 key, got %d", len(keys))
+		}
+		created := datastore.NameKey(kind, "created", parent)
+		if _, err := ndsClient.CompareAndSwap(ctx, created, nil, &casEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		keys, err = ndsClient.GetAllKeys(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 {
+			t.Fatalf("expected 2 keys, got %d", len(keys))
+		}
+	}
+}
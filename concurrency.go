@@ -0,0 +1,61 @@
+package nds
+
+import "context"
+
+// WithReadConcurrency bounds how many GetMulti shards of up to 1000 keys the
+// client runs at once, across all calls. A value of 0 or less leaves reads
+// unbounded, which is the default.
+func WithReadConcurrency(n int) ClientOption {
+	return func(c *Client) {
+		c.readLimit = newShardLimit(n)
+	}
+}
+
+// WithWriteConcurrency bounds how many PutMulti shards of up to 500 entities
+// the client runs at once, across all calls. Writes contend on indexes, so
+// throttling them harder than reads can help. A value of 0 or less leaves
+// writes unbounded, which is the default.
+func WithWriteConcurrency(n int) ClientOption {
+	return func(c *Client) {
+		c.writeLimit = newShardLimit(n)
+	}
+}
+
+// WithDeleteConcurrency bounds how many DeleteMulti shards of up to 500 keys
+// the client runs at once, across all calls. A value of 0 or less leaves
+// deletes unbounded, which is the default.
+func WithDeleteConcurrency(n int) ClientOption {
+	return func(c *Client) {
+		c.deleteLimit = newShardLimit(n)
+	}
+}
+
+// shardLimit is a semaphore bounding the shards of one kind of call. A nil
+// shardLimit is unbounded.
+type shardLimit chan struct{}
+
+func newShardLimit(n int) shardLimit {
+	if n <= 0 {
+		return nil
+	}
+	return make(shardLimit, n)
+}
+
+// acquire blocks until a shard may run or ctx is done.
+func (l shardLimit) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l shardLimit) release() {
+	if l != nil {
+		<-l
+	}
+}
@@ -0,0 +1,216 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestShardConcurrencySuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestShardConcurrency", ShardConcurrencyTest(item.ctx, item.cacher))
+			t.Run("TestCallConcurrency", CallConcurrencyTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+// concurrencyGauge tracks the highest number of concurrent calls of enter.
+// The first calls wait at a barrier until want of them have entered, so calls
+// allowed to overlap are seen to overlap however they are scheduled. If want
+// is never reached the barrier gives up after a timeout.
+type concurrencyGauge struct {
+	want int
+	full chan struct{}
+	once sync.Once
+
+	mu           sync.Mutex
+	current, max int
+}
+
+func newConcurrencyGauge(want int) *concurrencyGauge {
+	return &concurrencyGauge{want: want, full: make(chan struct{})}
+}
+
+func (g *concurrencyGauge) open() {
+	g.once.Do(func() {
+		close(g.full)
+	})
+}
+
+func (g *concurrencyGauge) enter() {
+	g.mu.Lock()
+	g.current++
+	if g.current > g.max {
+		g.max = g.current
+	}
+	if g.current >= g.want {
+		g.open()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-g.full:
+	case <-time.After(5 * time.Second):
+		g.open()
+	}
+
+	g.mu.Lock()
+	g.current--
+	g.mu.Unlock()
+}
+
+func (g *concurrencyGauge) maxConcurrent() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+func ShardConcurrencyTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithReadConcurrency(3),
+			nds.WithWriteConcurrency(1),
+			nds.WithDeleteConcurrency(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gets, puts, deletes := newConcurrencyGauge(3), newConcurrencyGauge(1),
+			newConcurrencyGauge(2)
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				gets.enter()
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+		nds.SetDatastorePutMultiHook(func() error {
+			puts.enter()
+			return nil
+		})
+		defer nds.SetDatastorePutMultiHook(nil)
+		nds.SetDatastoreDeleteMultiHook(func() error {
+			deletes.enter()
+			return nil
+		})
+		defer nds.SetDatastoreDeleteMultiHook(nil)
+
+		type testEntity struct {
+			Value int
+		}
+
+		// Five shards of every kind of call, on separate keys so the calls
+		// don't contend on the cache. The keys are new every run so none of
+		// them is cached yet.
+		const count = 5000
+		kind := fmt.Sprintf("ShardConcurrencyTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, 2*count)
+		entities := make([]testEntity, count/2)
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+		}
+
+		// Run the three kinds of calls at the same time so each limit is
+		// shown to be independent of the others.
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if err := ndsClient.GetMulti(ctx, keys[:count], make([]testEntity, count)); err != nil {
+				if _, ok := err.(datastore.MultiError); !ok {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := ndsClient.PutMulti(ctx, keys[count:count+count/2], entities); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := ndsClient.DeleteMulti(ctx, keys[count+count/2:]); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		defer ndsClient.DeleteMulti(ctx, keys[count:count+count/2])
+
+		if max := gets.maxConcurrent(); max != 3 {
+			t.Errorf("expected 3 concurrent get shards, got %d", max)
+		}
+		if max := puts.maxConcurrent(); max != 1 {
+			t.Errorf("expected 1 concurrent put shard, got %d", max)
+		}
+		if max := deletes.maxConcurrent(); max != 2 {
+			t.Errorf("expected 2 concurrent delete shards, got %d", max)
+		}
+	}
+}
+
+func CallConcurrencyTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithWriteConcurrency(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		puts := newConcurrencyGauge(4)
+		nds.SetDatastorePutMultiHook(func() error {
+			puts.enter()
+			return nil
+		})
+		defer nds.SetDatastorePutMultiHook(nil)
+
+		type testEntity struct {
+			Value int
+		}
+
+		// Five shards for every call.
+		const count = 2500
+		kind := fmt.Sprintf("CallConcurrencyTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, count)
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+		}
+		entities := make([]testEntity, count)
+		defer ndsClient.DeleteMulti(ctx, keys)
+
+		if _, err := ndsClient.PutMulti(ctx, keys, entities, nds.WithConcurrency(4)); err != nil {
+			t.Fatal(err)
+		}
+		if max := puts.maxConcurrent(); max != 4 {
+			t.Errorf("expected 4 concurrent put shards with the override, got %d", max)
+		}
+
+		// The next call is back to the Client's limit.
+		puts = newConcurrencyGauge(1)
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		if max := puts.maxConcurrent(); max != 1 {
+			t.Errorf("expected 1 concurrent put shard after the override, got %d", max)
+		}
+
+		for _, n := range []int{0, -1} {
+			if _, err := ndsClient.PutMulti(ctx, keys, entities, nds.WithConcurrency(n)); err == nil {
+				t.Errorf("expected PutMulti with WithConcurrency(%d) to fail", n)
+			}
+			if err := ndsClient.GetMulti(ctx, keys, entities, nds.WithConcurrency(n)); err == nil {
+				t.Errorf("expected GetMulti with WithConcurrency(%d) to fail", n)
+			}
+			if err := ndsClient.DeleteMulti(ctx, keys, nds.WithConcurrency(n)); err == nil {
+				t.Errorf("expected DeleteMulti with WithConcurrency(%d) to fail", n)
+			}
+		}
+	}
+}
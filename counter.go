@@ -0,0 +1,260 @@
+package nds
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// CounterProperty is the name of the int64 property of the entity Increment
+// flushes counts to.
+const CounterProperty = "Count"
+
+// defaultCounterFlush is how long Increment waits before flushing counts to
+// the datastore by default.
+const defaultCounterFlush = time.Second
+
+// counterFlushPoll is how often a flush checks whether the flush lock another
+// Client holds on a counter has cleared.
+const counterFlushPoll = 10 * time.Millisecond
+
+// WithCounterFlushInterval sets how long Increment lets counts accumulate in
+// the cache before flushing them to the datastore. Longer intervals save
+// datastore writes for hot counters at the cost of more counts being lost if
+// the cache fails. A value of 0 or less uses the default of one second.
+func WithCounterFlushInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.counterFlush = d
+	}
+}
+
+// pendingCounters are the counter keys with counts that may not have been
+// flushed to the datastore yet.
+type pendingCounters struct {
+	// flushMu makes flushes wait for the one in progress.
+	flushMu sync.Mutex
+
+	sync.Mutex
+	keys  map[string]*datastore.Key
+	timer *time.Timer
+}
+
+// Increment adds delta to the counter stored in the CounterProperty of the
+// entity for key. If the Cacher implements Incrementer the count is added to
+// a counter in the cache straight away, and a flush of the counts accumulated
+// in the cache to the entity is scheduled to happen within the interval set
+// by WithCounterFlushInterval. Concurrent calls and flushes, from any number
+// of Clients sharing a cache, never lose counts to each other or count them
+// twice. Without a Cacher that implements Incrementer each call adds delta to
+// the entity in a transaction of its own, which is durable once Increment
+// returns but is limited by the datastore's write rate for a single entity.
+//
+// Counting in the cache trades durability for throughput. Counts that haven't
+// been flushed yet are lost if the cache evicts the counter or the process
+// exits before the flush; call FlushCounters before shutting down. A flush
+// takes the counts it writes off the cached counter first, so a flush that
+// fails to write them and then also fails to put them back loses them.
+// Increment is not part of any transaction, and reading the entity only sees
+// the counts flushed so far.
+func (c *Client) Increment(ctx context.Context, key *datastore.Key, delta int64) error {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Increment")
+	defer span.End()
+	key = c.inNamespace(key)
+
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	if inc, ok := c.cacher.(Incrementer); ok {
+		_, err := incrementOne(ctx, inc, createCounterKey(c.keys, key), delta)
+		switch err {
+		case nil:
+			c.scheduleCounterFlush(ctx, key)
+			return nil
+		case ErrIncrementUnsupported:
+		default:
+			return errors.Wrap(err, "nds:Increment")
+		}
+	}
+
+	// The cache can't count, so count in the entity straight away.
+	return c.addCount(ctx, key, delta)
+}
+
+// FlushCounters writes the counts accumulated by Increment to the datastore
+// now instead of waiting for the scheduled flush. Counters that fail to flush
+// are retried by the next scheduled flush and the first error is returned.
+// If a flush is already in progress FlushCounters waits for it first.
+func (c *Client) FlushCounters(ctx context.Context) error {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.FlushCounters")
+	defer span.End()
+
+	c.counters.flushMu.Lock()
+	defer c.counters.flushMu.Unlock()
+
+	c.counters.Lock()
+	keys := c.counters.keys
+	c.counters.keys = nil
+	if c.counters.timer != nil {
+		c.counters.timer.Stop()
+		c.counters.timer = nil
+	}
+	c.counters.Unlock()
+
+	inc, ok := c.cacher.(Incrementer)
+	if !ok || len(keys) == 0 {
+		return nil
+	}
+
+	var firstErr error
+	for _, key := range keys {
+		if err := c.flushCounter(ctx, inc, key); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrap(err, "nds:FlushCounters")
+			}
+			c.scheduleCounterFlush(ctx, key)
+		}
+	}
+	return firstErr
+}
+
+func (c *Client) scheduleCounterFlush(ctx context.Context, key *datastore.Key) {
+	c.counters.Lock()
+	defer c.counters.Unlock()
+
+	if c.counters.keys == nil {
+		c.counters.keys = make(map[string]*datastore.Key)
+	}
+	c.counters.keys[key.Encode()] = key
+	if c.counters.timer != nil {
+		return
+	}
+
+	interval := c.counterFlush
+	if interval <= 0 {
+		interval = defaultCounterFlush
+	}
+	c.counters.timer = time.AfterFunc(interval, func() {
+		flushCtx, cancel := context.WithTimeout(detachedContext{ctx}, cacheLockTime)
+		defer cancel()
+		if err := c.FlushCounters(flushCtx); err != nil {
+			c.onError(flushCtx, err)
+		}
+	})
+}
+
+// flushCounter claims the count cached for key and then adds it to the
+// entity. The claimed count is put back if it can't be written.
+func (c *Client) flushCounter(ctx context.Context, inc Incrementer, key *datastore.Key) error {
+	counterKey := createCounterKey(c.keys, key)
+	pending, err := c.claimCount(ctx, inc, key, counterKey)
+	if err != nil || pending == 0 {
+		return err
+	}
+
+	if err := c.addCount(ctx, key, pending); err != nil {
+		if _, ierr := incrementOne(ctx, inc, counterKey, pending); ierr != nil {
+			c.onError(ctx, errors.Wrapf(ierr, "nds:FlushCounters lost a count of %d for %v", pending, key))
+		}
+		return err
+	}
+	return nil
+}
+
+// claimCount takes the count cached for key off the cached counter and returns
+// it, so that counts added in the meantime are left for the next flush. The
+// count is read and taken off while holding the counter's flush lock in the
+// cache, waiting for another Client's flush to release it first, as counts can
+// be negative and a flush can't tell from the counter alone whether another
+// one claimed them as well.
+func (c *Client) claimCount(ctx context.Context, inc Incrementer,
+	key *datastore.Key, counterKey string) (int64, error) {
+	lock := &Item{
+		Key:        createCounterFlushKey(c.keys, key),
+		Flags:      lockItem,
+		Value:      writerLock(),
+		Expiration: cacheLockTime,
+	}
+	for {
+		err := c.cacher.AddMulti(ctx, []*Item{lock})
+		if me, ok := err.(MultiError); ok {
+			err = me[0]
+		}
+		if err == nil {
+			break
+		}
+		if err != ErrNotStored {
+			return 0, err
+		}
+
+		timer := time.NewTimer(counterFlushPoll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	defer c.unlockCache(ctx, []*Item{lock}, "nds:FlushCounters DeleteMulti")
+
+	pending, err := incrementOne(ctx, inc, counterKey, 0)
+	if err != nil || pending == 0 {
+		return 0, err
+	}
+	if _, err := incrementOne(ctx, inc, counterKey, -pending); err != nil {
+		return 0, err
+	}
+	return pending, nil
+}
+
+// addCount adds delta to the CounterProperty of the entity for key in a
+// transaction.
+func (c *Client) addCount(ctx context.Context, key *datastore.Key, delta int64) error {
+	_, err := c.RunInTransaction(ctx, func(tx *Transaction) error {
+		var pl datastore.PropertyList
+		if err := tx.Get(key, &pl); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err := addCountProperty(&pl, delta); err != nil {
+			return err
+		}
+		_, err := tx.Put(key, &pl)
+		return err
+	})
+	return err
+}
+
+func incrementOne(ctx context.Context, inc Incrementer, key string, delta int64) (int64, error) {
+	vals, err := inc.IncrementMulti(ctx, []string{key}, []int64{delta})
+	if me, ok := err.(MultiError); ok {
+		err = me[0]
+	}
+	if err != nil {
+		return 0, err
+	}
+	return vals[0], nil
+}
+
+// addCountProperty adds delta to the CounterProperty of pl, adding the
+// property if pl doesn't have it yet.
+func addCountProperty(pl *datastore.PropertyList, delta int64) error {
+	for i, p := range *pl {
+		if p.Name != CounterProperty {
+			continue
+		}
+		count, ok := p.Value.(int64)
+		if !ok {
+			return errors.Errorf("nds: counter property %q is a %T, not an int64",
+				CounterProperty, p.Value)
+		}
+		(*pl)[i].Value = count + delta
+		return nil
+	}
+	*pl = append(*pl, datastore.Property{Name: CounterProperty, Value: delta})
+	return nil
+}
@@ -0,0 +1,183 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestIncrementSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestIncrementConcurrent", IncrementConcurrentTest(item.ctx, item.cacher))
+			t.Run("TestIncrementConcurrentFlush", IncrementConcurrentFlushTest(item.ctx, item.cacher))
+			t.Run("TestIncrementDatastoreFallback", IncrementDatastoreFallbackTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func IncrementConcurrentTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// Two clients sharing a cache count into the same counter.
+		clients := make([]*nds.Client, 2)
+		for i := range clients {
+			ndsClient, err := NewClient(ctx, cacher, t, nil,
+				nds.WithCounterFlushInterval(10*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients[i] = ndsClient
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("IncrementConcurrentTest%d", time.Now().UnixNano()), "hits", nil)
+
+		// Keep another property to check flushes don't drop it.
+		type counter struct {
+			Count int64
+			Label string
+		}
+		if _, err := clients[0].Put(ctx, key, &counter{Count: 5, Label: "hits"}); err != nil {
+			t.Fatal(err)
+		}
+
+		const goroutines, increments = 20, 50
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(ndsClient *nds.Client) {
+				defer wg.Done()
+				for i := 0; i < increments; i++ {
+					delta := int64(2)
+					if i%5 == 0 {
+						delta = -1
+					}
+					if err := ndsClient.Increment(ctx, key, delta); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(clients[g%len(clients)])
+		}
+		wg.Wait()
+
+		for _, ndsClient := range clients {
+			if err := ndsClient.FlushCounters(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var got counter
+		if err := clients[0].Get(ctx, key, &got); err != nil {
+			t.Fatal(err)
+		}
+		// Per goroutine, 10 increments of -1 and 40 of 2.
+		if want := int64(5 + goroutines*(40*2-10)); got.Count != want {
+			t.Fatalf("expected count %d, got %d", want, got.Count)
+		}
+		if got.Label != "hits" {
+			t.Fatalf("expected label to be kept, got %q", got.Label)
+		}
+	}
+}
+
+// slowReadIncrementer delays the reads of counters, which IncrementMulti does
+// with a delta of 0, so that concurrent flushes overlap.
+type slowReadIncrementer struct {
+	nds.Cacher
+	delay time.Duration
+}
+
+func (s *slowReadIncrementer) IncrementMulti(ctx context.Context,
+	keys []string, deltas []int64) ([]int64, error) {
+	vals, err := s.Cacher.(nds.Incrementer).IncrementMulti(ctx, keys, deltas)
+	if deltas[0] == 0 {
+		time.Sleep(s.delay)
+	}
+	return vals, err
+}
+
+func IncrementConcurrentFlushTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		slow := &slowReadIncrementer{Cacher: cacher, delay: 50 * time.Millisecond}
+		clients := make([]*nds.Client, 2)
+		for i := range clients {
+			ndsClient, err := NewClient(ctx, slow, t, nil,
+				nds.WithCounterFlushInterval(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients[i] = ndsClient
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("IncrementConcurrentFlushTest%d", time.Now().UnixNano()), "hits", nil)
+		for i, ndsClient := range clients {
+			if err := ndsClient.Increment(ctx, key, int64(i+2)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Both clients flush the same counts at once.
+		var wg sync.WaitGroup
+		for _, ndsClient := range clients {
+			wg.Add(1)
+			go func(ndsClient *nds.Client) {
+				defer wg.Done()
+				if err := ndsClient.FlushCounters(ctx); err != nil {
+					t.Error(err)
+				}
+			}(ndsClient)
+		}
+		wg.Wait()
+
+		var got struct {
+			Count int64
+		}
+		if err := clients[0].Get(ctx, key, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Count != 5 {
+			t.Fatalf("expected count 5, got %d", got.Count)
+		}
+	}
+}
+
+func IncrementDatastoreFallbackTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// mockCacher only implements nds.Cacher, and a nil cacher has
+		// nothing to count in either.
+		for _, c := range []nds.Cacher{&mockCacher{cacher: cacher}, nil} {
+			ndsClient, err := NewClient(ctx, c, t, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := datastore.NameKey(fmt.Sprintf("IncrementDatastoreFallbackTest%d",
+				time.Now().UnixNano()), "hits", nil)
+
+			// Every count is in the entity as soon as Increment returns.
+			for i := int64(1); i <= 5; i++ {
+				if err := ndsClient.Increment(ctx, key, 3); err != nil {
+					t.Fatal(err)
+				}
+				var got struct {
+					Count int64
+				}
+				if err := ndsClient.Get(ctx, key, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Count != 3*i {
+					t.Fatalf("expected count %d, got %d", 3*i, got.Count)
+				}
+			}
+			if err := ndsClient.FlushCounters(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
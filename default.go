@@ -0,0 +1,76 @@
+package nds
+
+import (
+	"context"
+	"sync/atomic"
+
+	"cloud.google.com/go/datastore"
+)
+
+// defaultClient holds the *Client set by SetDefault.
+var defaultClient atomic.Value
+
+// SetDefault makes c the Client the package-level functions such as Get and
+// Put delegate to, for apps that use a single Client. Passing nil clears it.
+// Apps that pass their Client around explicitly don't need it.
+func SetDefault(c *Client) {
+	defaultClient.Store(&c)
+}
+
+// Default returns the Client set by SetDefault, or nil if there is none.
+func Default() *Client {
+	c, _ := defaultClient.Load().(**Client)
+	if c == nil {
+		return nil
+	}
+	return *c
+}
+
+// mustDefault returns the default Client and panics if there is none, as
+// calling a package-level function without one is a programming error.
+func mustDefault() *Client {
+	c := Default()
+	if c == nil {
+		panic("nds: no default Client, call nds.SetDefault before using the package-level functions")
+	}
+	return c
+}
+
+// Get calls Get on the default Client.
+func Get(ctx context.Context, key *datastore.Key, val interface{}) error {
+	return mustDefault().Get(ctx, key, val)
+}
+
+// GetMulti calls GetMulti on the default Client.
+func GetMulti(ctx context.Context,
+	keys []*datastore.Key, vals interface{}, opts ...CallOption) error {
+	return mustDefault().GetMulti(ctx, keys, vals, opts...)
+}
+
+// Put calls Put on the default Client.
+func Put(ctx context.Context,
+	key *datastore.Key, val interface{}) (*datastore.Key, error) {
+	return mustDefault().Put(ctx, key, val)
+}
+
+// PutMulti calls PutMulti on the default Client.
+func PutMulti(ctx context.Context,
+	keys []*datastore.Key, vals interface{}, opts ...CallOption) ([]*datastore.Key, error) {
+	return mustDefault().PutMulti(ctx, keys, vals, opts...)
+}
+
+// Delete calls Delete on the default Client.
+func Delete(ctx context.Context, key *datastore.Key, opts ...CallOption) error {
+	return mustDefault().Delete(ctx, key, opts...)
+}
+
+// DeleteMulti calls DeleteMulti on the default Client.
+func DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...CallOption) error {
+	return mustDefault().DeleteMulti(ctx, keys, opts...)
+}
+
+// RunInTransaction calls RunInTransaction on the default Client.
+func RunInTransaction(ctx context.Context, f func(tx *Transaction) error,
+	opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	return mustDefault().RunInTransaction(ctx, f, opts...)
+}
@@ -0,0 +1,112 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestDefaultClientSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestDefaultClient", DefaultClientTest(item.ctx, item.cacher))
+			t.Run("TestDefaultClientNil", DefaultClientNilTest(item.ctx))
+		})
+	}
+}
+
+func DefaultClientTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nds.SetDefault(ndsClient)
+		defer nds.SetDefault(nil)
+		if nds.Default() != ndsClient {
+			t.Fatal("expected the default client to be set")
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("DefaultClientTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "one", nil),
+			datastore.NameKey(kind, "two", nil),
+		}
+		if _, err := nds.Put(ctx, keys[0], &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nds.PutMulti(ctx, keys[1:], []testEntity{{2}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The entities went through the default client.
+		got := make([]testEntity, len(keys))
+		if err := ndsClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		if got[0].IntVal != 1 || got[1].IntVal != 2 {
+			t.Fatalf("expected the entities put, got %+v", got)
+		}
+		got = make([]testEntity, len(keys))
+		if err := nds.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		if got[0].IntVal != 1 || got[1].IntVal != 2 {
+			t.Fatalf("expected the entities put, got %+v", got)
+		}
+
+		if _, err := nds.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+			_, err := tx.Put(keys[0], &testEntity{3})
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		entity := testEntity{}
+		if err := nds.Get(ctx, keys[0], &entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 3 {
+			t.Fatalf("expected the entity put in the transaction, got %+v", entity)
+		}
+
+		if err := nds.Delete(ctx, keys[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := nds.DeleteMulti(ctx, keys[1:]); err != nil {
+			t.Fatal(err)
+		}
+		err = ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys)))
+		if me, ok := err.(datastore.MultiError); !ok ||
+			me[0] != datastore.ErrNoSuchEntity || me[1] != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected the entities deleted, got %v", err)
+		}
+	}
+}
+
+func DefaultClientNilTest(ctx context.Context) func(t *testing.T) {
+	return func(t *testing.T) {
+		nds.SetDefault(nil)
+		if nds.Default() != nil {
+			t.Fatal("expected no default client")
+		}
+
+		defer func() {
+			r := recover()
+			if msg, ok := r.(string); !ok || !strings.Contains(msg, "nds.SetDefault") {
+				t.Fatalf("expected a panic naming nds.SetDefault, got %v", r)
+			}
+		}()
+		key := datastore.NameKey("DefaultClientNilTest", "one", nil)
+		nds.Get(ctx, key, &struct{}{})
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"sync"
 
 	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
+	"google.golang.org/api/iterator"
 )
 
 // deleteMultiLimit is the Google Cloud Datastore limit for the maximum number
@@ -13,15 +15,84 @@ import (
 // https://cloud.google.com/datastore/docs/concepts/limits
 const deleteMultiLimit = 500
 
+var (
+	// deleteMultiHook exists purely for testing. It is called after the
+	// datastore delete succeeds and its error replaces the result, to
+	// simulate a delete that was applied but reported as failed.
+	deleteMultiHook func() error
+)
+
+// deleteAllConcurrency is the maximum number of deleteMultiLimit sized batches
+// DeleteAll deletes concurrently while it streams the query results.
+const deleteAllConcurrency = 8
+
 // DeleteMulti works just like datastore.DeleteMulti except it maintains
 // cache consistency with other NDS methods. It also removes the API limit of
 // 500 entities per request by calling the datastore as many times as required
 // to put all the keys. It does this efficiently and concurrently.
-func (c *Client) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+// Pass WithoutCacheLocks to skip the cache locks for bulk cleanup, and
+// WithConcurrency to override the Client's delete concurrency.
+//
+// A key passed several times is deleted once, and its outcome is reported at
+// each of its indexes. With WithBatchErrors the errors of individual keys are
+// returned as a *BatchError.
+func (c *Client) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...CallOption) error {
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.DeleteMulti")
 	defer span.End()
+	ctx, emitTiming := c.startOpTiming(ctx, "DeleteMulti", len(keys))
+	defer emitTiming()
+	callerKeys := keys
+	keys = c.keysInNamespace(keys)
+
+	unique, indexes := uniqueKeys(keys)
+	if len(unique) == len(keys) {
+		return c.batchError(callerKeys, c.deleteMultiChunked(ctx, keys, opts))
+	}
+	err := c.deleteMultiChunked(ctx, unique, opts)
+	me, ok := err.(datastore.MultiError)
+	if !ok {
+		return err
+	}
+	errs := make(datastore.MultiError, len(keys))
+	for i, j := range indexes {
+		errs[i] = me[j]
+	}
+	return c.batchError(callerKeys, errs)
+}
 
+// uniqueKeys returns keys without duplicates and the index in it of each of
+// keys. Nil and incomplete keys are never duplicates so each gets its own
+// error.
+func uniqueKeys(keys []*datastore.Key) ([]*datastore.Key, []int) {
+	unique := make([]*datastore.Key, 0, len(keys))
+	indexes := make([]int, len(keys))
+	seen := make(map[string]int, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			indexes[i] = len(unique)
+			unique = append(unique, key)
+			continue
+		}
+		encoded := key.Encode()
+		j, ok := seen[encoded]
+		if !ok {
+			j = len(unique)
+			seen[encoded] = j
+			unique = append(unique, key)
+		}
+		indexes[i] = j
+	}
+	return unique, indexes
+}
+
+// deleteMultiChunked is DeleteMulti for keys without duplicates.
+func (c *Client) deleteMultiChunked(ctx context.Context, keys []*datastore.Key, opts []CallOption) error {
+	o := newCallOptions(opts)
+	limit, err := o.shardLimit(c.deleteLimit)
+	if err != nil {
+		return err
+	}
 	callCount := (len(keys)-1)/deleteMultiLimit + 1
 	errs := make([]error, callCount)
 
@@ -35,8 +106,12 @@ func (c *Client) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
 		}
 
 		go func(i int, keys []*datastore.Key) {
-			errs[i] = c.deleteMulti(ctx, keys)
-			wg.Done()
+			defer wg.Done()
+			if errs[i] = limit.acquire(ctx); errs[i] != nil {
+				return
+			}
+			defer limit.release()
+			errs[i] = c.deleteMulti(ctx, keys, o)
 		}(i, keys[lo:hi])
 	}
 	wg.Wait()
@@ -49,29 +124,243 @@ func (c *Client) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
 }
 
 // Delete deletes the entity for the given key.
-func (c *Client) Delete(ctx context.Context, key *datastore.Key) error {
+func (c *Client) Delete(ctx context.Context, key *datastore.Key, opts ...CallOption) error {
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Delete")
 	defer span.End()
-	err := c.deleteMulti(ctx, []*datastore.Key{key})
+	key = c.inNamespace(key)
+	err := c.deleteMulti(ctx, []*datastore.Key{key}, newCallOptions(opts))
 	if me, ok := err.(datastore.MultiError); ok {
 		return me[0]
 	}
 	return err
 }
 
+// DeleteIfExists deletes the entity for key and reports whether there was one
+// to delete, where Delete succeeds whether or not the entity exists. The
+// existence check and the delete are made in a transaction, so of a
+// DeleteIfExists racing a write that creates the entity or another
+// DeleteIfExists, the result always matches what is left stored. The check
+// reads the datastore, as the cache can't take part in the transaction, and
+// the cache is kept consistent like for any other transaction.
+func (c *Client) DeleteIfExists(ctx context.Context, key *datastore.Key) (bool, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.DeleteIfExists")
+	defer span.End()
+
+	var existed bool
+	if _, err := c.RunInTransaction(ctx, func(tx *Transaction) error {
+		// A retried transaction checks again.
+		existed = false
+		switch err := tx.Get(key, &datastore.PropertyList{}); err {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			return nil
+		default:
+			return err
+		}
+		existed = true
+		return tx.Delete(key)
+	}); err != nil {
+		return false, err
+	}
+	return existed, nil
+}
+
+// DeleteAll deletes every entity matched by q and returns how many were
+// deleted. The query is run keys-only and its results are streamed and deleted
+// in batches concurrently, using the same cache locking as DeleteMulti, so it
+// works for arbitrarily large result sets.
+//
+// Entities that start matching q after the query has started are not
+// guaranteed to be deleted. DeleteAll stops at the first error, from the query
+// or from a batch, and returns it along with the number of entities deleted,
+// which includes any batches that were already in flight and still succeeded.
+// Pass WithConcurrency to change how many batches are deleted at once.
+func (c *Client) DeleteAll(ctx context.Context, q *datastore.Query, opts ...CallOption) (int, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.DeleteAll")
+	defer span.End()
+
+	o := newCallOptions(opts)
+	concurrency, err := o.concurrencyOr(deleteAllConcurrency)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		deleted  int
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+	sem := make(chan struct{}, concurrency)
+	deleteBatch := func(keys []*datastore.Key) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := c.deleteMulti(ctx, keys, o); err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			deleted += len(keys)
+			mu.Unlock()
+		}()
+	}
+
+	// Reading each batch of keys counts as one call to the circuit breaker, as
+	// only some calls to Next reach the datastore. The batches are deleted
+	// outside of it, so no half-open probe is held while they are.
+	it := c.ds.Run(ctx, q.KeysOnly())
+	for more := true; more && ctx.Err() == nil; {
+		keys := make([]*datastore.Key, 0, deleteMultiLimit)
+		if err := c.guardDatastore(ctx, func() error {
+			for len(keys) < deleteMultiLimit {
+				key, err := it.Next(nil)
+				if err == iterator.Done {
+					more = false
+					return nil
+				}
+				if err != nil && ctx.Err() == context.Canceled {
+					// Canceled by a failed batch or the caller, which
+					// says nothing about the datastore.
+					return ignoreBreaker(err)
+				}
+				if err != nil {
+					return err
+				}
+				keys = append(keys, key)
+			}
+			return nil
+		}); err != nil {
+			fail(err)
+			break
+		}
+		if len(keys) > 0 {
+			deleteBatch(keys)
+		}
+	}
+	// A batch may have been dropped because ctx is done.
+	if err := ctx.Err(); err != nil {
+		fail(err)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return deleted, firstErr
+}
+
 // deleteMulti will batch delete keys by first locking the corresponding items in the
-// cache then deleting them from datastore.
-func (c *Client) deleteMulti(ctx context.Context, keys []*datastore.Key) error {
+// cache then deleting them from datastore. WithoutCacheLocks deletes the cache
+// items after deleting from datastore instead.
+func (c *Client) deleteMulti(ctx context.Context, keys []*datastore.Key, o callOptions) error {
+	c.forgetRequestCache(ctx, keys)
+	defer c.forgetRequestCache(ctx, keys)
+	c.rememberWrites(ctx, keys)
+
+	if c.cacher != nil && o.withoutCacheLocks {
+		err := c.guardDatastore(ctx, func() error {
+			return c.datastoreDeleteMulti(ctx, keys)
+		})
+
+		// The delete may have been applied even if it failed, and cached
+		// entities never expire, so they are removed whatever the outcome.
+		cacheKeys, _ := getCacheLocks(c.keys, keys)
+		c.invalidateCache(ctx, cacheKeys, "deleteMulti cache.DeleteMulti")
+		if err == nil {
+			c.invalidateQueries(ctx, keys)
+		}
+		return err
+	}
+
+	var lockCacheItems []*Item
 	if c.cacher != nil {
-		_, lockCacheItems := getCacheLocks(keys)
+		lockKeys := keys
+		if o.withoutColdKeyLocks {
+			lockKeys = c.warmKeys(ctx, keys)
+		}
+		var lockCacheKeys []string
+		lockCacheKeys, lockCacheItems = getCacheLocks(c.keys, lockKeys)
 
 		// Make sure we can lock the cache with no errors before deleting.
-		if err := c.cacher.SetMulti(ctx,
-			lockCacheItems); err != nil {
-			return err
+		if len(lockCacheItems) > 0 {
+			if err := c.setLocks(ctx,
+				lockCacheItems); err != nil {
+				if err := c.lockCacheFailed(ctx, err, "deleteMulti cache.SetMulti"); err != nil {
+					return err
+				}
+				// There are no locks to turn into tombstones.
+				lockCacheItems = nil
+				defer c.invalidateCache(ctx, lockCacheKeys, "deleteMulti cache.DeleteMulti")
+			}
 		}
 	}
 
-	return c.Client.DeleteMulti(ctx, keys)
+	err := c.guardDatastore(ctx, func() error {
+		return c.datastoreDeleteMulti(ctx, keys)
+	})
+	if err == nil && c.cacher != nil && c.tombstones() {
+		c.tombstoneLocks(ctx, keys, lockCacheItems)
+	}
+	if err == nil {
+		c.invalidateQueries(ctx, keys)
+	}
+	return err
+}
+
+func (c *Client) datastoreDeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if err := c.ds.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+	if deleteMultiHook != nil {
+		return deleteMultiHook()
+	}
+	return nil
+}
+
+// warmKeys returns the keys that have anything in the cache. It returns all
+// keys if the cache can't be checked.
+func (c *Client) warmKeys(ctx context.Context, keys []*datastore.Key) []*datastore.Key {
+	// Invalid keys are never locked.
+	cacheKeys, _ := getCacheLocks(c.keys, keys)
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+
+	items, err := c.cacher.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "deleteMulti cache.GetMulti"))
+		return keys
+	}
+
+	warm := make([]*datastore.Key, 0, len(items))
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		if _, ok := items[createCacheKey(c.keys, key)]; ok {
+			warm = append(warm, key)
+		}
+	}
+	return warm
 }
@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/qedus/nds/v2"
 )
@@ -20,6 +24,17 @@ func TestDeleteSuite(t *testing.T) {
 			t.Run("DeleteIncompleteKeyTest", DeleteIncompleteKeyTest(item.ctx, item.cacher))
 			t.Run("DeleteCacheFailTest", DeleteCacheFailTest(item.ctx, item.cacher))
 			t.Run("DeleteInTransactionTest", DeleteInTransactionTest(item.ctx, item.cacher))
+			t.Run("DeleteAllTest", DeleteAllTest(item.ctx, item.cacher))
+			t.Run("DeleteAllStopsOnErrorTest", DeleteAllStopsOnErrorTest(item.ctx, item.cacher))
+			t.Run("DeleteAllHalfOpenBreakerTest", DeleteAllHalfOpenBreakerTest(item.ctx, item.cacher))
+			t.Run("DeleteMultiWithoutCacheLocksTest", DeleteMultiWithoutCacheLocksTest(item.ctx, item.cacher))
+			t.Run("DeleteMultiWithoutCacheLocksAmbiguousErrorTest", DeleteMultiWithoutCacheLocksAmbiguousErrorTest(item.ctx, item.cacher))
+			t.Run("DeleteTombstonesTest", DeleteTombstonesTest(item.ctx, item.cacher))
+			t.Run("DeleteTombstonesWriteThroughTest", DeleteTombstonesWriteThroughTest(item.ctx, item.cacher))
+			t.Run("DeleteMultiWithoutColdKeyLocksTest", DeleteMultiWithoutColdKeyLocksTest(item.ctx, item.cacher))
+			t.Run("DeleteIfExistsTest", DeleteIfExistsTest(item.ctx, item.cacher))
+			t.Run("DeleteIfExistsRaceTest", DeleteIfExistsRaceTest(item.ctx, item.cacher))
+			t.Run("DeleteMultiDuplicateKeysTest", DeleteMultiDuplicateKeysTest(item.ctx, item.cacher))
 		})
 	}
 }
@@ -172,3 +187,755 @@ func DeleteInTransactionTest(ctx context.Context, cacher nds.Cacher) func(t *tes
 		}
 	}
 }
+
+func DeleteAllTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+
+		const count = 1201
+		keys := make([]*datastore.Key, count)
+		entities := make([]TestEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey("DeleteAllTest", strconv.Itoa(i), nil)
+			entities[i] = TestEntity{i}
+		}
+
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Prime cache.
+		if err := ndsClient.GetMulti(ctx, keys, make([]TestEntity, count)); err != nil {
+			t.Fatal(err)
+		}
+
+		deleted, err := ndsClient.DeleteAll(ctx, datastore.NewQuery("DeleteAllTest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != count {
+			t.Fatalf("expected %d deleted, got %d", count, deleted)
+		}
+
+		err = ndsClient.GetMulti(ctx, keys, make([]TestEntity, count))
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		}
+		for _, e := range me {
+			if e != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", e)
+			}
+		}
+
+		// Nothing left to delete.
+		if deleted, err := ndsClient.DeleteAll(ctx, datastore.NewQuery("DeleteAllTest")); err != nil {
+			t.Fatal(err)
+		} else if deleted != 0 {
+			t.Fatalf("expected 0 deleted, got %d", deleted)
+		}
+	}
+}
+
+func DeleteAllStopsOnErrorTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		if cacher == nil {
+			t.Skip("no cache to fail")
+		}
+
+		// The first batch fails to lock the cache.
+		expectedErr := errors.New("expected error")
+		var mu sync.Mutex
+		locks := 0
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				mu.Lock()
+				locks++
+				first := locks == 1
+				mu.Unlock()
+				if first {
+					return expectedErr
+				}
+				return cacher.SetMulti(ctx, items)
+			},
+		}
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		failingClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+
+		const (
+			count   = 10000
+			batches = 20
+		)
+		keys := make([]*datastore.Key, count)
+		entities := make([]TestEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey("DeleteAllStopsOnErrorTest", strconv.Itoa(i), nil)
+			entities[i] = TestEntity{i}
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, keys)
+
+		q := datastore.NewQuery("DeleteAllStopsOnErrorTest")
+		deleted, err := failingClient.DeleteAll(ctx, q)
+		if err != expectedErr {
+			t.Fatalf("expected %v, got %v", expectedErr, err)
+		}
+		if locks >= batches {
+			t.Fatalf("expected DeleteAll to stop before all %d batches, got %d", batches, locks)
+		}
+
+		left, err := ndsClient.Client.Count(ctx, q.KeysOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left != count-deleted {
+			t.Fatalf("expected %d entities left, got %d", count-deleted, left)
+		}
+	}
+}
+
+func DeleteAllHalfOpenBreakerTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		errUnavailable := status.Error(codes.Unavailable, "datastore down")
+		logOKTest := func(err error) bool {
+			return err == errUnavailable
+		}
+		const cooldown = 10 * time.Millisecond
+		ndsClient, err := NewClient(ctx, cacher, t, logOKTest,
+			nds.WithCircuitBreaker(nds.CircuitBreakerSettings{
+				MinRequests:    2,
+				FailureRatio:   0.5,
+				Cooldown:       cooldown,
+				HalfOpenProbes: 1,
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+
+		kind := fmt.Sprintf("DeleteAllHalfOpenBreakerTest%d", time.Now().UnixNano())
+		const count = 1201
+		keys := make([]*datastore.Key, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey(kind, strconv.Itoa(i), nil)
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, make([]TestEntity, count)); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Client.DeleteMulti(ctx, keys)
+
+		// Trip the breaker, then let it half-open.
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) > 0 {
+				return errUnavailable
+			}
+			return nil
+		})
+		for i := 0; i < 2; i++ {
+			if err := ndsClient.Get(ctx, keys[i], &TestEntity{}); err != errUnavailable {
+				nds.SetDatastoreGetMultiHook(nil)
+				t.Fatalf("expected unavailable error, got %v", err)
+			}
+		}
+		nds.SetDatastoreGetMultiHook(nil)
+		if state := ndsClient.BreakerState(); state != nds.BreakerOpen {
+			t.Fatalf("expected breaker open, got %s", state)
+		}
+		time.Sleep(2 * cooldown)
+
+		// Reading the first keys is the probe that closes the breaker, so
+		// the batches are let through.
+		deleted, err := ndsClient.DeleteAll(ctx, datastore.NewQuery(kind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != count {
+			t.Fatalf("expected %d deleted, got %d", count, deleted)
+		}
+		if state := ndsClient.BreakerState(); state != nds.BreakerClosed {
+			t.Fatalf("expected breaker closed, got %s", state)
+		}
+	}
+}
+
+func DeleteMultiWithoutCacheLocksTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		if cacher == nil {
+			t.Skip("no cache to lock")
+		}
+
+		var deletedCacheKeys []string
+		testCacher := &mockCacher{
+			cacher: cacher,
+			deleteMultiHook: func(ctx context.Context, keys []string) error {
+				deletedCacheKeys = append(deletedCacheKeys, keys...)
+				return cacher.DeleteMulti(ctx, keys)
+			},
+		}
+
+		ndsClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		keys := []*datastore.Key{
+			datastore.IDKey("DeleteMultiWithoutCacheLocksTest", 1, nil),
+			datastore.IDKey("DeleteMultiWithoutCacheLocksTest", 2, nil),
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cache the entities.
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+
+		testCacher.setMultiHook = func(ctx context.Context, items []*nds.Item) error {
+			t.Fatal("expected no cache locks to be set")
+			return nil
+		}
+		deletedCacheKeys = nil
+
+		if err := ndsClient.DeleteMulti(ctx, keys, nds.WithoutCacheLocks()); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(deletedCacheKeys) != len(keys) {
+			t.Fatalf("expected %d cache keys deleted, got %d", len(keys), len(deletedCacheKeys))
+		}
+		for i, key := range keys {
+			if deletedCacheKeys[i] != nds.CacheKey(key) {
+				t.Fatalf("expected cache key %s deleted, got %s", nds.CacheKey(key), deletedCacheKeys[i])
+			}
+		}
+
+		items, err := cacher.GetMulti(ctx, deletedCacheKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 0 {
+			t.Fatalf("expected cache entries to be removed, got %d", len(items))
+		}
+
+		err = ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys)))
+		if me, ok := err.(datastore.MultiError); !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		} else {
+			for _, err := range me {
+				if err != datastore.ErrNoSuchEntity {
+					t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", err)
+				}
+			}
+		}
+	}
+}
+
+func DeleteMultiWithoutCacheLocksAmbiguousErrorTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		if cacher == nil {
+			t.Skip("no cache to invalidate")
+		}
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		key := datastore.IDKey("DeleteMultiWithoutCacheLocksAmbiguousErrorTest", 1, nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cache the entity.
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The delete is applied but its response is lost.
+		expectedErr := errors.New("deadline exceeded")
+		nds.SetDatastoreDeleteMultiHook(func() error {
+			return expectedErr
+		})
+		defer nds.SetDatastoreDeleteMultiHook(nil)
+
+		if err := ndsClient.Delete(ctx, key, nds.WithoutCacheLocks()); err != expectedErr {
+			t.Fatalf("expected %v, got %v", expectedErr, err)
+		}
+
+		items, err := cacher.GetMulti(ctx, []string{nds.CacheKey(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 0 {
+			t.Fatal("expected the cache entry to be removed despite the error")
+		}
+
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", err)
+		}
+	}
+}
+
+func DeleteTombstonesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		const ttl = 100 * time.Millisecond
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithDeleteTombstones(ttl))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reads := 0
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				reads++
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		type testEntity struct {
+			Value int
+		}
+		key := datastore.NameKey("DeleteTombstonesTest", "one", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+		}
+		if reads != 0 {
+			t.Fatalf("expected the tombstone to be read, got %d datastore reads", reads)
+		}
+
+		// A put replaces the tombstone.
+		if _, err := ndsClient.Put(ctx, key, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		got := &testEntity{}
+		if err := ndsClient.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Value != 2 || reads != 1 {
+			t.Fatalf("expected 2 read from the datastore, got %d after %d reads", got.Value, reads)
+		}
+
+		// The tombstone expires.
+		if err := ndsClient.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * ttl)
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+		}
+		if reads != 2 {
+			t.Fatalf("expected the expired tombstone to be read from the datastore, got %d reads", reads)
+		}
+	}
+}
+
+func DeleteTombstonesWriteThroughTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDeleteTombstones(time.Minute), nds.WithWriteThrough(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reads := 0
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				reads++
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		type testEntity struct {
+			Value int
+		}
+		kind := fmt.Sprintf("DeleteTombstonesWriteThroughTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "one", nil)
+		for i := 1; i <= 3; i++ {
+			if _, err := ndsClient.Put(ctx, key, &testEntity{i}); err != nil {
+				t.Fatal(err)
+			}
+			got := &testEntity{}
+			if err := ndsClient.Get(ctx, key, got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Value != i {
+				t.Fatalf("expected %d, got %d", i, got.Value)
+			}
+			if err := ndsClient.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := ndsClient.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+			}
+		}
+		if reads != 0 {
+			t.Fatalf("expected every read served from the cache, got %d datastore reads", reads)
+		}
+	}
+}
+
+func DeleteMultiWithoutColdKeyLocksTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var locked []string
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				for _, item := range items {
+					locked = append(locked, item.Key)
+				}
+				return cacher.SetMulti(ctx, items)
+			},
+		}
+
+		ndsClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("DeleteMultiWithoutColdKeyLocksTest%d", time.Now().UnixNano())
+		cached := datastore.NameKey(kind, "cached", nil)
+		cold := datastore.NameKey(kind, "cold", nil)
+		reading := datastore.NameKey(kind, "reading", nil)
+		keys := []*datastore.Key{cached, cold, reading}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}, {3}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, cached, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A concurrent read has locked the key to fill the cache, which the
+		// delete must not let it do.
+		readLock := &nds.Item{
+			Key:        ndsClient.CacheKey(reading),
+			Flags:      nds.LockItem,
+			Value:      []byte("read"),
+			Expiration: time.Minute,
+		}
+		if err := cacher.AddMulti(ctx, []*nds.Item{readLock}); err != nil {
+			t.Fatal(err)
+		}
+
+		locked = nil
+		if err := ndsClient.DeleteMulti(ctx, keys, nds.WithoutColdKeyLocks()); err != nil {
+			t.Fatal(err)
+		}
+		if len(locked) != 2 || locked[0] != ndsClient.CacheKey(cached) ||
+			locked[1] != ndsClient.CacheKey(reading) {
+			t.Fatalf("expected only %v and %v locked, got %v", cached, reading, locked)
+		}
+
+		items, err := cacher.GetMulti(ctx, []string{readLock.Key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item, ok := items[readLock.Key]; !ok || string(item.Value) == "read" {
+			t.Fatal("expected the read's lock to be replaced")
+		}
+
+		err = ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys)))
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		}
+		for _, e := range me {
+			if e != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", e)
+			}
+		}
+	}
+}
+
+// BenchmarkDeleteMultiColdKeys reports the cache writes made deleting a batch
+// of keys of which only cachedPercent are cached.
+func BenchmarkDeleteMultiColdKeys(b *testing.B) {
+	ctx := context.Background()
+	for _, cachedPercent := range []int{0, 10, 100} {
+		for _, coldOpts := range [][]nds.CallOption{nil, {nds.WithoutColdKeyLocks()}} {
+			name := fmt.Sprintf("cached=%d%%/locks=all", cachedPercent)
+			if coldOpts != nil {
+				name = fmt.Sprintf("cached=%d%%/locks=warm", cachedPercent)
+			}
+			b.Run(name, func(b *testing.B) {
+				var reads, writes int
+				testCacher := &mockCacher{cacher: cachers[0].cacher}
+				testCacher.getMultiHook = func(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
+					reads++
+					return cachers[0].cacher.GetMulti(ctx, keys)
+				}
+				testCacher.setMultiHook = func(ctx context.Context, items []*nds.Item) error {
+					writes += len(items)
+					return cachers[0].cacher.SetMulti(ctx, items)
+				}
+				ndsClient, err := nds.NewClient(ctx, testCacher)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				type testEntity struct {
+					IntVal int
+				}
+
+				kind := fmt.Sprintf("BenchmarkDeleteMultiColdKeys%d", time.Now().UnixNano())
+				keys := make([]*datastore.Key, 100)
+				for i := range keys {
+					keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+				}
+				entities := make([]testEntity, len(keys))
+				warm := keys[:len(keys)*cachedPercent/100]
+
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+						b.Fatal(err)
+					}
+					if len(warm) > 0 {
+						if err := ndsClient.GetMulti(ctx, warm, make([]testEntity, len(warm))); err != nil {
+							b.Fatal(err)
+						}
+					}
+					reads, writes = 0, 0
+					b.StartTimer()
+
+					if err := ndsClient.DeleteMulti(ctx, keys, coldOpts...); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(reads), "cache-reads/op")
+				b.ReportMetric(float64(writes), "cache-writes/op")
+			})
+		}
+	}
+}
+
+func DeleteIfExistsTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("DeleteIfExistsTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "one", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		// Cache the entity so a stale cache would show after the delete.
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if deleted, err := ndsClient.DeleteIfExists(ctx, key); err != nil {
+			t.Fatal(err)
+		} else if !deleted {
+			t.Fatal("expected the existing entity to be deleted")
+		}
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+		}
+
+		if deleted, err := ndsClient.DeleteIfExists(ctx, key); err != nil {
+			t.Fatal(err)
+		} else if deleted {
+			t.Fatal("expected the missing entity not to be deleted")
+		}
+
+		if _, err := ndsClient.DeleteIfExists(ctx, nil); err == nil {
+			t.Fatal("expected an error for a nil key")
+		}
+	}
+}
+
+func DeleteIfExistsRaceTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("DeleteIfExistsRaceTest%d", time.Now().UnixNano())
+		for i := 0; i < 10; i++ {
+			key := datastore.NameKey(kind, strconv.Itoa(i), nil)
+
+			// Race the delete against the entity's creation.
+			var (
+				wg      sync.WaitGroup
+				deleted bool
+				delErr  error
+				putErr  error
+			)
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				deleted, delErr = ndsClient.DeleteIfExists(ctx, key)
+			}()
+			go func() {
+				defer wg.Done()
+				_, putErr = ndsClient.Put(ctx, key, &testEntity{i})
+			}()
+			wg.Wait()
+			if delErr != nil {
+				t.Fatal(delErr)
+			}
+			if putErr != nil {
+				t.Fatal(putErr)
+			}
+
+			// The delete either came first and found nothing, or came second
+			// and removed the new entity.
+			err := ndsClient.Get(ctx, key, &testEntity{})
+			switch {
+			case deleted && err != datastore.ErrNoSuchEntity:
+				t.Fatalf("expected a deleted entity to be gone, got %v", err)
+			case !deleted && err != nil:
+				t.Fatalf("expected an entity created after the check to remain, got %v", err)
+			}
+
+			// Of two deletes of the existing entity only one removes it.
+			if _, err := ndsClient.Put(ctx, key, &testEntity{i}); err != nil {
+				t.Fatal(err)
+			}
+			results := make([]bool, 2)
+			errs := make([]error, 2)
+			wg.Add(2)
+			for j := range results {
+				go func(j int) {
+					defer wg.Done()
+					results[j], errs[j] = ndsClient.DeleteIfExists(ctx, key)
+				}(j)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if results[0] == results[1] {
+				t.Fatalf("expected exactly one delete to remove the entity, got %v", results)
+			}
+		}
+	}
+}
+
+// deleteRecordingDatastore records the keys of the DeleteMulti calls made
+// through it.
+type deleteRecordingDatastore struct {
+	*datastore.Client
+	mu      sync.Mutex
+	deletes [][]*datastore.Key
+}
+
+func (d *deleteRecordingDatastore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	d.mu.Lock()
+	d.deletes = append(d.deletes, keys)
+	d.mu.Unlock()
+	return d.Client.DeleteMulti(ctx, keys)
+}
+
+func DeleteMultiDuplicateKeysTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &deleteRecordingDatastore{Client: dsClient}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient), nds.WithDatastore(ds))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("DeleteMultiDuplicateKeysTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "one", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Equal keys that aren't the same pointer are duplicates too.
+		keys := []*datastore.Key{key, datastore.NameKey(kind, "one", nil), key}
+		if err := ndsClient.DeleteMulti(ctx, keys); err != nil {
+			t.Fatalf("expected every index to succeed, got %v", err)
+		}
+		if len(ds.deletes) != 1 || len(ds.deletes[0]) != 1 {
+			t.Fatalf("expected one datastore delete of one key, got %v", ds.deletes)
+		}
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+		}
+
+		// A failure is reported at every index of the key.
+		keys = []*datastore.Key{key, nil, key}
+		err = ndsClient.DeleteMulti(ctx, keys)
+		me, ok := err.(datastore.MultiError)
+		if !ok || len(me) != len(keys) {
+			t.Fatalf("expected a MultiError for %d keys, got %v", len(keys), err)
+		}
+		if me[1] == nil {
+			t.Fatal("expected an error for the nil key")
+		}
+		if me[0] != me[2] {
+			t.Fatalf("expected the duplicates to share their outcome, got %v and %v", me[0], me[2])
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package nds
+
+import (
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+)
+
+// EncodeErrorPolicy decides what Put and PutMulti do with entities that can't
+// be encoded for the cache, for example because the codec set with
+// WithKindCodec rejects them.
+type EncodeErrorPolicy int
+
+const (
+	// EncodeErrorSkipCache writes the entities to the datastore without
+	// caching them and reports a *CacheSerializationError to the ObserverFunc
+	// and the OnErrorFunc for each, so one uncacheable entity never fails an
+	// otherwise valid PutMulti. This is the default.
+	EncodeErrorSkipCache EncodeErrorPolicy = iota
+	// EncodeErrorFail fails Put and PutMulti before anything is written if
+	// any entity can't be encoded, with a datastore.MultiError holding a
+	// *CacheSerializationError for each such entity, like the error for a
+	// nil entity. Every entity is encoded an extra time to check it.
+	EncodeErrorFail
+)
+
+// WithEncodeErrorPolicy sets what Put and PutMulti do with entities that
+// can't be encoded for the cache. The default is EncodeErrorSkipCache. Reads
+// never fail because of it: an entity read from the datastore that can't be
+// encoded is returned and simply not cached, whatever the policy.
+func WithEncodeErrorPolicy(policy EncodeErrorPolicy) ClientOption {
+	return func(c *Client) {
+		c.encodePolicy = policy
+	}
+}
+
+// checkEncodable returns a datastore.MultiError naming every entity in vals
+// that can't be encoded for the cache if the EncodeErrorFail policy is set.
+// Entities that are never cached, those with incomplete keys or implementing
+// Uncacheable, aren't checked.
+func (c *Client) checkEncodable(keys []*datastore.Key, vals reflect.Value) error {
+	if c.cacher == nil || c.encodePolicy != EncodeErrorFail {
+		return nil
+	}
+	failed, errs := false, make(datastore.MultiError, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() || isUncacheable(vals.Index(i)) {
+			continue
+		}
+		pl, err := saveValue(vals.Index(i))
+		if err != nil {
+			// The datastore reports it.
+			continue
+		}
+		if _, err := c.marshalEntity(key, roundTripPropertyList(pl)); err != nil {
+			failed = true
+			errs[i] = &CacheSerializationError{Key: key, Err: err}
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestEncodePolicySuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestEncodeErrorSkipCache", EncodeErrorPolicyTest(item.ctx, item.cacher, nds.EncodeErrorSkipCache))
+			t.Run("TestEncodeErrorFail", EncodeErrorPolicyTest(item.ctx, item.cacher, nds.EncodeErrorFail))
+		})
+	}
+}
+
+func EncodeErrorPolicyTest(ctx context.Context, cacher nds.Cacher,
+	policy nds.EncodeErrorPolicy) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, func(err error) bool {
+			_, ok := err.(*nds.CacheSerializationError)
+			return ok
+		}, nds.WithWriteThrough(true), nds.WithEncodeErrorPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the entity named bad can't be encoded.
+		encodeErr := errors.New("cannot encode")
+		nds.SetMarshal(func(pl datastore.PropertyList) ([]byte, error) {
+			for _, p := range pl {
+				if p.Name == "Name" && p.Value == "bad" {
+					return nil, encodeErr
+				}
+			}
+			return nds.MarshalPropertyList(pl)
+		})
+		defer nds.SetMarshal(nds.MarshalPropertyList)
+
+		type testEntity struct {
+			Name string
+		}
+
+		kind := fmt.Sprintf("EncodeErrorPolicyTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "good1", nil),
+			datastore.NameKey(kind, "bad", nil),
+			datastore.NameKey(kind, "good2", nil),
+		}
+		entities := []testEntity{{"good1"}, {"bad"}, {"good2"}}
+		_, err = ndsClient.PutMulti(ctx, keys, entities)
+
+		if policy == nds.EncodeErrorFail {
+			me, ok := err.(datastore.MultiError)
+			if !ok {
+				t.Fatalf("expected a datastore.MultiError, got %v", err)
+			}
+			var serr *nds.CacheSerializationError
+			if me[0] != nil || !errors.As(me[1], &serr) || me[2] != nil {
+				t.Fatalf("expected only the bad entity to fail, got %v", me)
+			}
+			if !serr.Key.Equal(keys[1]) || !errors.Is(serr, encodeErr) {
+				t.Fatalf("expected %v wrapping %v, got %v", keys[1], encodeErr, serr)
+			}
+			// Nothing was written.
+			err := ndsClient.Client.GetMulti(ctx, keys, make([]testEntity, len(keys)))
+			if me, ok := err.(datastore.MultiError); !ok || me[0] != datastore.ErrNoSuchEntity ||
+				me[1] != datastore.ErrNoSuchEntity || me[2] != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected no entity written, got %v", err)
+			}
+			return
+		}
+
+		if err != nil {
+			t.Fatalf("expected the batch to succeed, got %v", err)
+		}
+		stored := make([]testEntity, len(keys))
+		if err := ndsClient.Client.GetMulti(ctx, keys, stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored[1].Name != "bad" {
+			t.Fatalf("expected the bad entity written, got %+v", stored[1])
+		}
+
+		for i, want := range []nds.CacheState{nds.CacheEntity, nds.CacheAbsent, nds.CacheEntity} {
+			report, err := ndsClient.Inspect(ctx, keys[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.CacheState != want {
+				t.Fatalf("expected %s to be %s, got %s", keys[i].Name, want, report.CacheState)
+			}
+		}
+	}
+}
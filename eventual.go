@@ -0,0 +1,190 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+const (
+	// eventualCacheTTL is the longest entities read with eventual consistency
+	// stay cached, as they may already be stale when they are read.
+	eventualCacheTTL = 5 * time.Second
+
+	// eventualConcurrency is the maximum number of eventually consistent
+	// datastore reads a single GetMulti call makes at once.
+	eventualConcurrency = 16
+)
+
+type eventualKey struct{}
+
+// WithEventualConsistency returns a context that makes Get, GetMulti and
+// ExistsMulti read the datastore with eventual consistency, which is faster
+// but may not see the latest writes. It has no effect within transactions.
+//
+// Entities found in the cache are always preferred, as they are never older
+// than the datastore. The datastore's lookups are always strongly consistent,
+// so the entities that aren't cached are read with an eventually consistent
+// query per key instead. Those entities are only added to the cache if
+// nothing is cached for them yet, so they never replace a fresher entity or a
+// lock taken by a write in progress, and they expire after five seconds, or
+// the TTL set with WithCacheTTL if that is shorter, to bound how long a stale
+// read can be served to strongly consistent readers. Combine it with
+// WithReadYourWrites to still see the writes made with the context.
+func WithEventualConsistency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, eventualKey{}, true)
+}
+
+func eventualFrom(ctx context.Context) bool {
+	eventual, _ := ctx.Value(eventualKey{}).(bool)
+	return eventual
+}
+
+// getMultiEventual is getMultiUncached with eventual consistency.
+func (c *Client) getMultiEventual(ctx context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	cacheItems := c.newCacheItems(keys, vals)
+
+	if c.cacher != nil {
+		if err := c.loadCache(ctx, cacheItems); err != nil {
+			return err
+		}
+		if err := cacheStatsByKind(ctx, cacheItems); err != nil {
+			c.onError(ctx, errors.Wrapf(err, "nds:getMultiEventual cacheStatsByKind"))
+		}
+		c.recordCacheReads(cacheItems)
+		c.logLockedRead(ctx, cacheItems)
+	}
+
+	if c.breaker != nil && c.breaker.rejecting() {
+		if err := c.serveCacheOnly(cacheItems); err != nil {
+			return err
+		}
+	} else {
+		c.loadEventual(ctx, cacheItems)
+		if c.cacher != nil {
+			c.addEventual(ctx, cacheItems)
+		}
+	}
+
+	reportCacheItemsProvenance(ctx, cacheItems, ProvenanceEventual)
+	return cacheItemErrors(cacheItems)
+}
+
+// loadEventual reads the entities not found in the cache from the datastore.
+// Entities of keys that were neither cached nor locked get a cache item to be
+// added by addEventual.
+func (c *Client) loadEventual(ctx context.Context, cacheItems []cacheItem) {
+	expiration := eventualCacheTTL
+	if ttl := c.valueExpiration(); ttl > 0 && ttl < expiration {
+		expiration = ttl
+	}
+
+	sem := make(chan struct{}, eventualConcurrency)
+	var wg sync.WaitGroup
+	for i := range cacheItems {
+		if cacheItems[i].state == done {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(cacheItem *cacheItem) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			pl, err := c.getEventual(ctx, cacheItem.key)
+			switch err {
+			case nil:
+				var data []byte
+				if cacheItem.state == miss {
+					if data, err = c.marshalEntity(cacheItem.key, pl); err != nil {
+						c.cacheSerializationFailed(ctx, cacheItem.key, err)
+					}
+				}
+				cacheItem.err = setValue(cacheItem.val, pl, cacheItem.key)
+				// A CacheTTLer only knows its TTL once it is loaded.
+				exp, ok := c.capExpiration(expiration, pl, cacheItem.val)
+				if cacheItem.state == miss && ok && err == nil {
+					cacheItem.item = &Item{
+						Key:        cacheItem.cacheKey,
+						Flags:      entityItem,
+						Value:      data,
+						Expiration: exp,
+					}
+				}
+			case datastore.ErrNoSuchEntity:
+				if exp, ok := c.negativeExpiration(cacheItem.key); cacheItem.state == miss && ok {
+					cacheItem.item = &Item{
+						Key:        cacheItem.cacheKey,
+						Flags:      noneItem,
+						Value:      []byte{},
+						Expiration: shorterExpiration(expiration, exp),
+					}
+				}
+				cacheItem.err = err
+			default:
+				cacheItem.err = err
+			}
+		}(&cacheItems[i])
+	}
+	wg.Wait()
+}
+
+func (c *Client) getEventual(ctx context.Context, key *datastore.Key) (datastore.PropertyList, error) {
+	q := datastore.NewQuery(key.Kind).Namespace(key.Namespace).
+		Filter("__key__ =", key).Limit(1).EventualConsistency()
+	var pls []datastore.PropertyList
+	c.recordDatastoreReads([]*datastore.Key{key})
+	if err := c.guardDatastore(ctx, func() error {
+		_, err := c.ds.GetAll(ctx, q, &pls)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if len(pls) == 0 {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return pls[0], nil
+}
+
+// addEventual adds the entities read by loadEventual to the cache unless
+// something was cached for them in the meantime.
+func (c *Client) addEventual(ctx context.Context, cacheItems []cacheItem) {
+	addItems := make([]*Item, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == miss && cacheItem.item != nil {
+			addItems = append(addItems, cacheItem.item)
+		}
+	}
+	if len(addItems) == 0 {
+		return
+	}
+
+	if err := c.cacher.AddMulti(ctx, addItems); cacheFailure(err) != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:addEventual AddMulti"))
+	}
+}
+
+// cacheItemErrors returns the errors of cacheItems as a datastore.MultiError,
+// or nil if there are none.
+func cacheItemErrors(cacheItems []cacheItem) error {
+	me, errsNil := make(datastore.MultiError, len(cacheItems)), true
+	for i, cacheItem := range cacheItems {
+		if cacheItem.err != nil {
+			me[i] = cacheItem.err
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,117 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestEventualConsistencySuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetEventualConsistency", GetEventualConsistencyTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func GetEventualConsistencyTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var added []*nds.Item
+		testCacher := &mockCacher{
+			cacher: cacher,
+			addMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				added = append(added, items...)
+				return cacher.AddMulti(ctx, items)
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("GetEventualConsistencyTest%d", time.Now().UnixNano())
+		cachedKey := datastore.NameKey(kind, "cached", nil)
+		uncachedKey := datastore.NameKey(kind, "uncached", nil)
+		lockedKey := datastore.NameKey(kind, "locked", nil)
+		missingKey := datastore.NameKey(kind, "missing", nil)
+
+		keys := []*datastore.Key{cachedKey, uncachedKey, lockedKey}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}, {3}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, cachedKey, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Change the cached entity behind the cache's back, so that reading
+		// the cache can be told apart from reading the datastore.
+		if _, err := ndsClient.Client.Put(ctx, cachedKey, &testEntity{10}); err != nil {
+			t.Fatal(err)
+		}
+		// Take the cache lock a write in progress would hold.
+		lock := &nds.Item{
+			Key:        nds.CacheKey(lockedKey),
+			Flags:      nds.LockItem,
+			Value:      []byte{1, 2, 3, 4},
+			Expiration: time.Minute,
+		}
+		if err := cacher.SetMulti(ctx, []*nds.Item{lock}); err != nil {
+			t.Fatal(err)
+		}
+
+		added = nil
+		eventualCtx := nds.WithEventualConsistency(ctx)
+		got := make([]testEntity, 4)
+		err = ndsClient.GetMulti(eventualCtx,
+			[]*datastore.Key{cachedKey, uncachedKey, lockedKey, missingKey}, got)
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		}
+		if me[0] != nil || me[1] != nil || me[2] != nil || me[3] != datastore.ErrNoSuchEntity {
+			t.Fatalf("unexpected errors %v", me)
+		}
+
+		// The cached entity is preferred over the datastore.
+		if got[0].IntVal != 1 {
+			t.Fatalf("expected the cached entity, got %d", got[0].IntVal)
+		}
+		if got[1].IntVal != 2 || got[2].IntVal != 3 {
+			t.Fatalf("expected 2 and 3 from the datastore, got %v", got[1:3])
+		}
+
+		// Only the uncached and missing entities are added, with a short TTL
+		// and without taking locks, so the lock is left alone.
+		if len(added) != 2 {
+			t.Fatalf("expected 2 items added to the cache, got %d", len(added))
+		}
+		wantFlags := map[string]uint32{
+			nds.CacheKey(uncachedKey): nds.EntityItem,
+			nds.CacheKey(missingKey):  nds.NoneItem,
+		}
+		for _, item := range added {
+			if flags, ok := wantFlags[item.Key]; !ok || item.Flags != flags {
+				t.Fatalf("unexpected item %q with flags %d added", item.Key, item.Flags)
+			}
+			if item.Expiration != nds.EventualCacheTTL {
+				t.Fatalf("expected expiration %v, got %v", nds.EventualCacheTTL, item.Expiration)
+			}
+		}
+		items, err := cacher.GetMulti(ctx, []string{nds.CacheKey(lockedKey)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item := items[nds.CacheKey(lockedKey)]; item == nil || item.Flags != nds.LockItem {
+			t.Fatalf("expected the lock to be kept, got %+v", item)
+		}
+	}
+}
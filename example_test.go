@@ -0,0 +1,87 @@
+package nds_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+	"github.com/qedus/nds/v2/cachers/memory"
+)
+
+// kindIDKey is the cache key format of a system that caches entities under
+// "kind:id", or "kind:name" for named keys.
+func kindIDKey(key *datastore.Key) string {
+	if key.Name != "" {
+		return key.Kind + ":" + key.Name
+	}
+	return key.Kind + ":" + strconv.FormatInt(key.ID, 10)
+}
+
+// jsonCodec caches entities as flat JSON objects of their properties, the
+// value format of the same system. Numbers without a fraction decode as
+// int64, the others as float64.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	obj := make(map[string]interface{}, len(pl))
+	for _, p := range pl {
+		obj[p.Name] = p.Value
+	}
+	return json.Marshal(obj)
+}
+
+func (jsonCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return err
+	}
+	for name, value := range obj {
+		if n, ok := value.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				value = i
+			} else if value, err = n.Float64(); err != nil {
+				return err
+			}
+		}
+		*pl = append(*pl, datastore.Property{Name: name, Value: value})
+	}
+	return nil
+}
+
+// This shares the cache with a system that caches entities as JSON under
+// "kind:id" keys, so each reads what the other cached.
+func ExampleWithValueCodec() {
+	ctx := context.Background()
+	dsClient, err := datastore.NewClient(ctx, "my-project")
+	if err != nil {
+		panic(err)
+	}
+	client, err := nds.NewClient(ctx, memory.NewCacher(),
+		nds.WithDatastoreClient(dsClient),
+		nds.WithCacheKeyFunc(kindIDKey),
+		nds.WithValueCodec(jsonCodec{}))
+	if err != nil {
+		panic(err)
+	}
+
+	type User struct {
+		Name  string
+		Count int64
+	}
+	// The other system can write {"Count":2,"Name":"ann"} under "User:42"
+	// with nds.EntityFlags, and nds reads it from the cache.
+	var u User
+	if err := client.Get(ctx, datastore.IDKey("User", 42, nil), &u); err != nil {
+		panic(err)
+	}
+	fmt.Println(u.Name, u.Count)
+}
@@ -0,0 +1,239 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// existsConcurrency is the maximum number of keys-only queries ExistsMulti
+// runs concurrently for keys it can't answer from the cache.
+const existsConcurrency = 16
+
+// ExistsMulti reports for each key whether an entity is stored for it without
+// loading the entities. Keys cached as an entity or as missing are answered
+// from the cache without a datastore read, as reliably as Get answers from
+// it, so a warm cache makes existence checks nearly free. The rest, including
+// keys locked by a concurrent write, are checked with a keys-only datastore
+// query, which is eventually consistent with a context from
+// WithEventualConsistency. The cache is not populated.
+//
+// If a key can't be checked, the returned error is a datastore.MultiError
+// holding the error at the key's index, or a *BatchError with WithBatchErrors,
+// and the key's exists value is false.
+func (c *Client) ExistsMulti(ctx context.Context, keys []*datastore.Key) ([]bool, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.ExistsMulti")
+	defer span.End()
+	callerKeys := keys
+	keys = c.keysInNamespace(keys)
+
+	exists := make([]bool, len(keys))
+	me := make(datastore.MultiError, len(keys))
+	check := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			me[i] = datastore.ErrInvalidKey
+			continue
+		}
+		check = append(check, i)
+	}
+
+	if c.cacher != nil && len(check) > 0 {
+		var err error
+		if check, err = c.existsCache(ctx, keys, check, exists); err != nil {
+			return nil, err
+		}
+	}
+
+	sem := make(chan struct{}, existsConcurrency)
+	var wg sync.WaitGroup
+	for _, i := range check {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			exists[i], me[i] = c.existsDatastore(ctx, keys[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range me {
+		if err != nil {
+			return exists, c.batchError(callerKeys, me)
+		}
+	}
+	return exists, nil
+}
+
+// Exists reports whether an entity is stored for key the way ExistsMulti
+// does.
+func (c *Client) Exists(ctx context.Context, key *datastore.Key) (bool, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Exists")
+	defer span.End()
+
+	exists, err := c.ExistsMulti(ctx, []*datastore.Key{key})
+	if me, ok := unwrapBatchError(err).(datastore.MultiError); ok {
+		return false, me[0]
+	}
+	if err != nil && exists == nil {
+		return false, err
+	}
+	return exists[0], err
+}
+
+// WarmNegative caches every key in keys that has no entity stored as missing,
+// so that ExistsMulti and Get answer it from the cache, for example ahead of
+// repeated uniqueness checks. Each key is looked up in the datastore while
+// holding its cache lock, the way Get fills the cache, so a Put or Delete of
+// the key racing WarmNegative always wins and any later write clears the
+// entry the usual way. Keys cached already or locked by a write in progress
+// are left alone, as are keys that turn out to exist, whose entities aren't
+// cached, and keys of kinds left out by WithNegativeCacheKinds. WarmNegative
+// does nothing without a Cacher.
+//
+// If a key can't be warmed, the returned error is a datastore.MultiError
+// holding the error at the key's index, or a *BatchError with
+// WithBatchErrors.
+func (c *Client) WarmNegative(ctx context.Context, keys []*datastore.Key) error {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.WarmNegative")
+	defer span.End()
+	callerKeys := keys
+	keys = c.keysInNamespace(keys)
+
+	me, errsNil := make(datastore.MultiError, len(keys)), true
+	warmKeys := make([]*datastore.Key, 0, len(keys))
+	indexes := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			me[i], errsNil = datastore.ErrInvalidKey, false
+			continue
+		}
+		warmKeys = append(warmKeys, key)
+		indexes = append(indexes, i)
+	}
+	if c.cacher == nil || len(warmKeys) == 0 {
+		if errsNil {
+			return nil
+		}
+		return c.batchError(callerKeys, me)
+	}
+
+	vals := make([]datastore.PropertyList, len(warmKeys))
+	cacheItems := c.newCacheItems(warmKeys, reflect.ValueOf(vals))
+	if err := c.loadCache(ctx, cacheItems); err != nil {
+		return err
+	}
+	if err := c.lockCache(ctx, cacheItems); err != nil {
+		return err
+	}
+
+	lookupKeys := make([]*datastore.Key, 0, len(cacheItems))
+	locked := make([]int, 0, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == internalLock {
+			lookupKeys = append(lookupKeys, cacheItem.key)
+			locked = append(locked, i)
+		}
+	}
+	if len(lookupKeys) == 0 {
+		if errsNil {
+			return nil
+		}
+		return c.batchError(callerKeys, me)
+	}
+
+	// Lookups are strongly consistent, unlike keys-only queries.
+	lookupErrs := make(datastore.MultiError, len(lookupKeys))
+	if err := c.getDatastore(ctx, lookupKeys,
+		make([]datastore.PropertyList, len(lookupKeys))); err != nil {
+		if e, ok := err.(datastore.MultiError); ok {
+			lookupErrs = e
+		} else {
+			for j := range lookupErrs {
+				lookupErrs[j] = err
+			}
+		}
+	}
+
+	// The locks of keys that weren't confirmed missing, or whose kind isn't
+	// negatively cached, are removed.
+	unlock := make([]*Item, 0, len(locked))
+	for j, i := range locked {
+		exp, negative := c.negativeExpiration(cacheItems[i].key)
+		switch err := lookupErrs[j]; {
+		case err == datastore.ErrNoSuchEntity && negative:
+			cacheItems[i].item.Flags = noneItem
+			cacheItems[i].item.Expiration = exp
+			cacheItems[i].item.Value = []byte{}
+		default:
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				me[indexes[i]], errsNil = err, false
+			}
+			unlock = append(unlock, cacheItems[i].item)
+			cacheItems[i].state = externalLock
+		}
+	}
+	c.saveCache(ctx, cacheItems)
+	if len(unlock) > 0 {
+		c.unlockCache(ctx, unlock, "nds:WarmNegative DeleteMulti")
+	}
+
+	if errsNil {
+		return nil
+	}
+	return c.batchError(callerKeys, me)
+}
+
+// existsCache sets exists for the keys at indexes cached as an entity or as
+// missing and returns the indexes that still have to be checked. It only
+// returns an error if the cache failed and ExistsMulti has to fail with it.
+func (c *Client) existsCache(ctx context.Context, keys []*datastore.Key,
+	indexes []int, exists []bool) ([]int, error) {
+	cacheKeys := make([]string, len(indexes))
+	for i, index := range indexes {
+		cacheKeys[i] = createCacheKey(c.keys, keys[index])
+	}
+
+	items, err := c.cacher.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		return indexes, c.readCacheFailed(ctx, err, "nds:ExistsMulti GetMulti")
+	}
+
+	remaining := indexes[:0]
+	for i, index := range indexes {
+		item, ok := items[cacheKeys[i]]
+		switch {
+		case ok && item.Flags == entityItem:
+			exists[index] = true
+		case ok && item.Flags == noneItem:
+		default:
+			// Not cached or locked by a write in progress.
+			remaining = append(remaining, index)
+		}
+	}
+	return remaining, nil
+}
+
+func (c *Client) existsDatastore(ctx context.Context, key *datastore.Key) (bool, error) {
+	q := datastore.NewQuery(key.Kind).Namespace(key.Namespace).
+		Filter("__key__ =", key).KeysOnly().Limit(1)
+	if eventualFrom(ctx) && !c.written(ctx, key) {
+		q = q.EventualConsistency()
+	}
+	var found []*datastore.Key
+	err := c.guardDatastore(ctx, func() error {
+		var err error
+		found, err = c.ds.GetAll(ctx, q, nil)
+		return err
+	})
+	return len(found) > 0, err
+}
@@ -0,0 +1,260 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestExistsMultiSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestExistsMulti", ExistsMultiTest(item.ctx, item.cacher))
+			t.Run("TestExists", ExistsTest(item.ctx, item.cacher))
+			t.Run("TestWarmNegative", WarmNegativeTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func ExistsMultiTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		newKey := func(name string) *datastore.Key {
+			return datastore.NameKey("ExistsMultiTest", name, nil)
+		}
+		cachedPresent := newKey("cachedPresent")
+		cachedAbsent := newKey("cachedAbsent")
+		datastoreOnly := newKey("datastoreOnly")
+		locked := newKey("locked")
+		missing := newKey("missing")
+		keys := []*datastore.Key{cachedPresent, cachedAbsent, datastoreOnly, locked, missing, nil}
+		defer ndsClient.DeleteMulti(ctx, keys[:5])
+
+		// Cache an entity and a tombstone, then change the datastore behind
+		// the cache's back so answers from the cache can be told apart.
+		if _, err := ndsClient.Put(ctx, cachedPresent, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, cachedPresent, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, cachedAbsent, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+		}
+		if err := ndsClient.Client.Delete(ctx, cachedPresent); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ndsClient.Client.Put(ctx, cachedAbsent, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Entities only the datastore knows about, one of them locked.
+		if _, err := ndsClient.Client.PutMulti(ctx, []*datastore.Key{datastoreOnly, locked},
+			[]testEntity{{3}, {4}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cacher.SetMulti(ctx, []*nds.Item{{
+			Key:        ndsClient.CacheKey(locked),
+			Flags:      nds.LockItem,
+			Value:      []byte{1, 2, 3, 4},
+			Expiration: time.Minute,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		exists, err := ndsClient.ExistsMulti(ctx, keys)
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected a datastore.MultiError, got %v", err)
+		}
+		for i, e := range me[:5] {
+			if e != nil {
+				t.Fatalf("unexpected error for %v: %v", keys[i], e)
+			}
+		}
+		if me[5] != datastore.ErrInvalidKey {
+			t.Fatalf("expected %v for the nil key, got %v", datastore.ErrInvalidKey, me[5])
+		}
+
+		want := []bool{true, false, true, true, false, false}
+		for i := range want {
+			if exists[i] != want[i] {
+				t.Fatalf("expected %v, got %v", want, exists)
+			}
+		}
+
+		if exists, err := ndsClient.ExistsMulti(ctx, keys[:0]); err != nil || len(exists) != 0 {
+			t.Fatalf("expected no results, got %v, %v", exists, err)
+		}
+	}
+}
+
+func ExistsTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		kind := fmt.Sprintf("ExistsTest%d", time.Now().UnixNano())
+		hit := datastore.NameKey(kind, "hit", nil)
+		negativeHit := datastore.NameKey(kind, "negativeHit", nil)
+		unknown := datastore.NameKey(kind, "unknown", nil)
+
+		if _, err := ndsClient.Put(ctx, hit, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, hit, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, negativeHit, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+		}
+		if _, err := ndsClient.Client.Put(ctx, unknown, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			key            *datastore.Key
+			exists         bool
+			datastoreCalls int64
+		}{
+			{hit, true, 0},
+			{negativeHit, false, 0},
+			{unknown, true, 1},
+		}
+		for _, test := range tests {
+			var s nds.OpStats
+			exists, err := ndsClient.Exists(nds.WithOpStats(ctx, &s), test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists != test.exists {
+				t.Fatalf("expected %v to exist %v, got %v", test.key, test.exists, exists)
+			}
+			if s.DatastoreCalls != test.datastoreCalls {
+				t.Fatalf("expected %d datastore calls for %v, got %d",
+					test.datastoreCalls, test.key, s.DatastoreCalls)
+			}
+		}
+
+		if _, err := ndsClient.Exists(ctx, nil); err != datastore.ErrInvalidKey {
+			t.Fatalf("expected %v, got %v", datastore.ErrInvalidKey, err)
+		}
+
+		// A failed cache read fails the call under ReadCacheFail.
+		failingClient, err := NewClient(ctx, brokenReadCacher(cacher), t, nil,
+			nds.WithReadCacheErrorPolicy(nds.ReadCacheFail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, err := failingClient.Exists(ctx, hit)
+		var cre *nds.CacheReadError
+		if !errors.As(err, &cre) || exists {
+			t.Fatalf("expected a CacheReadError, got %v, %v", exists, err)
+		}
+	}
+}
+
+// queryCountingDatastore counts the queries run through GetAll.
+type queryCountingDatastore struct {
+	*datastore.Client
+	queries int32
+}
+
+func (q *queryCountingDatastore) GetAll(ctx context.Context, query *datastore.Query,
+	dst interface{}) ([]*datastore.Key, error) {
+	atomic.AddInt32(&q.queries, 1)
+	return q.Client.GetAll(ctx, query, dst)
+}
+
+func WarmNegativeTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &queryCountingDatastore{Client: dsClient}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient), nds.WithDatastore(ds))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("WarmNegativeTest%d", time.Now().UnixNano())
+		absent := []*datastore.Key{
+			datastore.NameKey(kind, "absent1", nil),
+			datastore.NameKey(kind, "absent2", nil),
+		}
+		present := datastore.NameKey(kind, "present", nil)
+		if _, err := ndsClient.Put(ctx, present, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		err = ndsClient.WarmNegative(ctx, append(absent, present, nil))
+		if me, ok := err.(datastore.MultiError); !ok || me[0] != nil || me[1] != nil ||
+			me[2] != nil || me[3] != datastore.ErrInvalidKey {
+			t.Fatalf("expected only the nil key to fail, got %v", err)
+		}
+
+		// The absent keys are answered from the cache.
+		exists, err := ndsClient.ExistsMulti(ctx, absent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists[0] || exists[1] {
+			t.Fatalf("expected the keys to be absent, got %v", exists)
+		}
+		if queries := atomic.LoadInt32(&ds.queries); queries != 0 {
+			t.Fatalf("expected no datastore queries, got %d", queries)
+		}
+		// The existing entity wasn't cached.
+		if exists, err := ndsClient.Exists(ctx, present); err != nil {
+			t.Fatal(err)
+		} else if !exists {
+			t.Fatal("expected the entity to exist")
+		}
+		if queries := atomic.LoadInt32(&ds.queries); queries != 1 {
+			t.Fatalf("expected the existing entity to be queried, got %d queries", queries)
+		}
+
+		// Creating an entity clears its negative entry.
+		if _, err := ndsClient.Put(ctx, absent[0], &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&ds.queries, 0)
+		exists, err = ndsClient.ExistsMulti(ctx, absent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists[0] || exists[1] {
+			t.Fatalf("expected only the created key to exist, got %v", exists)
+		}
+		if queries := atomic.LoadInt32(&ds.queries); queries != 1 {
+			t.Fatalf("expected only the created key to be queried, got %d queries", queries)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package nds
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// expiresTag is the struct tag that marks the field holding an entity's
+// expiry, as in `nds:"expires"`.
+const expiresTag = "expires"
+
+// minExpiresTTL is the shortest time to expiry an entity is cached for. Cache
+// backends ignore subsecond expirations, and treat 0 as never expiring.
+const minExpiresTTL = time.Second
+
+// WithExpiresProperty makes the cached copies of entities with a time.Time
+// property called name expire when that time is reached, so the cache never
+// outlives the logical validity of a record. Entities whose expiry is less
+// than a second away, or has passed, are not cached at all; entities without
+// the property, or with a zero time, are cached as usual. The expiry only ever
+// shortens the expiration set with WithCacheTTL, WithImmutableKinds or by a
+// CacheTTLer.
+//
+// Struct types can instead tag the field with `nds:"expires"`, which takes
+// precedence over name. It applies to every way entities are cached: by
+// reads, by WithWriteThrough and by WithImmutableKinds.
+func WithExpiresProperty(name string) ClientOption {
+	return func(c *Client) {
+		c.expiresProperty = name
+	}
+}
+
+// expiresFields caches the name of the property tagged as the expiry, or ""
+// for none, by struct type.
+var expiresFields sync.Map
+
+// expiresPropertyOf returns the name of the property holding the expiry of
+// the entity val is saved from or loaded into.
+func (c *Client) expiresPropertyOf(val reflect.Value) string {
+	t := val.Type()
+	if val.Kind() == reflect.Interface && !val.IsNil() {
+		t = val.Elem().Type()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return c.expiresProperty
+	}
+
+	name, ok := expiresFields.Load(t)
+	if !ok {
+		name = taggedExpiresProperty(t)
+		expiresFields.Store(t, name)
+	}
+	if name != "" {
+		return name.(string)
+	}
+	return c.expiresProperty
+}
+
+// taggedExpiresProperty returns the name of the property of the field of t
+// tagged as the expiry.
+func taggedExpiresProperty(t reflect.Type) string {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("nds") != expiresTag {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("datastore"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		return name
+	}
+	return ""
+}
+
+// capExpiration replaces exp, the expiration of the cached copy of the entity
+// pl saved from or loaded into val, with the entity's own TTL and caps it at
+// the entity's expiry. It returns false if the entity must not be cached.
+func (c *Client) capExpiration(exp time.Duration, pl datastore.PropertyList,
+	val reflect.Value) (time.Duration, bool) {
+
+	if ttl, ok := entityTTL(val); ok {
+		if ttl < minExpiresTTL {
+			return 0, false
+		}
+		exp = ttl
+	}
+
+	name := c.expiresPropertyOf(val)
+	if name == "" {
+		return exp, true
+	}
+
+	for _, p := range pl {
+		if p.Name != name {
+			continue
+		}
+		expiresAt, ok := p.Value.(time.Time)
+		if !ok || expiresAt.IsZero() {
+			break
+		}
+		ttl := time.Until(expiresAt)
+		if ttl < minExpiresTTL {
+			return 0, false
+		}
+		if exp <= 0 || ttl < exp {
+			exp = ttl
+		}
+		break
+	}
+	return exp, true
+}
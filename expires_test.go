@@ -0,0 +1,235 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestExpiresSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestExpiresTag", ExpiresTagTest(item.ctx, item.cacher))
+			t.Run("TestExpiresProperty", ExpiresPropertyTest(item.ctx, item.cacher))
+			t.Run("TestCacheTTLer", CacheTTLerTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+type expiringEntity struct {
+	IntVal    int
+	ExpiresAt time.Time `datastore:"expires_at" nds:"expires"`
+}
+
+// recordExpirations returns a cacher that records the expiration of every
+// entity it caches by cache key.
+func recordExpirations(cacher nds.Cacher) (*mockCacher, func() map[string]time.Duration) {
+	var mu sync.Mutex
+	expirations := make(map[string]time.Duration)
+	record := func(items []*nds.Item) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, item := range items {
+			if item.Flags == nds.EntityItem {
+				expirations[item.Key] = item.Expiration
+			}
+		}
+	}
+	mc := &mockCacher{
+		cacher: cacher,
+		compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+			record(items)
+			return cacher.CompareAndSwapMulti(ctx, items)
+		},
+		setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+			record(items)
+			return cacher.SetMulti(ctx, items)
+		},
+	}
+	return mc, func() map[string]time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		recorded := make(map[string]time.Duration, len(expirations))
+		for k, v := range expirations {
+			recorded[k] = v
+		}
+		return recorded
+	}
+}
+
+// sessionEntity caches itself until its session expires.
+type sessionEntity struct {
+	IntVal  int
+	Expires time.Time
+}
+
+func (s *sessionEntity) NDSCacheTTL() time.Duration {
+	return time.Until(s.Expires)
+}
+
+func CacheTTLerTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		for _, writeThrough := range []bool{false, true} {
+			mc, recorded := recordExpirations(cacher)
+			ndsClient, err := NewClient(ctx, mc, t, nil,
+				nds.WithWriteThrough(writeThrough), nds.WithCacheTTL(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kind := fmt.Sprintf("CacheTTLerTest%d", time.Now().UnixNano())
+			now := time.Now()
+			keys := []*datastore.Key{
+				datastore.NameKey(kind, "short", nil),
+				datastore.NameKey(kind, "long", nil),
+				datastore.NameKey(kind, "expired", nil),
+			}
+			entities := []sessionEntity{
+				{1, now.Add(10 * time.Minute)},
+				{2, now.Add(3 * time.Hour)},
+				{3, now.Add(-time.Minute)},
+			}
+			if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+				t.Fatal(err)
+			}
+
+			vals := make([]sessionEntity, len(keys))
+			if err := ndsClient.GetMulti(ctx, keys, vals); err != nil {
+				t.Fatal(err)
+			}
+			for i, val := range vals {
+				if val.IntVal != entities[i].IntVal {
+					t.Fatalf("expected %d, got %d", entities[i].IntVal, val.IntVal)
+				}
+			}
+
+			// Each entity in the batch is cached with its own TTL, which
+			// replaces the cache TTL.
+			expirations := recorded()
+			for i, want := range []time.Duration{10 * time.Minute, 3 * time.Hour} {
+				got, ok := expirations[nds.CreateCacheKey(keys[i])]
+				if !ok {
+					t.Fatalf("writeThrough=%v: expected %v cached", writeThrough, keys[i])
+				}
+				if got > want || got < want-time.Minute {
+					t.Fatalf("writeThrough=%v: expected %v cached for about %v, got %v",
+						writeThrough, keys[i], want, got)
+				}
+			}
+			if _, ok := expirations[nds.CreateCacheKey(keys[2])]; ok {
+				t.Fatalf("writeThrough=%v: expected %v never cached", writeThrough, keys[2])
+			}
+		}
+	}
+}
+
+func ExpiresTagTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		for _, writeThrough := range []bool{false, true} {
+			mc, recorded := recordExpirations(cacher)
+			ndsClient, err := NewClient(ctx, mc, t, nil,
+				nds.WithWriteThrough(writeThrough), nds.WithCacheTTL(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kind := fmt.Sprintf("ExpiresTagTest%d", time.Now().UnixNano())
+			now := time.Now()
+			keys := []*datastore.Key{
+				datastore.NameKey(kind, "soon", nil),
+				datastore.NameKey(kind, "later", nil),
+				datastore.NameKey(kind, "expired", nil),
+				datastore.NameKey(kind, "never", nil),
+			}
+			entities := []*expiringEntity{
+				{1, now.Add(10 * time.Minute)},
+				{2, now.Add(24 * time.Hour)},
+				{3, now.Add(-time.Minute)},
+				{4, time.Time{}},
+			}
+			if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+				t.Fatal(err)
+			}
+
+			vals := make([]*expiringEntity, len(keys))
+			if err := ndsClient.GetMulti(ctx, keys, vals); err != nil {
+				t.Fatal(err)
+			}
+			for i, val := range vals {
+				if val.IntVal != entities[i].IntVal {
+					t.Fatalf("expected %d, got %d", entities[i].IntVal, val.IntVal)
+				}
+			}
+
+			expirations := recorded()
+			within := func(key *datastore.Key, want time.Duration) {
+				got, ok := expirations[nds.CreateCacheKey(key)]
+				if !ok {
+					t.Fatalf("expected %v cached", key)
+				}
+				if got > want || got < want-time.Minute {
+					t.Fatalf("expected %v cached for about %v, got %v", key, want, got)
+				}
+			}
+			// The expiry caps the cache TTL but never lengthens it.
+			within(keys[0], 10*time.Minute)
+			within(keys[1], time.Hour)
+			within(keys[3], time.Hour)
+			if _, ok := expirations[nds.CreateCacheKey(keys[2])]; ok {
+				t.Fatalf("expected %v never cached", keys[2])
+			}
+
+			items, err := cacher.GetMulti(ctx, []string{nds.CreateCacheKey(keys[2])})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range items {
+				if item.Flags == nds.EntityItem {
+					t.Fatalf("found %v in the cache", keys[2])
+				}
+			}
+		}
+	}
+}
+
+func ExpiresPropertyTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		mc, recorded := recordExpirations(cacher)
+		ndsClient, err := NewClient(ctx, mc, t, nil,
+			nds.WithExpiresProperty("ValidUntil"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := fmt.Sprintf("ExpiresPropertyTest%d", time.Now().UnixNano())
+		soon := datastore.NameKey(kind, "soon", nil)
+		expired := datastore.NameKey(kind, "expired", nil)
+		keys := []*datastore.Key{soon, expired}
+		now := time.Now()
+		if _, err := ndsClient.PutMulti(ctx, keys, []datastore.PropertyList{
+			{{Name: "ValidUntil", Value: now.Add(time.Minute)}},
+			{{Name: "ValidUntil", Value: now.Add(-time.Minute)}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ndsClient.GetMulti(ctx, keys,
+			make([]datastore.PropertyList, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+
+		expirations := recorded()
+		if got := expirations[nds.CreateCacheKey(soon)]; got <= 0 || got > time.Minute {
+			t.Fatalf("expected %v cached for under a minute, got %v", soon, got)
+		}
+		if _, ok := expirations[nds.CreateCacheKey(expired)]; ok {
+			t.Fatalf("expected %v never cached", expired)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package nds
 import (
 	"context"
 	"reflect"
+	"time"
 
 	"cloud.google.com/go/datastore"
 )
@@ -13,14 +14,31 @@ var (
 
 	NoneItem   = noneItem
 	EntityItem = entityItem
+	LockItem   = lockItem
 
 	CacheMaxKeySize = cacheMaxKeySize
+
+	EventualCacheTTL = eventualCacheTTL
 )
 
+// ItemLockAt returns the value of a lock created at t.
+func ItemLockAt(t time.Time) []byte {
+	return itemLockAt(t)
+}
+
+// WriterLock returns the value of a lock set by a write.
+func WriterLock() []byte {
+	return writerLock()
+}
+
 func SetMarshal(f func(pl datastore.PropertyList) ([]byte, error)) {
 	marshal = f
 }
 
+func SetReindexPageSize(n int) {
+	reindexPageSize = n
+}
+
 func SetUnmarshal(f func(data []byte, pl *datastore.PropertyList) error) {
 	unmarshal = f
 }
@@ -30,7 +48,7 @@ func SetValue(val reflect.Value, pl datastore.PropertyList, key *datastore.Key)
 }
 
 func CreateCacheKey(key *datastore.Key) string {
-	return createCacheKey(key)
+	return createCacheKey(keyScheme{}, key)
 }
 
 func SetDatastorePutMultiHook(f func() error) {
@@ -41,6 +59,32 @@ func SetDatastoreGetMultiHook(f func(ctx context.Context, keys []*datastore.Key,
 	getMultiHook = f
 }
 
+func SetDatastoreDeleteMultiHook(f func() error) {
+	deleteMultiHook = f
+}
+
+func SetDatastoreRunInTransactionHook(f func(ctx context.Context,
+	f func(tx *datastore.Transaction) error) (*datastore.Commit, error)) {
+	runInTransactionHook = f
+}
+
 func SetDatastoreMutateHook(f func() error) {
 	mutateHook = f
 }
+
+// NewTestBreaker returns a function that runs f through a new circuit breaker
+// using now as its clock, reporting state changes to onChange.
+func NewTestBreaker(settings CircuitBreakerSettings, now func() time.Time,
+	onChange func(from, to BreakerState)) (func(f func() error) error, func() BreakerState) {
+	c := &Client{}
+	WithCircuitBreaker(settings)(c)
+	WithObserver(func(_ context.Context, e Event) {
+		if sc, ok := e.(BreakerStateChange); ok {
+			onChange(sc.From, sc.To)
+		}
+	})(c)
+	c.breaker.now = now
+	return func(f func() error) error {
+		return c.guardDatastore(context.Background(), f)
+	}, c.BreakerState
+}
@@ -59,13 +59,24 @@ var (
 // As a special case, datastore.PropertyList is an invalid type for dst, even
 // though a PropertyList is a slice of structs. It is treated as invalid to
 // avoid being mistakenly passed when []datastore.PropertyList was intended.
+//
+// Pass WithConcurrency to override the Client's read concurrency. With
+// WithBatchErrors the errors of individual keys are returned as a *BatchError.
 func (c *Client) GetMulti(ctx context.Context,
-	keys []*datastore.Key, vals interface{}) error {
+	keys []*datastore.Key, vals interface{}, opts ...CallOption) error {
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetMulti")
 	defer span.End()
+	ctx, emitTiming := c.startOpTiming(ctx, "GetMulti", len(keys))
+	defer emitTiming()
+	callerKeys := keys
+	keys = c.keysInNamespace(keys)
 	v := reflect.ValueOf(vals)
 	if err := checkKeysValues(keys, v); err != nil {
+		return c.batchError(callerKeys, err)
+	}
+	limit, err := newCallOptions(opts).shardLimit(c.readLimit)
+	if err != nil {
 		return err
 	}
 
@@ -82,8 +93,12 @@ func (c *Client) GetMulti(ctx context.Context,
 		}
 
 		go func(i int, keys []*datastore.Key, vals reflect.Value) {
-			errs[i] = c.getMulti(ctx, keys, vals)
-			wg.Done()
+			defer wg.Done()
+			if errs[i] = limit.acquire(ctx); errs[i] != nil {
+				return
+			}
+			defer limit.release()
+			errs[i] = c.getMultiBudgeted(ctx, keys, vals)
 		}(i, keys[lo:hi], v.Slice(lo, hi))
 	}
 	wg.Wait()
@@ -92,7 +107,7 @@ func (c *Client) GetMulti(ctx context.Context,
 		return nil
 	}
 
-	return groupErrors(errs, len(keys), getMultiLimit)
+	return c.batchError(callerKeys, groupErrors(errs, len(keys), getMultiLimit))
 }
 
 // Get loads the entity stored for key into val, which must be a struct pointer.
@@ -111,6 +126,7 @@ func (c *Client) Get(ctx context.Context, key *datastore.Key, val interface{}) e
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Get")
 	defer span.End()
+	key = c.inNamespace(key)
 	// GetMulti catches nil interface; we need to catch nil ptr here.
 	if val == nil {
 		return datastore.ErrInvalidEntityType
@@ -123,7 +139,7 @@ func (c *Client) Get(ctx context.Context, key *datastore.Key, val interface{}) e
 		return err
 	}
 
-	err := c.getMulti(ctx, keys, v)
+	err := c.getMultiBudgeted(ctx, keys, v)
 	if me, ok := err.(datastore.MultiError); ok {
 		return me[0]
 	}
@@ -149,6 +165,10 @@ type cacheItem struct {
 	item *Item
 
 	state cacheState
+	// locked is set when the cache held a lock for the entity.
+	locked bool
+	// stale is set when the entity was served from its stale copy.
+	stale bool
 }
 
 // getMulti attempts to get entities from the cache, then the datastore. It also
@@ -160,73 +180,129 @@ type cacheItem struct {
 func (c *Client) getMulti(ctx context.Context,
 	keys []*datastore.Key, vals reflect.Value) error {
 
-	if c.cacher != nil {
-		num := len(keys)
-		cacheItems := make([]cacheItem, num)
-		for i, key := range keys {
-			cacheItems[i].key = key
-			cacheItems[i].cacheKey = createCacheKey(key)
-			cacheItems[i].val = vals.Index(i)
-			cacheItems[i].state = miss
-		}
+	if rc := requestCacheFrom(ctx); rc != nil {
+		return c.getMultiRequestCached(ctx, rc, keys, vals)
+	}
+	return c.getMultiUncached(ctx, keys, vals)
+}
 
-		c.loadCache(ctx, cacheItems)
-		if err := cacheStatsByKind(ctx, cacheItems); err != nil {
-			c.onError(ctx, errors.Wrapf(err, "nds:getMulti cacheStatsByKind"))
-		}
+// getMultiUncached is getMulti without the request cache.
+func (c *Client) getMultiUncached(ctx context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
 
-		c.lockCache(ctx, cacheItems)
+	if eventualFrom(ctx) {
+		return c.getMultiReadYourWrites(ctx, keys, vals)
+	}
+
+	if c.cacher != nil && c.sampleShadowRead() {
+		return c.shadowGetMulti(ctx, keys, vals)
+	}
 
-		if err := c.loadDatastore(ctx, cacheItems, vals.Type()); err != nil {
+	if c.cacher != nil && c.sampleCanary() {
+		defer c.checkCanary(ctx, keys)
+	}
+
+	if c.cacher != nil {
+		cacheItems := c.newCacheItems(keys, vals)
+
+		if err := c.loadCache(ctx, cacheItems); err != nil {
+			return err
+		}
+		if err := c.waitForLocks(ctx, cacheItems); err != nil {
 			return err
 		}
+		if err := cacheStatsByKind(ctx, cacheItems); err != nil {
+			c.onError(ctx, errors.Wrapf(err, "nds:getMulti cacheStatsByKind"))
+		}
+		c.recordCacheReads(cacheItems)
+		c.logLockedRead(ctx, cacheItems)
 
-		c.saveCache(ctx, cacheItems)
+		if c.breaker != nil && c.breaker.rejecting() {
+			// Don't lock keys the datastore won't be asked for.
+			if err := c.serveCacheOnly(cacheItems); err != nil {
+				return err
+			}
+		} else {
+			if err := c.lockCache(ctx, cacheItems); err != nil {
+				return err
+			}
 
-		me, errsNil := make(datastore.MultiError, len(cacheItems)), true
-		for i, cacheItem := range cacheItems {
-			if cacheItem.err != nil {
-				me[i] = cacheItem.err
-				errsNil = false
+			if err := c.loadDatastore(ctx, cacheItems, vals.Type()); err != nil {
+				return err
 			}
+
+			c.fillCache(ctx, cacheItems)
 		}
 
-		if errsNil {
-			return nil
+		reportCacheItemsProvenance(ctx, cacheItems, ProvenanceDatastore)
+		return cacheItemErrors(cacheItems)
+	}
+	c.recordDatastoreReads(keys)
+	err := c.guardDatastore(ctx, func() error {
+		return c.ds.GetMulti(ctx, keys, vals.Interface())
+	})
+	reportErrorsProvenance(ctx, keys, err, ProvenanceDatastore)
+	return err
+}
+
+// newCacheItems returns the cache items for a read of keys into vals.
+// Uncacheable entities start out as external locks so they are loaded from
+// the datastore without ever being looked up in, or saved to, the cache.
+func (c *Client) newCacheItems(keys []*datastore.Key, vals reflect.Value) []cacheItem {
+	cacheItems := make([]cacheItem, len(keys))
+	for i, key := range keys {
+		cacheItems[i].key = key
+		cacheItems[i].cacheKey = createCacheKey(c.keys, key)
+		cacheItems[i].val = vals.Index(i)
+		cacheItems[i].state = miss
+		if isUncacheable(cacheItems[i].val) {
+			cacheItems[i].state = externalLock
 		}
-		return me
 	}
-	return c.Client.GetMulti(ctx, keys, vals.Interface())
+	return cacheItems
 }
 
-// loadCache will return the # of cache hits
-func (c *Client) loadCache(ctx context.Context, cacheItems []cacheItem) {
+// loadCache sets the cache items that missed so far that are found in the
+// cache. It only returns an error if the cache failed and the read has to
+// fail with it.
+func (c *Client) loadCache(ctx context.Context, cacheItems []cacheItem) error {
 
-	cacheKeys := make([]string, len(cacheItems))
+	cacheKeys := make([]string, 0, len(cacheItems))
+	indexes := make([]int, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
-		cacheKeys[i] = cacheItem.cacheKey
+		if cacheItem.state == miss {
+			cacheKeys = append(cacheKeys, cacheItem.cacheKey)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(cacheKeys) == 0 {
+		return nil
 	}
 
 	items, err := c.cacher.GetMulti(ctx, cacheKeys)
 	if err != nil {
-		for i := range cacheItems {
+		if err := c.readCacheFailed(ctx, err, "nds:loadCache GetMulti"); err != nil {
+			return err
+		}
+		for _, i := range indexes {
 			cacheItems[i].state = externalLock
 		}
-		c.onError(ctx, errors.Wrapf(err, "nds:loadCache GetMulti"))
-		return
+		return nil
 	}
 
-	for i, cacheKey := range cacheKeys {
+	for j, cacheKey := range cacheKeys {
+		i := indexes[j]
 		if item, ok := items[cacheKey]; ok {
 			switch item.Flags {
 			case lockItem:
 				cacheItems[i].state = externalLock
+				cacheItems[i].locked = true
 			case noneItem:
 				cacheItems[i].state = done
 				cacheItems[i].err = datastore.ErrNoSuchEntity
 			case entityItem:
 				pl := datastore.PropertyList{}
-				if err := unmarshal(item.Value, &pl); err != nil {
+				if err := c.unmarshalEntity(item.Value, &pl); err != nil {
 					c.onError(ctx, errors.Wrapf(err, "nds:loadCache unmarshal"))
 					cacheItems[i].state = externalLock
 					break
@@ -243,25 +319,56 @@ func (c *Client) loadCache(ctx context.Context, cacheItems []cacheItem) {
 			}
 		}
 	}
+	return nil
 }
 
 // itemLock creates a pseudorandom cache lock value that enables each call of
 // Get/GetMulti to determine if a lock retrieved from the cache is the one it
 // created. This is only important when multiple calls of Get/GetMulti are
 // performed concurrently for the same previously uncached entity.
+//
+// The random part is followed by the time the lock was created, which
+// ClearStuckLocks uses to tell the age of a lock. The lowest bit of the random
+// part tells writer locks, set by writerLock, from the locks of reads.
 func itemLock() []byte {
-	b := make([]byte, 4)
+	return itemLockAt(time.Now())
+}
+
+func itemLockAt(t time.Time) []byte {
+	b := make([]byte, lockValueSize)
 	binary.LittleEndian.PutUint32(b, rand.Uint32())
+	binary.LittleEndian.PutUint64(b[4:], uint64(t.UnixNano()))
+	b[0] &^= writerLockBit
 	return b
 }
 
+// writerLockBit is set in the first byte of the values of writer locks.
+const writerLockBit = 1
+
+// writerLock is itemLock for the locks writes set while they change the
+// datastore. Unlike the lock of a read, another writer's lock is left in place
+// when a write removes its own, see unlockCache.
+func writerLock() []byte {
+	b := itemLock()
+	b[0] |= writerLockBit
+	return b
+}
+
+// isWriterLock reports whether item is a lock set by a write.
+func isWriterLock(item *Item) bool {
+	return item.Flags == lockItem && len(item.Value) == lockValueSize &&
+		item.Value[0]&writerLockBit != 0
+}
+
 func init() {
 	// Seed the pseudorandom number generator to reduce the chance of itemLock
 	// collisions.
 	rand.Seed(time.Now().UnixNano())
 }
 
-func (c *Client) lockCache(ctx context.Context, cacheItems []cacheItem) {
+// lockCache locks the cache items that missed the cache. It only returns an
+// error if the cache failed and the read has to fail with it.
+func (c *Client) lockCache(ctx context.Context, cacheItems []cacheItem) error {
 
 	lockItems := make([]*Item, 0, len(cacheItems))
 	lockCacheKeys := make([]string, 0, len(cacheItems))
@@ -291,13 +398,15 @@ func (c *Client) lockCache(ctx context.Context, cacheItems []cacheItem) {
 
 		// Cache failed so forget about it and just use the datastore.
 		if err != nil {
+			if err := c.readCacheFailed(ctx, err, "nds:lockCache GetMulti"); err != nil {
+				return err
+			}
 			for i, cacheItem := range cacheItems {
 				if cacheItem.state == miss {
 					cacheItems[i].state = externalLock
 				}
 			}
-			c.onError(ctx, errors.Wrap(err, "nds:lockCache GetMulti"))
-			return
+			return nil
 		}
 
 		// Cache worked so figure out what items we got.
@@ -317,7 +426,7 @@ func (c *Client) lockCache(ctx context.Context, cacheItems []cacheItem) {
 						cacheItems[i].err = datastore.ErrNoSuchEntity
 					case entityItem:
 						pl := datastore.PropertyList{}
-						if err := unmarshal(item.Value, &pl); err != nil {
+						if err := c.unmarshalEntity(item.Value, &pl); err != nil {
 							c.onError(ctx, errors.Wrap(err, "nds:lockCache unmarshal"))
 							cacheItems[i].state = externalLock
 							break
@@ -341,6 +450,7 @@ func (c *Client) lockCache(ctx context.Context, cacheItems []cacheItem) {
 			}
 		}
 	}
+	return nil
 }
 
 func (c *Client) loadDatastore(ctx context.Context, cacheItems []cacheItem,
@@ -359,21 +469,24 @@ func (c *Client) loadDatastore(ctx context.Context, cacheItems []cacheItem,
 		}
 	}
 
-	if getMultiHook != nil {
-		if err := getMultiHook(ctx, keys, vals); err != nil {
-			return err
-		}
-	}
-
 	if len(keys) == 0 {
+		if getMultiHook != nil {
+			return getMultiHook(ctx, keys, vals)
+		}
 		return nil
 	}
 
+	c.recordDatastoreReads(keys)
 	var me datastore.MultiError
-	if err := c.Client.GetMulti(ctx, keys, vals); err == nil {
+	if err := c.getDatastore(ctx, keys, vals); err == nil {
 		me = make(datastore.MultiError, len(keys))
 	} else if e, ok := err.(datastore.MultiError); ok {
 		me = e
+	} else if err == ErrCircuitOpen {
+		// The breaker opened after lockCache checked it.
+		return c.serveCacheOnly(cacheItems)
+	} else if c.serveStale && isBreakerFailure(err) {
+		return c.serveStaleCopies(ctx, cacheItems, err)
 	} else {
 		return err
 	}
@@ -384,25 +497,38 @@ func (c *Client) loadDatastore(ctx context.Context, cacheItems []cacheItem,
 			pl := vals[i]
 			val := cacheItems[index].val
 
+			var data []byte
 			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = entityItem
-				cacheItems[index].item.Expiration = 0
-				if data, err := marshal(pl); err == nil {
-					cacheItems[index].item.Value = data
-				} else {
+				var err error
+				if data, err = c.marshalEntity(cacheItems[index].key, pl); err != nil {
 					cacheItems[index].state = externalLock
-					c.onError(ctx, errors.Wrap(err, "nds:loadDatastore marshal"))
+					c.cacheSerializationFailed(ctx, cacheItems[index].key, err)
 				}
 			}
 
 			if err := setValue(val, pl, cacheItems[index].key); err != nil {
 				cacheItems[index].err = err
 			}
+
+			// A CacheTTLer only knows its TTL once it is loaded.
+			if cacheItems[index].state == internalLock {
+				exp, ok := c.capExpiration(c.entityExpiration(cacheItems[index].key), pl, val)
+				cacheItems[index].item.Flags = entityItem
+				cacheItems[index].item.Expiration = exp
+				cacheItems[index].item.Value = data
+				if !ok {
+					cacheItems[index].state = externalLock
+				}
+			}
 		case datastore.ErrNoSuchEntity:
 			if cacheItems[index].state == internalLock {
+				exp, ok := c.negativeExpiration(cacheItems[index].key)
 				cacheItems[index].item.Flags = noneItem
-				cacheItems[index].item.Expiration = 0
+				cacheItems[index].item.Expiration = exp
 				cacheItems[index].item.Value = []byte{}
+				if !ok {
+					cacheItems[index].state = externalLock
+				}
 			}
 			cacheItems[index].err = datastore.ErrNoSuchEntity
 		default:
@@ -413,6 +539,47 @@ func (c *Client) loadDatastore(ctx context.Context, cacheItems []cacheItem,
 	return nil
 }
 
+// getDatastore looks keys up in the datastore, sharing the lookup with other
+// calls if WithReadCoalesceWindow is used.
+func (c *Client) getDatastore(ctx context.Context, keys []*datastore.Key,
+	vals []datastore.PropertyList) error {
+
+	if c.coalescer == nil || !coalescable(keys) {
+		return c.guardDatastore(ctx, func() error {
+			if getMultiHook != nil {
+				if err := getMultiHook(ctx, keys, vals); err != nil {
+					return err
+				}
+			}
+			return c.hedgedGetMulti(ctx, keys, vals)
+		})
+	}
+	if getMultiHook != nil {
+		if err := getMultiHook(ctx, keys, vals); err != nil {
+			return err
+		}
+	}
+	return c.coalescer.get(ctx, keys, vals)
+}
+
+// serveCacheOnly is used instead of loadDatastore while the circuit breaker is
+// open. With ServeCacheWhenOpen the cache hits are served and every other key
+// fails with ErrCircuitOpen, otherwise the whole call fails unless every key
+// was a cache hit.
+func (c *Client) serveCacheOnly(cacheItems []cacheItem) error {
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == done {
+			continue
+		}
+		if !c.breaker.settings.ServeCacheWhenOpen {
+			return ErrCircuitOpen
+		}
+		cacheItems[i].state = externalLock
+		cacheItems[i].err = ErrCircuitOpen
+	}
+	return nil
+}
+
 func (c *Client) saveCache(ctx context.Context, cacheItems []cacheItem) {
 	saveItems := make([]*Item, 0, len(cacheItems))
 	for _, cacheItem := range cacheItems {
@@ -425,7 +592,11 @@ func (c *Client) saveCache(ctx context.Context, cacheItems []cacheItem) {
 		return
 	}
 
-	if err := c.cacher.CompareAndSwapMulti(ctx, saveItems); err != nil {
+	err := c.cacher.CompareAndSwapMulti(ctx, saveItems)
+	if err != nil {
 		c.onError(ctx, errors.Wrap(err, "nds:saveCache CompareAndSwapMulti"))
 	}
+	if c.serveStale {
+		c.saveStale(ctx, cacheItems, err)
+	}
 }
@@ -1,13 +1,19 @@
 package nds_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/datastore"
 
@@ -43,6 +49,15 @@ func TestGetSuite(t *testing.T) {
 			t.Run("TestGetMultiFieldMismatch", GetMultiFieldMismatchTest(item.ctx, item.cacher))
 			t.Run("TestGetMultiExpiredContext", GetMultiExpiredContextTest(item.ctx, item.cacher))
 			t.Run("TestPropertyLoadSaverModification", PropertyLoadSaverModificationTest(item.ctx, item.cacher))
+			t.Run("TestGetMultiMaxInFlightBytes", GetMultiMaxInFlightBytesTest(item.ctx, item.cacher))
+			t.Run("TestGetMultiMaxInFlightBytesNilValue", GetMultiMaxInFlightBytesNilValueTest(item.ctx, item.cacher))
+			t.Run("TestGetMultiAsyncCacheFill", GetMultiAsyncCacheFillTest(item.ctx, item.cacher))
+			t.Run("TestGetLockWait", GetLockWaitTest(item.ctx, item.cacher))
+			t.Run("TestGetImmutableKinds", GetImmutableKindsTest(item.ctx, item.cacher))
+			t.Run("TestGetProperties", GetPropertiesTest(item.ctx, item.cacher))
+			t.Run("TestRewarmKeys", RewarmKeysTest(item.ctx, item.cacher))
+			t.Run("TestGetRequestCache", GetRequestCacheTest(item.ctx, item.cacher))
+			t.Run("TestGetMultiAlignment", GetMultiAlignmentTest(item.ctx, item.cacher))
 		})
 	}
 }
@@ -1605,6 +1620,29 @@ func KeyLoaderTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
 		if entities[0].I != 23 || entities[0].Key3 != keys[0].ID*3 {
 			t.Fatal("expected another value")
 		}
+
+		// Entities served from the cache and the request cache are given
+		// their key too.
+		var loaded []*datastore.Key
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			loaded = append(loaded, keys...)
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+		requestCtx := nds.WithRequestCache(ctx)
+		for _, ctx := range []context.Context{ctx, requestCtx, requestCtx} {
+			entity := &keyLoaderTest{}
+			if err := ndsClient.Get(ctx, keys[0], entity); err != nil {
+				t.Fatal(err)
+			}
+			if entity.I != 23 || entity.Key3 != keys[0].ID*3 {
+				t.Fatalf("expected the key loaded, got %+v", entity)
+			}
+		}
+		if len(loaded) != 0 {
+			t.Fatalf("expected cache hits, loaded %v", loaded)
+		}
 	}
 }
 
@@ -1764,3 +1802,678 @@ func PropertyLoadSaverModificationTest(ctx context.Context, cacher nds.Cacher) f
 		}
 	}
 }
+
+func GetMultiMaxInFlightBytesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			Payload []byte `datastore:",noindex"`
+		}
+
+		// Two shards of roughly 4MB each with room for only one at a time.
+		const (
+			count       = 1500
+			payloadSize = 4 << 10
+		)
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithMaxInFlightBytes(3<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make([]*datastore.Key, count)
+		entities := make([]testEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey("GetMultiMaxInFlightBytesTest", strconv.Itoa(i), nil)
+			entities[i] = testEntity{bytes.Repeat([]byte{byte(i)}, payloadSize)}
+		}
+
+		// The put teaches the client how large the entities are.
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, keys)
+
+		var (
+			mu          sync.Mutex
+			inFlight    int
+			maxInFlight int
+		)
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) == 0 {
+				return nil
+			}
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		got := make([]testEntity, count)
+		if err := ndsClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		if maxInFlight != 1 {
+			t.Fatalf("expected 1 shard in flight at a time, got %d", maxInFlight)
+		}
+		for i := range got {
+			if !bytes.Equal(got[i].Payload, entities[i].Payload) {
+				t.Fatalf("entity %d payload mismatch", i)
+			}
+		}
+	}
+}
+
+func GetMultiMaxInFlightBytesNilValueTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		plainClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		budgetClient, err := NewClient(ctx, cacher, t, nil, nds.WithMaxInFlightBytes(1<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A nil value fails the call the same way with or without the
+		// budget, instead of panicking while it is sized.
+		key := datastore.NameKey("GetMultiMaxInFlightBytesNilValueTest", "one", nil)
+		want := plainClient.GetMulti(ctx, []*datastore.Key{key}, []interface{}{nil})
+		if want == nil {
+			t.Fatal("expected an error for a nil value")
+		}
+		got := budgetClient.GetMulti(ctx, []*datastore.Key{key}, []interface{}{nil})
+		if got == nil || got.Error() != want.Error() {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func GetMultiAsyncCacheFillTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		release := make(chan struct{})
+		filled := make(chan error, 1)
+		testCacher := &mockCacher{
+			cacher: cacher,
+			compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+				<-release
+				err := cacher.CompareAndSwapMulti(ctx, items)
+				filled <- err
+				return err
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil, nds.WithAsyncCacheFill(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+		key := datastore.NameKey("GetMultiAsyncCacheFillTest", "one", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{42}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, key)
+
+		// The read must return while the cache write is still blocked.
+		readCtx, cancel := context.WithCancel(ctx)
+		got := &testEntity{}
+		err = ndsClient.Get(readCtx, key, got)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Value != 42 {
+			t.Fatalf("expected 42, got %d", got.Value)
+		}
+		select {
+		case err := <-filled:
+			t.Fatalf("expected the cache write to be pending, got %v", err)
+		default:
+		}
+
+		// Canceling the read doesn't cancel the cache write.
+		close(release)
+		select {
+		case err := <-filled:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the cache write")
+		}
+
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				return errors.New("should not be called")
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+		cached := &testEntity{}
+		if err := ndsClient.Get(ctx, key, cached); err != nil {
+			t.Fatal(err)
+		}
+		if cached.Value != 42 {
+			t.Fatalf("expected cached 42, got %d", cached.Value)
+		}
+	}
+}
+
+func GetLockWaitTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			Value int
+		}
+
+		key := datastore.NameKey("GetLockWaitTest", "one", nil)
+		write := func(ndsClient *nds.Client, value int, delay time.Duration) {
+			// Hold the lock like a Put does while it writes to the datastore.
+			lockKey := ndsClient.LockKey(key)
+			if err := cacher.SetMulti(ctx, []*nds.Item{{
+				Key:        lockKey,
+				Flags:      nds.LockItem,
+				Value:      []byte{1, 2, 3, 4},
+				Expiration: time.Minute,
+			}}); err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				time.Sleep(delay)
+				if _, err := ndsClient.Client.Put(ctx, key, &testEntity{value}); err != nil {
+					t.Error(err)
+				}
+				cacher.DeleteMulti(ctx, []string{lockKey})
+			}()
+		}
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, key)
+
+		// By default the reader doesn't wait for the write.
+		write(ndsClient, 2, 100*time.Millisecond)
+		got := &testEntity{}
+		if err := ndsClient.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Value != 1 {
+			t.Fatalf("expected the old value 1, got %d", got.Value)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		waitClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithLockWait(5*time.Second, 5*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		const delay = 50 * time.Millisecond
+		write(waitClient, 3, delay)
+		start := time.Now()
+		got = &testEntity{}
+		if err := waitClient.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Fatalf("expected the read to wait at least %v, took %v", delay, elapsed)
+		}
+		if got.Value != 3 {
+			t.Fatalf("expected the fresh value 3, got %d", got.Value)
+		}
+	}
+}
+
+func GetImmutableKindsTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var expirations []time.Duration
+		testCacher := &mockCacher{
+			cacher: cacher,
+			compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+				for _, item := range items {
+					expirations = append(expirations, item.Expiration)
+				}
+				return cacher.CompareAndSwapMulti(ctx, items)
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil,
+			nds.WithCacheTTL(time.Minute), nds.WithImmutableKinds([]string{"GetImmutableKindsTest"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+		written := datastore.NameKey("GetImmutableKindsTest", "written", nil)
+		if _, err := ndsClient.Put(ctx, written, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, written)
+		loaded := datastore.NameKey("GetImmutableKindsTest", "loaded", nil)
+		if _, err := ndsClient.Client.Put(ctx, loaded, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, loaded)
+
+		// The first load of an entity that bypassed nds is cached for good.
+		if err := ndsClient.Get(ctx, loaded, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if len(expirations) != 1 || expirations[0] != 0 {
+			t.Fatalf("expected one cached entity without expiry, got %v", expirations)
+		}
+
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				return errors.New("should not be called")
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		for i := 0; i < 3; i++ {
+			got := make([]testEntity, 2)
+			if err := ndsClient.GetMulti(ctx, []*datastore.Key{written, loaded}, got); err != nil {
+				t.Fatal(err)
+			}
+			if got[0].Value != 1 || got[1].Value != 2 {
+				t.Fatalf("expected [1 2], got %v", got)
+			}
+		}
+	}
+}
+
+func GetPropertiesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Name  string
+			Count int64
+			Ratio float64
+			OK    bool
+			Tags  []string
+		}
+		keys := []*datastore.Key{
+			datastore.NameKey("GetPropertiesTest", "struct", nil),
+			datastore.NameKey("GetPropertiesTest", "properties", nil),
+		}
+		if _, err := ndsClient.Put(ctx, keys[0], &testEntity{"one", 1, 0.5, true, []string{"a", "b"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ndsClient.Put(ctx, keys[1], &datastore.PropertyList{
+			{Name: "Other", Value: "two"},
+			{Name: "Count", Value: int64(2)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, keys)
+
+		want := []map[string]interface{}{
+			{"Name": "one", "Count": int64(1), "Ratio": 0.5, "OK": true,
+				"Tags": []interface{}{"a", "b"}},
+			{"Other": "two", "Count": int64(2)},
+		}
+		check := func(pls []datastore.PropertyList, want []map[string]interface{}) {
+			t.Helper()
+			for i, pl := range pls {
+				got := make(map[string]interface{}, len(pl))
+				for _, p := range pl {
+					got[p.Name] = p.Value
+				}
+				if !reflect.DeepEqual(got, want[i]) {
+					t.Fatalf("expected %v, got %v", want[i], got)
+				}
+			}
+		}
+
+		// The first read loads from the datastore, the second one from the
+		// cache.
+		for i := 0; i < 2; i++ {
+			if i == 1 {
+				nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+					keys []*datastore.Key, vals interface{}) error {
+					if len(keys) != 0 {
+						return errors.New("should not be called")
+					}
+					return nil
+				})
+			}
+			pls, err := ndsClient.GetPropertiesMulti(ctx, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(pls, want)
+		}
+		pl, err := ndsClient.GetProperties(ctx, keys[1])
+		nds.SetDatastoreGetMultiHook(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check([]datastore.PropertyList{pl}, want[1:])
+
+		missing := datastore.NameKey("GetPropertiesTest", "missing", nil)
+		if _, err := ndsClient.GetProperties(ctx, missing); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+		}
+	}
+}
+
+func RewarmKeysTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			Value int
+		}
+
+		// Two chunks, with every other entity missing.
+		const count = 1500
+		keys := make([]*datastore.Key, count)
+		putKeys := make([]*datastore.Key, 0, count/2)
+		entities := make([]testEntity, 0, count/2)
+		for i := range keys {
+			keys[i] = datastore.IDKey("RewarmKeysTest", int64(i+1), nil)
+			if i%2 == 0 {
+				putKeys = append(putKeys, keys[i])
+				entities = append(entities, testEntity{i})
+			}
+		}
+
+		oldClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := oldClient.PutMulti(ctx, putKeys, entities); err != nil {
+			t.Fatal(err)
+		}
+		defer oldClient.DeleteMulti(ctx, putKeys)
+
+		// A new cache key scheme starts with a cold cache.
+		newClient, err := NewClient(ctx, cacher, t, nil, nds.WithDatabaseID("RewarmKeysTest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer newClient.DeleteMulti(ctx, putKeys)
+
+		var reads int64
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				atomic.AddInt64(&reads, 1)
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		if err := newClient.RewarmKeys(ctx, keys); err != nil {
+			t.Fatal(err)
+		}
+		if reads != 2 {
+			t.Fatalf("expected 2 datastore reads, got %d", reads)
+		}
+
+		// Everything is cached now.
+		if err := newClient.RewarmKeys(ctx, keys); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]testEntity, count)
+		err = newClient.GetMulti(ctx, keys, got)
+		if reads != 2 {
+			t.Fatalf("expected no more datastore reads, got %d", reads-2)
+		}
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected a datastore.MultiError, got %v", err)
+		}
+		for i := range keys {
+			if i%2 == 0 && (me[i] != nil || got[i].Value != i) {
+				t.Fatalf("expected %d at %d, got %d and %v", i, i, got[i].Value, me[i])
+			} else if i%2 == 1 && me[i] != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected %v at %d, got %v", datastore.ErrNoSuchEntity, i, me[i])
+			}
+		}
+	}
+}
+
+func GetRequestCacheTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var cacheGets, datastoreGets int
+		testCacher := &mockCacher{
+			cacher: cacher,
+			getMultiHook: func(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
+				cacheGets++
+				return cacher.GetMulti(ctx, keys)
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				datastoreGets++
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		type testEntity struct {
+			Value int
+		}
+		key := datastore.NameKey("GetRequestCacheTest", "one", nil)
+		missing := datastore.NameKey("GetRequestCacheTest", "missing", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, key)
+
+		reqCtx := nds.WithRequestCache(ctx)
+		get := func() int {
+			t.Helper()
+			got := make([]testEntity, 2)
+			err := ndsClient.GetMulti(reqCtx, []*datastore.Key{key, missing}, got)
+			if me, ok := err.(datastore.MultiError); !ok || me[0] != nil ||
+				me[1] != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected [<nil> %v], got %v", datastore.ErrNoSuchEntity, err)
+			}
+			return got[0].Value
+		}
+
+		if v := get(); v != 1 {
+			t.Fatalf("expected 1, got %d", v)
+		}
+		if datastoreGets != 1 {
+			t.Fatalf("expected 1 datastore read, got %d", datastoreGets)
+		}
+		cacheGets, datastoreGets = 0, 0
+		got := &testEntity{}
+		if err := ndsClient.Get(reqCtx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if v := get(); v != 1 || got.Value != 1 {
+			t.Fatalf("expected 1, got %d and %d", v, got.Value)
+		}
+		if cacheGets != 0 || datastoreGets != 0 {
+			t.Fatalf("expected the request cache to be used, got %d cache and %d datastore reads",
+				cacheGets, datastoreGets)
+		}
+
+		// A write within the request is seen by the next read.
+		if _, err := ndsClient.Put(reqCtx, key, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		if v := get(); v != 2 {
+			t.Fatalf("expected 2 after the put, got %d", v)
+		}
+		if datastoreGets != 1 {
+			t.Fatalf("expected the put entity to be read again, got %d datastore reads", datastoreGets)
+		}
+
+		// Other contexts don't use the request cache.
+		cacheGets = 0
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if cacheGets == 0 {
+			t.Fatal("expected a cache read without the request cache")
+		}
+	}
+}
+
+// GetMultiAlignmentTest checks that every value lands at the index of its key
+// however the keys are spread over shards, cache hits, locked keys, missing
+// entities and duplicates, and whichever shard finishes first.
+func GetMultiAlignmentTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// Duplicates and locked keys lose the race to lock their slot.
+		logOKTest := func(err error) bool {
+			return strings.Contains(err.Error(), nds.ErrNotStored.Error()) ||
+				strings.Contains(err.Error(), nds.ErrCASConflict.Error())
+		}
+		ndsClient, err := NewClient(ctx, cacher, t, logOKTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			ID int64
+		}
+
+		// Enough keys for four shards. Every seventh one is never stored.
+		const keyCount = 3500
+		kind := fmt.Sprintf("GetMultiAlignmentTest%d", time.Now().UnixNano())
+		var stored []*datastore.Key
+		var entities []testEntity
+		for id := int64(1); id <= keyCount; id++ {
+			if id%7 != 0 {
+				stored = append(stored, datastore.IDKey(kind, id, nil))
+				entities = append(entities, testEntity{id})
+			}
+		}
+		if _, err := ndsClient.PutMulti(ctx, stored, entities); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, stored)
+
+		seed := time.Now().UnixNano()
+		t.Logf("seed %d", seed)
+		r := rand.New(rand.NewSource(seed))
+		var mu sync.Mutex
+		sleep := func() time.Duration {
+			mu.Lock()
+			defer mu.Unlock()
+			return time.Duration(r.Intn(5)) * time.Millisecond
+		}
+
+		// Let shards finish in any order.
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			time.Sleep(sleep())
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		for round := 0; round < 3; round++ {
+			// Shuffle the keys, with some repeated.
+			keys := make([]*datastore.Key, 0, keyCount+keyCount/10)
+			for _, id := range r.Perm(keyCount) {
+				keys = append(keys, datastore.IDKey(kind, int64(id+1), nil))
+			}
+			for i := 0; i < keyCount/10; i++ {
+				keys = append(keys, keys[r.Intn(keyCount)])
+			}
+
+			// Cache a random half and lock a random tenth of the keys.
+			var warm []*datastore.Key
+			var locks []*nds.Item
+			for _, key := range keys {
+				switch n := r.Intn(10); {
+				case n < 5:
+					warm = append(warm, key)
+				case n == 5:
+					locks = append(locks, &nds.Item{
+						Key:        ndsClient.CacheKey(key),
+						Flags:      nds.LockItem,
+						Value:      []byte{1, 2, 3, 4},
+						Expiration: time.Minute,
+					})
+				}
+			}
+			if err := ndsClient.GetMulti(ctx, warm, make([]testEntity, len(warm))); err != nil {
+				if _, ok := err.(datastore.MultiError); !ok {
+					t.Fatal(err)
+				}
+			}
+			if err := cacher.SetMulti(ctx, locks); err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(err error, id func(i int) int64) {
+				t.Helper()
+				me, ok := err.(datastore.MultiError)
+				if !ok {
+					t.Fatalf("expected a datastore.MultiError, got %v", err)
+				}
+				for i, key := range keys {
+					if key.ID%7 == 0 {
+						if me[i] != datastore.ErrNoSuchEntity {
+							t.Fatalf("round %d: expected %v missing, got %v", round, key, me[i])
+						}
+						continue
+					}
+					if me[i] != nil {
+						t.Fatalf("round %d: unexpected error for %v: %v", round, key, me[i])
+					}
+					if got := id(i); got != key.ID {
+						t.Fatalf("round %d: expected ID %d at index %d, got %d",
+							round, key.ID, i, got)
+					}
+				}
+			}
+
+			vals := make([]testEntity, len(keys))
+			err := ndsClient.GetMulti(ctx, keys, vals,
+				nds.WithConcurrency(1+r.Intn(4)))
+			check(err, func(i int) int64 { return vals[i].ID })
+
+			ptrs := make([]interface{}, len(keys))
+			for i := range ptrs {
+				ptrs[i] = &testEntity{}
+			}
+			err = ndsClient.GetMulti(ctx, keys, ptrs)
+			check(err, func(i int) int64 { return ptrs[i].(*testEntity).ID })
+
+			lockKeys := make([]string, len(locks))
+			for i, lock := range locks {
+				lockKeys[i] = lock.Key
+			}
+			if err := cacher.DeleteMulti(ctx, lockKeys); err != nil {
+				if _, ok := err.(nds.MultiError); !ok {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package nds
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WithReadHedgeDelay makes the datastore lookups of Get and GetMulti that
+// haven't returned after delay be sent a second time, using whichever of the
+// two returns first and canceling the other. Lookups are idempotent, so this
+// trades some extra datastore calls for a shorter tail latency when a call is
+// slow. A lookup that fails outright while its hedge is in flight waits for
+// the hedge instead. Only the lookups of entities missed in the cache are
+// hedged; reads made without a Cacher and cache calls never are. A delay of 0
+// or less disables hedging, which is the default.
+func WithReadHedgeDelay(delay time.Duration) ClientOption {
+	return func(c *Client) {
+		c.readHedgeDelay = delay
+	}
+}
+
+// hedgedRead is the outcome of one of the lookups made by hedgedGetMulti.
+type hedgedRead struct {
+	vals []datastore.PropertyList
+	err  error
+}
+
+// hedgedGetMulti loads keys into vals like the datastore's GetMulti, sending
+// the lookup again if it is slower than the hedge delay.
+func (c *Client) hedgedGetMulti(ctx context.Context, keys []*datastore.Key,
+	vals []datastore.PropertyList) error {
+	if c.readHedgeDelay <= 0 {
+		return c.ds.GetMulti(ctx, keys, vals)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	// Canceling ctx stops the lookup that lost.
+	defer cancel()
+
+	// Each lookup loads into its own vals as the loser may still be writing
+	// to them after the winner has returned.
+	results := make(chan hedgedRead, 2)
+	read := func() {
+		r := hedgedRead{vals: make([]datastore.PropertyList, len(vals))}
+		r.err = c.ds.GetMulti(ctx, keys, r.vals)
+		results <- r
+	}
+	go read()
+
+	timer := time.NewTimer(c.readHedgeDelay)
+	defer timer.Stop()
+	pending := 1
+	var r hedgedRead
+	for {
+		select {
+		case <-timer.C:
+			go read()
+			pending++
+			continue
+		case r = <-results:
+			pending--
+		}
+		if _, ok := r.err.(datastore.MultiError); r.err == nil || ok || pending == 0 {
+			break
+		}
+	}
+	copy(vals, r.vals)
+	return r.err
+}
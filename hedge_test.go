@@ -0,0 +1,102 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestReadHedgeSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestReadHedge", ReadHedgeTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+// slowFirstDatastore makes its first GetMulti hang until canceled.
+type slowFirstDatastore struct {
+	*datastore.Client
+	calls, canceled int32
+}
+
+func (s *slowFirstDatastore) GetMulti(ctx context.Context, keys []*datastore.Key,
+	dst interface{}) error {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		select {
+		case <-ctx.Done():
+			atomic.AddInt32(&s.canceled, 1)
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+	return s.Client.GetMulti(ctx, keys, dst)
+}
+
+func ReadHedgeTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &slowFirstDatastore{Client: dsClient}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient), nds.WithDatastore(ds),
+			nds.WithReadHedgeDelay(10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("ReadHedgeTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "one", nil),
+			datastore.NameKey(kind, "missing", nil),
+		}
+		if _, err := ndsClient.Put(ctx, keys[0], &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		got := make([]testEntity, len(keys))
+		err = ndsClient.GetMulti(ctx, keys, got)
+		if me, ok := err.(datastore.MultiError); !ok || me[0] != nil ||
+			me[1] != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected only the missing key to fail, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("expected the hedge to answer, took %v", elapsed)
+		}
+		if got[0].IntVal != 1 {
+			t.Fatalf("expected the hedge's entity, got %+v", got[0])
+		}
+		if calls := atomic.LoadInt32(&ds.calls); calls != 2 {
+			t.Fatalf("expected 2 lookups, got %d", calls)
+		}
+		// The slow lookup is canceled once the hedge has won.
+		for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&ds.canceled) != 1; {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the slow lookup to be canceled")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// The hedge's entity was cached.
+		got = make([]testEntity, 1)
+		if err := ndsClient.GetMulti(ctx, keys[:1], got); err != nil {
+			t.Fatal(err)
+		}
+		if calls := atomic.LoadInt32(&ds.calls); calls != 2 {
+			t.Fatalf("expected a cache hit, got %d lookups", calls)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+// WithImmutableKinds marks kinds whose entities are written once and never
+// changed, such as content addressed blobs. Put and PutMulti cache entities
+// of these kinds as soon as they are written, without locking the cache
+// first, and entities of these kinds are cached without expiry regardless of
+// WithCacheTTL, so Get and GetMulti trust the cache indefinitely.
+//
+// Only use it for kinds that are provably immutable. Overwriting an entity of
+// an immutable kind through nds leaves readers on other instances with the
+// old entity until it is evicted, and writes that bypass nds are never seen
+// while the entity stays cached. Missing entities are still cached with the
+// normal expiration so they show up once written.
+func WithImmutableKinds(kinds []string) ClientOption {
+	return func(c *Client) {
+		c.immutableKinds = make(map[string]bool, len(kinds))
+		for _, kind := range kinds {
+			c.immutableKinds[kind] = true
+		}
+	}
+}
+
+func (c *Client) immutable(key *datastore.Key) bool {
+	return key != nil && c.immutableKinds[key.Kind]
+}
+
+// entityExpiration returns the expiration to use for the cached entity of key.
+func (c *Client) entityExpiration(key *datastore.Key) time.Duration {
+	if c.immutable(key) {
+		return 0
+	}
+	return c.valueExpiration()
+}
+
+// splitImmutable returns the keys that need cache locks and the indexes of
+// the keys of immutable kinds.
+func (c *Client) splitImmutable(keys []*datastore.Key) ([]*datastore.Key, []int) {
+	if len(c.immutableKinds) == 0 {
+		return keys, nil
+	}
+	mutable := make([]*datastore.Key, 0, len(keys))
+	var immutable []int
+	for i, key := range keys {
+		if c.immutable(key) {
+			immutable = append(immutable, i)
+			continue
+		}
+		mutable = append(mutable, key)
+	}
+	return mutable, immutable
+}
+
+// cacheImmutable caches the just written entities at indexes. Any entity
+// that can't be cached, or is uncacheable, is evicted instead so no missing
+// entity stays cached.
+func (c *Client) cacheImmutable(ctx context.Context, keys []*datastore.Key,
+	vals reflect.Value, indexes []int) {
+
+	items := make([]*Item, 0, len(indexes))
+	var evict []string
+	for _, i := range indexes {
+		cacheKey := createCacheKey(c.keys, keys[i])
+		if isUncacheable(vals.Index(i)) {
+			evict = append(evict, cacheKey)
+			continue
+		}
+		pl, err := saveValue(vals.Index(i))
+		if err == nil {
+			exp, ok := c.capExpiration(0, pl, vals.Index(i))
+			if !ok {
+				evict = append(evict, cacheKey)
+				continue
+			}
+			var data []byte
+			if data, err = c.marshalEntity(keys[i], roundTripPropertyList(pl)); err == nil {
+				items = append(items, &Item{
+					Key:        cacheKey,
+					Flags:      entityItem,
+					Value:      data,
+					Expiration: exp,
+				})
+				continue
+			}
+		}
+		c.cacheSerializationFailed(ctx, keys[i], err)
+		evict = append(evict, cacheKey)
+	}
+
+	if err := c.cacher.SetMulti(ctx, items); err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:cacheImmutable SetMulti"))
+		for _, item := range items {
+			evict = append(evict, item.Key)
+		}
+	}
+	if len(evict) == 0 {
+		return
+	}
+	c.invalidateCache(ctx, evict, "nds:cacheImmutable DeleteMulti")
+}
@@ -0,0 +1,250 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WithMaxInFlightBytes bounds the approximate encoded size of the entities
+// being put and got concurrently by Put, PutMulti, Get and GetMulti. Each call
+// or shard is only admitted once the budget has room for it, so memory use
+// stays bounded however large the individual entities are. A shard larger than
+// n on its own is admitted once nothing else is in flight.
+//
+// Put shards are charged the size of their entities. The size of entities
+// being got isn't known until they are loaded, so Get shards are charged the
+// average entity size seen so far. Once loaded, a sample of their entities
+// updates the average for the shards that follow; a shard isn't charged more
+// if its estimate was low. DeleteMulti only sends keys and is not throttled.
+// A value of 0 or less disables the guard, which is the default.
+func WithMaxInFlightBytes(n int64) ClientOption {
+	return func(c *Client) {
+		if n <= 0 {
+			c.inFlight = nil
+			return
+		}
+		c.inFlight = newByteBudget(n)
+	}
+}
+
+// byteBudget is a weighted semaphore counted in bytes.
+type byteBudget struct {
+	max int64
+
+	sync.Mutex
+	used int64
+	// released is closed and replaced every time bytes are released to wake
+	// up waiting acquirers.
+	released chan struct{}
+
+	// entityBytes and entities track the average entity size seen so far to
+	// estimate the size of entities before they are loaded.
+	entityBytes, entities int64
+}
+
+// defaultEntitySize is the entity size estimate used before any entity size
+// has been observed.
+const defaultEntitySize = 1 << 10
+
+// budgetLease is the part of a byteBudget held by one call. A nil lease is a
+// no-op so callers don't need to check whether a budget is configured.
+type budgetLease struct {
+	b *byteBudget
+	n int64
+}
+
+func newByteBudget(max int64) *byteBudget {
+	return &byteBudget{
+		max:      max,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire blocks until n bytes are available or ctx is done. The returned
+// lease must be released. A nil budget returns a nil lease.
+func (b *byteBudget) acquire(ctx context.Context, n int64) (*budgetLease, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if n > b.max {
+		n = b.max
+	}
+	for {
+		b.Lock()
+		if b.used+n <= b.max {
+			b.used += n
+			b.Unlock()
+			return &budgetLease{b: b, n: n}, nil
+		}
+		released := b.released
+		b.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// estimate returns the estimated size of count entities.
+func (b *byteBudget) estimate(count int) int64 {
+	if b == nil {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.entities == 0 {
+		return int64(count) * defaultEntitySize
+	}
+	return int64(count) * (b.entityBytes / b.entities)
+}
+
+// observe records the size of count entities for future estimates.
+func (b *byteBudget) observe(size int64, count int) {
+	if b == nil || count == 0 {
+		return
+	}
+	b.Lock()
+	b.entityBytes += size
+	b.entities += int64(count)
+	b.Unlock()
+}
+
+func (l *budgetLease) release() {
+	if l == nil {
+		return
+	}
+	l.b.Lock()
+	l.b.used -= l.n
+	close(l.b.released)
+	l.b.released = make(chan struct{})
+	l.b.Unlock()
+}
+
+// getMultiBudgeted runs getMulti within the client's byte budget.
+func (c *Client) getMultiBudgeted(ctx context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+	if c.inFlight == nil {
+		return c.getMulti(ctx, keys, vals)
+	}
+
+	lease, err := c.inFlight.acquire(ctx, c.inFlight.estimate(len(keys)))
+	if err != nil {
+		return err
+	}
+	defer lease.release()
+
+	err = c.getMulti(ctx, keys, vals)
+	c.inFlight.observe(sampleEntitiesSize(keys, vals, sizeSamples))
+	return err
+}
+
+// sizeSamples is how many of the entities of a Get shard are measured to
+// update the average entity size, as measuring an entity encodes it again.
+const sizeSamples = 16
+
+// sampleEntitiesSize returns the approximate encoded size of up to n of the
+// entities in vals, spread evenly over them, and how many it measured.
+func sampleEntitiesSize(keys []*datastore.Key, vals reflect.Value, n int) (int64, int) {
+	step := 1
+	if len(keys) > n {
+		step = len(keys) / n
+	}
+	var size int64
+	count := 0
+	for i := 0; i < len(keys) && count < n; i += step {
+		size += approxEntitiesSize(keys[i:i+1], vals.Slice(i, i+1))
+		count++
+	}
+	return size, count
+}
+
+// putMultiBudgeted runs putMulti within the client's byte budget. vals is a
+// chunk sliced from the caller's slice with reflect.Value.Slice, so turning it
+// back into an interface{} for the datastore copies neither the slice nor the
+// entities, whatever their type; BenchmarkPutMultiPointers keeps an eye on it.
+func (c *Client) putMultiBudgeted(ctx context.Context,
+	keys []*datastore.Key, vals reflect.Value) ([]*datastore.Key, error) {
+	if c.inFlight == nil {
+		return c.putMulti(ctx, keys, vals.Interface())
+	}
+
+	size := approxEntitiesSize(keys, vals)
+	c.inFlight.observe(size, len(keys))
+	lease, err := c.inFlight.acquire(ctx, size)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.release()
+	return c.putMulti(ctx, keys, vals.Interface())
+}
+
+// approxEntitiesSize returns the approximate encoded size of the entities in
+// vals. Entities that can't be saved, such as nil pointers left by a failed
+// get or nil elements the call itself will reject, are counted as empty.
+func approxEntitiesSize(keys []*datastore.Key, vals reflect.Value) int64 {
+	var size int64
+	for i, key := range keys {
+		if key != nil {
+			size += int64(len(key.String()))
+		}
+		val := vals.Index(i)
+		if val.Kind() == reflect.Interface {
+			val = val.Elem()
+		}
+		if !val.IsValid() || val.Kind() == reflect.Ptr && val.IsNil() {
+			continue
+		}
+		pl, err := saveValue(val)
+		if err != nil {
+			continue
+		}
+		size += approxPropertyListSize(pl)
+	}
+	return size
+}
+
+func approxPropertyListSize(pl datastore.PropertyList) int64 {
+	var size int64
+	for _, p := range pl {
+		size += int64(len(p.Name)) + approxValueSize(p.Value)
+	}
+	return size
+}
+
+func approxValueSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case *datastore.Key:
+		return int64(len(v.String()))
+	case *datastore.Entity:
+		if v == nil {
+			return 0
+		}
+		size := approxPropertyListSize(v.Properties)
+		if v.Key != nil {
+			size += int64(len(v.Key.String()))
+		}
+		return size
+	case []interface{}:
+		var size int64
+		for _, e := range v {
+			size += approxValueSize(e)
+		}
+		return size
+	case datastore.GeoPoint:
+		return 16
+	case time.Time:
+		return 8
+	}
+	// Integers, floats, booleans and nil.
+	return 8
+}
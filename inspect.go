@@ -0,0 +1,121 @@
+package nds
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// CacheState is the state of a key's cache slot as reported by Inspect.
+type CacheState int
+
+const (
+	// CacheAbsent means nothing is cached for the key, so the next read
+	// loads it from the datastore.
+	CacheAbsent CacheState = iota
+	// CacheLocked means the key is locked by a write, or by a read about to
+	// fill the cache, so reads load it from the datastore.
+	CacheLocked
+	// CacheEntity means an entity is cached for the key.
+	CacheEntity
+	// CacheMissing means the key is cached as having no entity, so reads
+	// return datastore.ErrNoSuchEntity without reading the datastore.
+	CacheMissing
+)
+
+func (s CacheState) String() string {
+	switch s {
+	case CacheAbsent:
+		return "absent"
+	case CacheLocked:
+		return "locked"
+	case CacheEntity:
+		return "entity"
+	case CacheMissing:
+		return "missing"
+	}
+	return "unknown"
+}
+
+// KeyReport is the state of a single key in the cache and in the datastore,
+// as returned by Inspect.
+type KeyReport struct {
+	Key *datastore.Key
+	// CacheKey is the key of the cache slot for Key, as returned by
+	// Client.CacheKey, for looking it up with other cache tooling.
+	CacheKey   string
+	CacheState CacheState
+	// Cached is the cached entity if CacheState is CacheEntity and it could
+	// be decoded. CachedErr is the error decoding it otherwise.
+	Cached    datastore.PropertyList
+	CachedErr error
+	// Stored is the entity in the datastore and Exists reports whether there
+	// is one.
+	Stored datastore.PropertyList
+	Exists bool
+	// Match reports whether a read would return what the datastore holds:
+	// the cached entity equals the stored one, a key cached as missing has
+	// no entity, or nothing usable is cached for the key.
+	Match bool
+}
+
+// Inspect reports the state of key in the cache and in the datastore, for
+// triaging why a read returns stale data. It is read-only: it neither locks
+// nor fills the cache, so it never changes what other reads see. Without a
+// cacher the cache is always reported as absent.
+func (c *Client) Inspect(ctx context.Context, key *datastore.Key) (*KeyReport, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Inspect")
+	defer span.End()
+	key = c.inNamespace(key)
+
+	report := &KeyReport{
+		Key:      key,
+		CacheKey: createCacheKey(c.keys, key),
+	}
+
+	var item *Item
+	if c.cacher != nil {
+		items, err := c.cacher.GetMulti(ctx, []string{report.CacheKey})
+		if err != nil {
+			return nil, errors.Wrap(err, "nds:Inspect GetMulti")
+		}
+		item = items[report.CacheKey]
+	}
+
+	var pl datastore.PropertyList
+	err := c.guardDatastore(ctx, func() error {
+		return c.ds.Get(ctx, key, &pl)
+	})
+	switch err {
+	case nil:
+		report.Stored, report.Exists = pl, true
+	case datastore.ErrNoSuchEntity:
+	default:
+		return nil, errors.Wrap(err, "nds:Inspect Get")
+	}
+
+	report.Match = true
+	if item == nil {
+		return report, nil
+	}
+	switch item.Flags {
+	case lockItem:
+		report.CacheState = CacheLocked
+	case noneItem:
+		report.CacheState = CacheMissing
+		report.Match = !report.Exists
+	case entityItem:
+		report.CacheState = CacheEntity
+		cached := datastore.PropertyList{}
+		if report.CachedErr = c.unmarshalEntity(item.Value, &cached); report.CachedErr != nil {
+			report.Match = false
+			break
+		}
+		report.Cached = cached
+		report.Match = !c.cacheMismatch(ctx, item, pl, err)
+	}
+	return report, nil
+}
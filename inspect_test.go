@@ -0,0 +1,103 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestInspectSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestInspect", InspectTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func InspectTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("InspectTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "key", nil)
+		missing := datastore.NameKey(kind, "missing", nil)
+
+		inspect := func(key *datastore.Key, state nds.CacheState, exists, match bool) *nds.KeyReport {
+			t.Helper()
+			report, err := ndsClient.Inspect(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.Key.Equal(key) || report.CacheKey != ndsClient.CacheKey(key) {
+				t.Fatalf("expected report for %v, got %v under %q",
+					key, report.Key, report.CacheKey)
+			}
+			if report.CacheState != state || report.Exists != exists || report.Match != match {
+				t.Fatalf("expected %v, exists %t and match %t, got %v, %t and %t",
+					state, exists, match, report.CacheState, report.Exists, report.Match)
+			}
+			if exists != (report.Stored != nil) {
+				t.Fatalf("unexpected stored entity %v", report.Stored)
+			}
+			if (state == nds.CacheEntity) != (report.Cached != nil) || report.CachedErr != nil {
+				t.Fatalf("unexpected cached entity %v, %v", report.Cached, report.CachedErr)
+			}
+			return report
+		}
+
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		inspect(key, nds.CacheAbsent, true, true)
+		// Inspect doesn't fill the cache.
+		inspect(key, nds.CacheAbsent, true, true)
+
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		report := inspect(key, nds.CacheEntity, true, true)
+		if len(report.Cached) != 1 || report.Cached[0].Value != int64(1) {
+			t.Fatalf("unexpected cached entity %v", report.Cached)
+		}
+
+		// A write behind nds' back leaves the cache stale.
+		if _, err := ndsClient.Client.Put(ctx, key, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		report = inspect(key, nds.CacheEntity, true, false)
+		if report.Stored[0].Value != int64(2) || report.Cached[0].Value != int64(1) {
+			t.Fatalf("expected cached 1 and stored 2, got %v and %v",
+				report.Cached, report.Stored)
+		}
+
+		if err := ndsClient.Get(ctx, missing, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", err)
+		}
+		inspect(missing, nds.CacheMissing, false, true)
+		if _, err := ndsClient.Client.Put(ctx, missing, &testEntity{3}); err != nil {
+			t.Fatal(err)
+		}
+		inspect(missing, nds.CacheMissing, true, false)
+
+		if err := cacher.SetMulti(ctx, []*nds.Item{{
+			Key:   ndsClient.LockKey(key),
+			Flags: nds.LockItem,
+			Value: []byte("lock"),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		inspect(key, nds.CacheLocked, true, true)
+	}
+}
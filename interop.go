@@ -0,0 +1,40 @@
+package nds
+
+import "cloud.google.com/go/datastore"
+
+// EntityFlags are the Flags of the cache items that hold an entity. Another
+// system sharing the cache through WithCacheKeyFunc and WithValueCodec must
+// store its entities with these flags for nds to read them. Items with other
+// flags are the locks and markers of nds and must be left alone.
+const EntityFlags = entityItem
+
+// WithCacheKeyFunc replaces how the client derives the cache key of an
+// entity from its datastore key, so it can share the cache with another
+// system that uses its own key format, for example "kind:id". f must give
+// distinct keys for every datastore key the client handles, namespace and
+// ancestors included, and keys that fit the cache's limit, as they are used
+// as they are. Locks take the same key as the entity; the other keys of nds,
+// such as counters, prefix the key of f.
+//
+// Like WithKeyHasher, every Client sharing the cache must use the same f,
+// and the package level CacheKey and LockKey don't know about it.
+func WithCacheKeyFunc(f func(key *datastore.Key) string) ClientOption {
+	return func(c *Client) {
+		c.keys.keyFunc = f
+	}
+}
+
+// WithValueCodec makes codec encode the cached entities of every kind
+// without a codec set with WithKindCodec, in place of the default gob
+// encoding. Unlike WithKindCodec, what codec writes is cached as it is,
+// without its name, so another system can read and write the same entries;
+// its Name isn't used. Cached entities that start with a zero byte are taken
+// for those of a kind codec, so codec must never produce one.
+//
+// Entities cached before codec was set can't be decoded with it and are read
+// from the datastore instead, so flush the cache when setting or changing it.
+func WithValueCodec(codec Codec) ClientOption {
+	return func(c *Client) {
+		c.valueCodec = codec
+	}
+}
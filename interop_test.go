@@ -0,0 +1,98 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestInteropSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestCacheInterop", CacheInteropTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func CacheInteropTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithCacheKeyFunc(kindIDKey),
+			nds.WithValueCodec(jsonCodec{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Name  string
+			Count int64
+			Score float64
+		}
+
+		kind := fmt.Sprintf("CacheInteropTest%d", time.Now().UnixNano())
+		written := datastore.IDKey(kind, 1, nil)
+		external := datastore.IDKey(kind, 2, nil)
+
+		if got, want := ndsClient.CacheKey(written), kind+":1"; got != want {
+			t.Fatalf("expected cache key %q, got %q", want, got)
+		}
+
+		// What nds caches is in the external format.
+		if _, err := ndsClient.Put(ctx, written, &testEntity{"ann", 2, 1.5}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, written, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		items, err := cacher.GetMulti(ctx, []string{kind + ":1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, ok := items[kind+":1"]
+		if !ok {
+			t.Fatal("expected the entity cached under its external key")
+		}
+		if want := `{"Count":2,"Name":"ann","Score":1.5}`; string(item.Value) != want {
+			t.Fatalf("expected %s cached, got %s", want, item.Value)
+		}
+		if item.Flags != nds.EntityFlags {
+			t.Fatalf("expected flags %d, got %d", nds.EntityFlags, item.Flags)
+		}
+
+		// What the external system caches is read by nds, without the
+		// datastore, which holds something else.
+		if _, err := ndsClient.Client.Put(ctx, external, &testEntity{"datastore", 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cacher.SetMulti(ctx, []*nds.Item{{
+			Key:   kind + ":2",
+			Flags: nds.EntityFlags,
+			Value: []byte(`{"Name":"bob","Count":3,"Score":0.25}`),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		var got testEntity
+		if err := ndsClient.Get(ctx, external, &got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (testEntity{"bob", 3, 0.25}); got != want {
+			t.Fatalf("expected %+v from the cache, got %+v", want, got)
+		}
+
+		// Writes through nds still invalidate the external entry.
+		if _, err := ndsClient.Put(ctx, external, &testEntity{"carl", 4, 0.5}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, external, &got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (testEntity{"carl", 4, 0.5}); got != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+}
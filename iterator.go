@@ -0,0 +1,198 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/iterator"
+)
+
+// defaultMaxBufferedChunks is the number of chunks an EntityIterator loads
+// ahead of the chunk the caller is iterating over unless WithMaxBufferedChunks
+// says otherwise.
+const defaultMaxBufferedChunks = 2
+
+// WithMaxBufferedChunks limits how many chunks of up to 1000 entities each
+// iterator returned by GetMultiIter loads ahead of the chunk being iterated
+// over, and how many chunks GetMultiChan loads at once. Lower values bound
+// memory use more tightly, higher values hide more of the loading latency
+// from slow consumers. Values less than 1 are treated as 1. The default is 2.
+func WithMaxBufferedChunks(n int) ClientOption {
+	return func(c *Client) {
+		if n < 1 {
+			n = 1
+		}
+		c.maxBufferedChunks = n
+	}
+}
+
+// EntityIterator is the result of Client.GetMultiIter.
+type EntityIterator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	chunks chan entityChunk
+
+	chunk entityChunk
+	pos   int
+	err   error
+}
+
+type entityChunk struct {
+	keys []*datastore.Key
+	pls  []datastore.PropertyList
+	errs []error
+}
+
+// GetMultiIter returns an iterator over the entities for keys, in the order
+// of keys. Entities are loaded through the cache, exactly like GetMulti, in
+// chunks of 1000 keys, with at most two chunks, or as many as set with
+// WithMaxBufferedChunks, loaded ahead of the one being iterated over. This
+// keeps memory use flat however many keys there are.
+//
+// Stop must be called if the iterator is not iterated to the end, otherwise
+// the chunk loading ahead is never released.
+func (c *Client) GetMultiIter(ctx context.Context, keys []*datastore.Key) *EntityIterator {
+	// The span covers loading every chunk, so it ends once loading does.
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetMultiIter")
+	keys = c.keysInNamespace(keys)
+
+	buffered := c.maxBufferedChunks
+	if buffered == 0 {
+		buffered = defaultMaxBufferedChunks
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	it := &EntityIterator{
+		ctx:    ctx,
+		cancel: cancel,
+		// load holds one more chunk while it waits to send it.
+		chunks: make(chan entityChunk, buffered-1),
+	}
+	go it.load(c, keys, span)
+	return it
+}
+
+func (it *EntityIterator) load(c *Client, keys []*datastore.Key, span *trace.Span) {
+	defer span.End()
+	defer close(it.chunks)
+	for lo := 0; lo < len(keys); lo += getMultiLimit {
+		hi := lo + getMultiLimit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		select {
+		case it.chunks <- c.loadEntityChunk(it.ctx, keys[lo:hi]):
+		case <-it.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) loadEntityChunk(ctx context.Context, keys []*datastore.Key) entityChunk {
+	chunk := entityChunk{
+		keys: keys,
+		pls:  make([]datastore.PropertyList, len(keys)),
+		errs: make([]error, len(keys)),
+	}
+
+	// Nil keys would fail the whole chunk so only the valid ones are loaded.
+	validKeys := make([]*datastore.Key, 0, len(keys))
+	validIndex := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			chunk.errs[i] = datastore.ErrInvalidKey
+			continue
+		}
+		validKeys = append(validKeys, key)
+		validIndex = append(validIndex, i)
+	}
+	if len(validKeys) == 0 {
+		return chunk
+	}
+
+	pls := make([]datastore.PropertyList, len(validKeys))
+	err := c.getMulti(ctx, validKeys, reflect.ValueOf(pls))
+	me, isMultiErr := err.(datastore.MultiError)
+	for i, index := range validIndex {
+		chunk.pls[index] = pls[i]
+		if isMultiErr {
+			chunk.errs[index] = me[i]
+		} else {
+			chunk.errs[index] = err
+		}
+	}
+	return chunk
+}
+
+// Next loads the next entity into dst, which must be a struct pointer or
+// implement datastore.PropertyLoadSaver, and returns its key. If there is no
+// entity for the key, Next returns the key and datastore.ErrNoSuchEntity and
+// iteration can continue; any other error loading a key is returned the same
+// way. Next returns iterator.Done once every key has been returned, and the
+// context's error if it is done before then.
+func (it *EntityIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return nil, err
+	}
+
+	for it.pos >= len(it.chunk.keys) {
+		select {
+		case chunk, ok := <-it.chunks:
+			if !ok {
+				// Loading stops early if the context is done.
+				if err := it.ctx.Err(); err != nil {
+					it.err = err
+				} else {
+					it.err = iterator.Done
+					it.cancel()
+				}
+				return nil, it.err
+			}
+			it.chunk, it.pos = chunk, 0
+		case <-it.ctx.Done():
+			it.err = it.ctx.Err()
+			return nil, it.err
+		}
+	}
+
+	i := it.pos
+	it.pos++
+
+	key := it.chunk.keys[i]
+	if err := it.chunk.errs[i]; err != nil {
+		return key, err
+	}
+	pl := it.chunk.pls[i]
+	it.chunk.pls[i] = nil
+
+	if dst == nil {
+		return key, datastore.ErrInvalidEntityType
+	}
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		if err := pls.Load(pl); err != nil {
+			return key, err
+		}
+		if kl, ok := dst.(datastore.KeyLoader); ok {
+			return key, kl.LoadKey(key)
+		}
+		return key, nil
+	}
+	return key, datastore.LoadStruct(dst, pl)
+}
+
+// Stop releases the resources held by the iterator and waits for any chunk
+// being loaded to finish. Next returns context.Canceled after Stop has been
+// called, unless iteration had already ended.
+func (it *EntityIterator) Stop() {
+	it.cancel()
+	for range it.chunks {
+	}
+}
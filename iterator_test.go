@@ -0,0 +1,209 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestGetMultiIterSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetMultiIter", GetMultiIterTest(item.ctx, item.cacher))
+			t.Run("TestGetMultiIterCancel", GetMultiIterCancelTest(item.ctx, item.cacher))
+			t.Run("TestGetMultiIterMaxBufferedChunks", GetMultiIterMaxBufferedChunksTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func GetMultiIterTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		// Every third key has no entity.
+		const count = 2500
+		keys := make([]*datastore.Key, count)
+		putKeys := make([]*datastore.Key, 0, count)
+		entities := make([]testEntity, 0, count)
+		for i := range keys {
+			keys[i] = datastore.IDKey("GetMultiIterTest", int64(i+1), nil)
+			if i%3 != 0 {
+				putKeys = append(putKeys, keys[i])
+				entities = append(entities, testEntity{i})
+			}
+		}
+		if _, err := ndsClient.PutMulti(ctx, putKeys, entities); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, putKeys)
+
+		// Cache some of the entities so the iterator reads a mix.
+		if err := ndsClient.GetMulti(ctx, putKeys[:500], make([]testEntity, 500)); err != nil {
+			t.Fatal(err)
+		}
+
+		it := ndsClient.GetMultiIter(ctx, keys)
+		defer it.Stop()
+
+		i := 0
+		for ; ; i++ {
+			var got testEntity
+			key, err := it.Next(&got)
+			if err == iterator.Done {
+				break
+			}
+			if i >= count {
+				t.Fatal("expected iteration to end")
+			}
+			if !key.Equal(keys[i]) {
+				t.Fatalf("expected key %s, got %s", keys[i], key)
+			}
+			if i%3 == 0 {
+				if err != datastore.ErrNoSuchEntity {
+					t.Fatalf("expected datastore.ErrNoSuchEntity for %s, got %v", key, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Value != i {
+				t.Fatalf("expected %d, got %d", i, got.Value)
+			}
+		}
+		if i != count {
+			t.Fatalf("expected %d keys, got %d", count, i)
+		}
+
+		if _, err := it.Next(&testEntity{}); err != iterator.Done {
+			t.Fatalf("expected iterator.Done again, got %v", err)
+		}
+	}
+}
+
+func GetMultiIterCancelTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// Chunks loading ahead fail to use the cache once canceled.
+		logOKTest := func(err error) bool {
+			return strings.Contains(err.Error(), context.Canceled.Error())
+		}
+		ndsClient, err := NewClient(ctx, cacher, t, logOKTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		keys := make([]*datastore.Key, 2001)
+		for i := range keys {
+			keys[i] = datastore.IDKey("GetMultiIterCancelTest", int64(i+1), nil)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		it := ndsClient.GetMultiIter(ctx, keys)
+		defer it.Stop()
+
+		if _, err := it.Next(&testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", err)
+		}
+
+		cancel()
+		if _, err := it.Next(&testEntity{}); err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		if _, err := it.Next(&testEntity{}); err != context.Canceled {
+			t.Fatalf("expected context.Canceled again, got %v", err)
+		}
+	}
+}
+
+func GetMultiIterMaxBufferedChunksTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		const buffered = 3
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithMaxBufferedChunks(buffered))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every chunk load waits for the test to take its start, so the test
+		// knows exactly how many loads the iterator has started.
+		started := make(chan struct{})
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) == 0 {
+				return nil
+			}
+			select {
+			case started <- struct{}{}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		type testEntity struct {
+			Value int
+		}
+
+		// New keys every run so no chunk is served from the cache.
+		const chunks = 8
+		kind := fmt.Sprintf("GetMultiIterMaxBufferedChunksTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, chunks*1000)
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+		}
+
+		it := ndsClient.GetMultiIter(ctx, keys)
+		defer it.Stop()
+
+		loaded := 0
+		for i := range keys {
+			if i%1000 == 0 {
+				// The iterator loads as far ahead as it may before the
+				// next chunk is taken, and no further.
+				taken := i / 1000
+				want := taken + buffered
+				if want > chunks {
+					want = chunks
+				}
+				for ; loaded < want; loaded++ {
+					select {
+					case <-started:
+					case <-time.After(5 * time.Second):
+						t.Fatalf("expected %d chunks to be loaded ahead, got %d",
+							want-taken, loaded-taken)
+					}
+				}
+				select {
+				case <-started:
+					t.Fatalf("expected at most %d chunks loaded ahead, got %d",
+						buffered, loaded+1-taken)
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			if _, err := it.Next(&testEntity{}); err != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected datastore.ErrNoSuchEntity, got %v", err)
+			}
+		}
+		if _, err := it.Next(&testEntity{}); err != iterator.Done {
+			t.Fatalf("expected iterator.Done, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package nds
+
+import (
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// KindStats counts the reads of the entities of one kind since the Client was
+// created.
+type KindStats struct {
+	// Hits counts the entities found in the cache.
+	Hits int64
+	// Misses counts the entities not found in the cache.
+	Misses int64
+	// Locked counts the cache reads that found a lock still held, which
+	// aren't counted as misses.
+	Locked int64
+	// DatastoreReads counts the entities looked up in the datastore.
+	DatastoreReads int64
+}
+
+// WithStatsByKind makes the Client count the cache hits, misses and datastore
+// reads of Get and GetMulti by the kind of their keys, to be read with
+// StatsByKind. A good overall hit ratio can hide a kind that is hardly ever
+// a hit, whose TTL may need tuning or that may be better left uncached. The
+// counts are kept in memory per Client and cost a lock per read, so it is
+// disabled by default; the OpenCensus views in AllViews record the cache
+// counts by kind as well.
+func WithStatsByKind(enabled bool) ClientOption {
+	return func(c *Client) {
+		if enabled {
+			c.kindStats = &kindStats{stats: make(map[string]*KindStats)}
+		} else {
+			c.kindStats = nil
+		}
+	}
+}
+
+// StatsByKind returns a copy of the counts kept with WithStatsByKind by kind,
+// or nil if it isn't used.
+func (c *Client) StatsByKind() map[string]KindStats {
+	if c.kindStats == nil {
+		return nil
+	}
+	c.kindStats.mu.Lock()
+	defer c.kindStats.mu.Unlock()
+	stats := make(map[string]KindStats, len(c.kindStats.stats))
+	for kind, s := range c.kindStats.stats {
+		stats[kind] = *s
+	}
+	return stats
+}
+
+type kindStats struct {
+	mu    sync.Mutex
+	stats map[string]*KindStats
+}
+
+// kind returns the counts of kind, which must be called with mu held.
+func (ks *kindStats) kind(kind string) *KindStats {
+	s, ok := ks.stats[kind]
+	if !ok {
+		s = &KindStats{}
+		ks.stats[kind] = s
+	}
+	return s
+}
+
+// recordCacheReads counts the hits, misses and locks of a cache read like
+// cacheStatsByKind.
+func (c *Client) recordCacheReads(cacheItems []cacheItem) {
+	if c.kindStats == nil {
+		return
+	}
+	c.kindStats.mu.Lock()
+	defer c.kindStats.mu.Unlock()
+	for _, item := range cacheItems {
+		s := c.kindStats.kind(item.key.Kind)
+		switch {
+		case item.state == done:
+			s.Hits++
+		case item.locked:
+			s.Locked++
+		default:
+			s.Misses++
+		}
+	}
+}
+
+// recordDatastoreReads counts the keys looked up in the datastore.
+func (c *Client) recordDatastoreReads(keys []*datastore.Key) {
+	if c.kindStats == nil {
+		return
+	}
+	c.kindStats.mu.Lock()
+	defer c.kindStats.mu.Unlock()
+	for _, key := range keys {
+		c.kindStats.kind(key.Kind).DatastoreReads++
+	}
+}
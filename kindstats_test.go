@@ -0,0 +1,89 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestKindStatsSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestStatsByKind", StatsByKindTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func StatsByKindTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithStatsByKind(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		suffix := time.Now().UnixNano()
+		hotKind := fmt.Sprintf("StatsByKindHot%d", suffix)
+		coldKind := fmt.Sprintf("StatsByKindCold%d", suffix)
+		hotKey := datastore.NameKey(hotKind, "hot", nil)
+		coldKeys := []*datastore.Key{
+			datastore.NameKey(coldKind, "one", nil),
+			datastore.NameKey(coldKind, "two", nil),
+			datastore.NameKey(coldKind, "three", nil),
+		}
+
+		if _, err := ndsClient.Put(ctx, hotKey, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ndsClient.PutMulti(ctx, coldKeys,
+			[]testEntity{{1}, {2}, {3}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The hot entity is read three times, missing once and then hitting,
+		// while each cold entity is read once and always misses.
+		for i := 0; i < 3; i++ {
+			if err := ndsClient.Get(ctx, hotKey, &testEntity{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ndsClient.GetMulti(ctx, coldKeys, make([]testEntity, len(coldKeys))); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := ndsClient.StatsByKind()
+		if got, want := stats[hotKind], (nds.KindStats{Hits: 2, Misses: 1, DatastoreReads: 1}); got != want {
+			t.Fatalf("expected %+v for the hot kind, got %+v", want, got)
+		}
+		if got, want := stats[coldKind], (nds.KindStats{Misses: 3, DatastoreReads: 3}); got != want {
+			t.Fatalf("expected %+v for the cold kind, got %+v", want, got)
+		}
+
+		// The stats are a copy.
+		stats[hotKind] = nds.KindStats{}
+		if ndsClient.StatsByKind()[hotKind].Hits != 2 {
+			t.Fatal("expected StatsByKind to return a copy")
+		}
+
+		// Without the option there are no stats.
+		plainClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats := plainClient.StatsByKind(); stats != nil {
+			t.Fatalf("expected no stats, got %v", stats)
+		}
+
+		if err := ndsClient.DeleteMulti(ctx, append(coldKeys, hotKey)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
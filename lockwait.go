@@ -0,0 +1,96 @@
+package nds
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+// WithLockWait makes Get and GetMulti wait for cache locks held by a
+// concurrent Put, Delete or transaction to clear instead of reading around
+// them from the datastore straight away. The cache is polled every
+// pollInterval for up to maxWait, after which the read falls through to the
+// datastore as usual. This gives callers that read straight after another
+// request's write a better chance of seeing it, at the cost of latency while
+// writes are in flight. A maxWait of 0 or less disables waiting, which is the
+// default.
+func WithLockWait(maxWait, pollInterval time.Duration) ClientOption {
+	return func(c *Client) {
+		if pollInterval <= 0 {
+			pollInterval = time.Millisecond
+		}
+		c.lockWait, c.lockPoll = maxWait, pollInterval
+	}
+}
+
+// waitForLocks polls the cache for the cache items that were locked until the
+// locks clear or the client's lock wait time runs out. It only returns an
+// error if the cache failed and the read has to fail with it.
+func (c *Client) waitForLocks(ctx context.Context, cacheItems []cacheItem) error {
+	if c.lockWait <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(c.lockWait)
+	for {
+		var locked []int
+		for i := range cacheItems {
+			if cacheItems[i].locked {
+				locked = append(locked, i)
+			}
+		}
+		if len(locked) == 0 || !time.Now().Before(deadline) {
+			return nil
+		}
+
+		timer := time.NewTimer(c.lockPoll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		retry := make([]cacheItem, len(locked))
+		for j, i := range locked {
+			retry[j] = cacheItems[i]
+			retry[j].state, retry[j].locked = miss, false
+		}
+		if err := c.loadCache(ctx, retry); err != nil {
+			return err
+		}
+		for j, i := range locked {
+			cacheItems[i] = retry[j]
+		}
+	}
+}
+
+// WithLockedReadLogging makes Get and GetMulti report the keys they found
+// locked in the cache, after any wait set up with WithLockWait, to the
+// OnErrorFunc, which logs them by default. Whether or not it is enabled,
+// these reads are counted by the "nds/cache_locked" view rather than as cache
+// misses. Many of them point at write contention or at writes that
+// take long enough to keep the cache from serving reads.
+func WithLockedReadLogging(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.logLockedReads = enabled
+	}
+}
+
+// logLockedRead reports the keys of the cache items still locked, if enabled.
+func (c *Client) logLockedRead(ctx context.Context, cacheItems []cacheItem) {
+	if !c.logLockedReads {
+		return
+	}
+	var keys []*datastore.Key
+	for _, item := range cacheItems {
+		if item.locked {
+			keys = append(keys, item.key)
+		}
+	}
+	if len(keys) > 0 {
+		c.onError(ctx, errors.Errorf("nds: read found keys locked in the cache: %v", keys))
+	}
+}
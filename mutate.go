@@ -4,7 +4,6 @@ import (
 	"context"
 
 	"cloud.google.com/go/datastore"
-	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
 
@@ -25,45 +24,47 @@ const (
 type Mutation struct {
 	typ mutationType
 	k   *datastore.Key
+	src interface{}
 	mut *datastore.Mutation
 }
 
 func NewDelete(k *datastore.Key) *Mutation {
-	return &Mutation{
-		typ: deleteMutation,
-		k:   k,
-		mut: datastore.NewDelete(k),
-	}
+	return newMutation(deleteMutation, k, nil)
 }
 
 func NewInsert(k *datastore.Key, src interface{}) *Mutation {
-	return &Mutation{
-		typ: insertMutation,
-		k:   k,
-		mut: datastore.NewInsert(k, src),
-	}
+	return newMutation(insertMutation, k, src)
 }
 
 func NewUpdate(k *datastore.Key, src interface{}) *Mutation {
-	return &Mutation{
-		typ: updateMutation,
-		k:   k,
-		mut: datastore.NewUpdate(k, src),
-	}
+	return newMutation(updateMutation, k, src)
 }
 
 func NewUpsert(k *datastore.Key, src interface{}) *Mutation {
-	return &Mutation{
-		typ: upsertMutation,
-		k:   k,
-		mut: datastore.NewUpsert(k, src),
+	return newMutation(upsertMutation, k, src)
+}
+
+// newMutation keeps k and src so the mutation can be rebuilt for another key.
+func newMutation(typ mutationType, k *datastore.Key, src interface{}) *Mutation {
+	m := &Mutation{typ: typ, k: k, src: src}
+	switch typ {
+	case insertMutation:
+		m.mut = datastore.NewInsert(k, src)
+	case upsertMutation:
+		m.mut = datastore.NewUpsert(k, src)
+	case updateMutation:
+		m.mut = datastore.NewUpdate(k, src)
+	case deleteMutation:
+		m.mut = datastore.NewDelete(k)
 	}
+	return m
 }
 
 func (c *Client) Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Key, error) {
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Mutate")
 	defer span.End()
+	muts = c.mutationsInNamespace(muts)
 
 	toLock := make([]*datastore.Key, 0, len(muts))
 	toLockRelease := make([]*datastore.Key, 0, len(muts))
@@ -84,22 +85,38 @@ func (c *Client) Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Ke
 		}
 	}
 
+	c.forgetRequestCache(ctx, toLockRelease)
+	c.forgetRequestCache(ctx, toLock)
+	defer c.forgetRequestCache(ctx, toLockRelease)
+	defer c.forgetRequestCache(ctx, toLock)
+	c.rememberWrites(ctx, toLockRelease)
+	c.rememberWrites(ctx, toLock)
+
 	if c.cacher != nil {
-		releaseCacheKeys, lockCacheItems := getCacheLocks(toLockRelease)
-		_, moreLockCacheItems := getCacheLocks(toLock)
+		releaseCacheKeys, lockCacheItems := getCacheLocks(c.keys, toLockRelease)
+		lockOnlyCacheKeys, moreLockCacheItems := getCacheLocks(c.keys, toLock)
 		lockCacheItems = append(lockCacheItems, moreLockCacheItems...)
 
+		releaseItems := lockCacheItems[:len(releaseCacheKeys)]
+
+		// Optimistcally remove the locks.
+		locked := true
 		defer func() {
-			// Optimistcally remove the locks.
-			if err := c.cacher.DeleteMulti(ctx,
-				releaseCacheKeys); err != nil {
-				c.onError(ctx, errors.Wrap(err, "Mutate cache.DeleteMulti"))
+			if locked {
+				c.unlockCache(ctx, releaseItems, "Mutate cache.DeleteMulti")
+			} else {
+				c.invalidateCache(ctx, releaseCacheKeys, "Mutate cache.DeleteMulti")
 			}
 		}()
 
-		if err := c.cacher.SetMulti(ctx,
+		if err := c.setLocks(ctx,
 			lockCacheItems); err != nil {
-			return nil, err
+			if err := c.lockCacheFailed(ctx, err, "Mutate cache.SetMulti"); err != nil {
+				return nil, err
+			}
+			// The deferred DeleteMulti only removes the entities put.
+			locked = false
+			defer c.invalidateCache(ctx, lockOnlyCacheKeys, "Mutate cache.DeleteMulti")
 		}
 
 		if mutateHook != nil {
@@ -109,5 +126,13 @@ func (c *Client) Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Ke
 		}
 	}
 
-	return c.Client.Mutate(ctx, mutations...)
+	var keys []*datastore.Key
+	err := c.guardDatastore(ctx, func() (err error) {
+		keys, err = c.ds.Mutate(ctx, mutations...)
+		return
+	})
+	if err == nil {
+		c.invalidateQueries(ctx, append(append([]*datastore.Key{}, toLockRelease...), toLock...))
+	}
+	return keys, err
 }
@@ -0,0 +1,86 @@
+package nds
+
+import (
+	"cloud.google.com/go/datastore"
+)
+
+// WithNamespace puts every key given to the Client that has no namespace,
+// including incomplete keys and the keys' ancestors, in namespace ns before it
+// is used to address the datastore or to derive a cache key, so single tenant
+// processes don't have to set it on every key. Keys that already have a
+// namespace keep it.
+//
+// Queries, such as the ones given to DeleteAll and Reindex, are run as they
+// are, as their namespace can't be told apart from the default one; build
+// them with Query.Namespace. GetChildren queries the namespace of its parent.
+func WithNamespace(ns string) ClientOption {
+	return func(c *Client) {
+		c.namespace = ns
+	}
+}
+
+// inNamespace returns key, or a copy of it if it or one of its ancestors has
+// to be put in the namespace set with WithNamespace. Already namespaced keys
+// are returned as they are, so keys can go through it more than once.
+func (c *Client) inNamespace(key *datastore.Key) *datastore.Key {
+	if c.namespace == "" || key == nil || !needsNamespace(key) {
+		return key
+	}
+	nk := *key
+	if nk.Namespace == "" {
+		nk.Namespace = c.namespace
+	}
+	nk.Parent = c.inNamespace(key.Parent)
+	return &nk
+}
+
+// keysInNamespace is inNamespace for every key of keys. It returns keys
+// itself unless a key had to be copied, leaving the caller's slice untouched.
+func (c *Client) keysInNamespace(keys []*datastore.Key) []*datastore.Key {
+	if c.namespace == "" {
+		return keys
+	}
+	var nks []*datastore.Key
+	for i, key := range keys {
+		nk := c.inNamespace(key)
+		if nk != key && nks == nil {
+			nks = make([]*datastore.Key, len(keys))
+			copy(nks, keys[:i])
+		}
+		if nks != nil {
+			nks[i] = nk
+		}
+	}
+	if nks == nil {
+		return keys
+	}
+	return nks
+}
+
+func needsNamespace(key *datastore.Key) bool {
+	for ; key != nil; key = key.Parent {
+		if key.Namespace == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// mutationsInNamespace returns muts, or copies of the mutations whose keys
+// have to be put in the namespace set with WithNamespace.
+func (c *Client) mutationsInNamespace(muts []*Mutation) []*Mutation {
+	if c.namespace == "" {
+		return muts
+	}
+	nmuts := make([]*Mutation, len(muts))
+	for i, mut := range muts {
+		nmuts[i] = mut
+		if mut == nil {
+			continue
+		}
+		if k := c.inNamespace(mut.k); k != mut.k {
+			nmuts[i] = newMutation(mut.typ, k, mut.src)
+		}
+	}
+	return nmuts
+}
@@ -0,0 +1,100 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestNamespaceSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestNamespace", NamespaceTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func NamespaceTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithNamespace("tenant"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("NamespaceTest%d", time.Now().UnixNano())
+		parent := datastore.NameKey(kind, "parent", nil)
+		key := datastore.NameKey(kind, "child", parent)
+		nsParent := datastore.NameKey(kind, "parent", nil)
+		nsParent.Namespace = "tenant"
+		nsKey := datastore.NameKey(kind, "child", nsParent)
+		nsKey.Namespace = "tenant"
+
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, key)
+		if key.Namespace != "" || parent.Namespace != "" {
+			t.Fatal("expected the caller's key left untouched")
+		}
+
+		// The write landed in the namespace and nowhere else.
+		if err := ndsClient.Client.Get(ctx, nsKey, &testEntity{}); err != nil {
+			t.Fatalf("expected %v stored, got %v", nsKey, err)
+		}
+		if err := ndsClient.Client.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected nothing stored for %v, got %v", key, err)
+		}
+
+		// Reads find it, and cache it under the namespaced key.
+		val := &testEntity{}
+		if err := ndsClient.Get(ctx, key, val); err != nil {
+			t.Fatal(err)
+		}
+		if val.IntVal != 1 {
+			t.Fatalf("expected 1, got %d", val.IntVal)
+		}
+		cacheKey := ndsClient.CacheKey(key)
+		if cacheKey != nds.CacheKey(nsKey) {
+			t.Fatalf("expected cache key %s, got %s", nds.CacheKey(nsKey), cacheKey)
+		}
+		items, err := cacher.GetMulti(ctx, []string{cacheKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item, ok := items[cacheKey]; !ok || item.Flags != nds.EntityItem {
+			t.Fatalf("expected %v cached under %s", nsKey, cacheKey)
+		}
+
+		// Incomplete keys are namespaced too, and explicit namespaces kept.
+		incomplete, err := ndsClient.Put(ctx, datastore.IncompleteKey(kind, nil), &testEntity{2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, incomplete)
+		if incomplete.Namespace != "tenant" {
+			t.Fatalf("expected namespace tenant, got %q", incomplete.Namespace)
+		}
+		other := datastore.NameKey(kind, "other", nil)
+		other.Namespace = "other"
+		if got := ndsClient.CacheKey(other); got != nds.CacheKey(other) {
+			t.Fatalf("expected cache key %s, got %s", nds.CacheKey(other), got)
+		}
+
+		// Deletes remove it from the namespace.
+		if err := ndsClient.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Client.Get(ctx, nsKey, &testEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected %v deleted, got %v", nsKey, err)
+		}
+	}
+}
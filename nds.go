@@ -6,7 +6,11 @@ import (
 	"encoding/gob"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"reflect"
+	"strconv"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
@@ -16,6 +20,28 @@ const (
 	// cachePrefix is the namespace the cache uses to store entities.
 	cachePrefix = "NDS1:"
 
+	// counterPrefix is the namespace the cache uses to store the counts
+	// Increment hasn't flushed to the datastore yet.
+	counterPrefix = "NDSC1:"
+
+	// counterFlushPrefix is the namespace the cache uses to store the locks
+	// flushes take on the counts of a counter.
+	counterFlushPrefix = "NDSCF1:"
+
+	// stalePrefix is the namespace the cache uses to store the copies of
+	// entities WithServeStaleOnDatastoreError serves.
+	stalePrefix = "NDSS1:"
+
+	// projectionPrefix is the namespace the cache uses to store the partial
+	// entities GetMultiProjected reads, ahead of the projected fields.
+	projectionPrefix = "NDSP1:"
+
+	// queryPrefix is the namespace the cache uses to store the keys
+	// GetAllKeys cached for a query, and queryGenerationPrefix the one of the
+	// generation of each kind they are cached under.
+	queryPrefix           = "NDSQ1:"
+	queryGenerationPrefix = "NDSQG1:"
+
 	// cacheLockTime is the maximum length of time a cache lock will be
 	// held for. 32 seconds is chosen as 30 seconds is the maximum amount of
 	// time an underlying datastore call will retry even if the API reports a
@@ -68,7 +94,21 @@ const (
 	valueTypeKeyLoader
 )
 
+// valueTypes caches the valueType of every type checkValueType was called
+// with, as it is called for every entity loaded and the Implements checks
+// walk the method sets.
+var valueTypes sync.Map
+
 func checkValueType(valType reflect.Type) valueType {
+	if ty, ok := valueTypes.Load(valType); ok {
+		return ty.(valueType)
+	}
+	ty := findValueType(valType)
+	valueTypes.Store(valType, ty)
+	return ty
+}
+
+func findValueType(valType reflect.Type) valueType {
 
 	if reflect.PtrTo(valType).Implements(typeOfKeyLoader) {
 		return valueTypeKeyLoader
@@ -93,8 +133,13 @@ func checkValueType(valType reflect.Type) valueType {
 }
 
 func checkKeysValues(keys []*datastore.Key, values reflect.Value) error {
+	// Catching this here keeps callers that shard values from panicking in
+	// a goroutine on reflect.Value.Slice.
 	if values.Kind() != reflect.Slice {
-		return errors.New("nds: values is not a slice")
+		if !values.IsValid() {
+			return errors.New("nds: values is nil, not a slice")
+		}
+		return fmt.Errorf("nds: values is a %v, not a slice", values.Type())
 	}
 
 	if len(keys) != values.Len() {
@@ -122,11 +167,106 @@ func checkKeysValues(keys []*datastore.Key, values reflect.Value) error {
 	return nil
 }
 
-func createCacheKey(key *datastore.Key) string {
-	cacheKey := cachePrefix + key.Encode()
-	if len(cacheKey) > cacheMaxKeySize {
-		hash := sha1.Sum([]byte(cacheKey))
-		cacheKey = hex.EncodeToString(hash[:])
+// CacheKey returns the cache key nds uses to store the entity for key, so
+// that external tooling can inspect or invalidate the cache.
+//
+// The key is cachePrefix ("NDS1:") followed by key.Encode(), which includes
+// the key's namespace and ancestors. If that is longer than 250 bytes the hex
+// encoded SHA-1 of it is used instead. This format is stable; any change to
+// it will come with a new cachePrefix so old and new keys never collide.
+//
+// CacheKey always returns the key for the default database and hasher. Use
+// Client.CacheKey for a Client configured with WithDatabaseID or
+// WithKeyHasher.
+func CacheKey(key *datastore.Key) string {
+	return createCacheKey(keyScheme{}, key)
+}
+
+// LockKey returns the cache key nds uses to lock the entity for key while it
+// is being written. Locks are stored in the same slot as the cached entity,
+// so setting a lock evicts the entity, and LockKey always equals CacheKey.
+func LockKey(key *datastore.Key) string {
+	return createCacheKey(keyScheme{}, key)
+}
+
+// keyScheme is how a Client derives cache keys from datastore keys. The zero
+// value is the scheme of the package level CacheKey.
+type keyScheme struct {
+	databaseID string
+	// newHash and maxKeySize are set by WithKeyHasher. If unset long keys
+	// are hashed with SHA-1 over cacheMaxKeySize bytes.
+	newHash    func() hash.Hash
+	maxKeySize int
+	// keyFunc is set by WithCacheKeyFunc and replaces the derivation of
+	// entity cache keys.
+	keyFunc func(key *datastore.Key) string
+}
+
+// createCacheKey includes the database ID, if not the default database,
+// between cachePrefix and the encoded key. Encoded keys never contain a colon
+// so the two can't run into each other.
+func createCacheKey(ks keyScheme, key *datastore.Key) string {
+	if ks.keyFunc != nil {
+		return ks.keyFunc(key)
+	}
+	return prefixedCacheKey(cachePrefix, ks, key)
+}
+
+// createCounterKey is the cache key of the count Increment hasn't flushed to
+// the entity for key yet.
+func createCounterKey(ks keyScheme, key *datastore.Key) string {
+	return prefixedCacheKey(counterPrefix, ks, key)
+}
+
+// createCounterFlushKey is the cache key of the lock a flush holds while it
+// claims the count cached for key.
+func createCounterFlushKey(ks keyScheme, key *datastore.Key) string {
+	return prefixedCacheKey(counterFlushPrefix, ks, key)
+}
+
+// createStaleKey is the cache key of the stale copy of the entity for key.
+func createStaleKey(ks keyScheme, key *datastore.Key) string {
+	return prefixedCacheKey(stalePrefix, ks, key)
+}
+
+// createProjectionKey is the cache key of the projection of the entity for
+// key onto fields, which must be sorted. The field names are length prefixed
+// so that no two sets of fields give the same key.
+func createProjectionKey(ks keyScheme, fields []string, key *datastore.Key) string {
+	prefix := projectionPrefix + strconv.Itoa(len(fields)) + ":"
+	for _, field := range fields {
+		prefix += strconv.Itoa(len(field)) + ":" + field
+	}
+	return prefixedCacheKey(prefix, ks, key)
+}
+
+// prefixedCacheKey hashes the whole key, prefix included, so the keys of the
+// different namespaces stay apart once hashed.
+func prefixedCacheKey(prefix string, ks keyScheme, key *datastore.Key) string {
+	if ks.keyFunc != nil {
+		return shortenCacheKey(ks, prefix+ks.keyFunc(key))
+	}
+	cacheKey := prefix + key.Encode()
+	if ks.databaseID != "" {
+		cacheKey = prefix + ks.databaseID + ":" + key.Encode()
+	}
+	return shortenCacheKey(ks, cacheKey)
+}
+
+// shortenCacheKey returns cacheKey, or its hash if it is too long.
+func shortenCacheKey(ks keyScheme, cacheKey string) string {
+	maxKeySize := ks.maxKeySize
+	if maxKeySize <= 0 {
+		maxKeySize = cacheMaxKeySize
+	}
+	if len(cacheKey) > maxKeySize {
+		if ks.newHash == nil {
+			hash := sha1.Sum([]byte(cacheKey))
+			return hex.EncodeToString(hash[:])
+		}
+		h := ks.newHash()
+		h.Write([]byte(cacheKey))
+		return hex.EncodeToString(h.Sum(nil))
 	}
 	return cacheKey
 }
@@ -169,6 +309,76 @@ func setValue(val reflect.Value, pl datastore.PropertyList, key *datastore.Key)
 	return datastore.LoadStruct(val.Interface(), pl)
 }
 
+// saveValue returns the properties val is saved to the datastore with.
+func saveValue(val reflect.Value) (datastore.PropertyList, error) {
+	if val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+
+	if val.Kind() != reflect.Ptr {
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		val = ptr
+	}
+
+	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(val.Interface())
+}
+
+// roundTripPropertyList returns pl as the datastore returns it when read back,
+// so entities cached from a put are the same as entities cached from a get:
+// times are truncated to microseconds in the local time zone, pointers are
+// dereferenced and arrays are never marked as not indexed.
+func roundTripPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	rt := make(datastore.PropertyList, 0, len(pl))
+	for _, p := range pl {
+		// The datastore never stores a key field.
+		if p.Name == "__key__" {
+			continue
+		}
+		p.Value = roundTripValue(p.Value)
+		if _, ok := p.Value.([]interface{}); ok {
+			p.NoIndex = false
+		}
+		rt = append(rt, p)
+	}
+	return rt
+}
+
+func roundTripValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		v = v.Truncate(time.Microsecond)
+		return time.Unix(v.Unix(), int64(v.Nanosecond()))
+	case *datastore.Entity:
+		if v == nil {
+			return nil
+		}
+		return &datastore.Entity{
+			Key:        v.Key,
+			Properties: roundTripPropertyList(v.Properties),
+		}
+	case []interface{}:
+		rt := make([]interface{}, len(v))
+		for i, e := range v {
+			rt[i] = roundTripValue(e)
+		}
+		return rt
+	case nil, bool, int64, float64, string, []byte, *datastore.Key, datastore.GeoPoint:
+		return v
+	}
+
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		return roundTripValue(rv.Elem().Interface())
+	}
+	return v
+}
+
 func isErrorsNil(errs []error) bool {
 	for _, err := range errs {
 		if err != nil {
@@ -198,8 +408,10 @@ func groupErrors(errs []error, total, limit int) error {
 }
 
 // getCacheLocks will create cache Items locks for the given datastore keys.
-// It also removes duplicate entries.
-func getCacheLocks(keys []*datastore.Key) ([]string, []*Item) {
+// It also removes duplicate entries. Nil and incomplete keys are skipped:
+// an incomplete key has no stable cache key until the datastore allocates its
+// ID, and an entity that has never been written can't be cached yet.
+func getCacheLocks(ks keyScheme, keys []*datastore.Key) ([]string, []*Item) {
 	lockCacheKeys := make([]string, 0, len(keys))
 	lockCacheItems := make([]*Item, 0, len(keys))
 	set := make(map[string]interface{})
@@ -207,12 +419,12 @@ func getCacheLocks(keys []*datastore.Key) ([]string, []*Item) {
 		// Worst case scenario is that we lock the entity for cacheLockTime.
 		// datastore.Delete will raise the appropriate error.
 		if key != nil && !key.Incomplete() {
-			cacheKey := createCacheKey(key)
+			cacheKey := createCacheKey(ks, key)
 			if _, found := set[cacheKey]; !found {
 				item := &Item{
 					Key:        cacheKey,
 					Flags:      lockItem,
-					Value:      itemLock(),
+					Value:      writerLock(),
 					Expiration: cacheLockTime,
 				}
 				lockCacheItems = append(lockCacheItems, item)
@@ -2,6 +2,7 @@ package nds_test
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"flag"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -156,7 +158,7 @@ func TestMain(m *testing.M) {
 	os.Exit(retCode)
 }
 
-func NewClient(ctx context.Context, cacher nds.Cacher, t *testing.T, logOKTest func(err error) bool) (*nds.Client, error) {
+func NewClient(ctx context.Context, cacher nds.Cacher, t *testing.T, logOKTest func(err error) bool, opts ...nds.ClientOption) (*nds.Client, error) {
 	onErrorFn := func(_ context.Context, err error) {
 		if logOKTest != nil && logOKTest(err) {
 			t.Logf("%+v", err)
@@ -164,7 +166,7 @@ func NewClient(ctx context.Context, cacher nds.Cacher, t *testing.T, logOKTest f
 			t.Errorf("%+v", err)
 		}
 	}
-	return nds.NewClient(ctx, cacher, nds.WithOnErrorFunc(onErrorFn))
+	return nds.NewClient(ctx, cacher, append([]nds.ClientOption{nds.WithOnErrorFunc(onErrorFn)}, opts...)...)
 }
 
 func TestCachers(t *testing.T) {
@@ -177,6 +179,7 @@ func TestCachers(t *testing.T) {
 			t.Run("TestGetMultiErrorMix", GetMultiErrorMixTest(item.ctx, item.cacher))
 			t.Run("TestMultiCache", MultiCacheTest(item.ctx, item.cacher))
 			t.Run("TestRunInTransaction", RunInTransactionTest(item.ctx, item.cacher))
+			t.Run("TestDatabaseIDs", DatabaseIDsTest(item.ctx, item.cacher))
 		})
 	}
 
@@ -715,6 +718,69 @@ func RunInTransactionTest(ctx context.Context, cacher nds.Cacher) func(t *testin
 	}
 }
 
+func DatabaseIDsTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		dbA, err := NewClient(ctx, cacher, t, nil, nds.WithDatabaseID("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbB, err := NewClient(ctx, cacher, t, nil, nds.WithDatabaseID("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		key := datastore.IDKey("DatabaseIDsTest", 1, nil)
+		if dbA.CacheKey(key) == dbB.CacheKey(key) {
+			t.Fatal("expected distinct cache keys per database")
+		}
+		if dbA.CacheKey(key) == nds.CacheKey(key) {
+			t.Fatal("expected database cache key to differ from the default")
+		}
+
+		if _, err := dbA.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		defer dbA.Delete(ctx, key)
+
+		// Cache the entity under database a.
+		got := &testEntity{}
+		if err := dbA.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+
+		// Both clients share one datastore here, so change the entity behind
+		// nds' back to stand in for database b holding a different entity.
+		if _, err := dbA.Client.Put(ctx, key, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+
+		if cacher != nil {
+			items, err := cacher.GetMulti(ctx, []string{dbA.CacheKey(key), dbB.CacheKey(key)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := items[dbA.CacheKey(key)]; !ok {
+				t.Fatal("expected entity cached for database a")
+			}
+			if _, ok := items[dbB.CacheKey(key)]; ok {
+				t.Fatal("expected nothing cached for database b")
+			}
+		}
+
+		got = &testEntity{}
+		if err := dbB.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Value != 2 {
+			t.Fatalf("expected database b to miss database a's cache, got %d", got.Value)
+		}
+	}
+}
+
 func TestMarshalUnmarshalPropertyList(t *testing.T) {
 
 	type Int struct {
@@ -822,6 +888,114 @@ func TestCreateCacheKey(t *testing.T) {
 	}
 }
 
+func TestKeyHasher(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(opts ...nds.ClientOption) *nds.Client {
+		t.Helper()
+		c, err := NewClient(ctx, cachers[0].cacher, t, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	hashed := newClient(nds.WithKeyHasher(sha256.New, 100))
+	defaults := newClient()
+
+	short := datastore.NameKey("TestKeyHasher", "short", nil)
+	if got := hashed.CacheKey(short); got != nds.CacheKey(short) {
+		t.Fatalf("expected short key %s to stay readable, got %s", nds.CacheKey(short), got)
+	}
+
+	long := datastore.NameKey("TestKeyHasher", strings.Repeat("a", 100), nil)
+	sum := sha256.Sum256([]byte("NDS1:" + long.Encode()))
+	want := hex.EncodeToString(sum[:])
+	if got := hashed.CacheKey(long); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if got := newClient(nds.WithKeyHasher(sha256.New, 100)).CacheKey(long); got != want {
+		t.Fatalf("expected a stable hash %s, got %s", want, got)
+	}
+	if got := hashed.LockKey(long); got != want {
+		t.Fatalf("expected lock key %s to equal the cache key, got %s", want, got)
+	}
+	if got := defaults.CacheKey(long); got == want || got != nds.CacheKey(long) {
+		t.Fatalf("expected the default key %s, got %s", nds.CacheKey(long), got)
+	}
+	other := datastore.NameKey("TestKeyHasher", strings.Repeat("a", 99)+"b", nil)
+	if hashed.CacheKey(other) == want {
+		t.Fatal("expected different long keys to hash differently")
+	}
+
+	// Entities are cached under the hashed key.
+	type testEntity struct {
+		Value int
+	}
+	if _, err := hashed.Put(ctx, long, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	defer hashed.Delete(ctx, long)
+	if err := hashed.Get(ctx, long, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	items, err := cachers[0].cacher.GetMulti(ctx, []string{want})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := items[want]; !ok || item.Flags != nds.EntityItem {
+		t.Fatalf("expected the entity cached under %s", want)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	parent := datastore.NameKey("Parent", "p", nil)
+	nsParent := datastore.NameKey("Parent", "p", nil)
+	nsParent.Namespace = "tenant"
+	nsChild := datastore.IDKey("Child", 42, nsParent)
+	nsChild.Namespace = "tenant"
+
+	tests := []struct {
+		name string
+		key  *datastore.Key
+		want string
+	}{
+		{
+			"id key",
+			datastore.IDKey("Entity", 1, nil),
+			"NDS1:EgoKBkVudGl0eRAB",
+		},
+		{
+			"name key",
+			datastore.NameKey("Entity", "name", nil),
+			"NDS1:Eg4KBkVudGl0eRoEbmFtZQ",
+		},
+		{
+			"ancestor key",
+			datastore.IDKey("Child", 42, parent),
+			"NDS1:EgsKBlBhcmVudBoBcBIJCgVDaGlsZBAq",
+		},
+		{
+			"namespaced ancestor key",
+			nsChild,
+			"NDS1:CggiBnRlbmFudBILCgZQYXJlbnQaAXASCQoFQ2hpbGQQKg",
+		},
+		{
+			"hashed key",
+			datastore.NameKey("Entity", strings.Repeat("a", 300), nil),
+			"b0ab99af2726923a629e9fb0ea2965f052b5649e",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nds.CacheKey(tt.key); got != tt.want {
+				t.Errorf("CacheKey() = %v, want %v", got, tt.want)
+			}
+			if got := nds.LockKey(tt.key); got != tt.want {
+				t.Errorf("LockKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestNilCacher(t *testing.T) {
 	ctx := context.Background()
 	client, err := nds.NewClient(ctx, nil)
@@ -0,0 +1,64 @@
+package nds
+
+import (
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WithNegativeCacheKinds limits caching that entities don't exist to the
+// kinds in kinds, each with its own TTL, instead of every kind. Negative
+// caching saves the datastore reads of keys that are probed often and rarely
+// exist, but for kinds with a high insert rate the cached not-found results
+// soon go stale, costing the lock of the Put that replaces them. A TTL of 0
+// caches the results of a kind without expiry, like the default of
+// WithCacheTTL.
+//
+// The TTLs replace those of WithCacheTTL and WithDeleteTombstones for not-found
+// results: reads of listed kinds cache them, and so do deletes of listed kinds
+// with WithDeleteTombstones or not. Reads and deletes of the other kinds cache
+// nothing, leaving the lock of the read to expire. Eventually consistent reads
+// keep their own shorter TTL. Whatever the configuration, a Put always
+// replaces a cached not-found result.
+func WithNegativeCacheKinds(kinds map[string]time.Duration) ClientOption {
+	return func(c *Client) {
+		c.negativeKinds = make(map[string]time.Duration, len(kinds))
+		for kind, ttl := range kinds {
+			c.negativeKinds[kind] = ttl
+		}
+	}
+}
+
+// negativeExpiration returns the expiration of the cached not-found result of
+// a read of key, and false if it isn't cached.
+func (c *Client) negativeExpiration(key *datastore.Key) (time.Duration, bool) {
+	if c.negativeKinds == nil {
+		return c.valueExpiration(), true
+	}
+	ttl, ok := c.negativeKinds[key.Kind]
+	return ttl, ok
+}
+
+// tombstoneExpiration returns the expiration of the tombstone of the deleted
+// key, and false if it gets none.
+func (c *Client) tombstoneExpiration(key *datastore.Key) (time.Duration, bool) {
+	if c.negativeKinds == nil {
+		return c.tombstoneTTL, c.tombstoneTTL > 0
+	}
+	ttl, ok := c.negativeKinds[key.Kind]
+	return ttl, ok
+}
+
+// tombstones reports whether deletes might leave tombstones.
+func (c *Client) tombstones() bool {
+	return c.tombstoneTTL > 0 || len(c.negativeKinds) > 0
+}
+
+// shorterExpiration returns the shorter of two expirations, where 0 is the
+// longest as it never expires.
+func shorterExpiration(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,99 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestNegativeCacheSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestNegativeCacheKinds", NegativeCacheKindsTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func NegativeCacheKindsTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		suffix := time.Now().UnixNano()
+		probed := fmt.Sprintf("NegativeCacheKindsTestProbed%d", suffix)
+		inserted := fmt.Sprintf("NegativeCacheKindsTestInserted%d", suffix)
+
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &countingDatastore{Client: dsClient}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient), nds.WithDatastore(ds),
+			nds.WithNegativeCacheKinds(map[string]time.Duration{probed: time.Minute}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		// getMissing reads key three times and returns the datastore reads.
+		getMissing := func(key *datastore.Key) int32 {
+			t.Helper()
+			atomic.StoreInt32(&ds.gets, 0)
+			for i := 0; i < 3; i++ {
+				if err := ndsClient.Get(ctx, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+					t.Fatalf("expected %v, got %v", datastore.ErrNoSuchEntity, err)
+				}
+			}
+			return atomic.LoadInt32(&ds.gets)
+		}
+
+		probedKey := datastore.NameKey(probed, "one", nil)
+		insertedKey := datastore.NameKey(inserted, "one", nil)
+		if n := getMissing(probedKey); n != 1 {
+			t.Fatalf("expected the listed kind read once, got %d reads", n)
+		}
+		if n := getMissing(insertedKey); n != 3 {
+			t.Fatalf("expected the other kind read every time, got %d reads", n)
+		}
+
+		// A Put clears the cached not-found result.
+		if _, err := ndsClient.Put(ctx, probedKey, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		var got testEntity
+		if err := ndsClient.Get(ctx, probedKey, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.IntVal != 1 {
+			t.Fatalf("expected the put entity, got %+v", got)
+		}
+
+		// Deletes of the listed kind leave a tombstone, those of the other
+		// kind leave their lock to expire.
+		if _, err := ndsClient.Put(ctx, insertedKey, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.DeleteMulti(ctx, []*datastore.Key{probedKey, insertedKey}); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[*datastore.Key]nds.CacheState{
+			probedKey:   nds.CacheMissing,
+			insertedKey: nds.CacheLocked,
+		} {
+			report, err := ndsClient.Inspect(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.CacheState != want {
+				t.Fatalf("expected %s to be %s, got %s", key.Kind, want, report.CacheState)
+			}
+		}
+	}
+}
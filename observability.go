@@ -2,7 +2,11 @@ package nds
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
@@ -12,9 +16,19 @@ var (
 	// Measures
 	mCacheHit  = stats.Int64("cache_hit", "The number of cache hits", stats.UnitDimensionless)
 	mCacheMiss = stats.Int64("cache_miss", "The number of cache misses", stats.UnitDimensionless)
+	// A read finding a lock instead of an entity isn't counted as a miss.
+	mCacheLocked = stats.Int64("cache_locked", "The number of cache reads that found a lock", stats.UnitDimensionless)
+
+	mServedStale = stats.Int64("served_stale", "The number of entities served stale because the datastore failed", stats.UnitDimensionless)
+
+	mDatastoreCall    = stats.Int64("datastore_call", "The number of datastore calls", stats.UnitDimensionless)
+	mDatastoreLatency = stats.Float64("datastore_latency", "The latency of datastore calls", stats.UnitMilliseconds)
 
 	// Tag Keys
 	KeyKind, _ = tag.NewKey("kind")
+	// KeyStatus is "ok" or "error" depending on the outcome of a datastore
+	// call.
+	KeyStatus, _ = tag.NewKey("status")
 
 	// Views
 	AllViews = []*view.View{
@@ -32,19 +46,51 @@ var (
 			Aggregation: view.Sum(),
 			TagKeys:     []tag.Key{KeyKind},
 		},
+		{
+			Name:        "nds/cache_locked",
+			Description: "The number of cache reads that found a lock",
+			Measure:     mCacheLocked,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{KeyKind},
+		},
+		{
+			Name:        "nds/served_stale",
+			Description: "The number of entities served stale because the datastore failed",
+			Measure:     mServedStale,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{KeyKind},
+		},
+		{
+			Name:        "nds/datastore_call",
+			Description: "The number of datastore calls",
+			Measure:     mDatastoreCall,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{KeyStatus},
+		},
+		{
+			Name:        "nds/datastore_latency",
+			Description: "The latency distribution of datastore calls",
+			Measure:     mDatastoreLatency,
+			Aggregation: view.Distribution(1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000),
+			TagKeys:     []tag.Key{KeyStatus},
+		},
 	}
 )
 
+// cacheStatsByKind records the cache hits, misses and reads that found a lock
+// still held once any lock wait is over.
 func cacheStatsByKind(ctx context.Context, items []cacheItem) error {
-	cacheStats := make(map[string]*[2]int64)
+	cacheStats := make(map[string]*[3]int64)
 
 	for _, item := range items {
 		if _, ok := cacheStats[item.key.Kind]; !ok {
-			cacheStats[item.key.Kind] = &[2]int64{0, 0}
+			cacheStats[item.key.Kind] = &[3]int64{0, 0, 0}
 		}
-		switch item.state {
-		case done: // Hit
+		switch {
+		case item.state == done: // Hit
 			cacheStats[item.key.Kind][0]++
+		case item.locked: // Lock
+			cacheStats[item.key.Kind][2]++
 		default: // Miss
 			cacheStats[item.key.Kind][1]++
 		}
@@ -58,6 +104,7 @@ func cacheStatsByKind(ctx context.Context, items []cacheItem) error {
 			},
 			mCacheHit.M(s[0]),
 			mCacheMiss.M(s[1]),
+			mCacheLocked.M(s[2]),
 		); err != nil {
 			return err
 		}
@@ -65,3 +112,59 @@ func cacheStatsByKind(ctx context.Context, items []cacheItem) error {
 
 	return nil
 }
+
+// datastoreStats records a datastore call that started at start and returned
+// err.
+func (c *Client) datastoreStats(ctx context.Context, start time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	if err := stats.RecordWithTags(ctx,
+		[]tag.Mutator{
+			tag.Upsert(KeyStatus, status),
+		},
+		mDatastoreCall.M(1),
+		mDatastoreLatency.M(float64(time.Since(start))/float64(time.Millisecond)),
+	); err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:datastoreStats"))
+	}
+}
+
+// Event is a notification emitted by a Client to the ObserverFunc configured
+// with WithObserver. The concrete event types are defined alongside the
+// features that emit them.
+type Event interface {
+	isEvent()
+}
+
+// ObserverFunc is called for every Event emitted by a Client.
+type ObserverFunc func(ctx context.Context, e Event)
+
+// CacheSerializationError reports an entity that could not be encoded for the
+// cache. The call it happened in is not failed by it: the datastore read or
+// write went ahead and the entity simply wasn't cached. It is emitted to the
+// ObserverFunc as an Event and passed to the OnErrorFunc.
+type CacheSerializationError struct {
+	Key *datastore.Key
+	Err error
+}
+
+func (e *CacheSerializationError) Error() string {
+	return fmt.Sprintf("nds: cannot encode entity %v for the cache: %v", e.Key, e.Err)
+}
+
+// Unwrap returns the encoding error.
+func (e *CacheSerializationError) Unwrap() error {
+	return e.Err
+}
+
+func (*CacheSerializationError) isEvent() {}
+
+// cacheSerializationFailed reports that the entity for key could not be
+// encoded for the cache.
+func (c *Client) cacheSerializationFailed(ctx context.Context, key *datastore.Key, err error) {
+	e := &CacheSerializationError{Key: key, Err: err}
+	c.observe(ctx, e)
+	c.onError(ctx, e)
+}
@@ -0,0 +1,132 @@
+package nds_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/stats/view"
+
+	"github.com/qedus/nds/v2"
+	"github.com/qedus/nds/v2/cachers/memory"
+)
+
+func TestViews(t *testing.T) {
+	ctx := context.Background()
+	if err := view.Register(nds.AllViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(nds.AllViews...)
+
+	ndsClient, err := NewClient(ctx, memory.NewCacher(), t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testEntity struct {
+		Value int
+	}
+	key := datastore.NameKey("TestViews", "one", nil)
+	if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	defer ndsClient.Delete(ctx, key)
+	// A miss read from the datastore followed by two hits.
+	for i := 0; i < 3; i++ {
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if hits := viewSum(t, "nds/cache_hit", "TestViews"); hits != 2 {
+		t.Errorf("expected 2 cache hits, got %v", hits)
+	}
+	if misses := viewSum(t, "nds/cache_miss", "TestViews"); misses != 1 {
+		t.Errorf("expected 1 cache miss, got %v", misses)
+	}
+	// The put and the read of the miss.
+	if calls := viewSum(t, "nds/datastore_call", "ok"); calls != 2 {
+		t.Errorf("expected 2 datastore calls, got %v", calls)
+	}
+	if count := viewSum(t, "nds/datastore_latency", "ok"); count != 2 {
+		t.Errorf("expected 2 datastore latencies, got %v", count)
+	}
+}
+
+func TestViewsLockedRead(t *testing.T) {
+	ctx := context.Background()
+	if err := view.Register(nds.AllViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(nds.AllViews...)
+
+	cacher := memory.NewCacher()
+	var logged []string
+	ndsClient, err := NewClient(ctx, cacher, t, func(err error) bool {
+		logged = append(logged, err.Error())
+		return strings.Contains(err.Error(), "locked in the cache")
+	}, nds.WithLockedReadLogging(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testEntity struct {
+		Value int
+	}
+	key := datastore.NameKey("TestViewsLockedRead", "one", nil)
+	if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	defer ndsClient.Delete(ctx, key)
+
+	// Take the cache lock a write in progress would hold.
+	lock := &nds.Item{
+		Key:        ndsClient.CacheKey(key),
+		Flags:      nds.LockItem,
+		Value:      []byte{1, 2, 3, 4},
+		Expiration: time.Minute,
+	}
+	if err := cacher.SetMulti(ctx, []*nds.Item{lock}); err != nil {
+		t.Fatal(err)
+	}
+	got := &testEntity{}
+	if err := ndsClient.Get(ctx, key, got); err != nil {
+		t.Fatal(err)
+	} else if got.Value != 1 {
+		t.Fatalf("expected 1, got %d", got.Value)
+	}
+
+	if locked := viewSum(t, "nds/cache_locked", "TestViewsLockedRead"); locked != 1 {
+		t.Errorf("expected 1 locked cache read, got %v", locked)
+	}
+	if misses := viewSum(t, "nds/cache_miss", "TestViewsLockedRead"); misses != 0 {
+		t.Errorf("expected no cache misses, got %v", misses)
+	}
+	if len(logged) != 1 {
+		t.Errorf("expected the locked read to be reported once, got %q", logged)
+	}
+}
+
+func viewSum(t *testing.T, name, tagValue string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Value != tagValue {
+				continue
+			}
+			switch data := row.Data.(type) {
+			case *view.SumData:
+				return data.Value
+			case *view.DistributionData:
+				return float64(data.Count)
+			}
+		}
+	}
+	return 0
+}
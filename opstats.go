@@ -0,0 +1,108 @@
+package nds
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// OpStats counts the calls made on behalf of the operations given a context
+// from WithOpStats, to attribute their cost. Each count is of round trips: a
+// GetMulti that reads a thousand keys from the cache in one call is one
+// CacheRead. Read the counts once the operations have returned.
+type OpStats struct {
+	// CacheReads counts the Cacher GetMulti calls.
+	CacheReads int64
+	// CacheWrites counts the Cacher AddMulti, SetMulti, CompareAndSwapMulti
+	// and IncrementMulti calls, including the ones setting locks.
+	CacheWrites int64
+	// CacheDeletes counts the Cacher DeleteMulti and CompareAndDeleteMulti
+	// calls, including the ones removing locks.
+	CacheDeletes int64
+	// DatastoreCalls counts the datastore calls.
+	DatastoreCalls int64
+}
+
+type opStatsKey struct{}
+
+// WithOpStats returns a context that makes every Client call using it add the
+// cache and datastore calls it makes to s. Several operations, even
+// concurrent ones, can share s to count a whole request. Calls made in the
+// background after an operation has returned, such as counter flushes, are
+// not counted.
+func WithOpStats(ctx context.Context, s *OpStats) context.Context {
+	return context.WithValue(ctx, opStatsKey{}, s)
+}
+
+func opStatsFrom(ctx context.Context) *OpStats {
+	s, _ := ctx.Value(opStatsKey{}).(*OpStats)
+	return s
+}
+
+// countOp adds one to the count picked by field of the OpStats in ctx, if any.
+func countOp(ctx context.Context, field func(s *OpStats) *int64) {
+	if s := opStatsFrom(ctx); s != nil {
+		atomic.AddInt64(field(s), 1)
+	}
+}
+
+func cacheRead(s *OpStats) *int64     { return &s.CacheReads }
+func cacheWrite(s *OpStats) *int64    { return &s.CacheWrites }
+func cacheDelete(s *OpStats) *int64   { return &s.CacheDeletes }
+func datastoreCall(s *OpStats) *int64 { return &s.DatastoreCalls }
+
+// countingCacher counts the calls made to the wrapped Cacher in the OpStats
+// of their context, and times them for OpTiming.
+type countingCacher struct {
+	Cacher
+}
+
+func (cc *countingCacher) AddMulti(ctx context.Context, items []*Item) error {
+	countOp(ctx, cacheWrite)
+	defer timeCacheCall(ctx, time.Now())
+	return cc.Cacher.AddMulti(ctx, items)
+}
+
+func (cc *countingCacher) CompareAndSwapMulti(ctx context.Context, items []*Item) error {
+	countOp(ctx, cacheWrite)
+	defer timeCacheCall(ctx, time.Now())
+	return cc.Cacher.CompareAndSwapMulti(ctx, items)
+}
+
+func (cc *countingCacher) DeleteMulti(ctx context.Context, keys []string) error {
+	countOp(ctx, cacheDelete)
+	defer timeCacheCall(ctx, time.Now())
+	return cc.Cacher.DeleteMulti(ctx, keys)
+}
+
+func (cc *countingCacher) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	countOp(ctx, cacheRead)
+	defer timeCacheCall(ctx, time.Now())
+	return cc.Cacher.GetMulti(ctx, keys)
+}
+
+func (cc *countingCacher) SetMulti(ctx context.Context, items []*Item) error {
+	countOp(ctx, cacheWrite)
+	defer timeCacheCall(ctx, time.Now())
+	return cc.Cacher.SetMulti(ctx, items)
+}
+
+func (cc *countingCacher) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	inc, ok := cc.Cacher.(Incrementer)
+	if !ok {
+		return nil, ErrIncrementUnsupported
+	}
+	countOp(ctx, cacheWrite)
+	defer timeCacheCall(ctx, time.Now())
+	return inc.IncrementMulti(ctx, keys, deltas)
+}
+
+func (cc *countingCacher) CompareAndDeleteMulti(ctx context.Context, items []*Item) error {
+	cad, ok := cc.Cacher.(CompareAndDeleter)
+	if !ok {
+		return ErrCompareAndDeleteUnsupported
+	}
+	countOp(ctx, cacheDelete)
+	defer timeCacheCall(ctx, time.Now())
+	return cad.CompareAndDeleteMulti(ctx, items)
+}
@@ -0,0 +1,61 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestOpStatsSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestOpStatsPutMulti", OpStatsPutMultiTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func OpStatsPutMultiTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		// Two chunks of the datastore's put limit.
+		kind := fmt.Sprintf("OpStatsPutMultiTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, 501)
+		entities := make([]testEntity, len(keys))
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+			entities[i].IntVal = i
+		}
+
+		var s nds.OpStats
+		if _, err := ndsClient.PutMulti(nds.WithOpStats(ctx, &s), keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each chunk sets its locks, puts its entities and deletes its locks.
+		want := nds.OpStats{CacheWrites: 2, DatastoreCalls: 2, CacheDeletes: 2}
+		if s != want {
+			t.Fatalf("expected %+v, got %+v", want, s)
+		}
+
+		// Operations without the context aren't counted.
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		if s != want {
+			t.Fatalf("expected %+v, got %+v", want, s)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package nds
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// OpTiming is emitted to the ObserverFunc set with WithObserver at the end of
+// every GetMulti, PutMulti and DeleteMulti, to tell whether the cache or the
+// datastore made a slow call slow.
+//
+// CacheDuration and DatastoreDuration are the sums of the durations of every
+// cache and datastore call the operation made. Large operations are split
+// into chunks that run concurrently, so the sums can exceed TotalDuration;
+// compare them with each other rather than with TotalDuration. Calls made in
+// the background once the operation has returned, such as those of
+// WithAsyncCacheFill, are not included.
+type OpTiming struct {
+	// Operation is "GetMulti", "PutMulti" or "DeleteMulti".
+	Operation         string
+	CacheDuration     time.Duration
+	DatastoreDuration time.Duration
+	TotalDuration     time.Duration
+	KeyCount          int
+}
+
+func (OpTiming) isEvent() {}
+
+type opTimingKey struct{}
+
+// opTimer sums the durations of the cache and datastore calls of an
+// operation.
+type opTimer struct {
+	cache, datastore int64
+}
+
+// startOpTiming returns a context that sums the durations of the calls made
+// with it and a function that emits them as an OpTiming, if there is an
+// observer to emit it to.
+func (c *Client) startOpTiming(ctx context.Context, operation string,
+	keyCount int) (context.Context, func()) {
+	if c.observerFn == nil {
+		return ctx, func() {}
+	}
+	t := &opTimer{}
+	timedCtx := context.WithValue(ctx, opTimingKey{}, t)
+	start := time.Now()
+	return timedCtx, func() {
+		c.observe(ctx, OpTiming{
+			Operation:         operation,
+			CacheDuration:     time.Duration(atomic.LoadInt64(&t.cache)),
+			DatastoreDuration: time.Duration(atomic.LoadInt64(&t.datastore)),
+			TotalDuration:     time.Since(start),
+			KeyCount:          keyCount,
+		})
+	}
+}
+
+// timeCacheCall adds the time since start to the cache duration of the
+// operation of ctx, if it is timed.
+func timeCacheCall(ctx context.Context, start time.Time) {
+	if t, ok := ctx.Value(opTimingKey{}).(*opTimer); ok {
+		atomic.AddInt64(&t.cache, int64(time.Since(start)))
+	}
+}
+
+// timeDatastoreCall adds the time since start to the datastore duration of
+// the operation of ctx, if it is timed.
+func timeDatastoreCall(ctx context.Context, start time.Time) {
+	if t, ok := ctx.Value(opTimingKey{}).(*opTimer); ok {
+		atomic.AddInt64(&t.datastore, int64(time.Since(start)))
+	}
+}
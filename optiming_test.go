@@ -0,0 +1,137 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestOpTimingSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestOpTiming", OpTimingTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+// slowPutDatastore makes every PutMulti take at least delay.
+type slowPutDatastore struct {
+	*datastore.Client
+	delay time.Duration
+}
+
+func (s *slowPutDatastore) PutMulti(ctx context.Context,
+	keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	time.Sleep(s.delay)
+	return s.Client.PutMulti(ctx, keys, src)
+}
+
+func OpTimingTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		const cacheDelay, datastoreDelay = 20 * time.Millisecond, 50 * time.Millisecond
+
+		var slowReads bool
+		testCacher := &mockCacher{
+			cacher: cacher,
+			getMultiHook: func(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
+				if slowReads {
+					time.Sleep(cacheDelay)
+				}
+				return cacher.GetMulti(ctx, keys)
+			},
+		}
+
+		var mu sync.Mutex
+		var timings []nds.OpTiming
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil,
+			nds.WithDatastoreClient(dsClient),
+			nds.WithDatastore(&slowPutDatastore{Client: dsClient, delay: datastoreDelay}),
+			nds.WithObserver(func(_ context.Context, e nds.Event) {
+				if timing, ok := e.(nds.OpTiming); ok {
+					mu.Lock()
+					timings = append(timings, timing)
+					mu.Unlock()
+				}
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastTiming := func(operation string, keyCount int) nds.OpTiming {
+			t.Helper()
+			mu.Lock()
+			defer mu.Unlock()
+			if len(timings) == 0 {
+				t.Fatal("expected an OpTiming")
+			}
+			timing := timings[len(timings)-1]
+			timings = nil
+			if timing.Operation != operation || timing.KeyCount != keyCount {
+				t.Fatalf("expected %s of %d keys, got %+v", operation, keyCount, timing)
+			}
+			if timing.TotalDuration < timing.CacheDuration ||
+				timing.TotalDuration < timing.DatastoreDuration {
+				t.Fatalf("expected the total to cover the calls, got %+v", timing)
+			}
+			return timing
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("OpTimingTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "one", nil),
+			datastore.NameKey(kind, "two", nil),
+		}
+
+		// The put is slowed down by the datastore.
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+		timing := lastTiming("PutMulti", len(keys))
+		if timing.DatastoreDuration < datastoreDelay {
+			t.Fatalf("expected a datastore duration of at least %s, got %+v", datastoreDelay, timing)
+		}
+		if timing.CacheDuration >= datastoreDelay {
+			t.Fatalf("expected the cache to be faster than the datastore, got %+v", timing)
+		}
+
+		// Prime the cache, then a read served from it is slowed down by the
+		// cache only.
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+		lastTiming("GetMulti", len(keys))
+		slowReads = true
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+		timing = lastTiming("GetMulti", len(keys))
+		if timing.CacheDuration < cacheDelay {
+			t.Fatalf("expected a cache duration of at least %s, got %+v", cacheDelay, timing)
+		}
+		if timing.DatastoreDuration != 0 {
+			t.Fatalf("expected no datastore duration, got %+v", timing)
+		}
+		slowReads = false
+
+		if err := ndsClient.DeleteMulti(ctx, keys); err != nil {
+			t.Fatal(err)
+		}
+		timing = lastTiming("DeleteMulti", len(keys))
+		if timing.DatastoreDuration == 0 || timing.CacheDuration == 0 {
+			t.Fatalf("expected both durations, got %+v", timing)
+		}
+	}
+}
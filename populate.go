@@ -0,0 +1,85 @@
+package nds
+
+import (
+	"context"
+
+	"go.opencensus.io/trace"
+)
+
+// PopulateTailPolicy decides what happens to the entities WithMaxPopulateRate
+// hasn't written to the cache yet when the read's context is done.
+type PopulateTailPolicy int
+
+const (
+	// PopulateFinish keeps writing the entities to the cache after the
+	// read's context is done, for as long as the cache locks taken by the
+	// read are held. This is the default.
+	PopulateFinish PopulateTailPolicy = iota
+	// PopulateDrop stops writing once the read's context is done. The cache
+	// locks of the entities that weren't written are left to expire, until
+	// which reads of them load them from the datastore without caching them.
+	PopulateDrop
+)
+
+// WithMaxPopulateRate limits how fast entities Get and GetMulti load from the
+// datastore are written back to the cache to perSecond entities per second,
+// smoothing the cache writes of large cold reads. Reads return as soon as the
+// entities are loaded and the writes happen in the background, in batches
+// from a token bucket holding a tenth of a second's worth of entities, at
+// least one, shared by all reads of the client. Other cache writes, such as
+// the locks of puts and deletes, are not limited; use WithCacheRateLimit for
+// those.
+//
+// The writes still compare-and-swap the cache locks taken by the read, so
+// writes happening in the meantime always win, and entities that are still
+// waiting when the locks expire are never cached by the read. tail decides
+// what happens to the remaining entities once the read's context is done. A
+// perSecond of 0 or less disables the limit, which is the default.
+func WithMaxPopulateRate(perSecond float64, tail PopulateTailPolicy) ClientOption {
+	return func(c *Client) {
+		if perSecond <= 0 {
+			c.populateLimit = nil
+			return
+		}
+		c.populateLimit = newTokenBucket(perSecond)
+		c.populateTail = tail
+	}
+}
+
+// populateCache writes saveItems to the cache in the background at the rate
+// set with WithMaxPopulateRate.
+func (c *Client) populateCache(ctx context.Context, saveItems []cacheItem) {
+	if len(saveItems) == 0 {
+		return
+	}
+
+	// The locks expire after cacheLockTime so there is no point in trying
+	// any longer, whatever the caller's deadline was.
+	fillCtx, cancel := context.WithTimeout(detachedContext{ctx}, cacheLockTime)
+	waitCtx, cancelWait := fillCtx, context.CancelFunc(func() {})
+	if c.populateTail == PopulateDrop {
+		waitCtx, cancelWait = context.WithCancel(ctx)
+	}
+	batchSize := int(c.populateLimit.burst)
+
+	go func() {
+		defer func() {
+			cancelWait()
+			cancel()
+		}()
+		var span *trace.Span
+		fillCtx, span = trace.StartSpan(fillCtx, "github.com/qedus/nds.populateCache")
+		defer span.End()
+
+		for lo := 0; lo < len(saveItems); lo += batchSize {
+			hi := lo + batchSize
+			if hi > len(saveItems) {
+				hi = len(saveItems)
+			}
+			if err := c.populateLimit.wait(waitCtx, hi-lo); err != nil {
+				return
+			}
+			c.saveCache(fillCtx, saveItems[lo:hi])
+		}
+	}()
+}
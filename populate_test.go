@@ -0,0 +1,107 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestPopulateSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestMaxPopulateRate", MaxPopulateRateTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func MaxPopulateRateTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var mu sync.Mutex
+		var populated int
+		var first, last time.Time
+		testCacher := &mockCacher{
+			cacher: cacher,
+			compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+				mu.Lock()
+				if populated == 0 {
+					first = time.Now()
+				}
+				populated += len(items)
+				last = time.Now()
+				mu.Unlock()
+				return cacher.CompareAndSwapMulti(ctx, items)
+			},
+		}
+
+		// A burst of 2 entities, then one every 50ms.
+		const rate, count = 20, 20
+		ndsClient, err := NewClient(ctx, testCacher, t, nil,
+			nds.WithMaxPopulateRate(rate, nds.PopulateFinish))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("MaxPopulateRateTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, count)
+		entities := make([]testEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey(kind, strconv.Itoa(i), nil)
+			entities[i] = testEntity{i}
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// The read returns before the cache is populated.
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, count)); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if populated == count {
+			t.Fatal("expected the read to return before the cache was populated")
+		}
+		mu.Unlock()
+
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			mu.Lock()
+			n := populated
+			mu.Unlock()
+			if n == count {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d entities populated, got %d", count, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// All but the burst wait for the bucket to refill.
+		minElapsed := time.Duration(float64(count-2) / rate * 0.9 * float64(time.Second))
+		if elapsed := last.Sub(first); elapsed < minElapsed {
+			t.Fatalf("expected the populate to take at least %s, took %s", minElapsed, elapsed)
+		}
+
+		// Every entity was cached.
+		for _, key := range keys {
+			report, err := ndsClient.Inspect(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.CacheState != nds.CacheEntity {
+				t.Fatalf("expected %s to be cached, got %s", key.Name, report.CacheState)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// GetMultiProjected loads only the given fields of the entities for keys into
+// vals, which must be a slice of the same length as keys like for GetMulti.
+// It saves reading and caching the rest of large entities when only a couple
+// of their properties are needed.
+//
+// The fields are read from the datastore with a projection query per key,
+// which has the limits of any projection query: only indexed properties can
+// be projected, an entity without one of the fields isn't found and is
+// reported as datastore.ErrNoSuchEntity, and only one value of a
+// multi-valued property is loaded. Projection queries are eventually
+// consistent, so they may not see the latest writes.
+//
+// The partial entities are cached under keys made of both the entity's key
+// and the set of fields, in any order, so a projected read is only ever
+// served from the cache to a read of the same fields and never to Get or
+// GetMulti. As writes can't evict every projection of an entity, they expire
+// after five seconds, or the TTL set with WithCacheTTL if that is shorter, and
+// they are neither served nor cached while a write holds the entity's lock.
+func (c *Client) GetMultiProjected(ctx context.Context, keys []*datastore.Key,
+	fields []string, vals interface{}) error {
+
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetMultiProjected")
+	defer span.End()
+	keys = c.keysInNamespace(keys)
+	v := reflect.ValueOf(vals)
+	if err := checkKeysValues(keys, v); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return errors.New("nds: GetMultiProjected needs fields to project")
+	}
+	fields = projectionFields(fields)
+
+	cacheItems := make([]cacheItem, len(keys))
+	for i, key := range keys {
+		cacheItems[i].key = key
+		cacheItems[i].cacheKey = createProjectionKey(c.keys, fields, key)
+		cacheItems[i].val = v.Index(i)
+		cacheItems[i].state = miss
+		if c.cacher == nil || isUncacheable(cacheItems[i].val) {
+			cacheItems[i].state = externalLock
+		}
+	}
+	if c.cacher != nil {
+		if err := c.loadProjectionCache(ctx, cacheItems); err != nil {
+			return err
+		}
+	}
+
+	expiration := eventualCacheTTL
+	if ttl := c.valueExpiration(); ttl > 0 && ttl < expiration {
+		expiration = ttl
+	}
+	sem := make(chan struct{}, eventualConcurrency)
+	var wg sync.WaitGroup
+	for i := range cacheItems {
+		if cacheItems[i].state == done {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(cacheItem *cacheItem) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			c.loadProjection(ctx, cacheItem, fields, expiration)
+		}(&cacheItems[i])
+	}
+	wg.Wait()
+
+	if c.cacher != nil {
+		// Like eventual reads, projections never replace what was cached in
+		// the meantime.
+		c.addEventual(ctx, cacheItems)
+	}
+	return cacheItemErrors(cacheItems)
+}
+
+// projectionFields returns fields sorted and without duplicates, so the same
+// set of fields always gives the same query and cache key.
+func projectionFields(fields []string) []string {
+	sorted := append([]string(nil), fields...)
+	sort.Strings(sorted)
+	unique := sorted[:1]
+	for _, field := range sorted[1:] {
+		if field != unique[len(unique)-1] {
+			unique = append(unique, field)
+		}
+	}
+	return unique
+}
+
+// loadProjectionCache sets the cache items found in the cache along with the
+// entities' own cache slots, and marks the items whose entity is locked by a
+// write in progress so they are read from the datastore and not cached.
+func (c *Client) loadProjectionCache(ctx context.Context, cacheItems []cacheItem) error {
+	cacheKeys := make([]string, 0, 2*len(cacheItems))
+	entityKeys := make([]string, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			entityKeys[i] = createCacheKey(c.keys, cacheItem.key)
+			cacheKeys = append(cacheKeys, cacheItem.cacheKey, entityKeys[i])
+		}
+	}
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+
+	items, err := c.cacher.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		if err := c.readCacheFailed(ctx, err, "nds:GetMultiProjected GetMulti"); err != nil {
+			return err
+		}
+		for i := range cacheItems {
+			cacheItems[i].state = externalLock
+		}
+		return nil
+	}
+
+	for i := range cacheItems {
+		cacheItem := &cacheItems[i]
+		if cacheItem.state != miss {
+			continue
+		}
+		if item, ok := items[entityKeys[i]]; ok && item.Flags == lockItem {
+			cacheItem.state = externalLock
+			cacheItem.locked = true
+			continue
+		}
+		item, ok := items[cacheItem.cacheKey]
+		if !ok {
+			continue
+		}
+		switch item.Flags {
+		case noneItem:
+			cacheItem.state = done
+			cacheItem.err = datastore.ErrNoSuchEntity
+		case entityItem:
+			pl := datastore.PropertyList{}
+			if err := c.unmarshalEntity(item.Value, &pl); err != nil {
+				c.onError(ctx, errors.Wrap(err, "nds:GetMultiProjected unmarshal"))
+				cacheItem.state = externalLock
+				break
+			}
+			cacheItem.state = done
+			cacheItem.err = setValue(cacheItem.val, pl, cacheItem.key)
+		default:
+			cacheItem.state = externalLock
+		}
+	}
+	return nil
+}
+
+// loadProjection reads the projection of the entity for cacheItem from the
+// datastore. If the item missed the cache it gets a cache item to be added
+// by addEventual, expiring after expiration.
+func (c *Client) loadProjection(ctx context.Context, cacheItem *cacheItem,
+	fields []string, expiration time.Duration) {
+
+	key := cacheItem.key
+	q := datastore.NewQuery(key.Kind).Namespace(key.Namespace).
+		Filter("__key__ =", key).Project(fields...).Limit(1)
+	var pls []datastore.PropertyList
+	if err := c.guardDatastore(ctx, func() error {
+		_, err := c.ds.GetAll(ctx, q, &pls)
+		return err
+	}); err != nil {
+		cacheItem.err = err
+		return
+	}
+
+	if len(pls) == 0 {
+		cacheItem.err = datastore.ErrNoSuchEntity
+		if exp, ok := c.negativeExpiration(key); cacheItem.state == miss && ok {
+			cacheItem.item = &Item{
+				Key:        cacheItem.cacheKey,
+				Flags:      noneItem,
+				Value:      []byte{},
+				Expiration: shorterExpiration(expiration, exp),
+			}
+		}
+		return
+	}
+
+	var data []byte
+	var err error
+	if cacheItem.state == miss {
+		if data, err = c.marshalEntity(key, pls[0]); err != nil {
+			c.cacheSerializationFailed(ctx, key, err)
+		}
+	}
+	cacheItem.err = setValue(cacheItem.val, pls[0], key)
+	if cacheItem.state == miss && err == nil {
+		cacheItem.item = &Item{
+			Key:        cacheItem.cacheKey,
+			Flags:      entityItem,
+			Value:      data,
+			Expiration: expiration,
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestGetMultiProjectedSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetMultiProjected", GetMultiProjectedTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func GetMultiProjectedTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Small int
+			Large string
+		}
+
+		kind := fmt.Sprintf("GetMultiProjectedTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "one", nil),
+			datastore.NameKey(kind, "missing", nil),
+		}
+		if _, err := ndsClient.Put(ctx, keys[0], &testEntity{1, "large"}); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]testEntity, len(keys))
+		err = ndsClient.GetMultiProjected(ctx, keys, []string{"Small"}, got)
+		if me, ok := err.(datastore.MultiError); !ok || me[0] != nil ||
+			me[1] != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected only the missing key to fail, got %v", err)
+		}
+		if got[0] != (testEntity{Small: 1}) {
+			t.Fatalf("expected only Small to be loaded, got %+v", got[0])
+		}
+
+		// The projection must not have been cached as the entity.
+		items, err := cacher.GetMulti(ctx, []string{ndsClient.CacheKey(keys[0])})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item, ok := items[ndsClient.CacheKey(keys[0])]; ok {
+			t.Fatalf("expected nothing cached for the entity, got flags %d", item.Flags)
+		}
+		full := testEntity{}
+		if err := ndsClient.Get(ctx, keys[0], &full); err != nil {
+			t.Fatal(err)
+		}
+		if full != (testEntity{1, "large"}) {
+			t.Fatalf("expected the full entity, got %+v", full)
+		}
+
+		// Change the entity behind the cache's back to tell the cached
+		// projection apart from the datastore's.
+		if _, err := ndsClient.Client.Put(ctx, keys[0], &testEntity{2, "larger"}); err != nil {
+			t.Fatal(err)
+		}
+		got = make([]testEntity, 1)
+		if err := ndsClient.GetMultiProjected(ctx, keys[:1], []string{"Small", "Small"}, got); err != nil {
+			t.Fatal(err)
+		}
+		if got[0] != (testEntity{Small: 1}) {
+			t.Fatalf("expected the cached projection, got %+v", got[0])
+		}
+		// Other fields are cached separately.
+		got = make([]testEntity, 1)
+		if err := ndsClient.GetMultiProjected(ctx, keys[:1], []string{"Large", "Small"}, got); err != nil {
+			t.Fatal(err)
+		}
+		if got[0] != (testEntity{2, "larger"}) {
+			t.Fatalf("expected both fields from the datastore, got %+v", got[0])
+		}
+
+		if err := ndsClient.GetMultiProjected(ctx, keys[:1], nil, got); err == nil {
+			t.Fatal("expected an error without fields")
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package nds
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// GetPropertiesMulti works like GetMulti but returns the entities as
+// datastore.PropertyLists, so tools can read entities of any kind without
+// knowing their Go types. It uses the cache the same way GetMulti does.
+func (c *Client) GetPropertiesMulti(ctx context.Context,
+	keys []*datastore.Key) ([]datastore.PropertyList, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetPropertiesMulti")
+	defer span.End()
+
+	pls := make([]datastore.PropertyList, len(keys))
+	if len(keys) == 0 {
+		return pls, nil
+	}
+	return pls, c.GetMulti(ctx, keys, pls)
+}
+
+// GetProperties works like Get but returns the entity as a
+// datastore.PropertyList. If there is no such entity for the key,
+// GetProperties returns ErrNoSuchEntity.
+func (c *Client) GetProperties(ctx context.Context,
+	key *datastore.Key) (datastore.PropertyList, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetProperties")
+	defer span.End()
+
+	var pl datastore.PropertyList
+	return pl, c.Get(ctx, key, &pl)
+}
@@ -0,0 +1,116 @@
+package nds
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Provenance is where Get or GetMulti found an entity, or found that it
+// doesn't exist.
+type Provenance int
+
+const (
+	// ProvenanceDatastore is a strongly consistent datastore read.
+	ProvenanceDatastore Provenance = iota
+	// ProvenanceCache is an entity found in the cache.
+	ProvenanceCache
+	// ProvenanceNegativeCache is an entity the cache recorded as missing.
+	ProvenanceNegativeCache
+	// ProvenanceRequestCache is an entity, or its absence, memoized by
+	// WithRequestCache.
+	ProvenanceRequestCache
+	// ProvenanceEventual is an eventually consistent datastore read made
+	// because of WithEventualConsistency.
+	ProvenanceEventual
+	// ProvenanceStale is a possibly stale copy of an entity served by
+	// WithServeStaleOnDatastoreError because the datastore failed.
+	ProvenanceStale
+)
+
+func (p Provenance) String() string {
+	switch p {
+	case ProvenanceDatastore:
+		return "datastore"
+	case ProvenanceCache:
+		return "cache-hit"
+	case ProvenanceNegativeCache:
+		return "negative-cache"
+	case ProvenanceRequestCache:
+		return "request-cache"
+	case ProvenanceEventual:
+		return "eventual-datastore"
+	case ProvenanceStale:
+		return "stale-cache"
+	}
+	return "unknown"
+}
+
+// ProvenanceFunc is called by WithProvenance reads for every key they serve.
+type ProvenanceFunc func(key *datastore.Key, p Provenance)
+
+type provenanceKey struct{}
+
+// WithProvenance returns a context that makes Get, GetMulti and the calls
+// built on them report where each entity came from to f, to help diagnose
+// stale reads. f is called once per key that was served, with its entity or
+// with ErrNoSuchEntity, and not for keys that failed. Large GetMulti calls
+// call f from several goroutines at once. Reads without the context pay
+// nothing, so it can be switched on per request, for example by a debug
+// header.
+func WithProvenance(ctx context.Context, f ProvenanceFunc) context.Context {
+	return context.WithValue(ctx, provenanceKey{}, f)
+}
+
+func provenanceFrom(ctx context.Context) ProvenanceFunc {
+	f, _ := ctx.Value(provenanceKey{}).(ProvenanceFunc)
+	return f
+}
+
+// reportProvenance reports p for key to f, if any, if the read served it.
+func reportProvenance(f ProvenanceFunc, key *datastore.Key, err error, p Provenance) {
+	if f != nil && (err == nil || err == datastore.ErrNoSuchEntity) {
+		f(key, p)
+	}
+}
+
+// reportCacheItemsProvenance reports the cache hits of cacheItems and that
+// the rest were loaded from the datastore the way loaded says.
+func reportCacheItemsProvenance(ctx context.Context, cacheItems []cacheItem, loaded Provenance) {
+	f := provenanceFrom(ctx)
+	if f == nil {
+		return
+	}
+	for _, cacheItem := range cacheItems {
+		p := loaded
+		if cacheItem.stale {
+			p = ProvenanceStale
+		} else if cacheItem.state == done {
+			p = ProvenanceCache
+			if cacheItem.err == datastore.ErrNoSuchEntity {
+				p = ProvenanceNegativeCache
+			}
+		}
+		reportProvenance(f, cacheItem.key, cacheItem.err, p)
+	}
+}
+
+// reportErrorsProvenance reports p for the keys served by a read that
+// returned err.
+func reportErrorsProvenance(ctx context.Context, keys []*datastore.Key, err error, p Provenance) {
+	f := provenanceFrom(ctx)
+	if f == nil {
+		return
+	}
+	me, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return
+	}
+	for i, key := range keys {
+		var keyErr error
+		if me != nil {
+			keyErr = me[i]
+		}
+		reportProvenance(f, key, keyErr, p)
+	}
+}
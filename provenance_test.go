@@ -0,0 +1,130 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestProvenanceSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetProvenance", GetProvenanceTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+// provenanceRecorder collects the provenance reported for each key.
+type provenanceRecorder struct {
+	mu   sync.Mutex
+	seen map[string]nds.Provenance
+}
+
+func (r *provenanceRecorder) record(key *datastore.Key, p nds.Provenance) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen == nil {
+		r.seen = make(map[string]nds.Provenance)
+	}
+	r.seen[key.String()] = p
+}
+
+// check fails t unless exactly want was reported since the last check.
+func (r *provenanceRecorder) check(t *testing.T, want map[*datastore.Key]nds.Provenance) {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.seen) != len(want) {
+		t.Fatalf("expected %d keys reported, got %v", len(want), r.seen)
+	}
+	for key, p := range want {
+		if got, ok := r.seen[key.String()]; !ok || got != p {
+			t.Fatalf("expected %v for %v, got %v", p, key, got)
+		}
+	}
+	r.seen = nil
+}
+
+func GetProvenanceTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("GetProvenanceTest%d", time.Now().UnixNano())
+		found := datastore.NameKey(kind, "found", nil)
+		missing := datastore.NameKey(kind, "missing", nil)
+		uncached := datastore.NameKey(kind, "uncached", nil)
+		failed := datastore.IncompleteKey(kind, nil)
+		if _, err := ndsClient.PutMulti(ctx, []*datastore.Key{found, uncached},
+			[]testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var rec provenanceRecorder
+		pctx := nds.WithProvenance(ctx, rec.record)
+		keys := []*datastore.Key{found, missing}
+		get := func(ctx context.Context, keys []*datastore.Key) {
+			t.Helper()
+			err := ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys)))
+			if _, ok := err.(datastore.MultiError); err != nil && !ok {
+				t.Fatal(err)
+			}
+		}
+
+		get(pctx, keys)
+		rec.check(t, map[*datastore.Key]nds.Provenance{
+			found:   nds.ProvenanceDatastore,
+			missing: nds.ProvenanceDatastore,
+		})
+
+		get(pctx, keys)
+		rec.check(t, map[*datastore.Key]nds.Provenance{
+			found:   nds.ProvenanceCache,
+			missing: nds.ProvenanceNegativeCache,
+		})
+
+		// Keys that fail aren't reported.
+		if err := ndsClient.Get(pctx, failed, &testEntity{}); err == nil {
+			t.Fatal("expected an incomplete key to fail")
+		}
+		rec.check(t, nil)
+
+		rctx := nds.WithRequestCache(pctx)
+		get(rctx, keys)
+		rec.check(t, map[*datastore.Key]nds.Provenance{
+			found:   nds.ProvenanceCache,
+			missing: nds.ProvenanceNegativeCache,
+		})
+		get(rctx, keys)
+		rec.check(t, map[*datastore.Key]nds.Provenance{
+			found:   nds.ProvenanceRequestCache,
+			missing: nds.ProvenanceRequestCache,
+		})
+
+		get(nds.WithEventualConsistency(pctx), []*datastore.Key{found, uncached})
+		rec.check(t, map[*datastore.Key]nds.Provenance{
+			found:    nds.ProvenanceCache,
+			uncached: nds.ProvenanceEventual,
+		})
+
+		// Without the context nothing is reported.
+		get(ctx, keys)
+		rec.check(t, nil)
+
+		if got := nds.ProvenanceNegativeCache.String(); got != "negative-cache" {
+			t.Fatalf("expected negative-cache, got %q", got)
+		}
+	}
+}
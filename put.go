@@ -1,7 +1,9 @@
 package nds
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"reflect"
 	"sync"
 
@@ -25,11 +27,26 @@ var (
 // removes the API limit of 500 entities per request by calling the datastore as
 // many times as required to put all the keys. It does this efficiently and
 // concurrently.
+//
+// Each shard of up to 500 entities locks its keys in the cache, puts them and
+// unlocks them on its own, so one shard's datastore put overlaps the cache
+// calls of the others rather than waiting for every lock to be set.
+//
+// Incomplete keys bypass the cache entirely: no cache lock is set for them
+// and, even with write-through enabled, nothing is cached under the keys the
+// datastore allocates. The allocated keys are simply returned.
+//
+// Pass WithConcurrency to override the Client's write concurrency. With
+// WithBatchErrors the errors of individual keys are returned as a *BatchError.
 func (c *Client) PutMulti(ctx context.Context,
-	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+	keys []*datastore.Key, vals interface{}, opts ...CallOption) ([]*datastore.Key, error) {
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.PutMulti")
 	defer span.End()
+	ctx, emitTiming := c.startOpTiming(ctx, "PutMulti", len(keys))
+	defer emitTiming()
+	callerKeys := keys
+	keys = c.keysInNamespace(keys)
 
 	if len(keys) == 0 {
 		return nil, nil
@@ -37,6 +54,16 @@ func (c *Client) PutMulti(ctx context.Context,
 
 	v := reflect.ValueOf(vals)
 	if err := checkKeysValues(keys, v); err != nil {
+		return nil, c.batchError(callerKeys, err)
+	}
+	if err := checkPutValues(v); err != nil {
+		return nil, c.batchError(callerKeys, err)
+	}
+	if err := c.checkEncodable(keys, v); err != nil {
+		return nil, c.batchError(callerKeys, err)
+	}
+	limit, err := newCallOptions(opts).shardLimit(c.writeLimit)
+	if err != nil {
 		return nil, err
 	}
 
@@ -54,8 +81,12 @@ func (c *Client) PutMulti(ctx context.Context,
 		}
 
 		go func(i int, keys []*datastore.Key, vals reflect.Value) {
-			putKeys[i], errs[i] = c.putMulti(ctx, keys, vals.Interface())
-			wg.Done()
+			defer wg.Done()
+			if errs[i] = limit.acquire(ctx); errs[i] != nil {
+				return
+			}
+			defer limit.release()
+			putKeys[i], errs[i] = c.putMultiBudgeted(ctx, keys, vals)
 		}(i, keys[lo:hi], v.Slice(lo, hi))
 	}
 	wg.Wait()
@@ -96,7 +127,7 @@ func (c *Client) PutMulti(ctx context.Context,
 		}
 	}
 
-	return groupedKeys, groupedErrs
+	return groupedKeys, c.batchError(callerKeys, groupedErrs)
 }
 
 // Put saves the entity val into the datastore with key. val must be a struct
@@ -108,14 +139,22 @@ func (c *Client) Put(ctx context.Context,
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Put")
 	defer span.End()
+	key = c.inNamespace(key)
 
 	keys := []*datastore.Key{key}
 	vals := []interface{}{val}
-	if err := checkKeysValues(keys, reflect.ValueOf(vals)); err != nil {
+	v := reflect.ValueOf(vals)
+	if err := checkKeysValues(keys, v); err != nil {
 		return nil, err
 	}
+	if err := checkPutValues(v); err != nil {
+		return nil, err.(datastore.MultiError)[0]
+	}
+	if err := c.checkEncodable(keys, v); err != nil {
+		return nil, err.(datastore.MultiError)[0]
+	}
 
-	keys, err := c.putMulti(ctx, keys, vals)
+	keys, err := c.putMultiBudgeted(ctx, keys, v)
 	switch e := err.(type) {
 	case nil:
 		return keys[0], nil
@@ -126,30 +165,190 @@ func (c *Client) Put(ctx context.Context,
 	}
 }
 
+// checkPutValues returns a datastore.MultiError naming every nil entity in
+// vals so the mistake is reported before any cache or datastore call is made.
+func checkPutValues(vals reflect.Value) error {
+	isNilErr, nilErr := false, make(datastore.MultiError, vals.Len())
+	for i := 0; i < vals.Len(); i++ {
+		if isNilValue(vals.Index(i)) {
+			isNilErr = true
+			nilErr[i] = fmt.Errorf("nds: nil entity at index %d", i)
+		}
+	}
+	if isNilErr {
+		return nilErr
+	}
+	return nil
+}
+
+func isNilValue(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Interface:
+		if val.IsNil() {
+			return true
+		}
+		val = val.Elem()
+		return val.Kind() == reflect.Ptr && val.IsNil()
+	case reflect.Ptr:
+		return val.IsNil()
+	}
+	return false
+}
+
 // putMulti locks the items in cache, puts the entities into the datastore, and then deletes the locks in cache.
+// With write-through enabled the locks are replaced by the just written entities instead.
 func (c *Client) putMulti(ctx context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+	var lockCacheItems []*Item
+	var written bool
+	if c.cacher != nil && c.breaker != nil && c.breaker.rejecting() {
+		// Don't evict entities with locks for a write that can't happen.
+		return nil, ErrCircuitOpen
+	}
+
+	c.forgetRequestCache(ctx, keys)
+	defer c.forgetRequestCache(ctx, keys)
+	c.rememberWrites(ctx, keys)
+
+	lockKeys, immutable := c.splitImmutable(keys)
 	if c.cacher != nil {
-		lockCacheKeys, lockCacheItems := getCacheLocks(keys)
+		var lockCacheKeys []string
+		lockCacheKeys, lockCacheItems = getCacheLocks(c.keys, lockKeys)
 
+		locked := true
 		defer func() {
-			// Remove the locks.
-			if err := c.cacher.DeleteMulti(ctx,
-				lockCacheKeys); err != nil {
-				c.onError(ctx, errors.Wrap(err, "putMulti cache.DeleteMulti"))
+			// Remove the locks, even if ctx has been canceled.
+			switch {
+			case !locked:
+				c.invalidateCache(ctx, lockCacheKeys, "putMulti cache.DeleteMulti")
+			case written:
+				c.unlockCacheAsync(ctx, lockCacheItems, "putMulti cache.DeleteMulti")
+			case c.keepFailedLocks:
+				// The locks expire by themselves.
+			default:
+				c.unlockCache(ctx, lockCacheItems, "putMulti cache.DeleteMulti")
 			}
 		}()
 
-		if err := c.cacher.SetMulti(ctx,
+		// Without the locks the deferred DeleteMulti removes the entities.
+		if err := c.setLocks(ctx,
 			lockCacheItems); err != nil {
-			return nil, err
+			if err := c.lockCacheFailed(ctx, err, "putMulti cache.SetMulti"); err != nil {
+				return nil, err
+			}
+			locked = false
 		}
+	}
 
+	var putKeys []*datastore.Key
+	err := c.guardDatastore(ctx, func() (err error) {
 		if putMultiHook != nil {
 			if err := putMultiHook(); err != nil {
-				return keys, err
+				putKeys = keys
+				return err
+			}
+		}
+		putKeys, err = c.ds.PutMulti(ctx, keys, vals)
+		return
+	})
+	if err == nil {
+		// Incomplete keys are only known once they are put.
+		c.rememberWrites(ctx, putKeys)
+		c.invalidateQueries(ctx, putKeys)
+		written = true
+	}
+	if err == nil && c.cacher != nil && len(immutable) > 0 {
+		c.cacheImmutable(ctx, putKeys, reflect.ValueOf(vals), immutable)
+	}
+	if err == nil && c.cacher != nil && c.writeThrough {
+		lockCacheItems = c.replaceLocks(ctx, keys, reflect.ValueOf(vals), lockCacheItems)
+	}
+	return putKeys, err
+}
+
+// replaceLocks replaces the locks set by putMulti with the entities that were
+// just written so the next read is a cache hit. Only locks that are still the
+// ones putMulti set are replaced, using compare-and-swap, so a concurrent
+// writer's lock is never overwritten. Entities are cached the way the
+// datastore returns them, not the way they were passed in. It returns the
+// locks that could not be replaced and still need to be removed.
+func (c *Client) replaceLocks(ctx context.Context, keys []*datastore.Key,
+	vals reflect.Value, lockCacheItems []*Item) []*Item {
+
+	lockCacheKeys := make([]string, len(lockCacheItems))
+	for i, item := range lockCacheItems {
+		lockCacheKeys[i] = item.Key
+	}
+
+	// Duplicate keys are ambiguous and uncacheable entities must not be
+	// cached so neither is written through.
+	values := make(map[string]reflect.Value, len(keys))
+	valueKeys := make(map[string]*datastore.Key, len(keys))
+	skip := make(map[string]bool)
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		cacheKey := createCacheKey(c.keys, key)
+		if _, ok := values[cacheKey]; ok || isUncacheable(vals.Index(i)) {
+			skip[cacheKey] = true
+		}
+		values[cacheKey] = vals.Index(i)
+		valueKeys[cacheKey] = key
+	}
+
+	items, err := c.cacher.GetMulti(ctx, lockCacheKeys)
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:replaceLocks GetMulti"))
+		return lockCacheItems
+	}
+
+	remaining := make([]*Item, 0, len(lockCacheItems))
+	swapItems := make([]*Item, 0, len(lockCacheItems))
+	swapLocks := make([]*Item, 0, len(lockCacheItems))
+	for _, lock := range lockCacheItems {
+		item, ok := items[lock.Key]
+		if !ok || skip[lock.Key] || item.Flags != lockItem ||
+			!bytes.Equal(item.Value, lock.Value) {
+			remaining = append(remaining, lock)
+			continue
+		}
+
+		pl, err := saveValue(values[lock.Key])
+		if err == nil {
+			item.Value, err = c.marshalEntity(valueKeys[lock.Key], roundTripPropertyList(pl))
+		}
+		if err != nil {
+			c.cacheSerializationFailed(ctx, valueKeys[lock.Key], err)
+			remaining = append(remaining, lock)
+			continue
+		}
+		exp, ok := c.capExpiration(c.valueExpiration(), pl, values[lock.Key])
+		if !ok {
+			remaining = append(remaining, lock)
+			continue
+		}
+		item.Flags = entityItem
+		item.Expiration = exp
+		swapItems = append(swapItems, item)
+		swapLocks = append(swapLocks, lock)
+	}
+
+	if len(swapItems) == 0 {
+		return remaining
+	}
+
+	if err := c.cacher.CompareAndSwapMulti(ctx, swapItems); err != nil {
+		if me, ok := err.(MultiError); ok {
+			for i, e := range me {
+				if e != nil {
+					remaining = append(remaining, swapLocks[i])
+				}
 			}
+		} else {
+			remaining = append(remaining, swapLocks...)
 		}
+		c.onError(ctx, errors.Wrap(err, "nds:replaceLocks CompareAndSwapMulti"))
 	}
-	return c.Client.PutMulti(ctx, keys, vals)
+	return remaining
 }
@@ -1,12 +1,16 @@
 package nds_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/datastore"
 
@@ -25,6 +29,18 @@ func TestPutSuite(t *testing.T) {
 			t.Run("TestPutMultiUnlockCacheSuccess", PutMultiUnlockCacheSuccessTest(item.ctx, item.cacher))
 			t.Run("TestPutDatastoreMultiError", PutDatastoreMultiErrorTest(item.ctx, item.cacher))
 			t.Run("TestPutMultiZeroKeys", PutMultiZeroKeysTest(item.ctx, item.cacher))
+			t.Run("TestPutWriteThrough", PutWriteThroughTest(item.ctx, item.cacher))
+			t.Run("TestPutWriteThroughTime", PutWriteThroughTimeTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiIncompleteKeys", PutMultiIncompleteKeysTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiNilValue", PutMultiNilValueTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiNotSlice", PutMultiNotSliceTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiCanceledUnlock", PutMultiCanceledUnlockTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiNewerLockSurvives", PutMultiNewerLockSurvivesTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiReaderLockRemoved", PutMultiReaderLockRemovedTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiMaxInFlightBytes", PutMultiMaxInFlightBytesTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiTTLJitter", PutMultiTTLJitterTest(item.ctx, item.cacher))
+			t.Run("TestPutCacheSerializationError", PutCacheSerializationErrorTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiShardPipelining", PutMultiShardPipeliningTest(item.ctx, item.cacher))
 		})
 	}
 }
@@ -277,3 +293,793 @@ func PutMultiZeroKeysTest(ctx context.Context, cacher nds.Cacher) func(t *testin
 		}
 	}
 }
+
+func PutWriteThroughTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithWriteThrough(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+
+		keys := []*datastore.Key{
+			datastore.NameKey("PutWriteThroughTest", "one", nil),
+			datastore.NameKey("PutWriteThroughTest", "two", nil),
+		}
+		entities := []TestEntity{{1}, {2}}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		items, err := cacher.GetMulti(ctx, []string{nds.CacheKey(keys[0]), nds.CacheKey(keys[1])})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if item, ok := items[nds.CacheKey(key)]; !ok || item.Flags != nds.EntityItem {
+				t.Fatalf("expected entity item cached for %s", key)
+			}
+		}
+
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				return errors.New("should not be called")
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		got := make([]TestEntity, len(keys))
+		if err := ndsClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		for i := range got {
+			if got[i] != entities[i] {
+				t.Fatalf("expected %v, got %v", entities[i], got[i])
+			}
+		}
+	}
+}
+
+func PutWriteThroughTimeTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithWriteThrough(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			When  time.Time
+			Times []time.Time
+		}
+
+		key := datastore.NameKey("PutWriteThroughTimeTest", "one", nil)
+		when := time.Date(2019, 8, 1, 12, 30, 15, 123456789, time.UTC)
+		entity := &TestEntity{When: when, Times: []time.Time{when, when.Add(time.Nanosecond)}}
+		if _, err := ndsClient.Put(ctx, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, key)
+
+		// Read the cached entity.
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				return errors.New("should not be called")
+			}
+			return nil
+		})
+		cached := &TestEntity{}
+		err = ndsClient.Get(ctx, key, cached)
+		nds.SetDatastoreGetMultiHook(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored := &TestEntity{}
+		if err := ndsClient.Client.Get(ctx, key, stored); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(cached, stored) {
+			t.Fatalf("expected cached %+v to equal stored %+v", cached, stored)
+		}
+		want := when.Truncate(time.Microsecond)
+		if !cached.When.Equal(want) || cached.When.Location() != time.Local {
+			t.Fatalf("expected %v in local time, got %v", want, cached.When)
+		}
+	}
+}
+
+func PutMultiTTLJitterTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var locks, values []*nds.Item
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				locks = append(locks, items...)
+				return cacher.SetMulti(ctx, items)
+			},
+			compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+				values = append(values, items...)
+				return cacher.CompareAndSwapMulti(ctx, items)
+			},
+		}
+
+		// Step evenly through [0, 1) so the spread is deterministic.
+		const count = 20
+		ttl, fraction := time.Hour, 0.1
+		ndsClient, err := NewClient(ctx, testCacher, t, nil, nds.WithWriteThrough(true),
+			nds.WithCacheTTL(ttl), nds.WithTTLJitter(fraction),
+			nds.WithRand(&stepSource{steps: count}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+		keys := make([]*datastore.Key, count)
+		entities := make([]TestEntity, count)
+		for i := range keys {
+			keys[i] = datastore.IDKey("PutMultiTTLJitterTest", int64(i+1), nil)
+			entities[i] = TestEntity{i}
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, keys)
+
+		for _, item := range locks {
+			if item.Flags == nds.EntityItem || item.Expiration <= 0 ||
+				item.Expiration > time.Minute {
+				t.Fatalf("expected a short fixed lock expiration, got %v", item.Expiration)
+			}
+		}
+
+		if len(values) != count {
+			t.Fatalf("expected %d cached values, got %d", count, len(values))
+		}
+		min := time.Duration(float64(ttl) * (1 - fraction))
+		max := time.Duration(float64(ttl) * (1 + fraction))
+		seen := map[time.Duration]bool{}
+		for _, item := range values {
+			if item.Expiration < min || item.Expiration > max {
+				t.Fatalf("expiration %v outside [%v, %v]", item.Expiration, min, max)
+			}
+			seen[item.Expiration] = true
+		}
+		if len(seen) != count {
+			t.Fatalf("expected %d distinct expirations, got %d", count, len(seen))
+		}
+	}
+}
+
+func PutCacheSerializationErrorTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var events []nds.Event
+		ndsClient, err := NewClient(ctx, cacher, t, func(err error) bool {
+			_, ok := err.(*nds.CacheSerializationError)
+			return ok
+		}, nds.WithWriteThrough(true), nds.WithObserver(func(_ context.Context, e nds.Event) {
+			events = append(events, e)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encodeErr := errors.New("cannot encode")
+		nds.SetMarshal(func(pl datastore.PropertyList) ([]byte, error) {
+			return nil, encodeErr
+		})
+		defer nds.SetMarshal(nds.MarshalPropertyList)
+
+		type testEntity struct {
+			Value int
+		}
+		key := datastore.NameKey("PutCacheSerializationErrorTest", "one", nil)
+		if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+			t.Fatalf("expected the put to succeed, got %v", err)
+		}
+		defer ndsClient.Delete(ctx, key)
+
+		stored := &testEntity{}
+		if err := ndsClient.Client.Get(ctx, key, stored); err != nil || stored.Value != 1 {
+			t.Fatalf("expected the entity to be written, got %v and %v", stored, err)
+		}
+
+		if len(events) != 1 {
+			t.Fatalf("expected 1 event, got %v", events)
+		}
+		serr, ok := events[0].(*nds.CacheSerializationError)
+		if !ok {
+			t.Fatalf("expected a *nds.CacheSerializationError, got %T", events[0])
+		}
+		if !serr.Key.Equal(key) || !errors.Is(serr, encodeErr) {
+			t.Fatalf("expected %v wrapping %v, got %v", key, encodeErr, serr)
+		}
+	}
+}
+
+func PutMultiIncompleteKeysTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var locked []*nds.Item
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				locked = append(locked, items...)
+				return cacher.SetMulti(ctx, items)
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil, nds.WithWriteThrough(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+
+		keys := []*datastore.Key{
+			datastore.IncompleteKey("PutMultiIncompleteKeysTest", nil),
+			datastore.IncompleteKey("PutMultiIncompleteKeysTest", nil),
+		}
+		putKeys, err := ndsClient.PutMulti(ctx, keys, []TestEntity{{1}, {2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(locked) != 0 {
+			t.Fatalf("expected no cache locks, got %d", len(locked))
+		}
+
+		cacheKeys := make([]string, len(putKeys))
+		for i, key := range putKeys {
+			if key.Incomplete() {
+				t.Fatalf("expected complete key, got %s", key)
+			}
+			cacheKeys[i] = nds.CacheKey(key)
+		}
+
+		items, err := cacher.GetMulti(ctx, cacheKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 0 {
+			t.Fatalf("expected no cache items, got %d", len(items))
+		}
+	}
+}
+
+func PutMultiNilValueTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+
+		keys := []*datastore.Key{
+			datastore.IDKey("PutMultiNilValueTest", 1, nil),
+			datastore.IDKey("PutMultiNilValueTest", 2, nil),
+			datastore.IDKey("PutMultiNilValueTest", 3, nil),
+		}
+
+		for _, vals := range []interface{}{
+			[]*TestEntity{{1}, nil, {3}},
+			[]interface{}{&TestEntity{1}, (*TestEntity)(nil), &TestEntity{3}},
+			[]interface{}{&TestEntity{1}, nil, &TestEntity{3}},
+		} {
+			_, err := ndsClient.PutMulti(ctx, keys, vals)
+			me, ok := err.(datastore.MultiError)
+			if !ok {
+				t.Fatalf("expected datastore.MultiError, got %v", err)
+			}
+			if me[0] != nil || me[2] != nil {
+				t.Fatalf("expected only index 1 to error, got %v", me)
+			}
+			if me[1] == nil || !strings.Contains(me[1].Error(), "index 1") {
+				t.Fatalf("expected error naming index 1, got %v", me[1])
+			}
+		}
+
+		if _, err := ndsClient.Put(ctx, keys[0], (*TestEntity)(nil)); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
+
+func PutMultiNotSliceTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type TestEntity struct {
+			Value int
+		}
+
+		// More keys than fit in one datastore call, so the values would
+		// be sharded.
+		keys := make([]*datastore.Key, 501)
+		for i := range keys {
+			keys[i] = datastore.IDKey("PutMultiNotSliceTest", int64(i+1), nil)
+		}
+
+		for _, test := range []struct {
+			vals interface{}
+			want string
+		}{
+			{map[int]*TestEntity{1: {1}}, "map[int]*nds_test.TestEntity"},
+			{make(chan *TestEntity), "chan *nds_test.TestEntity"},
+			{[501]TestEntity{}, "[501]nds_test.TestEntity"},
+			{nil, "nil"},
+		} {
+			_, err := ndsClient.PutMulti(ctx, keys, test.vals)
+			if err == nil || !strings.Contains(err.Error(), "not a slice") ||
+				!strings.Contains(err.Error(), test.want) {
+				t.Fatalf("expected an error naming %s, got %v", test.want, err)
+			}
+		}
+	}
+}
+
+func PutMultiCanceledUnlockTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// Fail cache calls made with a canceled context, like a networked
+		// cache would.
+		deleted := make(chan []string, 1)
+		testCacher := &mockCacher{
+			cacher: cacher,
+			deleteMultiHook: func(ctx context.Context, keys []string) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				err := cacher.DeleteMulti(ctx, keys)
+				deleted <- keys
+				return err
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("PutMultiCanceledUnlockTest%d",
+			time.Now().UnixNano()), "key", nil)
+		cacheKey := ndsClient.CacheKey(key)
+
+		// The request is canceled while the datastore write is in flight.
+		putCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		nds.SetDatastorePutMultiHook(func() error {
+			cancel()
+			return context.Canceled
+		})
+		defer nds.SetDatastorePutMultiHook(nil)
+
+		if _, err := ndsClient.Put(putCtx, key, &testEntity{1}); err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+		// Put returns with its context, leaving the removal to finish.
+		select {
+		case keys := <-deleted:
+			if len(keys) != 1 || keys[0] != cacheKey {
+				t.Fatalf("expected the lock on %s removed, got %v", cacheKey, keys)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the lock on %s removed", cacheKey)
+		}
+		items, err := cacher.GetMulti(ctx, []string{cacheKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := items[cacheKey]; ok {
+			t.Fatalf("expected no lock left on %s", cacheKey)
+		}
+	}
+}
+
+func PutMultiNewerLockSurvivesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			IntVal int
+		}
+
+		// mockCacher doesn't implement CompareAndDeleter, so its Client
+		// falls back to deleting whatever lock is there.
+		_, compareAndDelete := cacher.(nds.CompareAndDeleter)
+		for _, test := range []struct {
+			cacher       nds.Cacher
+			writeThrough bool
+			survives     bool
+		}{
+			{cacher, false, compareAndDelete},
+			{cacher, true, compareAndDelete},
+			{&mockCacher{cacher: cacher}, false, false},
+		} {
+			ndsClient, err := NewClient(ctx, test.cacher, t, nil,
+				nds.WithWriteThrough(test.writeThrough))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := datastore.NameKey(fmt.Sprintf("PutMultiNewerLockSurvivesTest%d",
+				time.Now().UnixNano()), "key", nil)
+			cacheKey := ndsClient.CacheKey(key)
+
+			// A second writer locks the key while the first one is writing
+			// to the datastore.
+			newerLock := &nds.Item{
+				Key:        cacheKey,
+				Flags:      nds.LockItem,
+				Value:      nds.WriterLock(),
+				Expiration: time.Minute,
+			}
+			nds.SetDatastorePutMultiHook(func() error {
+				return cacher.SetMulti(ctx, []*nds.Item{newerLock})
+			})
+
+			if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+				nds.SetDatastorePutMultiHook(nil)
+				t.Fatal(err)
+			}
+			nds.SetDatastorePutMultiHook(nil)
+
+			items, err := cacher.GetMulti(ctx, []string{cacheKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			item, ok := items[cacheKey]
+			if !test.survives {
+				if ok {
+					t.Fatalf("%T: expected the lock removed, got %+v", test.cacher, item)
+				}
+				continue
+			}
+			if !ok || item.Flags != nds.LockItem ||
+				!bytes.Equal(item.Value, newerLock.Value) {
+				t.Fatalf("%T writeThrough=%v: expected the newer writer's lock, got %+v",
+					test.cacher, test.writeThrough, item)
+			}
+			if err := cacher.DeleteMulti(ctx, []string{cacheKey}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func PutMultiReaderLockRemovedTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			IntVal int
+		}
+
+		for _, writeThrough := range []bool{false, true} {
+			ndsClient, err := NewClient(ctx, cacher, t, nil,
+				nds.WithWriteThrough(writeThrough))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := datastore.NameKey(fmt.Sprintf("PutMultiReaderLockRemovedTest%d",
+				time.Now().UnixNano()), "key", nil)
+			cacheKey := ndsClient.CacheKey(key)
+
+			if _, err := ndsClient.Put(ctx, key, &testEntity{1}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The writer's lock is lost while it writes to the datastore, so
+			// a read locks the key itself and caches the entity being
+			// replaced.
+			nds.SetDatastorePutMultiHook(func() error {
+				if err := cacher.DeleteMulti(ctx, []string{cacheKey}); err != nil {
+					return err
+				}
+				return ndsClient.Get(ctx, key, &testEntity{})
+			})
+			_, err = ndsClient.Put(ctx, key, &testEntity{2})
+			nds.SetDatastorePutMultiHook(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := &testEntity{}
+			if err := ndsClient.Get(ctx, key, got); err != nil {
+				t.Fatal(err)
+			}
+			if got.IntVal != 2 {
+				t.Fatalf("writeThrough=%v: expected 2, got %d", writeThrough, got.IntVal)
+			}
+
+			// A read's lock left in place is removed too.
+			nds.SetDatastorePutMultiHook(func() error {
+				return cacher.SetMulti(ctx, []*nds.Item{{
+					Key:        cacheKey,
+					Flags:      nds.LockItem,
+					Value:      nds.ItemLockAt(time.Now()),
+					Expiration: time.Minute,
+				}})
+			})
+			_, err = ndsClient.Put(ctx, key, &testEntity{3})
+			nds.SetDatastorePutMultiHook(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items, err := cacher.GetMulti(ctx, []string{cacheKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item, ok := items[cacheKey]; ok && item.Flags == nds.LockItem {
+				t.Fatalf("writeThrough=%v: expected the read's lock removed, got %+v",
+					writeThrough, item)
+			}
+
+			if err := ndsClient.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func PutMultiMaxInFlightBytesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			Payload []byte `datastore:",noindex"`
+		}
+
+		// Three shards of roughly 2MB each with room for only one at a time.
+		const (
+			count       = 1500
+			payloadSize = 4 << 10
+			shardBytes  = 500 * payloadSize
+		)
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithMaxInFlightBytes(shardBytes*3/2))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			mu          sync.Mutex
+			inFlight    int
+			maxInFlight int
+		)
+		nds.SetDatastorePutMultiHook(func() error {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil
+		})
+		defer nds.SetDatastorePutMultiHook(nil)
+
+		keys := make([]*datastore.Key, count)
+		entities := make([]testEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey("PutMultiMaxInFlightBytesTest", strconv.Itoa(i), nil)
+			entities[i] = testEntity{bytes.Repeat([]byte{byte(i)}, payloadSize)}
+		}
+
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, keys)
+
+		if cacher != nil && maxInFlight != 1 {
+			t.Fatalf("expected 1 shard in flight at a time, got %d", maxInFlight)
+		}
+
+		got := make([]testEntity, count)
+		if err := ndsClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		for i := range got {
+			if !bytes.Equal(got[i].Payload, entities[i].Payload) {
+				t.Fatalf("entity %d payload mismatch", i)
+			}
+		}
+	}
+}
+
+// putRecordingDatastore calls onPut with the keys of every PutMulti before
+// making it.
+type putRecordingDatastore struct {
+	*datastore.Client
+	onPut func(keys []*datastore.Key)
+}
+
+func (p *putRecordingDatastore) PutMulti(ctx context.Context,
+	keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	p.onPut(keys)
+	return p.Client.PutMulti(ctx, keys, src)
+}
+
+// PutMultiShardPipeliningTest checks that every shard of a PutMulti puts its
+// entities as soon as its own locks are set, without waiting for the locks of
+// the other shards.
+func PutMultiShardPipeliningTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("PutMultiShardPipeliningTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, 1000)
+		entities := make([]testEntity, len(keys))
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+			entities[i] = testEntity{i}
+		}
+		// The shard of a key is its index divided by 500.
+		shard := func(key *datastore.Key) int {
+			return int(key.ID-1) / 500
+		}
+
+		var mu sync.Mutex
+		var events []string
+		record := func(event string) {
+			mu.Lock()
+			events = append(events, event)
+			mu.Unlock()
+		}
+
+		shards := make(map[string]int, len(keys))
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				n := shards[items[0].Key]
+				// The second shard is slow to lock.
+				if n == 1 {
+					time.Sleep(100 * time.Millisecond)
+				}
+				err := cacher.SetMulti(ctx, items)
+				record(fmt.Sprintf("lock%d", n))
+				return err
+			},
+		}
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil,
+			nds.WithDatastoreClient(dsClient),
+			nds.WithDatastore(&putRecordingDatastore{
+				Client: dsClient,
+				onPut: func(keys []*datastore.Key) {
+					record(fmt.Sprintf("put%d", shard(keys[0])))
+				},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			shards[ndsClient.LockKey(key)] = shard(key)
+		}
+
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		index := make(map[string]int, len(events))
+		for i, event := range events {
+			index[event] = i
+		}
+		for _, n := range []int{0, 1} {
+			lock, locked := index[fmt.Sprintf("lock%d", n)]
+			put, putOK := index[fmt.Sprintf("put%d", n)]
+			if !locked || !putOK || lock > put {
+				t.Fatalf("expected shard %d to lock before it puts, got %v", n, events)
+			}
+		}
+		if index["put0"] > index["lock1"] {
+			t.Fatalf("expected shard 0 to put while shard 1 locks, got %v", events)
+		}
+	}
+}
+
+// discardPuts is a Datastore that drops every put, so benchmarks measure
+// the work nds does rather than the datastore's.
+type discardPuts struct {
+	nds.Datastore
+}
+
+func (discardPuts) PutMulti(_ context.Context, keys []*datastore.Key,
+	_ interface{}) ([]*datastore.Key, error) {
+	return keys, nil
+}
+
+// BenchmarkPutMulti reports the cost of putting a batch of the same struct
+// type over and over.
+func BenchmarkPutMulti(b *testing.B) {
+	ctx := context.Background()
+	for _, writeThrough := range []bool{false, true} {
+		b.Run(fmt.Sprintf("writeThrough=%v", writeThrough), func(b *testing.B) {
+			ndsClient, err := nds.NewClient(ctx, cachers[0].cacher,
+				nds.WithDatastore(discardPuts{}), nds.WithWriteThrough(writeThrough))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			type testEntity struct {
+				IntVal     int
+				StringVal  string
+				TimeVal    time.Time
+				unexported int
+			}
+
+			kind := fmt.Sprintf("BenchmarkPutMulti%d", time.Now().UnixNano())
+			keys := make([]*datastore.Key, 100)
+			entities := make([]testEntity, len(keys))
+			for i := range keys {
+				keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+				entities[i] = testEntity{IntVal: i, StringVal: strconv.Itoa(i), TimeVal: time.Now()}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPutMultiPointers reports the allocations of putting a batch of
+// struct pointers large enough to be split into several datastore calls.
+func BenchmarkPutMultiPointers(b *testing.B) {
+	ctx := context.Background()
+	ndsClient, err := nds.NewClient(ctx, cachers[0].cacher,
+		nds.WithDatastore(discardPuts{}))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	type MyStruct struct {
+		IntVal    int
+		StringVal string
+		Payload   []byte
+	}
+
+	kind := fmt.Sprintf("BenchmarkPutMultiPointers%d", time.Now().UnixNano())
+	keys := make([]*datastore.Key, 5000)
+	entities := make([]*MyStruct, len(keys))
+	for i := range keys {
+		keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+		entities[i] = &MyStruct{IntVal: i, StringVal: strconv.Itoa(i), Payload: make([]byte, 256)}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
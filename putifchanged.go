@@ -0,0 +1,83 @@
+package nds
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// PutIfChanged is Put for jobs that keep writing entities that are mostly
+// unchanged, such as reconcilers. It reads the entity for key, through the
+// cache like Get, and only puts val, invalidating the cache, if it differs.
+// It returns whether val was written.
+//
+// The entities are compared by their encoded properties, so two values are
+// equal when Put would store the same properties for both. Pass WithEqual to
+// compare them another way. Entities that don't exist yet, can't be loaded
+// into the type of val, or have incomplete keys are always written.
+//
+// The read and the write are not atomic: a write made by someone else in
+// between is overwritten like with Put. Use a transaction if that matters.
+func (c *Client) PutIfChanged(ctx context.Context, key *datastore.Key,
+	val interface{}, opts ...CallOption) (bool, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.PutIfChanged")
+	defer span.End()
+
+	if key != nil && !key.Incomplete() && val != nil &&
+		!isNilValue(reflect.ValueOf(val)) {
+		changed, err := c.changed(ctx, key, val, newCallOptions(opts))
+		if err != nil || !changed {
+			return false, err
+		}
+	}
+	if _, err := c.Put(ctx, key, val); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// changed reports whether val differs from the entity stored for key.
+func (c *Client) changed(ctx context.Context, key *datastore.Key,
+	val interface{}, o callOptions) (bool, error) {
+	typ := reflect.TypeOf(val)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	current := reflect.New(typ)
+	switch err := c.Get(ctx, key, current.Interface()).(type) {
+	case nil:
+	case *datastore.ErrFieldMismatch:
+		return true, nil
+	default:
+		if err == datastore.ErrNoSuchEntity {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if o.equal != nil {
+		return !o.equal(current.Interface(), val), nil
+	}
+	currentPL, err := saveValue(current)
+	if err != nil {
+		return false, err
+	}
+	valPL, err := saveValue(reflect.ValueOf(val))
+	if err != nil {
+		return false, err
+	}
+	currentData, err := marshal(sortPropertyList(roundTripPropertyList(currentPL)))
+	if err != nil {
+		return false, errors.Wrap(err, "nds:PutIfChanged marshal")
+	}
+	valData, err := marshal(sortPropertyList(roundTripPropertyList(valPL)))
+	if err != nil {
+		return false, errors.Wrap(err, "nds:PutIfChanged marshal")
+	}
+	return !bytes.Equal(currentData, valData), nil
+}
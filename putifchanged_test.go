@@ -0,0 +1,110 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestPutIfChangedSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestPutIfChanged", PutIfChangedTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func PutIfChangedTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var puts int32
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient),
+			nds.WithDatastore(&putRecordingDatastore{
+				Client: dsClient,
+				onPut: func(keys []*datastore.Key) {
+					atomic.AddInt32(&puts, 1)
+				},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal    int
+			StringVal string
+			Updated   time.Time
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("PutIfChangedTest%d", time.Now().UnixNano()), "one", nil)
+		cacheState := func() nds.CacheState {
+			t.Helper()
+			report, err := ndsClient.Inspect(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return report.CacheState
+		}
+
+		// A missing entity is written.
+		if written, err := ndsClient.PutIfChanged(ctx, key, &testEntity{1, "one", time.Unix(1, 0)}); err != nil || !written {
+			t.Fatalf("expected the new entity written, got %v, %v", written, err)
+		}
+		if n := atomic.SwapInt32(&puts, 0); n != 1 {
+			t.Fatalf("expected 1 put, got %d", n)
+		}
+
+		// An unchanged entity is neither written nor evicted from the cache.
+		if err := ndsClient.Get(ctx, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if written, err := ndsClient.PutIfChanged(ctx, key, &testEntity{1, "one", time.Unix(1, 0)}); err != nil || written {
+			t.Fatalf("expected the unchanged entity skipped, got %v, %v", written, err)
+		}
+		if n := atomic.LoadInt32(&puts); n != 0 {
+			t.Fatalf("expected no put, got %d", n)
+		}
+		if state := cacheState(); state != nds.CacheEntity {
+			t.Fatalf("expected the entity still cached, got %s", state)
+		}
+
+		// A changed entity is written and evicted from the cache.
+		if written, err := ndsClient.PutIfChanged(ctx, key, &testEntity{2, "two", time.Unix(1, 0)}); err != nil || !written {
+			t.Fatalf("expected the changed entity written, got %v, %v", written, err)
+		}
+		if n := atomic.SwapInt32(&puts, 0); n != 1 {
+			t.Fatalf("expected 1 put, got %d", n)
+		}
+		if state := cacheState(); state != nds.CacheAbsent {
+			t.Fatalf("expected the cache invalidated, got %s", state)
+		}
+		var got testEntity
+		if err := ndsClient.Get(ctx, key, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.IntVal != 2 || got.StringVal != "two" {
+			t.Fatalf("expected the changed entity stored, got %+v", got)
+		}
+
+		// WithEqual decides what counts as a change.
+		ignoreUpdated := nds.WithEqual(func(current, val interface{}) bool {
+			a, b := current.(*testEntity), val.(*testEntity)
+			return a.IntVal == b.IntVal && a.StringVal == b.StringVal
+		})
+		if written, err := ndsClient.PutIfChanged(ctx, key, &testEntity{2, "two", time.Unix(2, 0)}, ignoreUpdated); err != nil || written {
+			t.Fatalf("expected the entity skipped, got %v, %v", written, err)
+		}
+		if n := atomic.LoadInt32(&puts); n != 0 {
+			t.Fatalf("expected no put, got %d", n)
+		}
+	}
+}
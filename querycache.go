@@ -0,0 +1,256 @@
+package nds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// WithQueryCacheTTL makes GetAllKeys cache the keys each query returns for
+// ttl, so the same query run again within ttl returns the cached keys without
+// reaching the datastore. A ttl of 0 or less disables the query cache, which
+// is the default.
+//
+// Writes made through the Client, whether Put, Delete, Mutate, CompareAndSwap
+// or a transaction, invalidate the cached queries of the kinds they write
+// once the datastore write succeeds, at the cost of an extra cache call per
+// write. This is best-effort: a write through another Client without the
+// option, or a cache failure, leaves the cached keys in place until ttl runs
+// out, and queries that aren't strongly consistent can cache results that
+// don't show a write yet. Only cache queries whose results can be that stale.
+func WithQueryCacheTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.queryCacheTTL = ttl
+	}
+}
+
+// GetAllKeys runs q keys-only and returns the keys of the entities it
+// matches. With WithQueryCacheTTL the keys are cached under a hash of the
+// query, covering its kind, ancestor, filters, orders, limit, offset and
+// cursors, so only an identical query is answered from the cache. Queries in
+// a transaction are never cached.
+func (c *Client) GetAllKeys(ctx context.Context, q *datastore.Query) ([]*datastore.Key, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetAllKeys")
+	defer span.End()
+
+	if c.cacher == nil || c.queryCacheTTL <= 0 {
+		return c.queryKeys(ctx, q)
+	}
+	signature, kind, namespace, ok := querySignature(q.KeysOnly())
+	if !ok {
+		return c.queryKeys(ctx, q)
+	}
+
+	generation, err := c.queryGeneration(ctx, kind, namespace)
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:GetAllKeys queryGeneration"))
+		return c.queryKeys(ctx, q)
+	}
+	cacheKey := shortenCacheKey(c.keys, queryPrefix+generation+":"+signature)
+
+	items, err := c.cacher.GetMulti(ctx, []string{cacheKey})
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:GetAllKeys GetMulti"))
+	} else if item, ok := items[cacheKey]; ok {
+		keys, err := decodeQueryKeys(item.Value)
+		if err == nil {
+			return keys, nil
+		}
+		c.onError(ctx, errors.Wrap(err, "nds:GetAllKeys decode"))
+	}
+
+	keys, err := c.queryKeys(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeQueryKeys(keys)
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:GetAllKeys encode"))
+		return keys, nil
+	}
+	if err := c.cacher.SetMulti(ctx, []*Item{{
+		Key:        cacheKey,
+		Flags:      entityItem,
+		Value:      data,
+		Expiration: c.queryCacheTTL,
+	}}); err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:GetAllKeys SetMulti"))
+	}
+	return keys, nil
+}
+
+// queryKeys runs q keys-only against the datastore.
+func (c *Client) queryKeys(ctx context.Context, q *datastore.Query) ([]*datastore.Key, error) {
+	var keys []*datastore.Key
+	err := c.guardDatastore(ctx, func() (err error) {
+		keys, err = c.ds.GetAll(ctx, q.KeysOnly(), nil)
+		return
+	})
+	return keys, err
+}
+
+// queryGenerationKey is the cache key of the generation the queries of kind
+// in namespace are cached under.
+func (c *Client) queryGenerationKey(kind, namespace string) string {
+	return shortenCacheKey(c.keys, fmt.Sprintf("%s%d:%s%d:%s%s",
+		queryGenerationPrefix, len(c.keys.databaseID), c.keys.databaseID,
+		len(namespace), namespace, kind))
+}
+
+// queryGeneration returns the current generation of the queries of kind in
+// namespace, starting a new one if there is none. Deleting the generation
+// invalidates every query cached under it at once.
+func (c *Client) queryGeneration(ctx context.Context, kind, namespace string) (string, error) {
+	genKey := c.queryGenerationKey(kind, namespace)
+	items, err := c.cacher.GetMulti(ctx, []string{genKey})
+	if err != nil {
+		return "", err
+	}
+	if item, ok := items[genKey]; ok {
+		return string(item.Value), nil
+	}
+
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, rand.Uint64())
+	generation := hex.EncodeToString(b)
+	err = c.cacher.AddMulti(ctx, []*Item{{
+		Key:   genKey,
+		Flags: entityItem,
+		Value: []byte(generation),
+	}})
+	if err == nil {
+		return generation, nil
+	}
+	// Another query started a generation first.
+	if items, err = c.cacher.GetMulti(ctx, []string{genKey}); err != nil {
+		return "", err
+	}
+	if item, ok := items[genKey]; ok {
+		return string(item.Value), nil
+	}
+	return "", errors.New("nds: query generation not stored")
+}
+
+// invalidateQueries removes the generations of the kinds of keys so the
+// queries cached for them are run again, if WithQueryCacheTTL is enabled.
+func (c *Client) invalidateQueries(ctx context.Context, keys []*datastore.Key) {
+	if c.cacher == nil || c.queryCacheTTL <= 0 {
+		return
+	}
+	seen := make(map[string]bool)
+	genKeys := make([]string, 0, 1)
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		genKey := c.queryGenerationKey(key.Kind, key.Namespace)
+		if !seen[genKey] {
+			seen[genKey] = true
+			genKeys = append(genKeys, genKey)
+		}
+	}
+	if len(genKeys) > 0 {
+		c.invalidateCache(ctx, genKeys, "invalidateQueries cache.DeleteMulti")
+	}
+}
+
+func encodeQueryKeys(keys []*datastore.Key) ([]byte, error) {
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = key.Encode()
+	}
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(encoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeQueryKeys(data []byte) ([]*datastore.Key, error) {
+	var encoded []string
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&encoded); err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, len(encoded))
+	for i, e := range encoded {
+		key, err := datastore.DecodeKey(e)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// querySignature returns the hex encoded hash of everything q is made of,
+// along with its kind and namespace. datastore.Query keeps all of it
+// unexported, so it is read with reflection. ok is false for a query that
+// can't be cached: one in a transaction or one that already failed to build.
+func querySignature(q *datastore.Query) (signature, kind, namespace string, ok bool) {
+	v := reflect.ValueOf(q).Elem()
+	if trans := v.FieldByName("trans"); trans.IsValid() && !trans.IsNil() {
+		return "", "", "", false
+	}
+	if err := v.FieldByName("err"); err.IsValid() && !err.IsNil() {
+		return "", "", "", false
+	}
+	h := sha256.New()
+	writeQueryValue(h, v)
+	return hex.EncodeToString(h.Sum(nil)), v.FieldByName("kind").String(),
+		v.FieldByName("namespace").String(), true
+}
+
+// writeQueryValue writes a representation of v to w that only equals the one
+// of another value if both are equal.
+func writeQueryValue(w io.Writer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		fmt.Fprintf(w, "b%t;", v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(w, "i%d;", v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fmt.Fprintf(w, "u%d;", v.Uint())
+	case reflect.Float32, reflect.Float64:
+		fmt.Fprintf(w, "f%v;", v.Float())
+	case reflect.String:
+		fmt.Fprintf(w, "s%d:%s;", len(v.String()), v.String())
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(w, "l%d[", v.Len())
+		for i := 0; i < v.Len(); i++ {
+			writeQueryValue(w, v.Index(i))
+		}
+		io.WriteString(w, "]")
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			io.WriteString(w, "n;")
+			return
+		}
+		if v.Kind() == reflect.Interface {
+			fmt.Fprintf(w, "t%s:", v.Elem().Type())
+		}
+		writeQueryValue(w, v.Elem())
+	case reflect.Struct:
+		// Keys, including ancestors and filter values, are compared by
+		// what they address rather than by their pointers.
+		io.WriteString(w, "{")
+		for i := 0; i < v.NumField(); i++ {
+			writeQueryValue(w, v.Field(i))
+		}
+		io.WriteString(w, "}")
+	default:
+		fmt.Fprintf(w, "?%s;", v.Kind())
+	}
+}
@@ -0,0 +1,91 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestQueryCacheSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetAllKeys", GetAllKeysTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func GetAllKeysTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &queryCountingDatastore{Client: dsClient}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient), nds.WithDatastore(ds),
+			nds.WithQueryCacheTTL(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Active bool
+		}
+
+		kind := fmt.Sprintf("GetAllKeysTest%d", time.Now().UnixNano())
+		parent := datastore.NameKey(kind, "parent", nil)
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "a", parent),
+			datastore.NameKey(kind, "b", parent),
+			datastore.NameKey(kind, "c", parent),
+		}
+		entities := []testEntity{{true}, {true}, {false}}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		active := func() *datastore.Query {
+			return datastore.NewQuery(kind).Ancestor(parent).Filter("Active =", true)
+		}
+		expectKeys := func(q *datastore.Query, want int, queries int32) {
+			t.Helper()
+			got, err := ndsClient.GetAllKeys(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != want {
+				t.Fatalf("expected %d keys, got %d", want, len(got))
+			}
+			if n := atomic.LoadInt32(&ds.queries); n != queries {
+				t.Fatalf("expected %d datastore queries, got %d", queries, n)
+			}
+		}
+
+		// An identical query, even built again, hits the cache.
+		expectKeys(active(), 2, 1)
+		expectKeys(active(), 2, 1)
+
+		// A different filter is a different query.
+		expectKeys(datastore.NewQuery(kind).Ancestor(parent).Filter("Active =", false), 1, 2)
+		expectKeys(datastore.NewQuery(kind).Ancestor(parent), 3, 3)
+		expectKeys(active(), 2, 3)
+
+		// A write to the kind invalidates its queries.
+		if _, err := ndsClient.Put(ctx, keys[2], &testEntity{true}); err != nil {
+			t.Fatal(err)
+		}
+		expectKeys(active(), 3, 4)
+		expectKeys(active(), 3, 4)
+
+		if err := ndsClient.Delete(ctx, keys[0]); err != nil {
+			t.Fatal(err)
+		}
+		expectKeys(active(), 2, 5)
+	}
+}
@@ -0,0 +1,42 @@
+package nds
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// WithRand sets the source of the randomness the client's features draw
+// from, such as the TTL jitter of WithTTLJitter and the sampling of
+// WithShadowReads, so tests and deployments that need it can make them
+// deterministic. The source doesn't need to be safe for concurrent use. By
+// default every Client has its own source seeded with the time it was
+// created. Cache lock values stay random whatever the source, as they must
+// never collide between clients.
+func WithRand(src rand.Source) ClientOption {
+	return func(c *Client) {
+		c.rand = newLockedRand(src)
+	}
+}
+
+// lockedRand makes a rand.Rand safe for concurrent use.
+type lockedRand struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	return &lockedRand{r: rand.New(src)}
+}
+
+func newDefaultRand() *lockedRand {
+	return newLockedRand(rand.NewSource(time.Now().UnixNano()))
+}
+
+// randFloat64 returns a pseudorandom number in [0.0,1.0) from the client's
+// source.
+func (c *Client) randFloat64() float64 {
+	c.rand.Lock()
+	defer c.rand.Unlock()
+	return c.rand.r.Float64()
+}
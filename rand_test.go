@@ -0,0 +1,92 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+// stepSource is a rand.Source stepping evenly through [0, 1) in steps steps.
+type stepSource struct {
+	steps, n int64
+}
+
+func (s *stepSource) Int63() int64 {
+	s.n++
+	return math.MaxInt64 / s.steps * (s.n % s.steps)
+}
+
+func (s *stepSource) Seed(seed int64) {
+	s.n = seed
+}
+
+func TestRandSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestRandJitter", RandJitterTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func RandJitterTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			Value int
+		}
+
+		const seed, count = 42, 10
+		ttl, fraction := time.Hour, 0.5
+		kind := fmt.Sprintf("RandJitterTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, count)
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+		}
+
+		// The expirations are drawn from the source, one per entity in the
+		// order they are cached.
+		r := rand.New(rand.NewSource(seed))
+		want := make([]time.Duration, count)
+		for i := range want {
+			want[i] = ttl + time.Duration((2*r.Float64()-1)*fraction*float64(ttl))
+		}
+
+		for run := 0; run < 2; run++ {
+			var got []time.Duration
+			testCacher := &mockCacher{
+				cacher: cacher,
+				compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+					for _, item := range items {
+						got = append(got, item.Expiration)
+					}
+					return cacher.CompareAndSwapMulti(ctx, items)
+				},
+			}
+			ndsClient, err := NewClient(ctx, testCacher, t, nil, nds.WithWriteThrough(true),
+				nds.WithCacheTTL(ttl), nds.WithTTLJitter(fraction),
+				nds.WithRand(rand.NewSource(seed)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := ndsClient.PutMulti(ctx, keys, make([]testEntity, count)); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != count {
+				t.Fatalf("expected %d cached entities, got %d", count, len(got))
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("run %d: expected expiration %v for entity %d, got %v",
+						run, want[i], i, got[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package nds
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithCacheRateLimit limits the cache writes made by the client to perSecond
+// items per second, so bulk operations such as RewarmKeys, DeleteAll and
+// large PutMulti calls don't trip the rate limits of the cache backend. Every
+// key passed to AddMulti, CompareAndSwapMulti, SetMulti, DeleteMulti,
+// CompareAndDeleteMulti and IncrementMulti counts as one item; cache reads
+// and datastore calls are not limited. Writes are smoothed by a token bucket
+// holding a tenth of a second's worth of items, at least one, so short bursts
+// go through at full speed.
+//
+// A write over the limit blocks until it is within it rather than being
+// dropped, and fails with the context's error if the context is done first. A
+// perSecond of 0 or less disables the limit, which is the default.
+func WithCacheRateLimit(perSecond float64) ClientOption {
+	return func(c *Client) {
+		if perSecond <= 0 {
+			c.cacheLimit = nil
+			return
+		}
+		c.cacheLimit = newTokenBucket(perSecond)
+	}
+}
+
+// tokenBucket lets callers reserve tokens ahead of time, waiting until the
+// bucket has refilled enough to cover the reservation.
+type tokenBucket struct {
+	rate, burst float64
+
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perSecond float64) *tokenBucket {
+	burst := perSecond / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   perSecond,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n tokens are available. A single call may take more
+// tokens than the bucket holds, in which case the calls that follow wait for
+// the debt to be paid off. The tokens are given back if ctx is done first.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.Lock()
+		b.tokens += float64(n)
+		b.Unlock()
+		return ctx.Err()
+	}
+}
+
+// rateLimitedCacher waits for the token bucket before every write to the
+// wrapped Cacher.
+type rateLimitedCacher struct {
+	Cacher
+	limit *tokenBucket
+}
+
+func (r *rateLimitedCacher) AddMulti(ctx context.Context, items []*Item) error {
+	if err := r.limit.wait(ctx, len(items)); err != nil {
+		return err
+	}
+	return r.Cacher.AddMulti(ctx, items)
+}
+
+func (r *rateLimitedCacher) CompareAndSwapMulti(ctx context.Context, items []*Item) error {
+	if err := r.limit.wait(ctx, len(items)); err != nil {
+		return err
+	}
+	return r.Cacher.CompareAndSwapMulti(ctx, items)
+}
+
+func (r *rateLimitedCacher) DeleteMulti(ctx context.Context, keys []string) error {
+	if err := r.limit.wait(ctx, len(keys)); err != nil {
+		return err
+	}
+	return r.Cacher.DeleteMulti(ctx, keys)
+}
+
+func (r *rateLimitedCacher) SetMulti(ctx context.Context, items []*Item) error {
+	if err := r.limit.wait(ctx, len(items)); err != nil {
+		return err
+	}
+	return r.Cacher.SetMulti(ctx, items)
+}
+
+func (r *rateLimitedCacher) IncrementMulti(ctx context.Context, keys []string, deltas []int64) ([]int64, error) {
+	inc, ok := r.Cacher.(Incrementer)
+	if !ok {
+		return nil, ErrIncrementUnsupported
+	}
+	if err := r.limit.wait(ctx, len(keys)); err != nil {
+		return nil, err
+	}
+	return inc.IncrementMulti(ctx, keys, deltas)
+}
+
+func (r *rateLimitedCacher) CompareAndDeleteMulti(ctx context.Context, items []*Item) error {
+	cad, ok := r.Cacher.(CompareAndDeleter)
+	if !ok {
+		return ErrCompareAndDeleteUnsupported
+	}
+	if err := r.limit.wait(ctx, len(items)); err != nil {
+		return err
+	}
+	return cad.CompareAndDeleteMulti(ctx, items)
+}
@@ -0,0 +1,129 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestCacheRateLimitSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestCacheRateLimit", CacheRateLimitTest(item.ctx, item.cacher))
+			t.Run("TestCacheRateLimitContext", CacheRateLimitContextTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func CacheRateLimitTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var written int64
+		mc := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				atomic.AddInt64(&written, int64(len(items)))
+				return cacher.SetMulti(ctx, items)
+			},
+			deleteMultiHook: func(ctx context.Context, keys []string) error {
+				atomic.AddInt64(&written, int64(len(keys)))
+				return cacher.DeleteMulti(ctx, keys)
+			},
+		}
+
+		const perSecond = 2000
+		ndsClient, err := NewClient(ctx, mc, t, nil, nds.WithCacheRateLimit(perSecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		// Each put locks and then unlocks its keys, writing two items per
+		// key to the cache.
+		kind := fmt.Sprintf("CacheRateLimitTest%d", time.Now().UnixNano())
+		const puts, keysPerPut = 20, 50
+		start := time.Now()
+		var wg sync.WaitGroup
+		errs := make([]error, puts)
+		for i := 0; i < puts; i++ {
+			keys := make([]*datastore.Key, keysPerPut)
+			for j := range keys {
+				keys[j] = datastore.NameKey(kind, strconv.Itoa(i*keysPerPut+j), nil)
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = ndsClient.PutMulti(ctx, keys, make([]testEntity, len(keys)))
+			}(i)
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+		for _, err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		total := atomic.LoadInt64(&written)
+		if total != 2*puts*keysPerPut {
+			t.Fatalf("expected %d items written, got %d", 2*puts*keysPerPut, total)
+		}
+		// Only the tenth of a second's burst may go through unthrottled.
+		burst := perSecond / 10
+		min := time.Duration(float64(total-int64(burst)) / perSecond * float64(time.Second))
+		if elapsed < min*9/10 {
+			t.Fatalf("expected %d items to take at least %v, took %v", total, min, elapsed)
+		}
+	}
+}
+
+func CacheRateLimitContextTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// Unlocking after the first put has to wait for a token, which it
+		// goes on doing after the put gives up with its context.
+		ndsClient, err := NewClient(ctx, cacher, t, func(err error) bool {
+			return strings.Contains(err.Error(), context.DeadlineExceeded.Error())
+		}, nds.WithCacheRateLimit(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("CacheRateLimitContextTest%d", time.Now().UnixNano())
+		put := func(key *datastore.Key) error {
+			t.Helper()
+			ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err := ndsClient.Put(ctx, key, &testEntity{1})
+			if elapsed := time.Since(start); elapsed > time.Second/2 {
+				t.Fatalf("expected the put to give up with its context, took %v", elapsed)
+			}
+			return err
+		}
+
+		// The bucket holds one token for the first put's lock.
+		if err := put(datastore.NameKey(kind, "first", nil)); err != nil {
+			t.Fatal(err)
+		}
+		// The second put can't lock its key in time.
+		if err := put(datastore.NameKey(kind, "second", nil)); err == nil ||
+			!strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// GetMultiRaw is GetMulti for callers that pass entities on without looking
+// at them, such as an API gateway. Instead of loading the entities into Go
+// values it returns each one as the wire encoding of a
+// google.datastore.v1.Entity protocol buffer, the message the Cloud Datastore
+// API itself uses, holding the entity's key and properties. The bytes can be
+// forwarded as they are, decoded with any protocol buffer library, or loaded
+// into a Go value with UnmarshalRaw.
+//
+// Entities are read through the cache like with GetMulti. Missing entities
+// are reported with datastore.ErrNoSuchEntity at their index in a
+// datastore.MultiError, or a *BatchError with WithBatchErrors, and have nil
+// bytes.
+//
+// GetMultiRaw is a convenience wrapper, not a faster path: the cache holds
+// entities in its own encoding, so each entity, cached or not, is loaded into
+// a datastore.PropertyList by GetMulti and then encoded as a protocol buffer.
+// It costs a little more than GetMulti into PropertyLists.
+func (c *Client) GetMultiRaw(ctx context.Context,
+	keys []*datastore.Key) ([][]byte, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetMultiRaw")
+	defer span.End()
+
+	pls := make([]datastore.PropertyList, len(keys))
+	err := unwrapBatchError(c.GetMulti(ctx, keys, pls))
+	me, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	raw := make([][]byte, len(keys))
+	failed, errs := false, make(datastore.MultiError, len(keys))
+	for i, key := range c.keysInNamespace(keys) {
+		if ok && me[i] != nil {
+			failed = true
+			errs[i] = me[i]
+			continue
+		}
+		e, err := propertiesToProto(key, pls[i])
+		if err == nil {
+			raw[i], err = proto.Marshal(e)
+		}
+		if err != nil {
+			failed = true
+			errs[i] = errors.Wrap(err, "nds:GetMultiRaw")
+		}
+	}
+	if failed {
+		return raw, c.batchError(keys, errs)
+	}
+	return raw, nil
+}
+
+// UnmarshalRaw loads an entity returned by GetMultiRaw into dst, which must
+// be a pointer to a struct or to a datastore.PropertyLoadSaver, like the
+// elements of the dst of GetMulti.
+func UnmarshalRaw(data []byte, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("nds: UnmarshalRaw needs a non-nil pointer")
+	}
+	var e pb.Entity
+	if err := proto.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	key, err := protoToKey(e.Key)
+	if err != nil {
+		return err
+	}
+	pl, err := protoToProperties(e.Properties)
+	if err != nil {
+		return err
+	}
+	return setValue(v.Elem(), pl, key)
+}
+
+// propertiesToProto encodes an entity the way the datastore package sends it
+// to the Cloud Datastore API. pl holds the properties as they are loaded from
+// the datastore, so only the types the datastore loads are expected.
+func propertiesToProto(key *datastore.Key, pl []datastore.Property) (*pb.Entity, error) {
+	e := &pb.Entity{
+		Key:        keyToProto(key),
+		Properties: make(map[string]*pb.Value, len(pl)),
+	}
+	for _, p := range pl {
+		v, err := valueToProto(p.Value, p.NoIndex)
+		if err != nil {
+			return nil, errors.Wrapf(err, "property %q", p.Name)
+		}
+		e.Properties[p.Name] = v
+	}
+	return e, nil
+}
+
+func valueToProto(value interface{}, noIndex bool) (*pb.Value, error) {
+	v := &pb.Value{ExcludeFromIndexes: noIndex}
+	switch value := value.(type) {
+	case nil:
+		v.ValueType = &pb.Value_NullValue{}
+	case int64:
+		v.ValueType = &pb.Value_IntegerValue{IntegerValue: value}
+	case bool:
+		v.ValueType = &pb.Value_BooleanValue{BooleanValue: value}
+	case string:
+		v.ValueType = &pb.Value_StringValue{StringValue: value}
+	case float64:
+		v.ValueType = &pb.Value_DoubleValue{DoubleValue: value}
+	case *datastore.Key:
+		if value == nil {
+			v.ValueType = &pb.Value_NullValue{}
+		} else {
+			v.ValueType = &pb.Value_KeyValue{KeyValue: keyToProto(value)}
+		}
+	case datastore.GeoPoint:
+		v.ValueType = &pb.Value_GeoPointValue{GeoPointValue: &latlng.LatLng{
+			Latitude:  value.Lat,
+			Longitude: value.Lng,
+		}}
+	case time.Time:
+		v.ValueType = &pb.Value_TimestampValue{TimestampValue: &timestamp.Timestamp{
+			Seconds: value.Unix(),
+			Nanos:   int32(value.Nanosecond()),
+		}}
+	case []byte:
+		v.ValueType = &pb.Value_BlobValue{BlobValue: value}
+	case *datastore.Entity:
+		e, err := propertiesToProto(value.Key, value.Properties)
+		if err != nil {
+			return nil, err
+		}
+		v.ValueType = &pb.Value_EntityValue{EntityValue: e}
+	case []interface{}:
+		values := make([]*pb.Value, len(value))
+		for i, elem := range value {
+			var err error
+			if values[i], err = valueToProto(elem, noIndex); err != nil {
+				return nil, err
+			}
+		}
+		v.ValueType = &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: values}}
+		// Like the datastore, arrays are excluded from indexes element by
+		// element.
+		v.ExcludeFromIndexes = false
+	default:
+		return nil, errors.Errorf("unexpected value type %T", value)
+	}
+	return v, nil
+}
+
+func protoToProperties(props map[string]*pb.Value) (datastore.PropertyList, error) {
+	pl := make(datastore.PropertyList, 0, len(props))
+	for name, v := range props {
+		value, err := protoToValue(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "property %q", name)
+		}
+		noIndex := v.ExcludeFromIndexes
+		if values, ok := value.([]interface{}); ok && len(values) > 0 {
+			noIndex = v.GetArrayValue().Values[0].ExcludeFromIndexes
+		}
+		pl = append(pl, datastore.Property{Name: name, Value: value, NoIndex: noIndex})
+	}
+	return pl, nil
+}
+
+func protoToValue(v *pb.Value) (interface{}, error) {
+	switch value := v.ValueType.(type) {
+	case *pb.Value_NullValue:
+		return nil, nil
+	case *pb.Value_IntegerValue:
+		return value.IntegerValue, nil
+	case *pb.Value_BooleanValue:
+		return value.BooleanValue, nil
+	case *pb.Value_StringValue:
+		return value.StringValue, nil
+	case *pb.Value_DoubleValue:
+		return value.DoubleValue, nil
+	case *pb.Value_KeyValue:
+		return protoToKey(value.KeyValue)
+	case *pb.Value_GeoPointValue:
+		return datastore.GeoPoint{
+			Lat: value.GeoPointValue.Latitude,
+			Lng: value.GeoPointValue.Longitude,
+		}, nil
+	case *pb.Value_TimestampValue:
+		return time.Unix(value.TimestampValue.Seconds,
+			int64(value.TimestampValue.Nanos)), nil
+	case *pb.Value_BlobValue:
+		return value.BlobValue, nil
+	case *pb.Value_EntityValue:
+		key, err := protoToKey(value.EntityValue.Key)
+		if err != nil {
+			return nil, err
+		}
+		pl, err := protoToProperties(value.EntityValue.Properties)
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.Entity{Key: key, Properties: pl}, nil
+	case *pb.Value_ArrayValue:
+		values := make([]interface{}, len(value.ArrayValue.Values))
+		for i, elem := range value.ArrayValue.Values {
+			var err error
+			if values[i], err = protoToValue(elem); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.Errorf("unexpected value type %T", v.ValueType)
+}
+
+// keyToProto encodes key like the datastore package does, with its path
+// running from the root ancestor to key.
+func keyToProto(key *datastore.Key) *pb.Key {
+	if key == nil {
+		return nil
+	}
+	var path []*pb.Key_PathElement
+	for k := key; k != nil; k = k.Parent {
+		elem := &pb.Key_PathElement{Kind: k.Kind}
+		if k.ID != 0 {
+			elem.IdType = &pb.Key_PathElement_Id{Id: k.ID}
+		} else if k.Name != "" {
+			elem.IdType = &pb.Key_PathElement_Name{Name: k.Name}
+		}
+		path = append([]*pb.Key_PathElement{elem}, path...)
+	}
+	p := &pb.Key{Path: path}
+	if key.Namespace != "" {
+		p.PartitionId = &pb.PartitionId{NamespaceId: key.Namespace}
+	}
+	return p
+}
+
+func protoToKey(p *pb.Key) (*datastore.Key, error) {
+	if p == nil {
+		return nil, nil
+	}
+	var namespace string
+	if p.PartitionId != nil {
+		namespace = p.PartitionId.NamespaceId
+	}
+	var key *datastore.Key
+	for _, elem := range p.Path {
+		key = &datastore.Key{
+			Kind:      elem.Kind,
+			ID:        elem.GetId(),
+			Name:      elem.GetName(),
+			Parent:    key,
+			Namespace: namespace,
+		}
+	}
+	if key == nil {
+		return nil, datastore.ErrInvalidKey
+	}
+	return key, nil
+}
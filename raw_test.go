@@ -0,0 +1,97 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestRawSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetMultiRaw", GetMultiRawTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func GetMultiRawTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal    int
+			StringVal string
+			TimeVal   time.Time
+			BytesVal  []byte `datastore:",noindex"`
+			KeyVal    *datastore.Key
+			Tags      []string
+			Location  datastore.GeoPoint
+		}
+
+		kind := fmt.Sprintf("GetMultiRawTest%d", time.Now().UnixNano())
+		parent := datastore.NameKey(kind+"Parent", "parent", nil)
+		keys := []*datastore.Key{
+			datastore.IDKey(kind, 1, parent),
+			datastore.IDKey(kind, 2, nil),
+		}
+		entity := testEntity{
+			IntVal:    3,
+			StringVal: "three",
+			TimeVal:   time.Now().Truncate(time.Microsecond).UTC(),
+			BytesVal:  []byte{1, 2, 3},
+			KeyVal:    parent,
+			Tags:      []string{"a", "b"},
+			Location:  datastore.GeoPoint{Lat: 51.5, Lng: -0.1},
+		}
+		if _, err := ndsClient.Put(ctx, keys[0], &entity); err != nil {
+			t.Fatal(err)
+		}
+
+		// The first read fills the cache, the second is served from it.
+		for _, source := range []string{"datastore", "cache"} {
+			raw, err := ndsClient.GetMultiRaw(ctx, keys)
+			me, ok := err.(datastore.MultiError)
+			if !ok || me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+				t.Fatalf("%s: expected only the second key missing, got %v", source, err)
+			}
+			if raw[1] != nil {
+				t.Fatalf("%s: expected no bytes for the missing entity", source)
+			}
+
+			var e pb.Entity
+			if err := proto.Unmarshal(raw[0], &e); err != nil {
+				t.Fatal(err)
+			}
+			if path := e.Key.Path; len(path) != 2 || path[0].Kind != parent.Kind ||
+				path[1].Kind != kind || path[1].GetId() != 1 {
+				t.Fatalf("%s: expected the key path of %v, got %v", source, keys[0], path)
+			}
+			if v := e.Properties["StringVal"]; v.GetStringValue() != "three" {
+				t.Fatalf("%s: expected StringVal three, got %v", source, v)
+			}
+			if !e.Properties["BytesVal"].ExcludeFromIndexes {
+				t.Fatalf("%s: expected BytesVal excluded from indexes", source)
+			}
+
+			var got testEntity
+			if err := nds.UnmarshalRaw(raw[0], &got); err != nil {
+				t.Fatal(err)
+			}
+			got.TimeVal = got.TimeVal.UTC()
+			if !reflect.DeepEqual(got, entity) {
+				t.Fatalf("%s: expected %+v, got %+v", source, entity, got)
+			}
+		}
+	}
+}
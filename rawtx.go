@@ -0,0 +1,101 @@
+package nds
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// PutMultiTx puts entities within tx, a transaction the caller started with
+// the wrapped datastore.Client rather than through nds. It works like
+// tx.PutMulti but remembers the keys so their cache entries can be locked
+// when the transaction commits.
+//
+// The commit contract: a transaction passed to PutMultiTx or DeleteMultiTx
+// must be finished with CommitTx or RollbackTx rather than tx.Commit or
+// tx.Rollback. CommitTx locks the cache entries of every key written before it
+// commits, exactly like Transaction.Commit does, so no stale entity can be
+// cached once the commit lands. Committing with tx.Commit instead leaves the
+// cache stale.
+func (c *Client) PutMultiTx(ctx context.Context, tx *datastore.Transaction,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.PendingKey, error) {
+	var span *trace.Span
+	_, span = trace.StartSpan(ctx, "github.com/qedus/nds.PutMultiTx")
+	defer span.End()
+	return c.wrapTx(ctx, tx).PutMulti(keys, vals)
+}
+
+// DeleteMultiTx deletes entities within tx like tx.DeleteMulti. See PutMultiTx
+// for how tx must be finished.
+func (c *Client) DeleteMultiTx(ctx context.Context, tx *datastore.Transaction,
+	keys []*datastore.Key) error {
+	var span *trace.Span
+	_, span = trace.StartSpan(ctx, "github.com/qedus/nds.DeleteMultiTx")
+	defer span.End()
+	return c.wrapTx(ctx, tx).DeleteMulti(keys)
+}
+
+// GetMultiTx gets entities within tx like tx.GetMulti. Like
+// Transaction.GetMulti it bypasses the cache, as transactional reads must see
+// the datastore.
+func (c *Client) GetMultiTx(ctx context.Context, tx *datastore.Transaction,
+	keys []*datastore.Key, vals interface{}) error {
+	var span *trace.Span
+	_, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetMultiTx")
+	defer span.End()
+	keys = c.keysInNamespace(keys)
+	return tx.GetMulti(keys, vals)
+}
+
+// CommitTx locks the cache entries of the keys written through PutMultiTx and
+// DeleteMultiTx and then commits tx. If the cache can't be locked tx is not
+// committed and can still be rolled back.
+func (c *Client) CommitTx(ctx context.Context, tx *datastore.Transaction) (*datastore.Commit, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.CommitTx")
+	defer span.End()
+
+	t := c.unwrapTx(tx)
+	if t == nil {
+		// Nothing was written through nds.
+		t = &Transaction{c: c, tx: tx}
+	}
+	t.ctx = ctx
+	return t.Commit()
+}
+
+// RollbackTx forgets the keys written through PutMultiTx and DeleteMultiTx
+// and rolls tx back.
+func (c *Client) RollbackTx(ctx context.Context, tx *datastore.Transaction) error {
+	var span *trace.Span
+	_, span = trace.StartSpan(ctx, "github.com/qedus/nds.RollbackTx")
+	defer span.End()
+
+	c.unwrapTx(tx)
+	return tx.Rollback()
+}
+
+// wrapTx returns the Transaction tracking the cache locks for tx.
+func (c *Client) wrapTx(ctx context.Context, tx *datastore.Transaction) *Transaction {
+	c.txsMu.Lock()
+	defer c.txsMu.Unlock()
+	if c.txs == nil {
+		c.txs = make(map[*datastore.Transaction]*Transaction)
+	}
+	t, ok := c.txs[tx]
+	if !ok {
+		t = &Transaction{c: c, ctx: ctx, tx: tx}
+		c.txs[tx] = t
+	}
+	return t
+}
+
+// unwrapTx stops tracking tx and returns its Transaction, if any.
+func (c *Client) unwrapTx(tx *datastore.Transaction) *Transaction {
+	c.txsMu.Lock()
+	defer c.txsMu.Unlock()
+	t := c.txs[tx]
+	delete(c.txs, tx)
+	return t
+}
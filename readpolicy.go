@@ -0,0 +1,57 @@
+package nds
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ReadCacheErrorPolicy decides what Get, GetMulti and ExistsMulti do when
+// reading the cache fails, as opposed to missing.
+type ReadCacheErrorPolicy int
+
+const (
+	// ReadCacheFallthrough reads from the datastore as if the cache had
+	// missed and passes the cache error to the OnErrorFunc. This is the
+	// default.
+	ReadCacheFallthrough ReadCacheErrorPolicy = iota
+	// ReadCacheFail fails the read with a *CacheReadError without touching
+	// the datastore, so that a cache brownout sheds load instead of moving
+	// all of it onto the datastore.
+	ReadCacheFail
+)
+
+// WithReadCacheErrorPolicy sets what reads do when the Cacher's GetMulti
+// returns an error. The default is ReadCacheFallthrough.
+func WithReadCacheErrorPolicy(policy ReadCacheErrorPolicy) ClientOption {
+	return func(c *Client) {
+		c.readCachePolicy = policy
+	}
+}
+
+// CacheReadError is returned by reads that failed because the cache couldn't
+// be read, with the ReadCacheFail policy.
+type CacheReadError struct {
+	Err error
+}
+
+func (e *CacheReadError) Error() string {
+	return fmt.Sprintf("nds: cannot read the cache: %v", e.Err)
+}
+
+// Unwrap returns the Cacher's error.
+func (e *CacheReadError) Unwrap() error {
+	return e.Err
+}
+
+// readCacheFailed handles err returned by the Cacher's GetMulti during op. It
+// returns the error the read has to fail with, if any; otherwise the read
+// carries on without the cache.
+func (c *Client) readCacheFailed(ctx context.Context, err error, op string) error {
+	if c.readCachePolicy == ReadCacheFail {
+		return &CacheReadError{Err: err}
+	}
+	c.onError(ctx, errors.Wrap(err, op))
+	return nil
+}
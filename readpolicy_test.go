@@ -0,0 +1,115 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestReadCacheErrorPolicySuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestReadCacheFallthrough", ReadCacheFallthroughTest(item.ctx, item.cacher))
+			t.Run("TestReadCacheFail", ReadCacheFailTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+var errCacheDown = errors.New("cache down")
+
+// brokenReadCacher returns a cacher whose GetMulti always fails.
+func brokenReadCacher(cacher nds.Cacher) *mockCacher {
+	return &mockCacher{
+		cacher: cacher,
+		getMultiHook: func(ctx context.Context, keys []string) (map[string]*nds.Item, error) {
+			return nil, errCacheDown
+		},
+	}
+}
+
+type readPolicyEntity struct {
+	IntVal int
+}
+
+func ReadCacheFallthroughTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var logged int
+		ndsClient, err := NewClient(ctx, brokenReadCacher(cacher), t, func(err error) bool {
+			logged++
+			return strings.Contains(err.Error(), errCacheDown.Error())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := datastore.NameKey("ReadCacheFallthroughTest", "entity", nil)
+		if _, err := ndsClient.Put(ctx, key, &readPolicyEntity{42}); err != nil {
+			t.Fatal(err)
+		}
+
+		var got readPolicyEntity
+		if err := ndsClient.Get(ctx, key, &got); err != nil {
+			t.Fatalf("expected the read to fall through, got %v", err)
+		}
+		if got.IntVal != 42 {
+			t.Fatalf("expected 42 from the datastore, got %d", got.IntVal)
+		}
+		if logged == 0 {
+			t.Fatal("expected the cache error to be passed to the OnErrorFunc")
+		}
+	}
+}
+
+func ReadCacheFailTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, brokenReadCacher(cacher), t, nil,
+			nds.WithReadCacheErrorPolicy(nds.ReadCacheFail))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := datastore.NameKey("ReadCacheFailTest", "entity", nil)
+		if _, err := ndsClient.Put(ctx, key, &readPolicyEntity{42}); err != nil {
+			t.Fatal(err)
+		}
+
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) != 0 {
+				t.Error("expected the datastore not to be read")
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		isCacheReadError := func(err error) bool {
+			var cre *nds.CacheReadError
+			return errors.As(err, &cre) && errors.Is(cre, errCacheDown)
+		}
+
+		if err := ndsClient.Get(ctx, key, &readPolicyEntity{}); !isCacheReadError(err) {
+			t.Fatalf("expected a CacheReadError, got %v", err)
+		}
+
+		err = ndsClient.GetMulti(ctx, []*datastore.Key{key, key}, make([]readPolicyEntity, 2))
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected a datastore.MultiError, got %v", err)
+		}
+		for i, err := range me {
+			if !isCacheReadError(err) {
+				t.Fatalf("expected a CacheReadError for key %d, got %v", i, err)
+			}
+		}
+
+		if _, err := ndsClient.ExistsMulti(ctx, []*datastore.Key{key}); !isCacheReadError(err) {
+			t.Fatalf("expected a CacheReadError from ExistsMulti, got %v", err)
+		}
+	}
+}
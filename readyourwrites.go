@@ -0,0 +1,146 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+type writtenKeysKey struct{}
+
+// writtenKeys is the set of cache keys of the entities written within one
+// request.
+type writtenKeys struct {
+	sync.Mutex
+	keys map[string]bool
+}
+
+// WithReadYourWrites returns a context that makes the reads using it see the
+// writes made with it, even with WithEventualConsistency. Put, Delete, Mutate,
+// CompareAndSwap and transactions using the context record the keys they
+// write, and Get, GetMulti and ExistsMulti then read those keys with strongly
+// consistent lookups instead of eventually consistent queries. The other keys
+// are still read with eventual consistency.
+//
+// Reads without WithEventualConsistency don't need it: the cache locks taken
+// by writes and the datastore's lookups by key already guarantee that a read
+// started after a write returned sees it. Like WithRequestCache, only use it
+// for short lived contexts such as the one of an HTTP request, as the set of
+// written keys only grows.
+func WithReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writtenKeysKey{}, &writtenKeys{
+		keys: make(map[string]bool),
+	})
+}
+
+func writtenKeysFrom(ctx context.Context) *writtenKeys {
+	wk, _ := ctx.Value(writtenKeysKey{}).(*writtenKeys)
+	return wk
+}
+
+// rememberWrites records keys in the written keys of ctx, if any.
+func (c *Client) rememberWrites(ctx context.Context, keys []*datastore.Key) {
+	wk := writtenKeysFrom(ctx)
+	if wk == nil {
+		return
+	}
+	wk.Lock()
+	defer wk.Unlock()
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			wk.keys[createCacheKey(c.keys, key)] = true
+		}
+	}
+}
+
+// rememberWriteItems records the entities locked by cache items in the
+// written keys of ctx, if any.
+func rememberWriteItems(ctx context.Context, items []*Item) {
+	wk := writtenKeysFrom(ctx)
+	if wk == nil {
+		return
+	}
+	wk.Lock()
+	defer wk.Unlock()
+	for _, item := range items {
+		wk.keys[item.Key] = true
+	}
+}
+
+// written reports whether key was written with ctx.
+func (c *Client) written(ctx context.Context, key *datastore.Key) bool {
+	wk := writtenKeysFrom(ctx)
+	if wk == nil {
+		return false
+	}
+	wk.Lock()
+	defer wk.Unlock()
+	return wk.keys[createCacheKey(c.keys, key)]
+}
+
+// strongContext returns ctx without WithEventualConsistency.
+func strongContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, eventualKey{}, false)
+}
+
+// getMultiReadYourWrites reads the keys written with ctx with strong
+// consistency and the rest with eventual consistency.
+func (c *Client) getMultiReadYourWrites(ctx context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	var strong, eventual []int
+	for i, key := range keys {
+		if c.written(ctx, key) {
+			strong = append(strong, i)
+		} else {
+			eventual = append(eventual, i)
+		}
+	}
+	if len(strong) == 0 {
+		return c.getMultiEventual(ctx, keys, vals)
+	}
+
+	me, errsNil := make(datastore.MultiError, len(keys)), true
+	load := func(indexes []int, get func(keys []*datastore.Key, vals reflect.Value) error) error {
+		if len(indexes) == 0 {
+			return nil
+		}
+		subKeys := make([]*datastore.Key, len(indexes))
+		subVals := reflect.MakeSlice(vals.Type(), len(indexes), len(indexes))
+		for j, i := range indexes {
+			subKeys[j] = keys[i]
+			subVals.Index(j).Set(vals.Index(i))
+		}
+
+		err := get(subKeys, subVals)
+		subErrs, ok := err.(datastore.MultiError)
+		if err != nil && !ok {
+			return err
+		}
+		for j, i := range indexes {
+			vals.Index(i).Set(subVals.Index(j))
+			if subErrs != nil && subErrs[j] != nil {
+				me[i], errsNil = subErrs[j], false
+			}
+		}
+		return nil
+	}
+
+	if err := load(strong, func(keys []*datastore.Key, vals reflect.Value) error {
+		return c.getMultiUncached(strongContext(ctx), keys, vals)
+	}); err != nil {
+		return err
+	}
+	if err := load(eventual, func(keys []*datastore.Key, vals reflect.Value) error {
+		return c.getMultiEventual(ctx, keys, vals)
+	}); err != nil {
+		return err
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,101 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestReadYourWritesSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestReadYourWrites", ReadYourWritesTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func ReadYourWritesTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("ReadYourWritesTest%d", time.Now().UnixNano())
+		written := datastore.NameKey(kind, "written", nil)
+		deleted := datastore.NameKey(kind, "deleted", nil)
+		other := datastore.NameKey(kind, "other", nil)
+		keys := []*datastore.Key{written, deleted, other}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}, {3}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Strongly consistent reads are datastore lookups, eventually
+		// consistent ones are queries.
+		var lookedUp []*datastore.Key
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			lookedUp = append(lookedUp, keys...)
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		requestCtx := nds.WithEventualConsistency(nds.WithReadYourWrites(ctx))
+		if _, err := ndsClient.Put(requestCtx, written, &testEntity{10}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Delete(requestCtx, deleted); err != nil {
+			t.Fatal(err)
+		}
+
+		vals := make([]testEntity, len(keys))
+		err = ndsClient.GetMulti(requestCtx, keys, vals)
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected a datastore.MultiError, got %v", err)
+		}
+		if me[0] != nil || me[1] != datastore.ErrNoSuchEntity || me[2] != nil {
+			t.Fatalf("unexpected errors %v", me)
+		}
+		if vals[0].IntVal != 10 || vals[2].IntVal != 3 {
+			t.Fatalf("unexpected values %v", vals)
+		}
+		if len(lookedUp) != 2 || !lookedUp[0].Equal(written) || !lookedUp[1].Equal(deleted) {
+			t.Fatalf("expected only the written keys looked up, got %v", lookedUp)
+		}
+
+		for _, key := range []*datastore.Key{written, deleted} {
+			exists, err := ndsClient.Exists(requestCtx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := key.Equal(written); exists != want {
+				t.Fatalf("expected %v to exist %v, got %v", key, want, exists)
+			}
+		}
+
+		// Other requests don't know about the writes.
+		fresh := datastore.NameKey(kind, "fresh", nil)
+		if _, err := ndsClient.Put(requestCtx, fresh, &testEntity{4}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, fresh)
+		lookedUp = nil
+		otherCtx := nds.WithEventualConsistency(nds.WithReadYourWrites(ctx))
+		if err := ndsClient.Get(otherCtx, fresh, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if len(lookedUp) != 0 {
+			t.Fatalf("expected no lookups, got %v", lookedUp)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package nds
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/iterator"
+)
+
+// reindexConcurrency is the number of entities Reindex re-puts at once.
+const reindexConcurrency = 16
+
+// reindexPageSize is the number of keys Reindex reads per query page. It is
+// a variable so tests can page through small result sets.
+var reindexPageSize = 500
+
+// Reindex re-puts every entity matched by q and returns how many were
+// re-put. Use it after adding a composite index, or otherwise changing the
+// index configuration, to populate the indexes for existing entities. The
+// query is run keys-only, a page at a time using cursors, so it works for
+// arbitrarily large result sets; each page is re-put before the next one is
+// read. Any limit or cursor set on q is overridden.
+//
+// Each entity is loaded and put back in its own transaction so a concurrent
+// write is never clobbered, and the cache is invalidated as for any other
+// transaction. The entity is rewritten as it is stored, as a
+// datastore.PropertyList, so properties keep their stored index settings.
+// Entities deleted after the query has returned their keys are skipped and not
+// counted.
+//
+// Reindex stops at the first error, from the query or from a transaction, and
+// returns it along with the number of entities re-put so far. Pass
+// WithConcurrency to change how many entities are re-put at once.
+func (c *Client) Reindex(ctx context.Context, q *datastore.Query, opts ...CallOption) (int, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Reindex")
+	defer span.End()
+
+	o := newCallOptions(opts)
+	concurrency, err := o.concurrencyOr(reindexConcurrency)
+	if err != nil {
+		return 0, err
+	}
+
+	reindexed := 0
+	var cursor datastore.Cursor
+	for {
+		keys, next, err := c.reindexPage(ctx, q, cursor)
+		if err != nil {
+			return reindexed, err
+		}
+		n, err := c.reindexKeys(ctx, keys, concurrency)
+		reindexed += n
+		if err != nil {
+			return reindexed, err
+		}
+		if len(keys) < reindexPageSize {
+			return reindexed, nil
+		}
+		cursor = next
+	}
+}
+
+// reindexPage returns the keys of the page of q starting at cursor, or at the
+// start of q if cursor is the zero value, and the cursor of the next page.
+func (c *Client) reindexPage(ctx context.Context, q *datastore.Query,
+	cursor datastore.Cursor) ([]*datastore.Key, datastore.Cursor, error) {
+
+	q = q.KeysOnly().Limit(reindexPageSize)
+	if cursor.String() != "" {
+		q = q.Start(cursor)
+	}
+
+	var keys []*datastore.Key
+	var next datastore.Cursor
+	err := c.guardDatastore(ctx, func() error {
+		it := c.ds.Run(ctx, q)
+		for {
+			key, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		var err error
+		next, err = it.Cursor()
+		return err
+	})
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	return keys, next, nil
+}
+
+// reindexKeys re-puts the entities for keys, concurrency at a time, and
+// returns how many were re-put along with the first error.
+func (c *Client) reindexKeys(ctx context.Context, keys []*datastore.Key,
+	concurrency int) (int, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		reindexed int
+		firstErr  error
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, key := range keys {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(key *datastore.Key) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := c.reindexKey(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				reindexed++
+			case err == datastore.ErrNoSuchEntity:
+			case firstErr == nil:
+				firstErr = err
+				cancel()
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		// ctx may have been done before every key was re-put.
+		firstErr = ctx.Err()
+	}
+	return reindexed, firstErr
+}
+
+// reindexKey loads the entity for key and puts it back in a transaction.
+func (c *Client) reindexKey(ctx context.Context, key *datastore.Key) error {
+	_, err := c.RunInTransaction(ctx, func(tx *Transaction) error {
+		var pl datastore.PropertyList
+		if err := tx.Get(key, &pl); err != nil {
+			return err
+		}
+		_, err := tx.Put(key, &pl)
+		return err
+	})
+	return err
+}
@@ -0,0 +1,86 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestReindexSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestReindex", ReindexTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func ReindexTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Page through the entities a few at a time.
+		nds.SetReindexPageSize(7)
+		defer nds.SetReindexPageSize(500)
+
+		type testEntity struct {
+			Value int
+		}
+
+		kind := fmt.Sprintf("ReindexTest%d", time.Now().UnixNano())
+		const count = 30
+		keys := make([]*datastore.Key, count)
+		entities := make([]testEntity, count)
+		for i := range keys {
+			keys[i] = datastore.NameKey(kind, strconv.Itoa(i), nil)
+			entities[i] = testEntity{i}
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		// Prime the cache, then change every other entity behind its back.
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, count)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i += 2 {
+			entities[i].Value += 100
+			if _, err := ndsClient.Client.Put(ctx, keys[i], &entities[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reindexed, err := ndsClient.Reindex(ctx, datastore.NewQuery(kind),
+			nds.WithConcurrency(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reindexed != count {
+			t.Fatalf("expected %d reindexed, got %d", count, reindexed)
+		}
+
+		// The external writes survived and the stale cache was refreshed.
+		got := make([]testEntity, count)
+		if err := ndsClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		for i := range got {
+			if got[i] != entities[i] {
+				t.Fatalf("expected %v for %v, got %v", entities[i], keys[i], got[i])
+			}
+		}
+
+		if _, err := ndsClient.Reindex(ctx, datastore.NewQuery(kind),
+			nds.WithConcurrency(0)); err == nil {
+			t.Fatal("expected an error for a concurrency of 0")
+		}
+	}
+}
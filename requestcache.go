@@ -0,0 +1,153 @@
+package nds
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+type requestCacheKey struct{}
+
+// requestCache memoizes the entities loaded within one request, keyed by
+// cache key. A nil value records a missing entity.
+type requestCache struct {
+	sync.Mutex
+	entities map[string][]byte
+}
+
+// WithRequestCache returns a context that memoizes the entities loaded by
+// Get and GetMulti for as long as it lives, so loading the same entity again
+// with that context or one derived from it doesn't touch the cache or the
+// datastore and sees the same entity. Put, Delete, Mutate, CompareAndSwap and
+// transactions using the context forget the entities they write. Writes made
+// with other contexts are not seen, so only use it for short lived contexts
+// such as the one of an HTTP request.
+func WithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheKey{}, &requestCache{
+		entities: make(map[string][]byte),
+	})
+}
+
+func requestCacheFrom(ctx context.Context) *requestCache {
+	rc, _ := ctx.Value(requestCacheKey{}).(*requestCache)
+	return rc
+}
+
+// forgetRequestCache removes keys from the request cache of ctx, if any.
+func (c *Client) forgetRequestCache(ctx context.Context, keys []*datastore.Key) {
+	rc := requestCacheFrom(ctx)
+	if rc == nil {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			delete(rc.entities, createCacheKey(c.keys, key))
+		}
+	}
+}
+
+// forgetRequestCacheItems removes the entities locked by cache items from the
+// request cache of ctx, if any.
+func forgetRequestCacheItems(ctx context.Context, items []*Item) {
+	rc := requestCacheFrom(ctx)
+	if rc == nil {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	for _, item := range items {
+		delete(rc.entities, item.Key)
+	}
+}
+
+// getMultiRequestCached serves the keys found in rc and loads the rest from
+// the cache and the datastore, remembering them in rc.
+func (c *Client) getMultiRequestCached(ctx context.Context, rc *requestCache,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	me, errsNil := make(datastore.MultiError, len(keys)), true
+	cacheKeys := make([]string, len(keys))
+	var missing []int
+	provenance := provenanceFrom(ctx)
+
+	rc.Lock()
+	for i, key := range keys {
+		cacheKeys[i] = createCacheKey(c.keys, key)
+		data, ok := rc.entities[cacheKeys[i]]
+		switch {
+		case !ok:
+			missing = append(missing, i)
+			continue
+		case data == nil:
+			me[i], errsNil = datastore.ErrNoSuchEntity, false
+		default:
+			pl := datastore.PropertyList{}
+			if err := unmarshal(data, &pl); err != nil {
+				c.onError(ctx, errors.Wrap(err, "nds:getMultiRequestCached unmarshal"))
+				missing = append(missing, i)
+				continue
+			} else if err := setValue(vals.Index(i), pl, key); err != nil {
+				me[i], errsNil = err, false
+			}
+		}
+		reportProvenance(provenance, key, me[i], ProvenanceRequestCache)
+	}
+	rc.Unlock()
+
+	if len(missing) > 0 {
+		missingKeys := make([]*datastore.Key, len(missing))
+		missingVals := reflect.MakeSlice(vals.Type(), len(missing), len(missing))
+		for j, i := range missing {
+			missingKeys[j] = keys[i]
+			missingVals.Index(j).Set(vals.Index(i))
+		}
+
+		err := c.getMultiUncached(ctx, missingKeys, missingVals)
+		missingErrs, ok := err.(datastore.MultiError)
+		if err != nil && !ok {
+			return err
+		}
+
+		rc.Lock()
+		for j, i := range missing {
+			vals.Index(i).Set(missingVals.Index(j))
+			var e error
+			if missingErrs != nil {
+				e = missingErrs[j]
+			}
+			switch {
+			case isUncacheable(missingVals.Index(j)):
+				if e != nil {
+					me[i], errsNil = e, false
+				}
+			case e == nil:
+				pl, err := saveValue(missingVals.Index(j))
+				var data []byte
+				if err == nil {
+					data, err = marshal(pl)
+				}
+				if err != nil {
+					c.cacheSerializationFailed(ctx, keys[i], err)
+					continue
+				}
+				rc.entities[cacheKeys[i]] = data
+			case e == datastore.ErrNoSuchEntity:
+				rc.entities[cacheKeys[i]] = nil
+				me[i], errsNil = e, false
+			default:
+				me[i], errsNil = e, false
+			}
+		}
+		rc.Unlock()
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,22 @@
+package nds
+
+import "fmt"
+
+// RetriesExhaustedError is returned when nds gave up on an operation it
+// retried internally. Err is the error of the last attempt and can be matched
+// through the RetriesExhaustedError with errors.Is.
+type RetriesExhaustedError struct {
+	// Attempts is the number of times the operation was tried.
+	Attempts int
+	// Err is the error returned by the last attempt.
+	Err error
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("nds: gave up after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.Err
+}
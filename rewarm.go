@@ -0,0 +1,76 @@
+package nds
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// rewarmConcurrency is the number of getMultiLimit sized chunks RewarmKeys
+// loads at once, which bounds how many entities it holds in memory.
+const rewarmConcurrency = 4
+
+// RewarmKeys reads the entities for keys so they are cached under the
+// client's current cache keys. Use it to warm the cache ahead of traffic after
+// the cache key scheme changed, for example after adding WithDatabaseID,
+// rather than letting every entity miss at once. Keys whose entities are
+// already cached don't touch the datastore, and missing entities are cached as
+// missing. The entities themselves are discarded.
+//
+// Keys are loaded in chunks, a few at a time, through GetMulti so
+// WithReadConcurrency and WithMaxInFlightBytes apply. Missing entities are not
+// an error; any other error is returned as a datastore.MultiError in
+// one-to-one correspondence with keys.
+func (c *Client) RewarmKeys(ctx context.Context, keys []*datastore.Key) error {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.RewarmKeys")
+	defer span.End()
+
+	if c.cacher == nil || len(keys) == 0 {
+		return nil
+	}
+
+	callCount := (len(keys)-1)/getMultiLimit + 1
+	errs := make([]error, callCount)
+	sem := make(chan struct{}, rewarmConcurrency)
+
+	var wg sync.WaitGroup
+	wg.Add(callCount)
+	for i := 0; i < callCount; i++ {
+		lo := i * getMultiLimit
+		hi := (i + 1) * getMultiLimit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		sem <- struct{}{}
+		go func(i int, keys []*datastore.Key) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = unwrapBatchError(c.GetMulti(ctx, keys,
+				make([]datastore.PropertyList, len(keys))))
+		}(i, keys[lo:hi])
+	}
+	wg.Wait()
+
+	if isErrorsNil(errs) {
+		return nil
+	}
+	me := groupErrors(errs, len(keys), getMultiLimit).(datastore.MultiError)
+	failed := false
+	for i, err := range me {
+		if err == datastore.ErrNoSuchEntity {
+			me[i] = nil
+		} else if err != nil {
+			failed = true
+		}
+	}
+	if !failed {
+		return nil
+	}
+	return me
+}
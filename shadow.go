@@ -0,0 +1,150 @@
+package nds
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+// CacheMismatch is emitted by shadow reads when the cached entity for Key
+// differs from the one stored in the datastore.
+type CacheMismatch struct {
+	Key *datastore.Key
+}
+
+func (CacheMismatch) isEvent() {}
+
+// WithShadowReads makes a sampleRate fraction of GetMulti and Get calls
+// return the entities from the datastore while comparing them against the
+// cache, emitting a CacheMismatch event for every key where the two differ.
+// Shadow reads neither lock nor populate the cache. It is intended for gaining
+// confidence in the cache when rolling out nds and adds the latency of a
+// datastore read to every sampled call. Calls are sampled using the source set
+// with WithRand.
+func WithShadowReads(sampleRate float64) ClientOption {
+	return func(c *Client) {
+		c.shadowRate = sampleRate
+	}
+}
+
+func (c *Client) sampleShadowRead() bool {
+	return c.shadowRate > 0 && c.randFloat64() < c.shadowRate
+}
+
+// shadowGetMulti loads vals from the datastore and reports any entities the
+// cache disagrees with.
+func (c *Client) shadowGetMulti(ctx context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	cacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		cacheKeys[i] = createCacheKey(c.keys, key)
+	}
+
+	items, cacheErr := c.cacher.GetMulti(ctx, cacheKeys)
+	if cacheErr != nil {
+		c.onError(ctx, errors.Wrap(cacheErr, "nds:shadowGetMulti GetMulti"))
+	}
+
+	pls := make([]datastore.PropertyList, len(keys))
+	var me datastore.MultiError
+	if err := c.guardDatastore(ctx, func() error {
+		return c.ds.GetMulti(ctx, keys, pls)
+	}); err == nil {
+		me = make(datastore.MultiError, len(keys))
+	} else if e, ok := err.(datastore.MultiError); ok {
+		me = e
+	} else {
+		return err
+	}
+
+	errsNil, provenance := true, provenanceFrom(ctx)
+	for i, key := range keys {
+		if item, ok := items[cacheKeys[i]]; ok && c.cacheMismatch(ctx, item, pls[i], me[i]) {
+			c.observe(ctx, CacheMismatch{Key: key})
+		}
+		if me[i] == nil {
+			me[i] = setValue(vals.Index(i), pls[i], key)
+		}
+		reportProvenance(provenance, key, me[i], ProvenanceDatastore)
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// cacheMismatch reports whether the cache item disagrees with the datastore
+// result pl, err. Locks never disagree.
+func (c *Client) cacheMismatch(ctx context.Context, item *Item,
+	pl datastore.PropertyList, err error) bool {
+
+	switch item.Flags {
+	case noneItem:
+		return err == nil
+	case entityItem:
+		if err != nil {
+			return err == datastore.ErrNoSuchEntity
+		}
+
+		// Both sides are re-encoded by this process so that equal entities
+		// always produce equal bytes. The datastore returns properties in
+		// no particular order so they are sorted first.
+		cachedPL := datastore.PropertyList{}
+		if err := c.unmarshalEntity(item.Value, &cachedPL); err != nil {
+			c.onError(ctx, errors.Wrap(err, "nds:cacheMismatch unmarshal"))
+			return true
+		}
+		cached, err := marshal(sortPropertyList(cachedPL))
+		if err != nil {
+			c.onError(ctx, errors.Wrap(err, "nds:cacheMismatch marshal"))
+			return false
+		}
+		stored, err := marshal(sortPropertyList(pl))
+		if err != nil {
+			c.onError(ctx, errors.Wrap(err, "nds:cacheMismatch marshal"))
+			return false
+		}
+		return !bytes.Equal(cached, stored)
+	}
+	return false
+}
+
+// sortPropertyList returns a copy of pl, and of any entities nested in it,
+// with the properties sorted by name.
+func sortPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	sorted := make(datastore.PropertyList, len(pl))
+	for i, p := range pl {
+		p.Value = sortValue(p.Value)
+		sorted[i] = p
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+func sortValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *datastore.Entity:
+		if v == nil {
+			return v
+		}
+		return &datastore.Entity{Key: v.Key, Properties: sortPropertyList(v.Properties)}
+	case []interface{}:
+		sorted := make([]interface{}, len(v))
+		for i, e := range v {
+			sorted[i] = sortValue(e)
+		}
+		return sorted
+	}
+	return v
+}
@@ -0,0 +1,132 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestShadowReadsSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestShadowReadsMismatch", ShadowReadsMismatchTest(item.ctx, item.cacher))
+			t.Run("TestShadowReadsNoFalseMismatch", ShadowReadsNoFalseMismatchTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func ShadowReadsMismatchTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var mismatches []*datastore.Key
+		observer := func(_ context.Context, e nds.Event) {
+			if m, ok := e.(nds.CacheMismatch); ok {
+				mismatches = append(mismatches, m.Key)
+			}
+		}
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shadowClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithShadowReads(1), nds.WithObserver(observer))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Val int
+		}
+
+		keys := []*datastore.Key{
+			datastore.NameKey("ShadowReadsMismatchTest", "consistent", nil),
+			datastore.NameKey("ShadowReadsMismatchTest", "stale", nil),
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Prime cache.
+		if err := ndsClient.GetMulti(ctx, keys, make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+
+		// Corrupt the cached value of the second key.
+		data, err := nds.MarshalPropertyList(datastore.PropertyList{
+			{Name: "Val", Value: int64(3)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cacher.SetMulti(ctx, []*nds.Item{{
+			Key:   nds.CacheKey(keys[1]),
+			Flags: nds.EntityItem,
+			Value: data,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]testEntity, len(keys))
+		if err := shadowClient.GetMulti(ctx, keys, got); err != nil {
+			t.Fatal(err)
+		}
+
+		// The datastore value is authoritative.
+		if got[0].Val != 1 || got[1].Val != 2 {
+			t.Fatalf("expected datastore values, got %v", got)
+		}
+
+		if len(mismatches) != 1 || !mismatches[0].Equal(keys[1]) {
+			t.Fatalf("expected a single mismatch for %s, got %v", keys[1], mismatches)
+		}
+	}
+}
+
+func ShadowReadsNoFalseMismatchTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var mismatches []*datastore.Key
+		observer := func(_ context.Context, e nds.Event) {
+			if m, ok := e.(nds.CacheMismatch); ok {
+				mismatches = append(mismatches, m.Key)
+			}
+		}
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithWriteThrough(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shadowClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithShadowReads(1), nds.WithObserver(observer))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			A, B, C, D string
+			When       time.Time
+		}
+
+		// The datastore returns properties in no particular order and with
+		// microsecond precision, neither of which is a mismatch.
+		key := datastore.NameKey("ShadowReadsNoFalseMismatchTest", "one", nil)
+		entity := &testEntity{"a", "b", "c", "d", time.Unix(1564660215, 123456789)}
+		if _, err := ndsClient.Put(ctx, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.Delete(ctx, key)
+
+		for i := 0; i < 10; i++ {
+			if err := shadowClient.Get(ctx, key, &testEntity{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(mismatches) != 0 {
+			t.Fatalf("expected no mismatches, got %d", len(mismatches))
+		}
+	}
+}
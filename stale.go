@@ -0,0 +1,123 @@
+package nds
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// WithServeStaleOnDatastoreError makes Get and GetMulti serve a possibly
+// stale copy of an entity when the datastore read for it fails, rather than
+// failing, trading freshness for availability during datastore incidents.
+// Every entity the cache is filled with is also copied to a second cache slot
+// that writes don't invalidate and that only expires when the cacher evicts
+// it. If a datastore read fails with an error that says the datastore is
+// unhealthy, the same errors that trip WithCircuitBreaker, the keys with a
+// copy are served from it and counted in the nds/served_stale view; the other
+// keys get the error in a datastore.MultiError, or the call fails with it if
+// no key had a copy.
+//
+// A stale copy may be of an entity that has been changed or deleted since,
+// and is never written back to the cache. The copies cost an extra cache
+// write for every cache fill. It is disabled by default.
+func WithServeStaleOnDatastoreError(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.serveStale = enabled
+	}
+}
+
+// saveStale copies the entities saveCache just cached to their stale slots.
+// err is the error saveCache got, and the entities that could not be cached
+// are not copied either.
+func (c *Client) saveStale(ctx context.Context, cacheItems []cacheItem, err error) {
+	me, ok := err.(MultiError)
+	if err != nil && !ok {
+		return
+	}
+
+	staleItems := make([]*Item, 0, len(cacheItems))
+	i := 0
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state != internalLock {
+			continue
+		}
+		failed := me != nil && me[i] != nil
+		i++
+		if failed || cacheItem.item.Flags != entityItem {
+			continue
+		}
+		staleItems = append(staleItems, &Item{
+			Key:   createStaleKey(c.keys, cacheItem.key),
+			Flags: entityItem,
+			Value: cacheItem.item.Value,
+		})
+	}
+	if len(staleItems) == 0 {
+		return
+	}
+
+	if err := c.cacher.SetMulti(ctx, staleItems); err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:saveStale SetMulti"))
+	}
+}
+
+// serveStaleCopies serves the cache items loadDatastore failed to load with
+// dsErr from their stale copies. It returns dsErr if there were none.
+func (c *Client) serveStaleCopies(ctx context.Context, cacheItems []cacheItem,
+	dsErr error) error {
+
+	staleKeys := make([]string, 0, len(cacheItems))
+	indexes := make([]int, 0, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		switch cacheItem.state {
+		case internalLock, externalLock:
+			staleKeys = append(staleKeys, createStaleKey(c.keys, cacheItem.key))
+			indexes = append(indexes, i)
+		}
+	}
+
+	items, err := c.cacher.GetMulti(ctx, staleKeys)
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:serveStaleCopies GetMulti"))
+		return dsErr
+	}
+
+	served := make(map[string]int64)
+	for j, i := range indexes {
+		cacheItem := &cacheItems[i]
+		// Neither served nor failed entities are written to the cache.
+		cacheItem.state = externalLock
+		cacheItem.err = dsErr
+
+		item, ok := items[staleKeys[j]]
+		if !ok || item.Flags != entityItem {
+			continue
+		}
+		var pl datastore.PropertyList
+		if err := c.unmarshalEntity(item.Value, &pl); err != nil {
+			c.onError(ctx, errors.Wrap(err, "nds:serveStaleCopies unmarshal"))
+			continue
+		}
+		cacheItem.err = setValue(cacheItem.val, pl, cacheItem.key)
+		cacheItem.stale = true
+		served[cacheItem.key.Kind]++
+	}
+	if len(served) == 0 {
+		return dsErr
+	}
+
+	for kind, n := range served {
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{
+				tag.Upsert(KeyKind, kind),
+			},
+			mServedStale.M(n),
+		); err != nil {
+			c.onError(ctx, errors.Wrap(err, "nds:serveStaleCopies stats"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestServeStaleSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestServeStale", ServeStaleTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func ServeStaleTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		if err := view.Register(nds.AllViews...); err != nil {
+			t.Fatal(err)
+		}
+		defer view.Unregister(nds.AllViews...)
+
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithServeStaleOnDatastoreError(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("ServeStaleTest%d", time.Now().UnixNano())
+		copied := datastore.NameKey(kind, "copied", nil)
+		uncopied := datastore.NameKey(kind, "uncopied", nil)
+		keys := []*datastore.Key{copied, uncopied}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}, {1}}); err != nil {
+			t.Fatal(err)
+		}
+		// Cache, and so copy, only the first entity and then change it,
+		// which evicts it from the cache but not its copy.
+		if err := ndsClient.Get(ctx, copied, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ndsClient.Put(ctx, copied, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+
+		unavailable := status.Error(codes.Unavailable, "datastore down")
+		nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) > 0 {
+				return unavailable
+			}
+			return nil
+		})
+		defer nds.SetDatastoreGetMultiHook(nil)
+
+		var rec provenanceRecorder
+		pctx := nds.WithProvenance(ctx, rec.record)
+		got := make([]testEntity, len(keys))
+		err = ndsClient.GetMulti(pctx, keys, got)
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("expected datastore.MultiError, got %v", err)
+		}
+		if me[0] != nil || me[1] != unavailable {
+			t.Fatalf("expected the copy served and %v, got %v", unavailable, me)
+		}
+		if got[0].IntVal != 1 {
+			t.Fatalf("expected the stale copy 1, got %d", got[0].IntVal)
+		}
+		rec.check(t, map[*datastore.Key]nds.Provenance{
+			copied: nds.ProvenanceStale,
+		})
+
+		// Without any copy the read fails as usual.
+		if err := ndsClient.Get(ctx, uncopied, &testEntity{}); err != unavailable {
+			t.Fatalf("expected %v, got %v", unavailable, err)
+		}
+
+		rows, err := view.RetrieveData("nds/served_stale")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var served float64
+		for _, row := range rows {
+			for _, tag := range row.Tags {
+				if tag.Value == kind {
+					served = row.Data.(*view.SumData).Value
+				}
+			}
+		}
+		if served != 1 {
+			t.Fatalf("expected 1 entity served stale, got %v", served)
+		}
+
+		// Once the datastore is back the fresh entity is read and the stale
+		// copy was never cached.
+		nds.SetDatastoreGetMultiHook(nil)
+		entity := &testEntity{}
+		if err := ndsClient.Get(ctx, copied, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 2 {
+			t.Fatalf("expected 2, got %d", entity.IntVal)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package nds
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// Result is an entity loaded by GetMultiChan.
+type Result struct {
+	// Index is the position of Key in the keys passed to GetMultiChan.
+	Index int
+	Key   *datastore.Key
+	// Entity is the entity for Key if Err is nil.
+	Entity datastore.PropertyList
+	// Err is datastore.ErrNoSuchEntity if there is no entity for Key, or any
+	// other error loading it.
+	Err error
+}
+
+// GetMultiChan loads the entities for keys and sends them on the returned
+// channel as they are loaded, for pipelines that process entities while the
+// rest are still loading. Entities are loaded through the cache, exactly like
+// GetMulti, in chunks of 1000 keys, with at most two chunks, or as many as set
+// with WithMaxBufferedChunks, loading or waiting to be received at once.
+// Results within a chunk are sent in the order of keys but chunks are sent as
+// they complete, so use Result.Index to tell where a result belongs.
+//
+// The channel is closed once every result has been sent, or as soon as ctx is
+// done, in which case the remaining results are dropped; check ctx.Err() to
+// tell the two apart. Either receive until the channel is closed or cancel ctx,
+// otherwise the chunks waiting to be received are never released.
+func (c *Client) GetMultiChan(ctx context.Context, keys []*datastore.Key) <-chan Result {
+	// The span covers loading every chunk, so it ends once loading does.
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.GetMultiChan")
+	keys = c.keysInNamespace(keys)
+
+	concurrency := c.maxBufferedChunks
+	if concurrency == 0 {
+		concurrency = defaultMaxBufferedChunks
+	}
+
+	results := make(chan Result)
+	go func() {
+		var wg sync.WaitGroup
+		defer span.End()
+		defer close(results)
+		defer wg.Wait()
+
+		sem := make(chan struct{}, concurrency)
+		for lo := 0; lo < len(keys); lo += getMultiLimit {
+			hi := lo + getMultiLimit
+			if hi > len(keys) {
+				hi = len(keys)
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(lo int, keys []*datastore.Key) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				chunk := c.loadEntityChunk(ctx, keys)
+				for i, key := range chunk.keys {
+					result := Result{
+						Index:  lo + i,
+						Key:    key,
+						Entity: chunk.pls[i],
+						Err:    chunk.errs[i],
+					}
+					if result.Err != nil {
+						result.Entity = nil
+					}
+					select {
+					case results <- result:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(lo, keys[lo:hi])
+		}
+	}()
+	return results
+}
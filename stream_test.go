@@ -0,0 +1,133 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestGetMultiChanSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestGetMultiChan", GetMultiChanTest(item.ctx, item.cacher))
+			t.Run("TestGetMultiChanCancel", GetMultiChanCancelTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func GetMultiChanTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		// Every third key has no entity and one key is invalid.
+		kind := fmt.Sprintf("GetMultiChanTest%d", time.Now().UnixNano())
+		const count = 2500
+		keys := make([]*datastore.Key, count)
+		var putKeys []*datastore.Key
+		var entities []testEntity
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+			if i%3 != 0 {
+				putKeys = append(putKeys, keys[i])
+				entities = append(entities, testEntity{i})
+			}
+		}
+		keys[1200] = nil
+		if _, err := ndsClient.PutMulti(ctx, putKeys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make([]bool, count)
+		for result := range ndsClient.GetMultiChan(ctx, keys) {
+			i := result.Index
+			if seen[i] {
+				t.Fatalf("result %d sent twice", i)
+			}
+			seen[i] = true
+			if result.Key != keys[i] {
+				t.Fatalf("expected key %v for result %d, got %v", keys[i], i, result.Key)
+			}
+
+			switch {
+			case i == 1200:
+				if result.Err != datastore.ErrInvalidKey {
+					t.Fatalf("expected datastore.ErrInvalidKey, got %v", result.Err)
+				}
+			case i%3 == 0:
+				if result.Err != datastore.ErrNoSuchEntity || result.Entity != nil {
+					t.Fatalf("expected datastore.ErrNoSuchEntity for %d, got %v, %v",
+						i, result.Entity, result.Err)
+				}
+			default:
+				if result.Err != nil {
+					t.Fatal(result.Err)
+				}
+				got := testEntity{}
+				if err := datastore.LoadStruct(&got, result.Entity); err != nil {
+					t.Fatal(err)
+				}
+				if got.Value != i {
+					t.Fatalf("expected %d, got %d", i, got.Value)
+				}
+			}
+		}
+		for i, ok := range seen {
+			if !ok {
+				t.Fatalf("result %d never sent", i)
+			}
+		}
+	}
+}
+
+func GetMultiChanCancelTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, func(err error) bool {
+			return strings.Contains(err.Error(), context.Canceled.Error())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := fmt.Sprintf("GetMultiChanCancelTest%d", time.Now().UnixNano())
+		keys := make([]*datastore.Key, 5000)
+		for i := range keys {
+			keys[i] = datastore.IDKey(kind, int64(i+1), nil)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := ndsClient.GetMultiChan(ctx, keys)
+		received := 0
+		timeout := time.After(10 * time.Second)
+		for done := false; !done; {
+			select {
+			case _, ok := <-results:
+				if !ok {
+					done = true
+					break
+				}
+				if received++; received == 10 {
+					cancel()
+				}
+			case <-timeout:
+				t.Fatal("channel not closed after cancel")
+			}
+		}
+		if received >= len(keys) {
+			t.Fatalf("expected results to stop after cancel, got all %d", received)
+		}
+	}
+}
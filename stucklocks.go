@@ -0,0 +1,127 @@
+package nds
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// lockValueSize is the size of the values of the locks nds sets: 4 random
+// bytes followed by the time the lock was created in nanoseconds.
+const lockValueSize = 12
+
+// defaultStuckLockAge is how old a lock must be for ClearStuckLocks to clear
+// it by default: the longest an underlying datastore call retries, so no write
+// can still be in flight under it.
+const defaultStuckLockAge = 30 * time.Second
+
+// WithStuckLockAge sets how old a cache lock must be for ClearStuckLocks to
+// consider it stuck. The default is 30 seconds, the longest a datastore call
+// retries, after which no write can still be in flight under the lock. A
+// shorter age clears locks sooner at the risk of clearing the lock of a slow
+// write, which lets a concurrent read cache the entity the write is about to
+// replace. An age of 0 or less keeps the default.
+func WithStuckLockAge(age time.Duration) ClientOption {
+	return func(c *Client) {
+		c.stuckLockAge = age
+	}
+}
+
+// ClearStuckLocks removes the cache locks of keys that are older than the age
+// set with WithStuckLockAge, so reads can fill the cache for them again, and
+// returns how many it removed. It is the remediation for keys Inspect reports
+// as CacheLocked long after any write, for example with a cache that doesn't
+// honor lock expirations.
+//
+// nds can't know whether a write is still in flight, so the age of a lock is
+// all it goes by. Locks whose age can't be told, such as the ones set by
+// older versions of nds, are left alone, as are locks that are replaced
+// between being read and removed if the Cacher implements CompareAndDeleter.
+// Without a cacher there are no locks and it returns 0.
+func (c *Client) ClearStuckLocks(ctx context.Context, keys []*datastore.Key) (int, error) {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.ClearStuckLocks")
+	defer span.End()
+	keys = c.keysInNamespace(keys)
+
+	if c.cacher == nil {
+		return 0, nil
+	}
+	cacheKeys, _ := getCacheLocks(c.keys, keys)
+	if len(cacheKeys) == 0 {
+		return 0, nil
+	}
+	items, err := c.cacher.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		return 0, errors.Wrap(err, "nds:ClearStuckLocks GetMulti")
+	}
+
+	maxAge := c.stuckLockAge
+	if maxAge <= 0 {
+		maxAge = defaultStuckLockAge
+	}
+	now := time.Now()
+	stuck := make([]*Item, 0, len(items))
+	for _, cacheKey := range cacheKeys {
+		item, ok := items[cacheKey]
+		if !ok || item.Flags != lockItem {
+			continue
+		}
+		if created, ok := lockCreated(item.Value); ok && now.Sub(created) > maxAge {
+			stuck = append(stuck, item)
+		}
+	}
+	if len(stuck) == 0 {
+		return 0, nil
+	}
+
+	if cad, ok := c.cacher.(CompareAndDeleter); ok {
+		err := cad.CompareAndDeleteMulti(ctx, stuck)
+		switch e := err.(type) {
+		case nil:
+			return len(stuck), nil
+		case MultiError:
+			// Locks that changed or expired meanwhile aren't stuck.
+			var cleared int
+			var firstErr error
+			for _, lockErr := range e {
+				switch lockErr {
+				case nil:
+					cleared++
+				case ErrCASConflict, ErrCacheMiss:
+				default:
+					if firstErr == nil {
+						firstErr = errors.Wrap(lockErr, "nds:ClearStuckLocks CompareAndDeleteMulti")
+					}
+				}
+			}
+			return cleared, firstErr
+		default:
+			if err != ErrCompareAndDeleteUnsupported {
+				return 0, errors.Wrap(err, "nds:ClearStuckLocks CompareAndDeleteMulti")
+			}
+		}
+	}
+
+	stuckKeys := make([]string, len(stuck))
+	for i, item := range stuck {
+		stuckKeys[i] = item.Key
+	}
+	if err := c.cacher.DeleteMulti(ctx, stuckKeys); err != nil {
+		return 0, errors.Wrap(err, "nds:ClearStuckLocks DeleteMulti")
+	}
+	return len(stuck), nil
+}
+
+// lockCreated returns the time the lock with value was created, if it is a
+// lock set by itemLock.
+func lockCreated(value []byte) (time.Time, bool) {
+	if len(value) != lockValueSize {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(value[4:]))), true
+}
@@ -0,0 +1,105 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestClearStuckLocksSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestClearStuckLocks", ClearStuckLocksTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func ClearStuckLocksTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithStuckLockAge(10*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("ClearStuckLocksTest%d", time.Now().UnixNano())
+		stuck := datastore.NameKey(kind, "stuck", nil)
+		fresh := datastore.NameKey(kind, "fresh", nil)
+		unknown := datastore.NameKey(kind, "unknown", nil)
+		cached := datastore.NameKey(kind, "cached", nil)
+		keys := []*datastore.Key{stuck, fresh, unknown, cached}
+		if _, err := ndsClient.PutMulti(ctx, keys,
+			[]testEntity{{1}, {2}, {3}, {4}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.Get(ctx, cached, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cacher.SetMulti(ctx, []*nds.Item{
+			{
+				Key:        ndsClient.LockKey(stuck),
+				Flags:      nds.LockItem,
+				Value:      nds.ItemLockAt(time.Now().Add(-time.Hour)),
+				Expiration: time.Minute,
+			},
+			{
+				Key:        ndsClient.LockKey(fresh),
+				Flags:      nds.LockItem,
+				Value:      nds.ItemLockAt(time.Now()),
+				Expiration: time.Minute,
+			},
+			{
+				// A lock without a creation time is never cleared.
+				Key:        ndsClient.LockKey(unknown),
+				Flags:      nds.LockItem,
+				Value:      []byte("lock"),
+				Expiration: time.Minute,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		cleared, err := ndsClient.ClearStuckLocks(ctx, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cleared != 1 {
+			t.Fatalf("expected 1 lock cleared, got %d", cleared)
+		}
+
+		for key, want := range map[*datastore.Key]nds.CacheState{
+			stuck:   nds.CacheAbsent,
+			fresh:   nds.CacheLocked,
+			unknown: nds.CacheLocked,
+			cached:  nds.CacheEntity,
+		} {
+			report, err := ndsClient.Inspect(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.CacheState != want {
+				t.Fatalf("expected %s to be %s, got %s", key.Name, want, report.CacheState)
+			}
+		}
+
+		// The cleared key is cached again by the next read.
+		if err := ndsClient.Get(ctx, stuck, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if report, err := ndsClient.Inspect(ctx, stuck); err != nil {
+			t.Fatal(err)
+		} else if report.CacheState != nds.CacheEntity {
+			t.Fatalf("expected the entity to be cached, got %s", report.CacheState)
+		}
+	}
+}
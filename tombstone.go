@@ -0,0 +1,86 @@
+package nds
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/pkg/errors"
+)
+
+// WithDeleteTombstones makes Delete and DeleteMulti replace their cache locks
+// with a tombstone once the datastore delete succeeds, so a read straight
+// after a delete is served from the cache as datastore.ErrNoSuchEntity
+// instead of reading the datastore. Tombstones expire after ttl and, like any
+// cached entity, are replaced by the next Put. Only locks that are still the
+// ones the delete set are replaced, using compare-and-swap. A ttl of 0 or less
+// disables tombstones, which is the default, and leaves the locks to expire.
+//
+// This gives keys that are deleted and soon created again a grace window that
+// costs no datastore reads: reads in between are tombstone hits, and the Put
+// that creates the entity again locks its cache slot like any other write, so
+// it can't be shadowed by the tombstone, after which a single read caches it,
+// or none with WithWriteThrough. Tombstones are only set once the delete is
+// known to have been applied. As with any cached entity, an entity created by
+// a write that bypasses nds is hidden by the tombstone until it expires, so
+// ttl bounds how long such a write can go unseen.
+//
+// With WithNegativeCacheKinds, deletes of the listed kinds get tombstones
+// expiring after the TTL of their kind instead, and other kinds get none.
+func WithDeleteTombstones(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.tombstoneTTL = ttl
+	}
+}
+
+// tombstoneLocks replaces the cache locks set by deleteMulti for keys with
+// tombstones, for the keys that get one.
+func (c *Client) tombstoneLocks(ctx context.Context, keys []*datastore.Key,
+	lockCacheItems []*Item) {
+	expirations := make(map[string]time.Duration, len(keys))
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		if exp, ok := c.tombstoneExpiration(key); ok {
+			expirations[createCacheKey(c.keys, key)] = exp
+		}
+	}
+
+	lockCacheKeys := make([]string, 0, len(lockCacheItems))
+	for _, item := range lockCacheItems {
+		if _, ok := expirations[item.Key]; ok {
+			lockCacheKeys = append(lockCacheKeys, item.Key)
+		}
+	}
+	if len(lockCacheKeys) == 0 {
+		return
+	}
+
+	items, err := c.cacher.GetMulti(ctx, lockCacheKeys)
+	if err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:tombstoneLocks GetMulti"))
+		return
+	}
+
+	swapItems := make([]*Item, 0, len(lockCacheItems))
+	for _, lock := range lockCacheItems {
+		item, ok := items[lock.Key]
+		exp, tombstone := expirations[lock.Key]
+		if !ok || !tombstone || item.Flags != lockItem || !bytes.Equal(item.Value, lock.Value) {
+			continue
+		}
+		item.Flags = noneItem
+		item.Value = []byte{}
+		item.Expiration = exp
+		swapItems = append(swapItems, item)
+	}
+
+	if len(swapItems) == 0 {
+		return
+	}
+	if err := c.cacher.CompareAndSwapMulti(ctx, swapItems); err != nil {
+		c.onError(ctx, errors.Wrap(err, "nds:tombstoneLocks CompareAndSwapMulti"))
+	}
+}
@@ -2,18 +2,28 @@ package nds
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"go.opencensus.io/trace"
 )
 
+var (
+	// runInTransactionHook exists purely for testing
+	runInTransactionHook func(ctx context.Context,
+		f func(tx *datastore.Transaction) error) (*datastore.Commit, error)
+)
+
 type Transaction struct {
 	c   *Client
 	ctx context.Context
 	tx  *datastore.Transaction
 	sync.Mutex
 	lockCacheItems []*Item
+	// written holds the keys written for WithQueryCacheTTL to invalidate.
+	written []*datastore.Key
 }
 
 func (t *Transaction) lockKey(key *datastore.Key) {
@@ -22,10 +32,13 @@ func (t *Transaction) lockKey(key *datastore.Key) {
 
 func (t *Transaction) lockKeys(keys []*datastore.Key) {
 	if t.c.cacher != nil {
-		_, lockCacheItems := getCacheLocks(keys)
+		_, lockCacheItems := getCacheLocks(t.c.keys, keys)
 		t.Lock()
 		t.lockCacheItems = append(t.lockCacheItems,
 			lockCacheItems...)
+		if t.c.queryCacheTTL > 0 {
+			t.written = append(t.written, keys...)
+		}
 		t.Unlock()
 	}
 }
@@ -35,7 +48,11 @@ func (c *Client) NewTransaction(ctx context.Context, opts ...datastore.Transacti
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.NewTransaction")
 	defer span.End()
-	tx, err := c.Client.NewTransaction(ctx, opts...)
+	var tx *datastore.Transaction
+	err = c.guardDatastore(ctx, func() (err error) {
+		tx, err = c.ds.NewTransaction(ctx, opts...)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -47,6 +64,7 @@ func (t *Transaction) Get(key *datastore.Key, dst interface{}) error {
 	var span *trace.Span
 	t.ctx, span = trace.StartSpan(t.ctx, "github.com/qedus/nds.Transaction.Get")
 	defer span.End()
+	key = t.c.inNamespace(key)
 	return t.tx.Get(key, dst)
 }
 
@@ -55,6 +73,7 @@ func (t *Transaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
 	var span *trace.Span
 	t.ctx, span = trace.StartSpan(t.ctx, "github.com/qedus/nds.Transaction.GetMulti")
 	defer span.End()
+	keys = t.c.keysInNamespace(keys)
 	// We bypass the cache in transactional Get calls
 	return t.tx.GetMulti(keys, dst)
 }
@@ -63,6 +82,7 @@ func (t *Transaction) Put(key *datastore.Key, src interface{}) (*datastore.Pendi
 	var span *trace.Span
 	t.ctx, span = trace.StartSpan(t.ctx, "github.com/qedus/nds.Transaction.Put")
 	defer span.End()
+	key = t.c.inNamespace(key)
 	t.lockKey(key)
 	return t.tx.Put(key, src)
 }
@@ -72,6 +92,7 @@ func (t *Transaction) PutMulti(keys []*datastore.Key, src interface{}) (ret []*d
 	var span *trace.Span
 	t.ctx, span = trace.StartSpan(t.ctx, "github.com/qedus/nds.Transaction.PutMulti")
 	defer span.End()
+	keys = t.c.keysInNamespace(keys)
 	t.lockKeys(keys)
 	return t.tx.PutMulti(keys, src)
 }
@@ -80,6 +101,7 @@ func (t *Transaction) Delete(key *datastore.Key) error {
 	var span *trace.Span
 	t.ctx, span = trace.StartSpan(t.ctx, "github.com/qedus/nds.Transaction.Delete")
 	defer span.End()
+	key = t.c.inNamespace(key)
 	t.lockKey(key)
 	return t.tx.Delete(key)
 }
@@ -89,6 +111,7 @@ func (t *Transaction) DeleteMulti(keys []*datastore.Key) (err error) {
 	var span *trace.Span
 	t.ctx, span = trace.StartSpan(t.ctx, "github.com/qedus/nds.Transaction.DeleteMulti")
 	defer span.End()
+	keys = t.c.keysInNamespace(keys)
 	t.lockKeys(keys)
 	return t.tx.DeleteMulti(keys)
 }
@@ -103,7 +126,16 @@ func (t *Transaction) Commit() (*datastore.Commit, error) {
 	if err := t.commitCache(); err != nil {
 		return nil, err
 	}
-	return t.tx.Commit()
+	var cmt *datastore.Commit
+	err := t.c.guardDatastore(t.ctx, func() (err error) {
+		cmt, err = t.tx.Commit()
+		return
+	})
+	if err == nil {
+		t.unlockCache(t.ctx)
+		t.c.invalidateQueries(t.ctx, t.written)
+	}
+	return cmt, err
 }
 
 // Rollback is just a passthrough to the underlying datastore.Transaction.
@@ -127,6 +159,7 @@ func (t *Transaction) Mutate(muts ...*Mutation) ([]*datastore.PendingKey, error)
 	var span *trace.Span
 	t.ctx, span = trace.StartSpan(t.ctx, "github.com/qedus/nds.Transaction.Mutate")
 	defer span.End()
+	muts = t.c.mutationsInNamespace(muts)
 	mutations := make([]*datastore.Mutation, len(muts))
 	keys := make([]*datastore.Key, len(muts))
 	for i, mut := range muts {
@@ -140,28 +173,190 @@ func (t *Transaction) Mutate(muts ...*Mutation) ([]*datastore.PendingKey, error)
 // RunInTransaction works just like datastore.RunInTransaction however it
 // interacts correctly with the cache. You should always use this method for
 // transactions if you are using the NDS package.
+//
+// If the transaction still conflicts after the last attempt the returned
+// error is a *RetriesExhaustedError wrapping
+// datastore.ErrConcurrentTransaction.
+//
+// If the locks of the written entities can't be set in the cache, the
+// transaction is rolled back and retried after a backoff that doubles each
+// time, for up to 3 attempts. Once they are spent the returned error is a
+// *RetriesExhaustedError wrapping the cache error. Each of these attempts gets
+// the datastore's own retries of conflicts, set with datastore.MaxAttempts.
+// Errors returned by f are never retried.
+//
+// Besides the datastore options, opts can hold OnCommit and OnAbort callbacks.
+//
+// The entities the transaction writes are locked in the cache with a single
+// call before it commits, whatever their kinds, and unlocked with a single
+// call once it has committed.
 func (c *Client) RunInTransaction(ctx context.Context, f func(tx *Transaction) error, opts ...datastore.TransactionOption) (cmt *datastore.Commit, err error) {
 	var span *trace.Span
 	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.RunInTransaction")
 	defer span.End()
 
-	return c.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		txn := &Transaction{c: c, ctx: ctx, tx: tx}
-		if err := f(txn); err != nil {
-			return err
+	opts, callbacks := splitTransactionCallbacks(opts)
+	defer func() {
+		for _, cb := range callbacks {
+			if err == nil && cb.onCommit != nil {
+				cb.onCommit(cmt)
+			} else if err != nil && cb.onAbort != nil {
+				cb.onAbort(err)
+			}
 		}
+	}()
+
+	// attempts counts the calls of f and fErr holds the last one's error, so
+	// a conflict reported by the commit can be told apart from f's own.
+	// lockErr holds the error of the cache locks of the last attempt, so
+	// cache failures can be told apart from the datastore's.
+	var attempts int
+	var fErr, lockErr error
+	var txn *Transaction
+	run := func(tx *datastore.Transaction) error {
+		attempts++
+		lockErr = nil
+		txn = &Transaction{c: c, ctx: ctx, tx: tx}
+		if fErr = f(txn); fErr != nil {
+			if isDatastoreError(fErr) {
+				return fErr
+			}
+			return ignoreBreaker(fErr)
+		}
+
+		lockErr = txn.commitCache()
+		return ignoreBreaker(lockErr)
+	}
 
-		return txn.commitCache()
-	}, opts...)
+	backoff := transactionLockBackoff
+	for lockAttempts := 1; ; lockAttempts++ {
+		// f's reads hit the datastore so its datastore errors count towards
+		// the circuit breaker, but the caller's own errors and cache errors
+		// don't.
+		dsErr := c.guardDatastore(ctx, func() error {
+			if runInTransactionHook != nil {
+				cmt, err = runInTransactionHook(ctx, run)
+			} else {
+				cmt, err = c.ds.RunInTransaction(ctx, run, opts...)
+			}
+			return err
+		})
+		if dsErr == nil {
+			break
+		}
+		if lockErr == nil {
+			if dsErr == datastore.ErrConcurrentTransaction && fErr == nil {
+				dsErr = &RetriesExhaustedError{Attempts: attempts, Err: dsErr}
+			}
+			return nil, dsErr
+		}
+		if lockAttempts >= transactionLockAttempts {
+			return nil, &RetriesExhaustedError{Attempts: attempts, Err: lockErr}
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+	// Only the last attempt committed, the locks of the others expire.
+	if txn != nil {
+		txn.unlockCache(ctx)
+		c.invalidateQueries(ctx, txn.written)
+	}
+	return
 }
 
+// transactionLockAttempts is the number of attempts RunInTransaction makes at
+// a transaction whose cache locks can't be set.
+const transactionLockAttempts = 3
+
+// transactionLockBackoff is the wait before the first retry of a transaction
+// whose cache locks couldn't be set.
+const transactionLockBackoff = 20 * time.Millisecond
+
 // commitCache will commit the transaction changes to the cache
 func (t *Transaction) commitCache() error {
 	// tx.Unlock() is not called as the tx context should never be called
 	// again so we rather block than allow people to misuse the context.
 	t.Lock()
-	if t.c.cacher != nil {
+	t.lockCacheItems = sortedLockItems(t.lockCacheItems)
+	forgetRequestCacheItems(t.ctx, t.lockCacheItems)
+	rememberWriteItems(t.ctx, t.lockCacheItems)
+	if t.c.cacher != nil && len(t.lockCacheItems) > 0 {
 		return t.c.cacher.SetMulti(t.ctx, t.lockCacheItems)
 	}
 	return nil
 }
+
+// unlockCache removes the locks set by commitCache once the transaction has
+// committed, in a single call like they were set.
+func (t *Transaction) unlockCache(ctx context.Context) {
+	if t.c.cacher != nil && len(t.lockCacheItems) > 0 {
+		t.c.unlockCache(ctx, t.lockCacheItems, "nds:Transaction cache.DeleteMulti")
+	}
+}
+
+// sortedLockItems returns lockItems sorted by cache key with a single lock
+// for each key, so however many keys and kinds a transaction writes, and in
+// whatever order, its locks are set in the same order in one cache call.
+func sortedLockItems(lockItems []*Item) []*Item {
+	sorted := make([]*Item, 0, len(lockItems))
+	seen := make(map[string]bool, len(lockItems))
+	for _, item := range lockItems {
+		if !seen[item.Key] {
+			seen[item.Key] = true
+			sorted = append(sorted, item)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// transactionCallback is a datastore.TransactionOption that RunInTransaction
+// handles itself. The embedded option is always nil and only there so it
+// satisfies the interface; it must never be passed on to the datastore.
+type transactionCallback struct {
+	datastore.TransactionOption
+	onCommit func(commit *datastore.Commit)
+	onAbort  func(err error)
+}
+
+// OnCommit returns a RunInTransaction option that calls f once the
+// transaction has committed, with the same Commit RunInTransaction returns.
+// It is called exactly once however many attempts it took. Pending keys must
+// be resolved with commit.Key using the PendingKeys of the last call of the
+// transaction function, as earlier attempts were rolled back.
+//
+// OnCommit and OnAbort are only understood by Client.RunInTransaction and
+// must not be passed to the datastore package.
+func OnCommit(f func(commit *datastore.Commit)) datastore.TransactionOption {
+	return &transactionCallback{onCommit: f}
+}
+
+// OnAbort returns a RunInTransaction option that calls f with the error
+// RunInTransaction returns if the transaction didn't commit, either because
+// the transaction function failed or because it still conflicted after the
+// last attempt. It is not called for the attempts that are retried.
+func OnAbort(f func(err error)) datastore.TransactionOption {
+	return &transactionCallback{onAbort: f}
+}
+
+// splitTransactionCallbacks separates the callbacks from the options meant
+// for the datastore.
+func splitTransactionCallbacks(opts []datastore.TransactionOption) (
+	[]datastore.TransactionOption, []*transactionCallback) {
+	var callbacks []*transactionCallback
+	dsOpts := make([]datastore.TransactionOption, 0, len(opts))
+	for _, opt := range opts {
+		if cb, ok := opt.(*transactionCallback); ok {
+			callbacks = append(callbacks, cb)
+			continue
+		}
+		dsOpts = append(dsOpts, opt)
+	}
+	return dsOpts, callbacks
+}
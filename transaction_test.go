@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/datastore"
 
@@ -19,11 +21,16 @@ func TestTransactionSuite(t *testing.T) {
 			t.Run("TestTransactionGet", TransactionGetTest(item.ctx, item.cacher))
 			t.Run("TestRunInTransactionError", RunInTransactionErrorTest(item.ctx, item.cacher))
 			t.Run("TestTransactionTracking", TransactionTrackingTest(item.ctx, item.cacher))
+			t.Run("TestTransactionLockBatching", TransactionLockBatchingTest(item.ctx, item.cacher))
 			t.Run("TestTransactionNewError", TransactionNewErrorTest(item.ctx, item.cacher))
 			t.Run("TestTransactionCommit", TransactionCommitTest(item.ctx, item.cacher))
 			t.Run("TestTransactionCommitError", TransactionCommitErrorTest(item.ctx, item.cacher))
 			t.Run("TestTransactionRollback", TransactionRollbackTest(item.ctx, item.cacher))
 			t.Run("TestTransactionQueryHelper", TransactionQueryHelperTest(item.ctx, item.cacher))
+			t.Run("TestPutMultiTx", PutMultiTxTest(item.ctx, item.cacher))
+			t.Run("TestRunInTransactionRetriesExhausted", RunInTransactionRetriesExhaustedTest(item.ctx, item.cacher))
+			t.Run("TestRunInTransactionCallbacks", RunInTransactionCallbacksTest(item.ctx, item.cacher))
+			t.Run("TestRunInTransactionLockRetry", RunInTransactionLockRetryTest(item.ctx, item.cacher))
 
 		})
 	}
@@ -143,6 +150,151 @@ func RunInTransactionErrorTest(ctx context.Context, cacher nds.Cacher) func(t *t
 	}
 }
 
+// conflictingTransactions makes RunInTransaction call f attempts times as if
+// every commit conflicted.
+func conflictingTransactions(t *testing.T, ndsClient *nds.Client, attempts int) {
+	nds.SetDatastoreRunInTransactionHook(func(ctx context.Context,
+		f func(tx *datastore.Transaction) error) (*datastore.Commit, error) {
+		for i := 0; i < attempts; i++ {
+			tx, err := ndsClient.Client.NewTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f(tx)
+			tx.Rollback()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, datastore.ErrConcurrentTransaction
+	})
+}
+
+func RunInTransactionRetriesExhaustedTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conflictingTransactions(t, ndsClient, 3)
+		defer nds.SetDatastoreRunInTransactionHook(nil)
+
+		_, err = ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+			return nil
+		})
+		var exhausted *nds.RetriesExhaustedError
+		if !errors.As(err, &exhausted) {
+			t.Fatalf("expected a *nds.RetriesExhaustedError, got %v", err)
+		}
+		if exhausted.Attempts != 3 {
+			t.Fatalf("expected 3 attempts, got %d", exhausted.Attempts)
+		}
+		if !errors.Is(err, datastore.ErrConcurrentTransaction) {
+			t.Fatalf("expected %v to wrap %v", err, datastore.ErrConcurrentTransaction)
+		}
+
+		// f's own errors are returned as they are.
+		_, err = ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+			return datastore.ErrConcurrentTransaction
+		})
+		if err != datastore.ErrConcurrentTransaction {
+			t.Fatalf("expected %v, got %v", datastore.ErrConcurrentTransaction, err)
+		}
+	}
+}
+
+func RunInTransactionCallbacksTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		var commits, aborts int
+		var committedKey *datastore.Key
+		var abortErr error
+		var pending *datastore.PendingKey
+		onCommit := nds.OnCommit(func(commit *datastore.Commit) {
+			commits++
+			committedKey = commit.Key(pending)
+		})
+		onAbort := nds.OnAbort(func(err error) {
+			aborts++
+			abortErr = err
+		})
+		put := func(tx *nds.Transaction) (err error) {
+			pending, err = tx.Put(datastore.IncompleteKey("RunInTransactionCallbacksTest", nil), &testEntity{7})
+			return err
+		}
+
+		// Two conflicting attempts and a successful third one.
+		attempts := 0
+		nds.SetDatastoreRunInTransactionHook(func(ctx context.Context,
+			f func(tx *datastore.Transaction) error) (*datastore.Commit, error) {
+			for {
+				attempts++
+				tx, err := ndsClient.Client.NewTransaction(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if err := f(tx); err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+				if attempts == 3 {
+					return tx.Commit()
+				}
+				tx.Rollback()
+			}
+		})
+		_, err = ndsClient.RunInTransaction(ctx, put, onCommit, onAbort, datastore.MaxAttempts(3))
+		nds.SetDatastoreRunInTransactionHook(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != 3 || commits != 1 || aborts != 0 {
+			t.Fatalf("expected 3 attempts, 1 commit and no abort, got %d, %d and %d",
+				attempts, commits, aborts)
+		}
+		if committedKey == nil || committedKey.Incomplete() {
+			t.Fatalf("expected the pending key to resolve, got %v", committedKey)
+		}
+		defer ndsClient.Delete(ctx, committedKey)
+		if err := ndsClient.Get(ctx, committedKey, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every attempt conflicts.
+		commits, aborts = 0, 0
+		conflictingTransactions(t, ndsClient, 3)
+		_, err = ndsClient.RunInTransaction(ctx, put, onCommit, onAbort)
+		nds.SetDatastoreRunInTransactionHook(nil)
+		if !errors.Is(err, datastore.ErrConcurrentTransaction) {
+			t.Fatalf("expected %v, got %v", datastore.ErrConcurrentTransaction, err)
+		}
+		if commits != 0 || aborts != 1 || abortErr != err {
+			t.Fatalf("expected one abort with %v, got %d commits and %d aborts with %v",
+				err, commits, aborts, abortErr)
+		}
+
+		// The transaction function fails.
+		commits, aborts = 0, 0
+		fErr := errors.New("expected")
+		_, err = ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+			return fErr
+		}, onCommit, onAbort)
+		if err != fErr || commits != 0 || aborts != 1 || abortErr != fErr {
+			t.Fatalf("expected one abort with %v, got %v with %d commits and %d aborts",
+				fErr, err, commits, aborts)
+		}
+	}
+}
+
 func TransactionTrackingTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
 	return func(t *testing.T) {
 		testCacher := &mockCacher{
@@ -178,6 +330,8 @@ func TransactionTrackingTest(ctx context.Context, cacher nds.Cacher) func(t *tes
 				t.Fatalf("could not put entity: %v", err)
 			}
 		}
+		// Transactions lock their keys sorted by cache key.
+		sort.Strings(expectedKeys)
 
 		cacheOk := false
 		testCacher.setMultiHook = func(ctx context.Context, items []*nds.Item) error {
@@ -229,6 +383,75 @@ func TransactionTrackingTest(ctx context.Context, cacher nds.Cacher) func(t *tes
 	}
 }
 
+func TransactionLockBatchingTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var setCalls, deleteCalls [][]string
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				keys := make([]string, len(items))
+				for i, item := range items {
+					keys[i] = item.Key
+				}
+				setCalls = append(setCalls, keys)
+				return cacher.SetMulti(ctx, items)
+			},
+			deleteMultiHook: func(ctx context.Context, keys []string) error {
+				deleteCalls = append(deleteCalls, keys)
+				return cacher.DeleteMulti(ctx, keys)
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		suffix := time.Now().UnixNano()
+		var keys []*datastore.Key
+		for _, kind := range []string{"C", "A", "B"} {
+			kind = fmt.Sprintf("TransactionLockBatchingTest%s%d", kind, suffix)
+			keys = append(keys,
+				datastore.NameKey(kind, "one", nil),
+				datastore.NameKey(kind, "two", nil))
+		}
+		expectedKeys := make([]string, len(keys))
+		for i, key := range keys {
+			expectedKeys[i] = ndsClient.CacheKey(key)
+		}
+		sort.Strings(expectedKeys)
+
+		if _, err := ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+			// The kinds are written interleaved, and one key twice.
+			for _, i := range []int{4, 0, 2, 5, 1, 3} {
+				if _, err := tx.Put(keys[i], &testEntity{i}); err != nil {
+					return err
+				}
+			}
+			return tx.Delete(keys[0])
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(setCalls) != 1 || fmt.Sprint(setCalls[0]) != fmt.Sprint(expectedKeys) {
+			t.Fatalf("expected one lock call for %v, got %v", expectedKeys, setCalls)
+		}
+		if len(deleteCalls) != 1 || fmt.Sprint(deleteCalls[0]) != fmt.Sprint(expectedKeys) {
+			t.Fatalf("expected one unlock call for %v, got %v", expectedKeys, deleteCalls)
+		}
+		items, err := cacher.GetMulti(ctx, expectedKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 0 {
+			t.Fatalf("expected no locks left, got %d", len(items))
+		}
+	}
+}
+
 func TransactionNewErrorTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
 	return func(t *testing.T) {
 		ndsClient, err := NewClient(ctx, cacher, t, nil)
@@ -288,6 +511,72 @@ func TransactionCommitTest(ctx context.Context, cacher nds.Cacher) func(t *testi
 	}
 }
 
+func PutMultiTxTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		keys := []*datastore.Key{datastore.NameKey("PutMultiTxTest", "one", nil)}
+		if _, err := ndsClient.PutMulti(ctx, keys, []testEntity{{1}}); err != nil {
+			t.Fatal(err)
+		}
+		defer ndsClient.DeleteMulti(ctx, keys)
+
+		get := func() int {
+			dst := make([]testEntity, 1)
+			if err := ndsClient.GetMulti(ctx, keys, dst); err != nil {
+				t.Fatal(err)
+			}
+			return dst[0].Value
+		}
+		// Cache the entity.
+		if v := get(); v != 1 {
+			t.Fatalf("expected 1, got %d", v)
+		}
+
+		write := func(value int) *datastore.Transaction {
+			tx, err := ndsClient.Client.NewTransaction(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := make([]testEntity, 1)
+			if err := ndsClient.GetMultiTx(ctx, tx, keys, dst); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ndsClient.PutMultiTx(ctx, tx, keys,
+				[]testEntity{{dst[0].Value + value}}); err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}
+
+		tx := write(10)
+		if err := ndsClient.RollbackTx(ctx, tx); err != nil {
+			t.Fatal(err)
+		}
+		if v := get(); v != 1 {
+			t.Fatalf("expected the rolled back write to be discarded, got %d", v)
+		}
+
+		tx = write(100)
+		if v := get(); v != 1 {
+			t.Fatalf("expected 1 before the commit, got %d", v)
+		}
+		if _, err := ndsClient.CommitTx(ctx, tx); err != nil {
+			t.Fatal(err)
+		}
+		if v := get(); v != 101 {
+			t.Fatalf("expected the cache to be invalidated by the commit, got %d", v)
+		}
+	}
+}
+
 func TransactionCommitErrorTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
 	return func(t *testing.T) {
 		testCacher := &mockCacher{
@@ -537,3 +826,73 @@ func ClearNamespacedLocksTest(ctx context.Context, cacher nds.Cacher) func(t *te
 		_ = ndsClient.Delete(ctx, key)
 	}
 }
+
+func RunInTransactionLockRetryTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		lockErr := errors.New("lock failed")
+		var failures int
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				if failures > 0 {
+					failures--
+					return lockErr
+				}
+				return cacher.SetMulti(ctx, items)
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			Value int
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("RunInTransactionLockRetryTest%d", time.Now().UnixNano()), "one", nil)
+
+		// The lock fails once, so the transaction is retried and commits.
+		failures = 1
+		var calls int
+		if _, err := ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+			calls++
+			_, err := tx.Put(key, &testEntity{calls})
+			return err
+		}); err != nil {
+			t.Fatalf("expected the transaction to commit, got %v", err)
+		}
+		if calls != 2 {
+			t.Fatalf("expected 2 calls, got %d", calls)
+		}
+		var stored testEntity
+		if err := ndsClient.Get(ctx, key, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Value != 2 {
+			t.Fatalf("expected the last attempt committed, got %+v", stored)
+		}
+
+		// The lock keeps failing, so the budget is spent whatever the
+		// datastore's own budget.
+		failures, calls = 10, 0
+		_, err = ndsClient.RunInTransaction(ctx, func(tx *nds.Transaction) error {
+			calls++
+			_, err := tx.Put(key, &testEntity{10})
+			return err
+		}, datastore.MaxAttempts(1))
+		var exhausted *nds.RetriesExhaustedError
+		if !errors.As(err, &exhausted) || exhausted.Attempts != 3 || !errors.Is(err, lockErr) {
+			t.Fatalf("expected 3 attempts failing with %v, got %v", lockErr, err)
+		}
+		if calls != 3 {
+			t.Fatalf("expected 3 calls, got %d", calls)
+		}
+		if err := ndsClient.Client.Get(ctx, key, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Value != 2 {
+			t.Fatalf("expected nothing committed, got %+v", stored)
+		}
+	}
+}
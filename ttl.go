@@ -0,0 +1,78 @@
+package nds
+
+import (
+	"reflect"
+	"time"
+)
+
+// WithCacheTTL sets how long entities stay cached before they have to be read
+// from the datastore again. A value of 0, the default, caches entities until
+// the cacher evicts them. Cache locks are not affected.
+func WithCacheTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.cacheTTL = ttl
+	}
+}
+
+// WithTTLJitter randomizes the TTL set with WithCacheTTL by up to ±fraction
+// for every cached entity, so entities cached together don't all expire at
+// the same time and hit the datastore in a stampede. For example a fraction
+// of 0.1 with a TTL of one hour expires entities between 54 and 66 minutes
+// after they were cached. The fraction is clamped to [0, 1]. Cache locks
+// always expire after a fixed time. The jitter is drawn from the source set
+// with WithRand.
+func WithTTLJitter(fraction float64) ClientOption {
+	return func(c *Client) {
+		switch {
+		case fraction < 0:
+			fraction = 0
+		case fraction > 1:
+			fraction = 1
+		}
+		c.ttlJitter = fraction
+	}
+}
+
+// valueExpiration returns the expiration to use for a cached entity.
+func (c *Client) valueExpiration() time.Duration {
+	if c.cacheTTL <= 0 || c.ttlJitter == 0 {
+		return c.cacheTTL
+	}
+	delta := (2*c.randFloat64() - 1) * c.ttlJitter * float64(c.cacheTTL)
+	return c.cacheTTL + time.Duration(delta)
+}
+
+// CacheTTLer is implemented by entity types that decide how long each entity
+// stays cached, such as a session that should be cached until it expires. The
+// duration NDSCacheTTL returns replaces the TTL set with WithCacheTTL or
+// WithImmutableKinds for that entity, without jitter, and entities with less
+// than a second left are not cached at all. An expiry set with
+// WithExpiresProperty still caps it.
+//
+// The method is called on the entity as it is cached, once it has been
+// loaded on reads and as it was passed in on writes. Every entity in a batch
+// is cached with its own TTL.
+type CacheTTLer interface {
+	NDSCacheTTL() time.Duration
+}
+
+// entityTTL returns the TTL the entity value v, an element of the vals slice
+// of a call, declares for itself, if any.
+func entityTTL(v reflect.Value) (time.Duration, bool) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch {
+	case !v.IsValid():
+		return 0, false
+	case v.Kind() == reflect.Ptr && v.IsNil():
+		return 0, false
+	case v.Kind() != reflect.Ptr && v.CanAddr():
+		v = v.Addr()
+	}
+	ttler, ok := v.Interface().(CacheTTLer)
+	if !ok {
+		return 0, false
+	}
+	return ttler.NDSCacheTTL(), true
+}
@@ -0,0 +1,37 @@
+package nds
+
+import "reflect"
+
+// Uncacheable is implemented by entity types that may declare themselves
+// uncacheable, such as types holding ephemeral or security sensitive data.
+// If NDSUncacheable returns true, Get and GetMulti always load the entity
+// from the datastore and never add it to the cache, and write-through and
+// WithImmutableKinds never cache it on write. Writes still lock and evict the
+// cache for it as usual, as locks hold no entity data, so reads of the same key
+// into other types never see it stale.
+//
+// The method is called on the value passed to the call, or on a new zero
+// value for nil pointers, so it should depend on the type rather than on the
+// entity. Within a batch only the elements that are uncacheable bypass the
+// cache.
+type Uncacheable interface {
+	NDSUncacheable() bool
+}
+
+// isUncacheable reports whether the entity value v, an element of the vals
+// slice of a call, declares itself uncacheable.
+func isUncacheable(v reflect.Value) bool {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch {
+	case !v.IsValid():
+		return false
+	case v.Kind() == reflect.Ptr && v.IsNil():
+		v = reflect.New(v.Type().Elem())
+	case v.Kind() != reflect.Ptr && v.CanAddr():
+		v = v.Addr()
+	}
+	u, ok := v.Interface().(Uncacheable)
+	return ok && u.NDSUncacheable()
+}
@@ -0,0 +1,128 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestUncacheableSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestUncacheableMixedBatch", UncacheableMixedBatchTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+type cacheableEntity struct {
+	IntVal int
+}
+
+type uncacheableEntity struct {
+	Secret string
+}
+
+func (*uncacheableEntity) NDSUncacheable() bool {
+	return true
+}
+
+func UncacheableMixedBatchTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		var mu sync.Mutex
+		cached := make(map[string]bool)
+		record := func(items []*nds.Item) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, item := range items {
+				if item.Flags == nds.EntityItem {
+					cached[item.Key] = true
+				}
+			}
+		}
+		mc := &mockCacher{
+			cacher: cacher,
+			addMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				record(items)
+				return cacher.AddMulti(ctx, items)
+			},
+			compareAndSwapHook: func(ctx context.Context, items []*nds.Item) error {
+				record(items)
+				return cacher.CompareAndSwapMulti(ctx, items)
+			},
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				record(items)
+				return cacher.SetMulti(ctx, items)
+			},
+		}
+
+		for _, writeThrough := range []bool{false, true} {
+			ndsClient, err := NewClient(ctx, mc, t, nil, nds.WithWriteThrough(writeThrough))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kind := fmt.Sprintf("UncacheableMixedBatchTest%d", time.Now().UnixNano())
+			plain := datastore.NameKey(kind, "plain", nil)
+			secret := datastore.NameKey(kind, "secret", nil)
+			keys := []*datastore.Key{plain, secret}
+			if _, err := ndsClient.PutMulti(ctx, keys, []interface{}{
+				&cacheableEntity{1}, &uncacheableEntity{"hidden"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var loaded []*datastore.Key
+			nds.SetDatastoreGetMultiHook(func(ctx context.Context,
+				keys []*datastore.Key, vals interface{}) error {
+				loaded = append(loaded, keys...)
+				return nil
+			})
+
+			for i := 0; i < 2; i++ {
+				loaded = nil
+				plainVal, secretVal := &cacheableEntity{}, &uncacheableEntity{}
+				if err := ndsClient.GetMulti(ctx, keys,
+					[]interface{}{plainVal, secretVal}); err != nil {
+					t.Fatal(err)
+				}
+				if plainVal.IntVal != 1 || secretVal.Secret != "hidden" {
+					t.Fatalf("unexpected values %+v and %+v", plainVal, secretVal)
+				}
+				if i == 0 && !writeThrough {
+					continue
+				}
+				// Only the uncacheable entity comes from the datastore once
+				// the cacheable one is cached.
+				if len(loaded) != 1 || !loaded[0].Equal(secret) {
+					t.Fatalf("expected only %v loaded, got %v", secret, loaded)
+				}
+			}
+			nds.SetDatastoreGetMultiHook(nil)
+
+			plainKey := nds.CreateCacheKey(plain)
+			secretKey := nds.CreateCacheKey(secret)
+			mu.Lock()
+			if !cached[plainKey] {
+				t.Fatalf("expected %v cached", plain)
+			}
+			if cached[secretKey] {
+				t.Fatalf("expected %v never cached", secret)
+			}
+			mu.Unlock()
+
+			items, err := cacher.GetMulti(ctx, []string{plainKey, secretKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item, ok := items[secretKey]; ok && item.Flags == nds.EntityItem {
+				t.Fatalf("found %v in the cache", secret)
+			}
+		}
+	}
+}
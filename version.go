@@ -0,0 +1,106 @@
+package nds
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// ErrVersionConflict is returned by PutIfVersion when the stored entity's
+// version isn't the expected one.
+var ErrVersionConflict = errors.New("nds: version conflict")
+
+// defaultVersionProperty is the property PutIfVersion keeps versions in by
+// default.
+const defaultVersionProperty = "Version"
+
+// WithVersionProperty sets the name of the int64 property PutIfVersion keeps
+// entity versions in. It defaults to "Version"; an empty name keeps the
+// default.
+func WithVersionProperty(name string) ClientOption {
+	return func(c *Client) {
+		c.versionProperty = name
+	}
+}
+
+func (c *Client) versionPropertyName() string {
+	if c.versionProperty == "" {
+		return defaultVersionProperty
+	}
+	return c.versionProperty
+}
+
+// PutIfVersion saves val for key, with its version property set to
+// expectedVersion+1, only if the stored entity's version is expectedVersion.
+// It returns ErrVersionConflict otherwise, for example because another write
+// got in first. A missing entity, or one without the version property, has
+// version 0, so an expectedVersion of 0 creates the entity.
+//
+// The check and the write are made in a transaction, so the cache is kept
+// consistent like for any other transaction. If val is a pointer its version
+// property is set to the written version once the transaction has committed.
+func (c *Client) PutIfVersion(ctx context.Context, key *datastore.Key,
+	val interface{}, expectedVersion int64) error {
+
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.PutIfVersion")
+	defer span.End()
+
+	v := reflect.ValueOf(val)
+	if !v.IsValid() {
+		return datastore.ErrInvalidEntityType
+	}
+	pl, err := saveValue(v)
+	if err != nil {
+		return err
+	}
+	name := c.versionPropertyName()
+	pl = setVersion(pl, name, expectedVersion+1)
+
+	if _, err := c.RunInTransaction(ctx, func(tx *Transaction) error {
+		var stored datastore.PropertyList
+		switch err := tx.Get(key, &stored); err {
+		case nil, datastore.ErrNoSuchEntity:
+		default:
+			return err
+		}
+		if version(stored, name) != expectedVersion {
+			return ErrVersionConflict
+		}
+		_, err := tx.Put(key, &pl)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if v.Kind() == reflect.Ptr {
+		return setValue(v, pl, key)
+	}
+	return nil
+}
+
+// version returns the int64 value of the property name in pl, or 0 if there
+// is none.
+func version(pl datastore.PropertyList, name string) int64 {
+	for _, p := range pl {
+		if p.Name == name {
+			v, _ := p.Value.(int64)
+			return v
+		}
+	}
+	return 0
+}
+
+// setVersion returns pl with the property name set to v.
+func setVersion(pl datastore.PropertyList, name string, v int64) datastore.PropertyList {
+	for i, p := range pl {
+		if p.Name == name {
+			pl[i].Value = v
+			return pl
+		}
+	}
+	return append(pl, datastore.Property{Name: name, Value: v})
+}
@@ -0,0 +1,114 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestPutIfVersionSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestPutIfVersion", PutIfVersionTest(item.ctx, item.cacher))
+			t.Run("TestPutIfVersionProperty", PutIfVersionPropertyTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func PutIfVersionTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal  int
+			Version int64
+		}
+
+		kind := fmt.Sprintf("PutIfVersionTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "key", nil)
+
+		// Version 0 creates the entity.
+		entity := &testEntity{IntVal: 1}
+		if err := ndsClient.PutIfVersion(ctx, key, entity, 0); err != nil {
+			t.Fatal(err)
+		}
+		if entity.Version != 1 {
+			t.Fatalf("expected version 1, got %d", entity.Version)
+		}
+
+		// Prime the cache, which the update must invalidate.
+		got := &testEntity{}
+		if err := ndsClient.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if *got != *entity {
+			t.Fatalf("expected %+v, got %+v", entity, got)
+		}
+
+		if err := ndsClient.PutIfVersion(ctx, key, &testEntity{IntVal: 2}, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.PutIfVersion(ctx, key, &testEntity{IntVal: 3}, 1); err != nds.ErrVersionConflict {
+			t.Fatalf("expected nds.ErrVersionConflict, got %v", err)
+		}
+		if err := ndsClient.PutIfVersion(ctx, key, &testEntity{IntVal: 3}, 0); err != nds.ErrVersionConflict {
+			t.Fatalf("expected nds.ErrVersionConflict, got %v", err)
+		}
+
+		got = &testEntity{}
+		if err := ndsClient.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (testEntity{IntVal: 2, Version: 2}); *got != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func PutIfVersionPropertyTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		ndsClient, err := NewClient(ctx, cacher, t, nil, nds.WithVersionProperty("Rev"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type testEntity struct {
+			IntVal int
+			Rev    int64
+		}
+
+		kind := fmt.Sprintf("PutIfVersionPropertyTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "key", nil)
+
+		// Entities written without PutIfVersion start at version 0.
+		if _, err := ndsClient.Put(ctx, key, &testEntity{IntVal: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ndsClient.PutIfVersion(ctx, key, &testEntity{IntVal: 2}, 1); err != nds.ErrVersionConflict {
+			t.Fatalf("expected nds.ErrVersionConflict, got %v", err)
+		}
+		entity := &testEntity{IntVal: 2}
+		if err := ndsClient.PutIfVersion(ctx, key, entity, 0); err != nil {
+			t.Fatal(err)
+		}
+		if entity.Rev != 1 {
+			t.Fatalf("expected revision 1, got %d", entity.Rev)
+		}
+
+		got := &testEntity{}
+		if err := ndsClient.Get(ctx, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if *got != *entity {
+			t.Fatalf("expected %+v, got %+v", entity, got)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package nds
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
+)
+
+// WarmupComplete is emitted to the ObserverFunc once the warmup started by
+// WithStartupWarmup is done.
+type WarmupComplete struct {
+	// Keys is the number of seed keys.
+	Keys     int
+	Duration time.Duration
+	// Err is the error Warmup returned, if any.
+	Err error
+}
+
+func (WarmupComplete) isEvent() {}
+
+// WithStartupWarmup makes NewClient warm the cache with the entities for
+// keys, such as a service's configuration entities, so the first requests
+// don't all miss. The warmup runs in the background and doesn't hold up
+// NewClient; WarmupDone tells when it is done and a WarmupComplete event
+// reports how it went. The Client can be used in the meantime, reads of the
+// seed keys just aren't guaranteed to be cache hits yet.
+//
+// The warmup uses the values, but not the deadline, of the context passed to
+// NewClient.
+func WithStartupWarmup(keys []*datastore.Key) ClientOption {
+	return func(c *Client) {
+		c.warmupKeys = keys
+	}
+}
+
+// Warmup reads the entities for keys so they are cached, like RewarmKeys,
+// for warming a known hot set of keys ahead of traffic.
+func (c *Client) Warmup(ctx context.Context, keys []*datastore.Key) error {
+	var span *trace.Span
+	ctx, span = trace.StartSpan(ctx, "github.com/qedus/nds.Warmup")
+	defer span.End()
+	return c.RewarmKeys(ctx, keys)
+}
+
+// WarmupDone returns a channel that is closed once the warmup started by
+// WithStartupWarmup is done, whether or not it succeeded. Without
+// WithStartupWarmup it is closed already.
+func (c *Client) WarmupDone() <-chan struct{} {
+	return c.warmupDone
+}
+
+// startWarmup runs the startup warmup in the background, if there is one.
+func (c *Client) startWarmup(ctx context.Context) {
+	c.warmupDone = make(chan struct{})
+	if len(c.warmupKeys) == 0 {
+		close(c.warmupDone)
+		return
+	}
+	ctx = detachedContext{ctx}
+	go func() {
+		defer close(c.warmupDone)
+		start := time.Now()
+		err := c.Warmup(ctx, c.warmupKeys)
+		c.observe(ctx, WarmupComplete{
+			Keys:     len(c.warmupKeys),
+			Duration: time.Since(start),
+			Err:      err,
+		})
+	}()
+}
@@ -0,0 +1,102 @@
+package nds_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestWarmupSuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestStartupWarmup", StartupWarmupTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+func StartupWarmupTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		type testEntity struct {
+			IntVal int
+		}
+
+		kind := fmt.Sprintf("StartupWarmupTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "one", nil),
+			datastore.NameKey(kind, "two", nil),
+			datastore.NameKey(kind, "missing", nil),
+		}
+
+		// Write the entities without caching them.
+		dsClient, err := datastore.NewClient(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dsClient.PutMulti(ctx, keys[:2], []testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan nds.WarmupComplete, 1)
+		ds := &countingDatastore{Client: dsClient}
+		ndsClient, err := NewClient(ctx, cacher, t, nil,
+			nds.WithDatastoreClient(dsClient), nds.WithDatastore(ds),
+			nds.WithStartupWarmup(keys),
+			nds.WithObserver(func(_ context.Context, e nds.Event) {
+				if complete, ok := e.(nds.WarmupComplete); ok {
+					done <- complete
+				}
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-ndsClient.WarmupDone():
+		case <-time.After(10 * time.Second):
+			t.Fatal("expected the warmup to be done")
+		}
+		complete := <-done
+		if complete.Err != nil {
+			t.Fatalf("expected the warmup to succeed, got %v", complete.Err)
+		}
+		if complete.Keys != len(keys) {
+			t.Fatalf("expected %d keys, got %d", len(keys), complete.Keys)
+		}
+
+		// The seed keys are now cache hits.
+		atomic.StoreInt32(&ds.gets, 0)
+		for i, key := range keys[:2] {
+			var entity testEntity
+			if err := ndsClient.Get(ctx, key, &entity); err != nil {
+				t.Fatal(err)
+			}
+			if entity.IntVal != i+1 {
+				t.Fatalf("expected %d, got %d", i+1, entity.IntVal)
+			}
+		}
+		if gets := atomic.LoadInt32(&ds.gets); gets != 0 {
+			t.Fatalf("expected no datastore reads, got %d", gets)
+		}
+
+		// Without a startup warmup the client is ready straight away.
+		plainClient, err := NewClient(ctx, cacher, t, nil, nds.WithDatastoreClient(dsClient))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-plainClient.WarmupDone():
+		default:
+			t.Fatal("expected WarmupDone to be closed")
+		}
+
+		if err := ndsClient.DeleteMulti(ctx, keys); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package nds
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// WriteCacheErrorPolicy decides what Put, PutMulti, Delete, DeleteMulti and
+// Mutate do when the cache can't be locked before writing to the datastore.
+type WriteCacheErrorPolicy int
+
+const (
+	// WriteCacheFail fails the write without touching the datastore, so the
+	// cache can never be left serving an entity older than the datastore's.
+	// This is the default.
+	WriteCacheFail WriteCacheErrorPolicy = iota
+	// WriteCacheFailOpen writes to the datastore anyway and then removes the
+	// written entities from the cache, passing the lock error to the
+	// OnErrorFunc. A cache outage then doesn't stop writes, but if removing
+	// the entities from the cache fails as well, reads may be served the old
+	// entities from the cache until it recovers or they are written again.
+	// Transactions always fail when the cache can't be locked.
+	WriteCacheFailOpen
+)
+
+// WithWriteCacheErrorPolicy sets what writes do when locking the cache fails.
+// The default is WriteCacheFail.
+func WithWriteCacheErrorPolicy(policy WriteCacheErrorPolicy) ClientOption {
+	return func(c *Client) {
+		c.writeCachePolicy = policy
+	}
+}
+
+// WithLockRetry makes Put, PutMulti, Delete, DeleteMulti and Mutate try to
+// lock the cache up to attempts times before writing to the datastore, so a
+// momentary cache hiccup doesn't fail the write. Only the locks the cache
+// failed to set are retried, after waiting backoff, which doubles after every
+// attempt. Once the attempts are exhausted the WriteCacheErrorPolicy applies
+// to a RetriesExhaustedError holding the last error. An attempts of 1 or less
+// disables retries, which is the default.
+func WithLockRetry(attempts int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.lockRetryAttempts, c.lockRetryBackoff = attempts, backoff
+	}
+}
+
+// WithAsyncLockCleanup makes Put and PutMulti return as soon as the datastore
+// write has succeeded and remove their cache locks in the background, taking
+// the cache round trip off the write's latency. Until the locks are removed
+// reads of the written entities keep going to the datastore, a little longer
+// than they otherwise would. At most maxPending background removals run at
+// once; once that many are pending, writes remove their locks themselves as
+// they do by default. Failures are still passed to the OnErrorFunc. A value
+// of 0 or less disables it, which is the default.
+func WithAsyncLockCleanup(maxPending int) ClientOption {
+	return func(c *Client) {
+		if maxPending <= 0 {
+			c.lockCleanup = nil
+			return
+		}
+		c.lockCleanup = make(chan struct{}, maxPending)
+	}
+}
+
+// WithLockExpiryOnFailedWrite makes Put and PutMulti leave their cache locks
+// to expire, after up to 32 seconds, when the datastore write fails, instead of
+// removing them straight away. A failed write may still have been applied,
+// for example when it timed out, and is often retried: while the locks are
+// held reads go to the datastore without caching what they find, so an entity
+// read while the outcome is unknown or a retry is under way is never cached.
+// The cost is more datastore reads of those entities until the locks expire.
+// Locks are still removed promptly after writes that succeed. It is disabled
+// by default.
+func WithLockExpiryOnFailedWrite(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.keepFailedLocks = enabled
+	}
+}
+
+// setLocks sets lockItems in the cache, retrying the ones that failed as
+// configured by WithLockRetry.
+func (c *Client) setLocks(ctx context.Context, lockItems []*Item) error {
+	items := lockItems
+	// indexes maps items to lockItems once only failed locks are retried.
+	var indexes []int
+	backoff := c.lockRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.cacher.SetMulti(ctx, items)
+		if err == nil || c.lockRetryAttempts <= 1 {
+			return err
+		}
+
+		me, partial := err.(MultiError)
+		if partial && indexes != nil {
+			full := make(MultiError, len(lockItems))
+			for i, e := range me {
+				full[indexes[i]] = e
+			}
+			err = full
+		}
+		if attempt >= c.lockRetryAttempts {
+			return &RetriesExhaustedError{Attempts: attempt, Err: err}
+		}
+
+		if partial {
+			var retry []*Item
+			var retryIndexes []int
+			for i, e := range me {
+				if e == nil {
+					continue
+				}
+				retry = append(retry, items[i])
+				if indexes != nil {
+					retryIndexes = append(retryIndexes, indexes[i])
+				} else {
+					retryIndexes = append(retryIndexes, i)
+				}
+			}
+			items, indexes = retry, retryIndexes
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &RetriesExhaustedError{Attempts: attempt, Err: err}
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// lockCacheFailed handles err returned by the Cacher's SetMulti when locking
+// the cache for op. It returns the error the write has to fail with, if any;
+// otherwise the write goes ahead without locks and the caller has to remove
+// the written entities from the cache afterwards.
+func (c *Client) lockCacheFailed(ctx context.Context, err error, op string) error {
+	if c.writeCachePolicy != WriteCacheFailOpen {
+		return err
+	}
+	c.onError(ctx, errors.Wrap(err, op))
+	return nil
+}
+
+// invalidateCache removes cacheKeys from the cache, reporting any error but
+// misses to the OnErrorFunc. Canceling ctx doesn't stop the removal, it only
+// stops invalidateCache from waiting for it.
+func (c *Client) invalidateCache(ctx context.Context, cacheKeys []string, op string) {
+	c.cleanupCache(ctx, func(cleanupCtx context.Context) error {
+		return c.cacher.DeleteMulti(cleanupCtx, cacheKeys)
+	}, op)
+}
+
+// unlockCache removes the locks in lockItems from the cache, like
+// invalidateCache, but leaves a key alone if another writer has locked it
+// since. Whatever else replaced a lock is removed: a read may have locked the
+// key after the lock was evicted or cleared, or if none was set, and the
+// entity it would cache can be older than the write. Without a
+// CompareAndDeleter the keys are deleted regardless.
+func (c *Client) unlockCache(ctx context.Context, lockItems []*Item, op string) {
+	c.cleanupCache(ctx, func(cleanupCtx context.Context) error {
+		cad, ok := c.cacher.(CompareAndDeleter)
+		if !ok {
+			return c.cacher.DeleteMulti(cleanupCtx, itemKeys(lockItems))
+		}
+		err := cad.CompareAndDeleteMulti(cleanupCtx, lockItems)
+		if err == ErrCompareAndDeleteUnsupported {
+			return c.cacher.DeleteMulti(cleanupCtx, itemKeys(lockItems))
+		}
+		me, ok := err.(MultiError)
+		if !ok {
+			return err
+		}
+		var replaced []*Item
+		for i, err := range me {
+			switch err {
+			case nil, ErrCacheMiss:
+			case ErrCASConflict:
+				replaced = append(replaced, lockItems[i])
+			default:
+				return me
+			}
+		}
+		if len(replaced) == 0 {
+			return nil
+		}
+		return c.deleteUnlessWriterLocked(cleanupCtx, replaced)
+	}, op)
+}
+
+// deleteUnlessWriterLocked deletes the keys of lockItems unless another
+// writer's lock is cached for them. Another writer locking a key between the
+// read and the delete has its lock deleted, which is safe: it deletes whatever
+// is cached for the key itself once its write is done.
+func (c *Client) deleteUnlessWriterLocked(ctx context.Context, lockItems []*Item) error {
+	cacheKeys := itemKeys(lockItems)
+	items, err := c.cacher.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		return err
+	}
+	deleteKeys := make([]string, 0, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if item, ok := items[cacheKey]; ok && isWriterLock(item) &&
+			!bytes.Equal(item.Value, lockItems[i].Value) {
+			continue
+		}
+		deleteKeys = append(deleteKeys, cacheKey)
+	}
+	if len(deleteKeys) == 0 {
+		return nil
+	}
+	return c.cacher.DeleteMulti(ctx, deleteKeys)
+}
+
+func itemKeys(items []*Item) []string {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return keys
+}
+
+// unlockCacheAsync is unlockCache without waiting for the locks to be
+// removed, if WithAsyncLockCleanup is enabled and there is room.
+func (c *Client) unlockCacheAsync(ctx context.Context, lockItems []*Item, op string) {
+	select {
+	case c.lockCleanup <- struct{}{}:
+	default:
+		c.unlockCache(ctx, lockItems, op)
+		return
+	}
+
+	go func() {
+		defer func() {
+			<-c.lockCleanup
+		}()
+		ctx, span := trace.StartSpan(detachedContext{ctx}, "github.com/qedus/nds.unlockCache")
+		defer span.End()
+		c.unlockCache(ctx, lockItems, op)
+	}()
+}
+
+// cleanupCache runs the cache removal f with a context that outlives ctx,
+// reporting any error but misses and conflicts to the OnErrorFunc.
+func (c *Client) cleanupCache(ctx context.Context, f func(context.Context) error, op string) {
+	cleanupCtx, cancel := cleanupContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		if err := f(cleanupCtx); cacheFailure(err) != nil {
+			c.onError(cleanupCtx, errors.Wrap(err, op))
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
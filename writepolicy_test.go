@@ -0,0 +1,316 @@
+package nds_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/qedus/nds/v2"
+)
+
+func TestWriteCacheErrorPolicySuite(t *testing.T) {
+	for _, item := range cachers {
+		t.Run(fmt.Sprintf("cacher=%T", item.cacher), func(t *testing.T) {
+			t.Run("TestWriteCacheFail", WriteCacheFailTest(item.ctx, item.cacher))
+			t.Run("TestWriteCacheFailOpen", WriteCacheFailOpenTest(item.ctx, item.cacher))
+			t.Run("TestWriteLockRetry", WriteLockRetryTest(item.ctx, item.cacher))
+			t.Run("TestAsyncLockCleanup", AsyncLockCleanupTest(item.ctx, item.cacher))
+			t.Run("TestLockExpiryOnFailedWrite", LockExpiryOnFailedWriteTest(item.ctx, item.cacher))
+		})
+	}
+}
+
+var errCacheLock = errors.New("cache lock failed")
+
+// breakableLockCacher returns a cacher whose SetMulti, which writes use to
+// lock the cache, fails while broken is set.
+func breakableLockCacher(cacher nds.Cacher, broken *int32) *mockCacher {
+	return &mockCacher{
+		cacher: cacher,
+		setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+			if atomic.LoadInt32(broken) != 0 {
+				return errCacheLock
+			}
+			return cacher.SetMulti(ctx, items)
+		},
+	}
+}
+
+type writePolicyEntity struct {
+	IntVal int
+}
+
+func WriteCacheFailTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		broken := int32(1)
+		// Removing the locks that were never set misses the cache.
+		ndsClient, err := NewClient(ctx, breakableLockCacher(cacher, &broken), t,
+			func(err error) bool {
+				return strings.Contains(err.Error(), nds.ErrCacheMiss.Error())
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("WriteCacheFailTest%d", time.Now().UnixNano()), "entity", nil)
+		if _, err := ndsClient.Put(ctx, key, &writePolicyEntity{1}); err != errCacheLock {
+			t.Fatalf("expected the lock error, got %v", err)
+		}
+		if err := ndsClient.Client.Get(ctx, key, &writePolicyEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected nothing written to the datastore, got %v", err)
+		}
+	}
+}
+
+func WriteCacheFailOpenTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		broken := int32(0)
+		ndsClient, err := NewClient(ctx, breakableLockCacher(cacher, &broken), t,
+			func(err error) bool {
+				return strings.Contains(err.Error(), errCacheLock.Error())
+			},
+			nds.WithWriteCacheErrorPolicy(nds.WriteCacheFailOpen))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := datastore.NameKey(fmt.Sprintf("WriteCacheFailOpenTest%d", time.Now().UnixNano()), "entity", nil)
+		if _, err := ndsClient.Put(ctx, key, &writePolicyEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		// Cache the entity so that stale cache entries would be noticed.
+		if err := ndsClient.Get(ctx, key, &writePolicyEntity{}); err != nil {
+			t.Fatal(err)
+		}
+
+		atomic.StoreInt32(&broken, 1)
+		if _, err := ndsClient.Put(ctx, key, &writePolicyEntity{2}); err != nil {
+			t.Fatalf("expected the put to go ahead, got %v", err)
+		}
+		var got writePolicyEntity
+		if err := ndsClient.Client.Get(ctx, key, &got); err != nil || got.IntVal != 2 {
+			t.Fatalf("expected 2 in the datastore, got %d and %v", got.IntVal, err)
+		}
+		got = writePolicyEntity{}
+		if err := ndsClient.Get(ctx, key, &got); err != nil || got.IntVal != 2 {
+			t.Fatalf("expected the cached entity to be removed, got %d and %v", got.IntVal, err)
+		}
+
+		if err := ndsClient.Delete(ctx, key); err != nil {
+			t.Fatalf("expected the delete to go ahead, got %v", err)
+		}
+		if err := ndsClient.Get(ctx, key, &writePolicyEntity{}); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("expected the deleted entity to be removed from the cache, got %v", err)
+		}
+	}
+}
+
+func WriteLockRetryTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// The first lock-set fails for the second key only, later ones
+		// succeed unless failing is set.
+		var (
+			calls   int32
+			failing int32
+			retried []string
+		)
+		testCacher := &mockCacher{
+			cacher: cacher,
+			setMultiHook: func(ctx context.Context, items []*nds.Item) error {
+				switch call := atomic.AddInt32(&calls, 1); {
+				case atomic.LoadInt32(&failing) != 0:
+					return errCacheLock
+				case call == 1:
+					if err := cacher.SetMulti(ctx, items[:1]); err != nil {
+						return err
+					}
+					return nds.MultiError{nil, errCacheLock}
+				case call == 2:
+					for _, item := range items {
+						retried = append(retried, item.Key)
+					}
+				}
+				return cacher.SetMulti(ctx, items)
+			},
+		}
+		ndsClient, err := NewClient(ctx, testCacher, t, nil,
+			nds.WithLockRetry(3, time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := fmt.Sprintf("WriteLockRetryTest%d", time.Now().UnixNano())
+		keys := []*datastore.Key{
+			datastore.NameKey(kind, "a", nil),
+			datastore.NameKey(kind, "b", nil),
+		}
+		if _, err := ndsClient.PutMulti(ctx, keys,
+			[]writePolicyEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 2 {
+			t.Fatalf("expected 2 lock-sets, got %d", calls)
+		}
+		if len(retried) != 1 || retried[0] != ndsClient.CacheKey(keys[1]) {
+			t.Fatalf("expected only the lock on %s retried, got %v",
+				ndsClient.CacheKey(keys[1]), retried)
+		}
+		entities := make([]writePolicyEntity, len(keys))
+		if err := ndsClient.Client.GetMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		if entities[0].IntVal != 1 || entities[1].IntVal != 2 {
+			t.Fatalf("expected the entities written, got %+v", entities)
+		}
+
+		// Once the attempts are exhausted the write fails as before.
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&failing, 1)
+		_, err = ndsClient.Put(ctx, keys[0], &writePolicyEntity{3})
+		re, ok := err.(*nds.RetriesExhaustedError)
+		if !ok || re.Attempts != 3 || re.Err != errCacheLock {
+			t.Fatalf("expected 3 attempts failing with %v, got %v", errCacheLock, err)
+		}
+		if calls != 3 {
+			t.Fatalf("expected 3 lock-sets, got %d", calls)
+		}
+		entity := &writePolicyEntity{}
+		if err := ndsClient.Client.Get(ctx, keys[0], entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 1 {
+			t.Fatalf("expected nothing written to the datastore, got %+v", entity)
+		}
+	}
+}
+
+func AsyncLockCleanupTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		// The lock removal blocks until released, and fails while failing
+		// is set. The mock isn't a CompareAndDeleter so locks are deleted.
+		var failing int32
+		release := make(chan struct{})
+		testCacher := &mockCacher{
+			cacher: cacher,
+			deleteMultiHook: func(ctx context.Context, keys []string) error {
+				<-release
+				if atomic.LoadInt32(&failing) != 0 {
+					return errCacheLock
+				}
+				return cacher.DeleteMulti(ctx, keys)
+			},
+		}
+		errs := make(chan error, 1)
+		ndsClient, err := nds.NewClient(ctx, testCacher,
+			nds.WithAsyncLockCleanup(1),
+			nds.WithOnErrorFunc(func(_ context.Context, err error) {
+				errs <- err
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kind := fmt.Sprintf("AsyncLockCleanupTest%d", time.Now().UnixNano())
+		key := datastore.NameKey(kind, "a", nil)
+		cacheKey := ndsClient.CacheKey(key)
+		locked := func() bool {
+			t.Helper()
+			items, err := cacher.GetMulti(ctx, []string{cacheKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			item, ok := items[cacheKey]
+			return ok && item.Flags == nds.LockItem
+		}
+
+		// The write returns with its lock still held.
+		if _, err := ndsClient.Put(ctx, key, &writePolicyEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+		if !locked() {
+			t.Fatal("expected the lock to be removed in the background")
+		}
+		release <- struct{}{}
+		for deadline := time.Now().Add(time.Second); locked(); {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the lock to be removed eventually")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// A failed removal is reported once it has failed.
+		atomic.StoreInt32(&failing, 1)
+		if _, err := ndsClient.Put(ctx, key, &writePolicyEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errs:
+			t.Fatalf("expected no error before the removal, got %v", err)
+		default:
+		}
+		close(release)
+		select {
+		case err := <-errs:
+			if !strings.Contains(err.Error(), errCacheLock.Error()) {
+				t.Fatalf("expected %v, got %v", errCacheLock, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the failed removal to reach the OnErrorFunc")
+		}
+	}
+}
+
+func LockExpiryOnFailedWriteTest(ctx context.Context, cacher nds.Cacher) func(t *testing.T) {
+	return func(t *testing.T) {
+		errWrite := errors.New("write failed")
+		nds.SetDatastorePutMultiHook(func() error {
+			return errWrite
+		})
+		defer nds.SetDatastorePutMultiHook(nil)
+
+		kind := fmt.Sprintf("LockExpiryOnFailedWriteTest%d", time.Now().UnixNano())
+		for _, keep := range []bool{false, true} {
+			ndsClient, err := NewClient(ctx, cacher, t, nil,
+				nds.WithLockExpiryOnFailedWrite(keep))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := datastore.NameKey(kind, fmt.Sprint(keep), nil)
+			cacheKey := ndsClient.CacheKey(key)
+			locked := func() bool {
+				t.Helper()
+				items, err := cacher.GetMulti(ctx, []string{cacheKey})
+				if err != nil {
+					t.Fatal(err)
+				}
+				item, ok := items[cacheKey]
+				return ok && item.Flags == nds.LockItem
+			}
+
+			if _, err := ndsClient.Put(ctx, key, &writePolicyEntity{1}); err != errWrite {
+				t.Fatalf("expected %v, got %v", errWrite, err)
+			}
+			if locked() != keep {
+				t.Fatalf("expected the lock held to be %t after a failed write", keep)
+			}
+
+			// A successful retry removes the lock.
+			nds.SetDatastorePutMultiHook(nil)
+			if _, err := ndsClient.Put(ctx, key, &writePolicyEntity{2}); err != nil {
+				t.Fatal(err)
+			}
+			if locked() {
+				t.Fatal("expected the lock removed after a successful write")
+			}
+			nds.SetDatastorePutMultiHook(func() error {
+				return errWrite
+			})
+		}
+	}
+}